@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+func TestDump(t *testing.T) {
+	dir := t.TempDir()
+	r, err := repo.New(dir, map[string][]byte{"README.md": []byte("# hi\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := r.WriteBlob([]byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := object.NewTree()
+	sub.AddEntry(object.ModeFile, "hello.txt", blob)
+	subHash, err := r.WriteTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := object.NewTree()
+	root.AddEntry(object.ModeFile, "a.txt", blob)
+	root.AddEntry("40000", "dir", subHash)
+	rootHash, err := r.WriteTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := refs["refs/heads/main"]
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", -5*3600))
+	commit := object.NewCommitAt(rootHash, parent, "A U Thor <author@example.com>", "C O Mitter <committer@example.com>", "Add things\n", when)
+	commitHash, err := r.WriteCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := object.NewCommitAt(rootHash, parent, "A U Thor <author@example.com>", "C O Mitter <committer@example.com>", "Signed\n", when)
+	signed.Signature = "-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n"
+	signedHash, err := r.WriteCommit(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, hash, want string
+	}{
+		{"blob", blob, "type blob\nsize 6\n\nhello\n"},
+		{"tree", rootHash, fmt.Sprintf("type tree\nsize %d\n\n100644 blob %s\ta.txt\n040000 tree %s\tdir\n",
+			len(root.Serialize()), blob, subHash)},
+		{"commit", commitHash, fmt.Sprintf("type commit\nsize %d\n\ntree %s\nparent %s\n"+
+			"author A U Thor <author@example.com> 1709314200 -0500\n"+
+			"committer C O Mitter <committer@example.com> 1709314200 -0500\n\nAdd things\n",
+			len(commit.Serialize()), rootHash, parent)},
+		{"signed commit", signedHash, fmt.Sprintf("type commit\nsize %d\n\ntree %s\nparent %s\n"+
+			"author A U Thor <author@example.com> 1709314200 -0500\n"+
+			"committer C O Mitter <committer@example.com> 1709314200 -0500\n"+
+			"gpgsig -----BEGIN PGP SIGNATURE-----\n \n abc\n -----END PGP SIGNATURE-----\n\nSigned\n",
+			len(signed.Serialize()), rootHash, parent)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runDump([]string{"-dump", tt.hash, "-repo", dir}, &stdout, &stderr); code != 0 {
+				t.Fatalf("exit %d: %s", code, stderr.String())
+			}
+			if got := stdout.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("git dir", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if code := runDump([]string{"-dump", blob, "-git-dir", filepath.Join(dir, ".git")}, &stdout, &stderr); code != 0 {
+			t.Fatalf("exit %d: %s", code, stderr.String())
+		}
+		if !strings.HasSuffix(stdout.String(), "\nhello\n") {
+			t.Errorf("got %q", stdout.String())
+		}
+	})
+
+	for _, args := range [][]string{
+		{"-repo", dir},
+		{"-dump", "not-a-hash", "-repo", dir},
+		{"-dump", strings.Repeat("0", 40), "-repo", dir},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := runDump(args, &stdout, &stderr); code == 0 {
+			t.Errorf("runDump(%q) succeeded", args)
+		}
+	}
+}
+
+func TestIsDump(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"-dump", "abc"}, true},
+		{[]string{"--dump=abc"}, true},
+		{[]string{"-repo", "x", "-dump", "abc"}, true},
+		{[]string{"serve"}, false},
+		{[]string{"-dmp", "abc"}, false},
+		{[]string{"dump"}, false},
+		{[]string{"-dumpster"}, false},
+	} {
+		if got := isDump(tt.args); got != tt.want {
+			t.Errorf("isDump(%q) = %t, want %t", tt.args, got, tt.want)
+		}
+	}
+}
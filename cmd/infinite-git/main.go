@@ -6,18 +6,64 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	_ "github.com/chainguard-dev/clog/gcp/init"
+	"github.com/imjasonh/infinite-git/internal/clock"
 	"github.com/imjasonh/infinite-git/internal/generator"
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/protocol"
 	"github.com/imjasonh/infinite-git/internal/repo"
 	"github.com/imjasonh/infinite-git/internal/server"
 	"github.com/sethvargo/go-envconfig"
 )
 
 var env = envconfig.MustProcess(context.Background(), &struct {
-	Port     string `env:"PORT,default=8080"`
-	RepoPath string `env:"REPO_PATH,default=./infinite-repo"`
+	Port          string        `env:"PORT,default=8080"`
+	RepoPath      string        `env:"REPO_PATH,default=./infinite-repo"`
+	PackCacheSize int           `env:"PACK_CACHE_SIZE,default=8"`
+	VerifyCommits bool          `env:"VERIFY_ON_GENERATE,default=false"`
+	MaxObjectSize int64         `env:"MAX_OBJECT_SIZE,default=0"`
+	PersistCount  bool          `env:"PERSIST_COUNTER,default=false"`
+	TemplateDir   string        `env:"TEMPLATE_DIR"`
+	GitDir        string        `env:"REPO_GIT_DIR"`
+	TCPKeepAlive  time.Duration `env:"TCP_KEEPALIVE,default=15s"`
+	AdminToken    string        `env:"ADMIN_TOKEN"`
+	BasicAuth     []string      `env:"BASIC_AUTH"` // comma-separated user:password pairs git clients must present
+	ZlibWorkers   int           `env:"ZLIB_WORKERS,default=1"`
+	ReadAhead     int           `env:"READ_AHEAD,default=0"`
+	KeepAlive     time.Duration `env:"UPLOAD_PACK_KEEPALIVE,default=5s"`
+	Filter        bool          `env:"ADVERTISE_FILTER,default=false"`
+	TypeFilter    bool          `env:"FILTER_OBJECT_TYPE,default=false"` // also accept object:type=<type> filters
+	MaxStoreBytes int64         `env:"MAX_STORE_BYTES,default=0"`
+	IdemTTL       time.Duration `env:"IDEMPOTENCY_TTL,default=10m"`
+	MaxRounds     int           `env:"MAX_NEGOTIATION_ROUNDS,default=256"`
+	MaxHaves      int           `env:"MAX_HAVES,default=65536"`
+	GCGrace       time.Duration `env:"GC_GRACE,default=1h"`
+	MaxRequest    int64         `env:"MAX_REQUEST_BYTES,default=10485760"`
+	MaxLines      int           `env:"MAX_REQUEST_LINES,default=131072"`
+	LenientObjs   bool          `env:"LENIENT_OBJECTS,default=false"`
+	FilesPerPull  int           `env:"FILES_PER_COMMIT,default=0"`
+	FilePattern   string        `env:"FILE_NAME_PATTERN,default=pull-%d-file-%d.txt"` // printf-style, taking the pull count and file number
+	AnyWant       bool          `env:"ALLOW_UNADVERTISED_WANTS,default=false"`
+	DataSize      int           `env:"DATA_SIZE,default=0"`
+	Entropy       float64       `env:"ENTROPY,default=1"`
+	StatsIndex    bool          `env:"STATS_INDEX,default=false"`
+	LogCaps       bool          `env:"LOG_CAPABILITIES,default=false"`
+	Trailers      []string      `env:"TRAILERS"` // comma-separated key:value pairs
+	Authors       []string      `env:"AUTHORS"`  // comma-separated Name <email> identities, used in turn
+	ContentLength bool          `env:"CONTENT_LENGTH,default=false"`
+	SpillBytes    int64         `env:"SPILL_THRESHOLD,default=67108864"`
+	SpillDir      string        `env:"SPILL_DIR"`
+	Branches      []string      `env:"CLIENT_BRANCHES"` // branches clients may check out instead of main
+	Prewarm       bool          `env:"PACK_PREWARM,default=false"`
+	PackOrder     string        `env:"PACK_ORDER,default=hash"`    // hash or recency
+	ObjectFormat  string        `env:"OBJECT_FORMAT,default=sha1"` // sha1 or sha256, for new repositories
+	ArchivePath   string        `env:"ARCHIVE_PATH"`               // serve this git bundle read-only, without generating
+	GenTimeout    time.Duration `env:"GENERATE_TIMEOUT,default=0"` // generate on a background worker, waiting this long
+	AllowPush     bool          `env:"ALLOW_PUSH,default=false"`
+	MaxPush       int64         `env:"MAX_PUSH_BYTES,default=104857600"`
 }{})
 
 // gitContent provides the default infinite-git file content.
@@ -43,15 +89,132 @@ func (g *gitContent) CommitMessage(count int64, now time.Time) string {
 var _ generator.ContentProvider = (*gitContent)(nil)
 
 func main() {
+	if args := os.Args[1:]; len(args) > 0 {
+		// The server is configured by environment alone, so the only
+		// arguments it takes are the dump command's.
+		if !isDump(args) {
+			fmt.Fprintln(os.Stderr, "usage: infinite-git [-dump <hash> [-repo <path> | -git-dir <path>]]")
+			os.Exit(2)
+		}
+		os.Exit(runDump(args, os.Stdout, os.Stderr))
+	}
+
 	slog.Info("initializing repository", "env", env)
-	content := &gitContent{}
-	gitRepo, err := repo.New(env.RepoPath, content.InitialFiles())
+	var content generator.ContentProvider = &gitContent{}
+	if env.TemplateDir != "" {
+		tc, err := generator.NewTemplateContent(env.TemplateDir)
+		if err != nil {
+			slog.Error("failed to load template dir", "error", err)
+			os.Exit(1)
+		}
+		content = tc
+	}
+	var trailers []generator.Trailer
+	for _, s := range env.Trailers {
+		t, err := generator.ParseTrailer(s)
+		if err != nil {
+			slog.Error("invalid TRAILERS", "error", err)
+			os.Exit(1)
+		}
+		trailers = append(trailers, t)
+	}
+	packOrder, err := protocol.ParsePackOrder(env.PackOrder)
+	if err != nil {
+		slog.Error("invalid PACK_ORDER", "error", err)
+		os.Exit(1)
+	}
+	format, err := object.ParseFormat(env.ObjectFormat)
+	if err != nil {
+		slog.Error("invalid OBJECT_FORMAT", "error", err)
+		os.Exit(1)
+	}
+	var authors []string
+	for _, s := range env.Authors {
+		ident, err := generator.ParseIdentity(s)
+		if err != nil {
+			slog.Error("invalid AUTHORS", "error", err)
+			os.Exit(1)
+		}
+		authors = append(authors, ident)
+	}
+	if err := generator.ValidateFileNamePattern(env.FilePattern, env.FilesPerPull); err != nil {
+		slog.Error("invalid FILE_NAME_PATTERN", "error", err)
+		os.Exit(1)
+	}
+	var auth server.AuthFunc
+	if len(env.BasicAuth) > 0 {
+		creds := make(map[string]string, len(env.BasicAuth))
+		for _, pair := range env.BasicAuth {
+			user, pass, ok := strings.Cut(pair, ":")
+			if !ok || user == "" {
+				slog.Error("invalid BASIC_AUTH: want user:password")
+				os.Exit(1)
+			}
+			creds[user] = pass
+		}
+		auth = server.StaticCredentials(creds)
+	}
+	repoPath := env.RepoPath
+	// Only generated commits use the real clock: the initial commit keeps
+	// repo.InitialCommitTime, so every new repository with the same files
+	// starts from the same root commit.
+	clk := clock.Real{}
+	repoOpts := []repo.Option{repo.WithLenientObjects(env.LenientObjs), repo.WithStatsIndex(env.StatsIndex), repo.WithObjectFormat(format)}
+	if env.GitDir != "" {
+		// Serve from a bare object store with no working tree.
+		repoPath = ""
+		repoOpts = append(repoOpts, repo.WithGitDir(env.GitDir))
+	}
+	var gitRepo *repo.Repository
+	if env.ArchivePath != "" {
+		gitRepo, err = repo.OpenArchive(env.ArchivePath)
+	} else {
+		gitRepo, err = repo.New(repoPath, content.InitialFiles(), repoOpts...)
+	}
 	if err != nil {
 		slog.Error("failed to initialize repository", "error", err)
 		os.Exit(1)
 	}
 
-	srv := server.New(gitRepo, content)
+	srv := server.New(gitRepo, content,
+		server.WithClock(clk),
+		server.WithPackCache(env.PackCacheSize),
+		server.WithAdminToken(env.AdminToken),
+		server.WithAuth(auth),
+		server.WithIdempotencyTTL(env.IdemTTL),
+		server.WithGCGrace(env.GCGrace),
+		server.WithMaxRequestBytes(env.MaxRequest),
+		server.WithAllowUnadvertisedWants(env.AnyWant),
+		server.WithLogCapabilities(env.LogCaps),
+		server.WithContentLength(env.ContentLength, env.SpillBytes, env.SpillDir),
+		server.WithClientBranches(env.Branches...),
+		server.WithPackPrewarm(env.Prewarm),
+		server.WithStaticHistory(env.ArchivePath != ""),
+		server.WithGenerationWorker(env.GenTimeout),
+		server.WithPush(env.AllowPush, env.MaxPush),
+		server.WithGeneratorOptions(
+			generator.WithVerify(env.VerifyCommits),
+			generator.WithPersistentCounter(env.PersistCount),
+			generator.WithMaxStoreBytes(env.MaxStoreBytes),
+			generator.WithFilesPerCommit(env.FilesPerPull),
+			generator.WithFileNamePattern(env.FilePattern),
+			generator.WithEntropyData(env.DataSize, env.Entropy),
+			generator.WithTrailers(trailers...),
+			generator.WithAuthors(authors...),
+		),
+		server.WithUploadPackOptions(
+			protocol.WithMaxObjectSize(env.MaxObjectSize),
+			protocol.WithZlibWorkers(env.ZlibWorkers),
+			protocol.WithReadAhead(env.ReadAhead),
+			protocol.WithKeepAlive(env.KeepAlive),
+			protocol.WithPackOrder(packOrder),
+			protocol.WithFilter(env.Filter),
+			protocol.WithObjectTypeFilter(env.TypeFilter),
+			protocol.WithMaxNegotiationRounds(env.MaxRounds),
+			protocol.WithMaxHaves(env.MaxHaves),
+			protocol.WithRequestLimits(env.MaxLines, env.MaxRequest),
+		),
+	)
 
 	httpServer := &http.Server{
 		Addr:         ":" + env.Port,
@@ -61,8 +224,14 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	ln, err := server.Listen(context.Background(), httpServer.Addr, env.TCPKeepAlive)
+	if err != nil {
+		slog.Error("failed to listen", "error", err)
+		os.Exit(1)
+	}
+
 	slog.Info("starting HTTP server", "port", env.Port)
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
 		slog.Error("HTTP server error", "error", err)
 		os.Exit(1)
 	}
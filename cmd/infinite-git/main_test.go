@@ -4,15 +4,23 @@ import (
 	"fmt"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/imjasonh/infinite-git/internal/generator"
+	"github.com/imjasonh/infinite-git/internal/protocol"
 	"github.com/imjasonh/infinite-git/internal/repo"
 	"github.com/imjasonh/infinite-git/internal/server"
 )
@@ -114,6 +122,37 @@ func TestCloneAndPull(t *testing.T) {
 	}
 }
 
+// TestMultiAckDetailedGoGit pulls with go-git once it is allowed to
+// negotiate multi_ack_detailed, which it leaves out by default, so the
+// server answers with common and final ACKs.
+func TestMultiAckDetailedGoGit(t *testing.T) {
+	saved := transport.UnsupportedCapabilities
+	t.Cleanup(func() { transport.UnsupportedCapabilities = saved })
+	transport.UnsupportedCapabilities = slices.DeleteFunc(slices.Clone(saved), func(c capability.Capability) bool {
+		return c == capability.MultiACK || c == capability.MultiACKDetailed
+	})
+
+	ts := newTestServer(t)
+	dir := t.TempDir()
+	gitRepo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+	w, err := gitRepo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := countCommits(t, gitRepo)
+	for i := range 3 {
+		if err := w.Pull(&git.PullOptions{RemoteName: "origin"}); err != nil {
+			t.Fatalf("pull %d failed: %v", i+1, err)
+		}
+	}
+	if got, want := countCommits(t, gitRepo), before+3; got != want {
+		t.Errorf("%d commits after three pulls, want %d", got, want)
+	}
+}
+
 func TestConcurrentPulls(t *testing.T) {
 	ts := newTestServer(t)
 
@@ -238,6 +277,331 @@ func TestPushRejection(t *testing.T) {
 	t.Logf("Push rejected with error: %v", err)
 }
 
+// TestCounterRefNotAdvertised checks that the persisted counter ref stays
+// internal to the server.
+func TestCounterRefNotAdvertised(t *testing.T) {
+	content := &gitContent{}
+	serverRepo, err := repo.New(t.TempDir(), content.InitialFiles())
+	if err != nil {
+		t.Fatalf("failed to create server repo: %v", err)
+	}
+	srv := server.New(serverRepo, content, server.WithGeneratorOptions(generator.WithPersistentCounter(true)))
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	if _, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL}); err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+
+	refs, err := serverRepo.GetRefs()
+	if err != nil {
+		t.Fatalf("failed to get server refs: %v", err)
+	}
+	if refs[generator.CounterRef] == "" {
+		t.Fatalf("server did not persist %s", generator.CounterRef)
+	}
+
+	remote := git.NewRemote(nil, &config.RemoteConfig{Name: "origin", URLs: []string{ts.URL}})
+	advertised, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list remote refs: %v", err)
+	}
+	for _, ref := range advertised {
+		if strings.HasPrefix(ref.Name().String(), "refs/infinite/") {
+			t.Errorf("internal ref %s was advertised", ref.Name())
+		}
+	}
+}
+
+// emptyContent generates commits that never contain any files.
+type emptyContent struct{}
+
+func (emptyContent) InitialFiles() map[string][]byte { return nil }
+
+func (emptyContent) GenerateFiles(int64, time.Time) map[string][]byte { return nil }
+
+func (emptyContent) CommitMessage(count int64, _ time.Time) string {
+	return fmt.Sprintf("Empty pull #%d", count)
+}
+
+func TestCloneEmptyTree(t *testing.T) {
+	serverRepo, err := repo.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("failed to create server repo: %v", err)
+	}
+	ts := httptest.NewServer(server.New(serverRepo, emptyContent{}).Handler())
+	t.Cleanup(ts.Close)
+
+	gitRepo, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+	ref, err := gitRepo.Head()
+	if err != nil {
+		t.Fatalf("failed to get HEAD: %v", err)
+	}
+	commit, err := gitRepo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatalf("failed to read HEAD commit: %v", err)
+	}
+	if got, want := commit.TreeHash.String(), "4b825dc642cb6eb9a060e54bf8d69288fbee4904"; got != want {
+		t.Errorf("HEAD tree = %s, want the empty tree %s", got, want)
+	}
+	if got := countCommits(t, gitRepo); got != 2 {
+		t.Errorf("expected 2 commits, got %d", got)
+	}
+}
+
+func TestCloneBareGitDir(t *testing.T) {
+	content := &gitContent{}
+	gitDir := filepath.Join(t.TempDir(), "objects-store")
+	serverRepo, err := repo.New("", content.InitialFiles(), repo.WithGitDir(gitDir))
+	if err != nil {
+		t.Fatalf("failed to create bare repo: %v", err)
+	}
+	ts := httptest.NewServer(server.New(serverRepo, content).Handler())
+	t.Cleanup(ts.Close)
+
+	clientDir := t.TempDir()
+	if _, err := git.PlainClone(clientDir, false, &git.CloneOptions{URL: ts.URL}); err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(clientDir, "README.md")); err != nil {
+		t.Errorf("README.md missing from clone: %v", err)
+	}
+}
+
+// TestDiskCapServesExistingHistory checks that a server whose object store
+// is full stops generating commits but can still be cloned.
+func TestDiskCapServesExistingHistory(t *testing.T) {
+	content := &gitContent{}
+	serverRepo, err := repo.New(t.TempDir(), content.InitialFiles())
+	if err != nil {
+		t.Fatalf("failed to create server repo: %v", err)
+	}
+	srv := server.New(serverRepo, content, server.WithGeneratorOptions(generator.WithMaxStoreBytes(1)))
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	for i := 0; i < 2; i++ {
+		gitRepo, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL})
+		if err != nil {
+			t.Fatalf("clone %d failed: %v", i+1, err)
+		}
+		if got := countCommits(t, gitRepo); got != 1 {
+			t.Errorf("clone %d has %d commits, want only the initial commit", i+1, got)
+		}
+	}
+}
+
+// TestGitCLIClone clones and pulls with the canonical git client, which is
+// stricter than go-git about advertisements, pkt-lines and packs.
+// Skipped when the git binary is not in PATH.
+func TestGitCLIClone(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts := newTestServer(t)
+	cloneDir := t.TempDir()
+
+	runGit := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(gitBin, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\noutput: %s", args, err, out)
+		}
+		return string(out)
+	}
+
+	runGit("clone", ts.URL, cloneDir)
+
+	want := map[string]string{
+		"README.md": string(((&gitContent{}).InitialFiles())["README.md"]),
+		"hello.txt": "Pull #1\n",
+	}
+	for name, prefix := range want {
+		data, err := os.ReadFile(filepath.Join(cloneDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if !strings.HasPrefix(string(data), prefix) {
+			t.Errorf("%s = %q, want prefix %q", name, data, prefix)
+		}
+	}
+
+	runGit("-C", cloneDir, "pull")
+	data, err := os.ReadFile(filepath.Join(cloneDir, "hello.txt"))
+	if err != nil {
+		t.Fatalf("failed to read hello.txt after pull: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "Pull #2\n") {
+		t.Errorf("hello.txt after pull = %q, want Pull #2", data)
+	}
+
+	if got := strings.Fields(runGit("-C", cloneDir, "rev-list", "--count", "HEAD")); len(got) != 1 || got[0] != "3" {
+		t.Errorf("rev-list --count = %v, want 3", got)
+	}
+	runGit("-C", cloneDir, "fsck", "--strict")
+}
+
+// linkContent adds a symlink to the default content on every pull.
+type linkContent struct{ gitContent }
+
+func (linkContent) GenerateSymlinks(int64, time.Time) map[string]string {
+	return map[string]string{"latest": "hello.txt"}
+}
+
+var _ generator.SymlinkProvider = (*linkContent)(nil)
+
+// TestCloneSymlink checks that git checks out a generated symlink as a real
+// link rather than a file holding the target path.
+func TestCloneSymlink(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	content := &linkContent{}
+	serverRepo, err := repo.New(t.TempDir(), content.InitialFiles())
+	if err != nil {
+		t.Fatalf("failed to create server repo: %v", err)
+	}
+	ts := httptest.NewServer(server.New(serverRepo, content).Handler())
+	t.Cleanup(ts.Close)
+
+	cloneDir := t.TempDir()
+	if out, err := exec.Command(gitBin, "clone", ts.URL, cloneDir).CombinedOutput(); err != nil {
+		t.Fatalf("clone failed: %v\noutput: %s", err, out)
+	}
+
+	link := filepath.Join(cloneDir, "latest")
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("failed to stat symlink: %v", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("latest has mode %v, want a symlink", fi.Mode())
+	}
+	if target, err := os.Readlink(link); err != nil || target != "hello.txt" {
+		t.Errorf("latest -> %q, %v; want hello.txt", target, err)
+	}
+
+	out, err := exec.Command(gitBin, "-C", cloneDir, "ls-tree", "HEAD", "latest").CombinedOutput()
+	if err != nil {
+		t.Fatalf("ls-tree failed: %v\noutput: %s", err, out)
+	}
+	if !strings.HasPrefix(string(out), "120000 blob ") {
+		t.Errorf("ls-tree = %q, want mode 120000", out)
+	}
+}
+
+// TestMaxObjectSizeClone checks that git reports the server's reason when
+// a clone is refused for an oversized object.
+func TestMaxObjectSizeClone(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	content := &gitContent{}
+	serverRepo, err := repo.New(t.TempDir(), content.InitialFiles())
+	if err != nil {
+		t.Fatalf("failed to create server repo: %v", err)
+	}
+	srv := server.New(serverRepo, content, server.WithUploadPackOptions(protocol.WithMaxObjectSize(16)))
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	out, err := exec.Command(gitBin, "clone", ts.URL, t.TempDir()).CombinedOutput()
+	if err == nil {
+		t.Fatal("clone succeeded despite oversized objects")
+	}
+	if !strings.Contains(string(out), "object size limit") {
+		t.Errorf("clone output does not explain the failure:\n%s", out)
+	}
+}
+
+// TestServeRealGitRepo opens a repository created by the git CLI, with
+// subdirectories, a CRLF commit message and a merge commit, and clones it.
+func TestServeRealGitRepo(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+
+	dir := t.TempDir()
+	runGit := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command(gitBin, append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=Real Git",
+			"GIT_AUTHOR_EMAIL=real@example.com",
+			"GIT_AUTHOR_DATE=1700000000 -0530",
+			"GIT_COMMITTER_NAME=Real Git",
+			"GIT_COMMITTER_EMAIL=real@example.com",
+			"GIT_COMMITTER_DATE=1700000000 +0900",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\noutput: %s", args, err, out)
+		}
+	}
+	writeFile := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runGit("init", "-q", "-b", "main")
+	writeFile("hello.txt", "hello\n")
+	writeFile("foo.txt", "foo file\n")
+	writeFile("foo/bar.txt", "nested\n")
+	runGit("add", ".")
+	runGit("commit", "-q", "-m", "Initial\r\n\r\nWith CRLF body\r\n")
+	runGit("checkout", "-q", "-b", "side")
+	writeFile("side.txt", "side\n")
+	runGit("add", ".")
+	runGit("commit", "-q", "-m", "Side")
+	runGit("checkout", "-q", "main")
+	writeFile("main.txt", "main\n")
+	runGit("add", ".")
+	runGit("commit", "-q", "-m", "Main")
+	runGit("merge", "-q", "--no-ff", "-m", "Merge side", "side")
+
+	content := &gitContent{}
+	serverRepo, err := repo.New(dir, content.InitialFiles())
+	if err != nil {
+		t.Fatalf("failed to open real git repo: %v", err)
+	}
+	ts := httptest.NewServer(server.New(serverRepo, content).Handler())
+	t.Cleanup(ts.Close)
+
+	clientDir := t.TempDir()
+	gitRepo, err := git.PlainClone(clientDir, false, &git.CloneOptions{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+
+	// 4 real commits plus the one generated by the clone.
+	if got := countCommits(t, gitRepo); got != 5 {
+		t.Errorf("expected 5 commits, got %d", got)
+	}
+	for _, name := range []string{"foo.txt", "foo/bar.txt", "side.txt", "main.txt", "hello.txt"} {
+		if _, err := os.Stat(filepath.Join(clientDir, name)); err != nil {
+			t.Errorf("missing %s in clone: %v", name, err)
+		}
+	}
+
+	// The generated commit must hash the way git does, or fsck complains.
+	cmd := exec.Command(gitBin, "-C", clientDir, "fsck", "--strict")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("git fsck failed: %v\noutput: %s", err, out)
+	}
+}
+
 // Helper function to count commits
 func countCommits(t *testing.T, repo *git.Repository) int {
 	iter, err := repo.Log(&git.LogOptions{})
@@ -0,0 +1,26 @@
+// Package clock provides the time source for generated commits, so that
+// tests can make them reproducible.
+package clock
+
+import "time"
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the system clock.
+type Real struct{}
+
+// Now returns time.Now().
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Fixed is a clock that is stopped at a single instant.
+type Fixed time.Time
+
+// Now returns the fixed time.
+func (f Fixed) Now() time.Time {
+	return time.Time(f)
+}
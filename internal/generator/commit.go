@@ -1,193 +1,460 @@
 package generator
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/imjasonh/infinite-git/internal/clock"
 	"github.com/imjasonh/infinite-git/internal/object"
 	"github.com/imjasonh/infinite-git/internal/repo"
 )
 
+// CounterRef is the internal ref that stores the pull counter when the
+// counter is persisted. It points at a blob holding the count in decimal.
+const CounterRef = "refs/infinite/counter"
+
+// ErrDiskCap is returned by GenerateCommit once the object store has
+// reached the size set by WithMaxStoreBytes.
+var ErrDiskCap = errors.New("object store is at its size cap")
+
 // Generator creates new commits on demand.
 type Generator struct {
 	repo     *repo.Repository
 	counter  int64
 	provider ContentProvider
+	verify   bool
+	persist  bool
+	maxStore int64
+	onCommit []func(hash string, count int64)
+	extra    int
+	pattern  string
+	clock    clock.Clock
+	trailers []Trailer
+	authors  []string
+	dataSize int
+	entropy  float64
+
+	// writeObject writes objects to the repo; tests replace it to
+	// inject faults.
+	writeObject func(object.Object) (string, error)
+}
+
+// Option configures a Generator.
+type Option func(*Generator)
+
+// WithVerify makes the generator read back and re-hash every object it
+// writes before advancing the branch. A commit that fails verification
+// is never made reachable.
+func WithVerify(verify bool) Option {
+	return func(g *Generator) {
+		g.verify = verify
+	}
+}
+
+// WithPersistentCounter stores the pull counter in CounterRef after each
+// commit and resumes from it on startup, so numbering survives restarts.
+func WithPersistentCounter(persist bool) Option {
+	return func(g *Generator) {
+		g.persist = persist
+	}
+}
+
+// WithMaxStoreBytes stops generating commits once the object store holds
+// n bytes or more. The cap is checked before each commit, so the store
+// can overshoot it by one commit's objects. Zero means no cap.
+func WithMaxStoreBytes(n int64) Option {
+	return func(g *Generator) {
+		g.maxStore = n
+	}
+}
+
+// WithOnCommit calls fn after each successful GenerateCommit with the new
+// commit's hash and the pull count, so tests can wait for generation
+// without polling. Callbacks given in several options are called in
+// order.
+func WithOnCommit(fn func(hash string, count int64)) Option {
+	return func(g *Generator) {
+		g.onCommit = append(g.onCommit, fn)
+	}
+}
+
+// WithEntropyData adds a data.bin file of size bytes to every generated
+// commit. Entropy, from 0 to 1, is the fraction of its bytes that are
+// random; the rest repeat a fixed pattern, so packs range from highly
+// compressible to incompressible.
+func WithEntropyData(size int, entropy float64) Option {
+	return func(g *Generator) {
+		g.dataSize = size
+		g.entropy = min(max(entropy, 0), 1)
+	}
+}
+
+// WithClock takes the time of generated commits, which is also passed to
+// the content provider, from c instead of the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(g *Generator) {
+		g.clock = c
+	}
+}
+
+// Trailer is a "Key: Value" line at the end of a commit message, such as
+// Signed-off-by or Co-authored-by.
+type Trailer struct {
+	Key, Value string
+}
+
+// ParseTrailer parses a "key:value" pair into a Trailer.
+func ParseTrailer(s string) (Trailer, error) {
+	key, value, ok := strings.Cut(s, ":")
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !ok || key == "" || value == "" || strings.ContainsAny(key, " \n") || strings.Contains(value, "\n") {
+		return Trailer{}, fmt.Errorf("invalid trailer %q: want key:value", s)
+	}
+	return Trailer{Key: key, Value: value}, nil
+}
+
+// WithTrailers appends trailers to every generated commit message,
+// separated from it by a blank line as git expects.
+func WithTrailers(trailers ...Trailer) Option {
+	return func(g *Generator) {
+		g.trailers = append(g.trailers, trailers...)
+	}
+}
+
+// withTrailers returns msg followed by the trailer block.
+func withTrailers(msg string, trailers []Trailer) string {
+	if len(trailers) == 0 {
+		return msg
+	}
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(msg, "\n"))
+	b.WriteString("\n\n")
+	for _, t := range trailers {
+		fmt.Fprintf(&b, "%s: %s\n", t.Key, t.Value)
+	}
+	return b.String()
+}
+
+// defaultIdentity authors and commits generated commits unless
+// WithAuthors is used.
+const defaultIdentity = "Infinite Git <infinite@example.com>"
+
+// ParseIdentity checks that s is a git identity, "Name <email>", and
+// returns it with surrounding space trimmed.
+func ParseIdentity(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	name, rest, ok := strings.Cut(s, " <")
+	if !ok || name == "" || !strings.HasSuffix(rest, ">") ||
+		strings.ContainsAny(name, "<>\n") || strings.ContainsAny(rest[:len(rest)-1], "<>\n ") {
+		return "", fmt.Errorf("invalid identity %q: want Name <email>", s)
+	}
+	return s, nil
+}
+
+// WithAuthors authors and commits successive generated commits as each
+// of identities in turn, which must be valid as ParseIdentity checks. An
+// identity listed more than once comes up proportionally more often.
+func WithAuthors(identities ...string) Option {
+	return func(g *Generator) {
+		g.authors = append(g.authors, identities...)
+	}
+}
+
+// identity returns who authors the count'th generated commit.
+func (g *Generator) identity(count int64) string {
+	if len(g.authors) == 0 {
+		return defaultIdentity
+	}
+	n := int64(len(g.authors))
+	return g.authors[((count-1)%n+n)%n]
+}
+
+// WithFilesPerCommit adds n new files to every generated commit, on top
+// of the provider's, named after the pull count so they never collide.
+// This grows the tree and the object count of every pack. See
+// WithFileNamePattern for how they are named.
+func WithFilesPerCommit(n int) Option {
+	return func(g *Generator) {
+		g.extra = n
+	}
 }
 
 // New creates a new commit generator.
-func New(r *repo.Repository, provider ContentProvider) *Generator {
-	return &Generator{
-		repo:     r,
-		provider: provider,
+func New(r *repo.Repository, provider ContentProvider, opts ...Option) *Generator {
+	g := &Generator{
+		repo:        r,
+		provider:    provider,
+		clock:       clock.Real{},
+		writeObject: r.WriteObject,
+	}
+	for _, opt := range opts {
+		opt(g)
 	}
+	if g.persist {
+		count, err := g.loadCounter()
+		if err != nil {
+			slog.Warn("failed to load persisted counter, starting from zero", "error", err)
+		}
+		g.counter = count
+	}
+	return g
+}
+
+// loadCounter reads the persisted counter, returning zero if none exists.
+func (g *Generator) loadCounter() (int64, error) {
+	refs, err := g.repo.GetRefs()
+	if err != nil {
+		return 0, fmt.Errorf("getting refs: %w", err)
+	}
+	hash := refs[CounterRef]
+	if hash == "" {
+		return 0, nil
+	}
+	data, err := g.repo.ReadObject(hash)
+	if err != nil {
+		return 0, fmt.Errorf("reading counter blob: %w", err)
+	}
+	count, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing counter: %w", err)
+	}
+	return count, nil
+}
+
+// saveCounter records count in CounterRef. Caller must hold the repo lock.
+func (g *Generator) saveCounter(count int64) error {
+	hash, err := g.writeObject(object.NewBlob([]byte(strconv.FormatInt(count, 10) + "\n")))
+	if err != nil {
+		return fmt.Errorf("writing counter blob: %w", err)
+	}
+	return g.repo.UpdateRefLocked(CounterRef, hash)
 }
 
 // GenerateCommit creates a new commit and updates the main branch.
 // It holds the repo lock for the entire read-modify-write cycle to
 // prevent concurrent generates from reading the same parent.
 func (g *Generator) GenerateCommit() (string, error) {
-	// Increment counter atomically
-	count := atomic.AddInt64(&g.counter, 1)
+	hash, count, _, err := g.generateCommit(0, false, false)
+	if err != nil {
+		return "", err
+	}
+	// Called without the repo lock, so the callback may read the repo.
+	for _, fn := range g.onCommit {
+		fn(hash, count)
+	}
+	return hash, nil
+}
+
+// GenerateSeededCommit creates a commit on main like GenerateCommit, but
+// generates its content as if seed were the pull count and dates it seed
+// seconds after the Unix epoch. The commit then depends only on its
+// parent and the seed, whatever the counter or clock say.
+func (g *Generator) GenerateSeededCommit(seed int64) (string, error) {
+	hash, count, _, err := g.generateCommit(seed, true, false)
+	if err != nil {
+		return "", err
+	}
+	for _, fn := range g.onCommit {
+		fn(hash, count)
+	}
+	return hash, nil
+}
+
+// GenerateAndPack generates a commit like GenerateCommit and also returns
+// a pack of the objects it added on top of its parent: the commit, its
+// tree and the new blobs. The pack is built under the same lock as the
+// commit, so it is exactly what a client at the parent needs.
+func (g *Generator) GenerateAndPack() (string, []byte, error) {
+	hash, count, pack, err := g.generateCommit(0, false, true)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, fn := range g.onCommit {
+		fn(hash, count)
+	}
+	return hash, pack, nil
+}
 
+// generateCommit creates the next commit on main and returns it with its
+// pull count. Its content is generated for that count and it is dated by
+// the clock, unless seeded, when seed stands in for both.
+func (g *Generator) generateCommit(seed int64, seeded, wantPack bool) (string, int64, []byte, error) {
 	// Hold the repo lock for the entire operation to prevent races.
 	g.repo.Lock()
 	defer g.repo.Unlock()
 
+	// The counter only moves under the lock, once main has, so each
+	// commit counts one past its parent and a failure leaves it alone.
+	next := atomic.LoadInt64(&g.counter) + 1
+	count, at := next, time.Time{}
+	if seeded {
+		count, at = seed, time.Unix(seed, 0).UTC()
+	}
+
+	if g.maxStore > 0 {
+		size, err := g.repo.ObjectStoreSize()
+		if err != nil {
+			return "", 0, nil, fmt.Errorf("checking store size: %w", err)
+		}
+		if size >= g.maxStore {
+			return "", 0, nil, ErrDiskCap
+		}
+	}
+
 	// Get current HEAD commit (use exported method is fine since
 	// getRefs is called internally, but we already hold the lock,
 	// so we call the unexported version via GetRefsLocked).
 	refs, err := g.repo.GetRefsLocked()
 	if err != nil {
-		return "", fmt.Errorf("getting refs: %w", err)
+		return "", 0, nil, fmt.Errorf("getting refs: %w", err)
 	}
 
 	parentHash := refs["refs/heads/main"]
 	if parentHash == "" {
-		return "", fmt.Errorf("main branch not found")
+		return "", 0, nil, fmt.Errorf("main branch not found")
 	}
 
 	// Read parent commit to get its tree
 	parentData, err := g.repo.ReadObject(parentHash)
 	if err != nil {
-		return "", fmt.Errorf("reading parent commit: %w", err)
+		return "", 0, nil, fmt.Errorf("reading parent commit: %w", err)
 	}
 
-	// Parse parent commit to find tree hash
-	var parentTreeHash string
-	lines := splitLines(string(parentData))
-	for _, line := range lines {
-		if len(line) > 5 && line[:5] == "tree " {
-			parentTreeHash = line[5:]
-			break
-		}
+	parentCommit, err := object.ParseCommit(parentData)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("parsing parent commit: %w", err)
 	}
 
 	// Read parent tree
-	parentTreeData, err := g.repo.ReadObject(parentTreeHash)
+	parentTreeData, err := g.repo.ReadObject(parentCommit.Tree)
 	if err != nil {
-		return "", fmt.Errorf("reading parent tree: %w", err)
+		return "", 0, nil, fmt.Errorf("reading parent tree: %w", err)
 	}
 
 	// Parse existing tree entries
-	existingEntries := parseTree(parentTreeData)
+	parentTree, err := g.repo.Format().ParseTree(parentTreeData)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("parsing parent tree: %w", err)
+	}
+
+	now := at
+	if now.IsZero() {
+		now = g.clock.Now()
+	}
 
 	// Generate files from content provider
-	now := time.Now()
 	generatedFiles := g.provider.GenerateFiles(count, now)
-
-	// Create new tree with existing entries, replacing any generated files
-	tree := object.NewTree()
-
-	// Add existing entries, skipping any that will be replaced
-	for _, entry := range existingEntries {
-		if _, replaced := generatedFiles[entry.Name]; !replaced {
-			tree.AddEntry(entry.Mode, entry.Name, entry.Hash)
+	if g.extra > 0 || g.dataSize > 0 {
+		files := make(map[string][]byte, len(generatedFiles)+g.extra+1)
+		maps.Copy(files, generatedFiles)
+		for i := 1; i <= g.extra; i++ {
+			files[g.fileName(count, i)] = []byte(fmt.Sprintf("Pull #%d, file %d\n", count, i))
+		}
+		if g.dataSize > 0 {
+			files["data.bin"] = entropyData(count, g.dataSize, g.entropy)
+		}
+		generatedFiles = files
+	}
+	var symlinks map[string]string
+	if sp, ok := g.provider.(SymlinkProvider); ok {
+		symlinks = sp.GenerateSymlinks(count, now)
+	}
+	for name := range symlinks {
+		if _, ok := generatedFiles[name]; ok {
+			return "", 0, nil, fmt.Errorf("%s generated as both a file and a symlink", name)
 		}
 	}
 
-	// Add generated files
+	// Merge the generated entries into the parent's tree, writing
+	// subtrees for nested paths.
+	generated := newGeneratedTree()
 	for name, content := range generatedFiles {
-		blob := object.NewBlob(content)
-		blobHash, err := g.repo.WriteObject(blob)
-		if err != nil {
-			return "", fmt.Errorf("writing blob for %s: %w", name, err)
+		if err := generated.add(name, generatedEntry{object.ModeFile, content}); err != nil {
+			return "", 0, nil, err
+		}
+	}
+	// A symlink is a blob holding exactly the target path, with no
+	// trailing newline, which git checks out as a link.
+	for name, target := range symlinks {
+		if err := generated.add(name, generatedEntry{object.ModeSymlink, []byte(target)}); err != nil {
+			return "", 0, nil, err
 		}
-		tree.AddEntry("100644", name, blobHash)
 	}
 
-	treeHash, err := g.repo.WriteObject(tree)
+	// Objects the parent tree already has are not new.
+	fresh := newObjectSet(parentTree)
+	var written []string
+	treeHash, err := g.writeTree(generated, parentCommit.Tree, parentTree, fresh, &written)
 	if err != nil {
-		return "", fmt.Errorf("writing tree: %w", err)
+		return "", 0, nil, err
 	}
 
 	// Create commit
-	commitMsg := g.provider.CommitMessage(count, now)
-	commit := object.NewCommit(
+	commitMsg := withTrailers(g.provider.CommitMessage(count, now), g.trailers)
+	ident := g.identity(count)
+	commit := object.NewCommitAt(
 		treeHash,
 		parentHash,
-		"Infinite Git <infinite@example.com>",
-		"Infinite Git <infinite@example.com>",
+		ident,
+		ident,
 		commitMsg,
+		now,
 	)
 
-	commitHash, err := g.repo.WriteObject(commit)
+	commitHash, err := g.writeObject(commit)
 	if err != nil {
-		return "", fmt.Errorf("writing commit: %w", err)
-	}
-
-	// Update refs/heads/main
-	if err := g.repo.UpdateRef("refs/heads/main", commitHash); err != nil {
-		return "", fmt.Errorf("updating ref: %w", err)
+		return "", 0, nil, fmt.Errorf("writing commit: %w", err)
 	}
+	written = append(written, commitHash)
+	fresh.add(commitHash, commit)
 
-	return commitHash, nil
-}
-
-// GetCounter returns the current counter value.
-func (g *Generator) GetCounter() int64 {
-	return atomic.LoadInt64(&g.counter)
-}
-
-// splitLines splits a string into lines.
-func splitLines(s string) []string {
-	var lines []string
-	start := 0
-	for i, c := range s {
-		if c == '\n' {
-			lines = append(lines, s[start:i])
-			start = i + 1
+	if g.verify {
+		for _, hash := range written {
+			if err := g.repo.VerifyObject(hash); err != nil {
+				slog.Error("generated object failed verification, not advancing ref",
+					"object", hash, "commit", commitHash, "error", err)
+				return "", 0, nil, fmt.Errorf("verifying object %s: %w", hash, err)
+			}
 		}
 	}
-	if start < len(s) {
-		lines = append(lines, s[start:])
-	}
-	return lines
-}
 
-// parseTree parses tree object data into entries.
-func parseTree(data []byte) []object.TreeEntry {
-	var entries []object.TreeEntry
-	i := 0
-
-	for i < len(data) {
-		// Find space (end of mode)
-		modeEnd := i
-		for modeEnd < len(data) && data[modeEnd] != ' ' {
-			modeEnd++
-		}
-		if modeEnd >= len(data) {
-			break
+	var pack []byte
+	if wantPack {
+		if pack, err = fresh.pack(g.repo.Format()); err != nil {
+			return "", 0, nil, fmt.Errorf("packing new objects: %w", err)
 		}
-		mode := string(data[i:modeEnd])
+	}
 
-		// Find null (end of name)
-		nameStart := modeEnd + 1
-		nameEnd := nameStart
-		for nameEnd < len(data) && data[nameEnd] != 0 {
-			nameEnd++
-		}
-		if nameEnd >= len(data) {
-			break
+	// Save the counter before main moves, so that failing to save it
+	// leaves main where it was.
+	if g.persist {
+		if err := g.saveCounter(next); err != nil {
+			return "", 0, nil, fmt.Errorf("saving counter: %w", err)
 		}
-		name := string(data[nameStart:nameEnd])
+	}
 
-		// Read 20-byte SHA-1
-		hashStart := nameEnd + 1
-		if hashStart+20 > len(data) {
-			break
+	// Update refs/heads/main
+	if err := g.repo.UpdateRefLocked("refs/heads/main", commitHash); err != nil {
+		if g.persist {
+			// Put the saved counter back to match main.
+			if serr := g.saveCounter(next - 1); serr != nil {
+				slog.Error("failed to restore persisted counter", "error", serr)
+			}
 		}
-		hash := fmt.Sprintf("%x", data[hashStart:hashStart+20])
-
-		entries = append(entries, object.TreeEntry{
-			Mode: mode,
-			Name: name,
-			Hash: hash,
-		})
-
-		i = hashStart + 20
+		return "", 0, nil, fmt.Errorf("updating ref: %w", err)
 	}
+	atomic.StoreInt64(&g.counter, next)
+
+	return commitHash, next, pack, nil
+}
 
-	return entries
+// GetCounter returns the current counter value.
+func (g *Generator) GetCounter() int64 {
+	return atomic.LoadInt64(&g.counter)
 }
@@ -0,0 +1,569 @@
+package generator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/imjasonh/infinite-git/internal/clock"
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/protocol"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// testContent is a minimal ContentProvider for generator tests.
+type testContent struct{}
+
+func (testContent) InitialFiles() map[string][]byte {
+	return map[string][]byte{"hello.txt": []byte("Pull #0\n")}
+}
+
+func (testContent) GenerateFiles(count int64, now time.Time) map[string][]byte {
+	return map[string][]byte{"hello.txt": []byte(fmt.Sprintf("Pull #%d\n", count))}
+}
+
+func (testContent) CommitMessage(count int64, now time.Time) string {
+	return fmt.Sprintf("Pull #%d", count)
+}
+
+func newTestRepo(t *testing.T) *repo.Repository {
+	t.Helper()
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	return r
+}
+
+func mainRef(t *testing.T, r *repo.Repository) string {
+	t.Helper()
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	return refs["refs/heads/main"]
+}
+
+func TestVerifyRejectsCorruptObject(t *testing.T) {
+	r := newTestRepo(t)
+	g := New(r, testContent{}, WithVerify(true))
+
+	// Write blobs correctly, then corrupt them on disk.
+	g.writeObject = func(obj object.Object) (string, error) {
+		hash, err := r.WriteObject(obj)
+		if err != nil || obj.Type() != object.TypeBlob {
+			return hash, err
+		}
+		path := filepath.Join(r.GitDir(), "objects", hash[:2], hash[2:])
+		return hash, os.WriteFile(path, []byte("corrupt"), 0644)
+	}
+
+	before := mainRef(t, r)
+	if _, err := g.GenerateCommit(); err == nil {
+		t.Fatal("GenerateCommit succeeded with a corrupt blob")
+	}
+	if after := mainRef(t, r); after != before {
+		t.Errorf("ref advanced from %s to %s despite failed verification", before, after)
+	}
+}
+
+func TestVerifyAcceptsGoodObjects(t *testing.T) {
+	r := newTestRepo(t)
+	g := New(r, testContent{}, WithVerify(true))
+
+	hash, err := g.GenerateCommit()
+	if err != nil {
+		t.Fatalf("GenerateCommit: %v", err)
+	}
+	if got := mainRef(t, r); got != hash {
+		t.Errorf("main = %s, want %s", got, hash)
+	}
+}
+
+func TestPersistentCounter(t *testing.T) {
+	r := newTestRepo(t)
+
+	g := New(r, testContent{}, WithPersistentCounter(true))
+	for i := 0; i < 3; i++ {
+		if _, err := g.GenerateCommit(); err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+	}
+
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	if refs[CounterRef] == "" {
+		t.Fatalf("%s not written", CounterRef)
+	}
+
+	// A new generator, as after a restart, resumes the count.
+	g = New(r, testContent{}, WithPersistentCounter(true))
+	if got := g.GetCounter(); got != 3 {
+		t.Errorf("resumed counter = %d, want 3", got)
+	}
+	if _, err := g.GenerateCommit(); err != nil {
+		t.Fatalf("GenerateCommit: %v", err)
+	}
+	if got := g.GetCounter(); got != 4 {
+		t.Errorf("counter after generation = %d, want 4", got)
+	}
+}
+
+func TestPersistentCounterFailure(t *testing.T) {
+	r := newTestRepo(t)
+	g := New(r, testContent{}, WithPersistentCounter(true))
+	if _, err := g.GenerateCommit(); err != nil {
+		t.Fatalf("GenerateCommit: %v", err)
+	}
+
+	// Fail to write the counter blob for the second commit.
+	g.writeObject = func(obj object.Object) (string, error) {
+		if b, ok := obj.(*object.Blob); ok && string(b.Content) == "2\n" {
+			return "", errors.New("disk full")
+		}
+		return r.WriteObject(obj)
+	}
+	head := mainRef(t, r)
+	if _, err := g.GenerateCommit(); err == nil {
+		t.Fatal("GenerateCommit succeeded without saving the counter")
+	}
+	if got := mainRef(t, r); got != head {
+		t.Errorf("main moved from %s to %s without saving the counter", head, got)
+	}
+	if got := g.GetCounter(); got != 1 {
+		t.Errorf("counter = %d, want 1", got)
+	}
+
+	// Any other failure leaves the counter alone too.
+	g.writeObject = func(obj object.Object) (string, error) {
+		if obj.Type() == object.TypeCommit {
+			return "", errors.New("disk full")
+		}
+		return r.WriteObject(obj)
+	}
+	if _, err := g.GenerateCommit(); err == nil {
+		t.Fatal("GenerateCommit succeeded without writing the commit")
+	}
+	if got := g.GetCounter(); got != 1 {
+		t.Errorf("counter = %d, want 1", got)
+	}
+
+	g.writeObject = r.WriteObject
+	if _, err := g.GenerateCommit(); err != nil {
+		t.Fatalf("GenerateCommit: %v", err)
+	}
+	if got := New(r, testContent{}, WithPersistentCounter(true)).GetCounter(); got != 2 {
+		t.Errorf("resumed counter = %d, want 2", got)
+	}
+}
+
+func TestConcurrentGenerateAndGetRefs(t *testing.T) {
+	r := newTestRepo(t)
+	g := New(r, testContent{})
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if _, err := g.GenerateCommit(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			select {
+			case err := <-errs:
+				t.Fatalf("GenerateCommit: %v", err)
+			default:
+			}
+			return
+		default:
+		}
+		refs, err := r.GetRefs()
+		if err != nil {
+			t.Fatalf("GetRefs: %v", err)
+		}
+		if main := refs["refs/heads/main"]; !object.ValidHash(main) {
+			t.Fatalf("GetRefs returned malformed main %q", main)
+		}
+	}
+}
+
+// bigContent writes an incompressible 64KiB blob on every pull.
+type bigContent struct{ testContent }
+
+func (bigContent) GenerateFiles(count int64, now time.Time) map[string][]byte {
+	data := make([]byte, 64<<10)
+	rand.NewChaCha8([32]byte{byte(count)}).Read(data)
+	return map[string][]byte{"big.bin": data}
+}
+
+func TestDiskCap(t *testing.T) {
+	r := newTestRepo(t)
+	initial, err := r.ObjectStoreSize()
+	if err != nil {
+		t.Fatalf("ObjectStoreSize: %v", err)
+	}
+
+	// Room for two big blobs; the third commit starts under the cap and
+	// overshoots it.
+	g := New(r, bigContent{}, WithMaxStoreBytes(initial+150<<10))
+	for i := 0; i < 3; i++ {
+		if _, err := g.GenerateCommit(); err != nil {
+			t.Fatalf("commit %d: %v", i+1, err)
+		}
+	}
+
+	head := mainRef(t, r)
+	for i := 0; i < 2; i++ {
+		if _, err := g.GenerateCommit(); !errors.Is(err, ErrDiskCap) {
+			t.Fatalf("GenerateCommit over the cap = %v, want ErrDiskCap", err)
+		}
+	}
+	if got := mainRef(t, r); got != head {
+		t.Errorf("main moved from %s to %s at the cap", head, got)
+	}
+	if got := g.GetCounter(); got != 3 {
+		t.Errorf("counter = %d, want 3", got)
+	}
+
+	// The cached size matches a fresh walk of the store.
+	cached, err := r.ObjectStoreSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := repo.New(r.Path(), nil)
+	if err != nil {
+		t.Fatalf("reopening repo: %v", err)
+	}
+	if walked, err := reopened.ObjectStoreSize(); err != nil || walked != cached {
+		t.Errorf("walked size = %d, %v; cached size = %d", walked, err, cached)
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	r := newTestRepo(t)
+
+	type event struct {
+		hash  string
+		count int64
+	}
+	var events []event
+	g := New(r, testContent{}, WithOnCommit(func(hash string, count int64) {
+		// The repo is unlocked, so reading it here must not deadlock.
+		if got := mainRef(t, r); got != hash {
+			t.Errorf("main = %s in callback, want %s", got, hash)
+		}
+		events = append(events, event{hash, count})
+	}))
+
+	var want []event
+	for i := int64(1); i <= 3; i++ {
+		hash, err := g.GenerateCommit()
+		if err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+		want = append(want, event{hash, i})
+	}
+	if !slices.Equal(events, want) {
+		t.Errorf("callbacks = %v, want %v", events, want)
+	}
+}
+
+func TestFilesPerCommit(t *testing.T) {
+	r := newTestRepo(t)
+	g := New(r, testContent{}, WithFilesPerCommit(5))
+
+	treeOf := func(hash string) map[string]string {
+		t.Helper()
+		data, err := r.ReadObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = r.ReadObject(c.Tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := object.ParseTree(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := make(map[string]string)
+		for _, e := range tree.Entries {
+			entries[e.Name] = e.Hash
+		}
+		return entries
+	}
+
+	prev := treeOf(mainRef(t, r))
+	for i := 0; i < 3; i++ {
+		hash, err := g.GenerateCommit()
+		if err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+		cur := treeOf(hash)
+		var added []string
+		for name := range cur {
+			if _, ok := prev[name]; !ok {
+				added = append(added, name)
+			}
+		}
+		if len(added) != 5 {
+			t.Errorf("commit %d added %v, want 5 files", i+1, added)
+		}
+		prev = cur
+	}
+}
+
+func TestEntropyData(t *testing.T) {
+	const size = 256 << 10
+	packSize := func(entropy float64) int {
+		t.Helper()
+		r := newTestRepo(t)
+		hash, err := New(r, testContent{}, WithEntropyData(size, entropy)).GenerateCommit()
+		if err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := protocol.NewUploadPack(r).WritePack(&buf, []string{hash}); err != nil {
+			t.Fatalf("WritePack: %v", err)
+		}
+		return buf.Len()
+	}
+
+	low, high := packSize(0), packSize(1)
+	if high < size {
+		t.Errorf("pack with random data is %d bytes, want at least %d", high, size)
+	}
+	if low*10 > high {
+		t.Errorf("low-entropy pack is %d bytes, want much smaller than high-entropy pack of %d bytes", low, high)
+	}
+}
+
+func TestFixedClockReproducible(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	generate := func() []string {
+		t.Helper()
+		r, err := repo.New(t.TempDir(), testContent{}.InitialFiles(), repo.WithClock(clock.Fixed(at)))
+		if err != nil {
+			t.Fatalf("creating repo: %v", err)
+		}
+		g := New(r, testContent{}, WithClock(clock.Fixed(at)))
+		hashes := []string{mainRef(t, r)}
+		for range 3 {
+			hash, err := g.GenerateCommit()
+			if err != nil {
+				t.Fatalf("GenerateCommit: %v", err)
+			}
+			hashes = append(hashes, hash)
+		}
+
+		data, err := r.ReadObject(hashes[len(hashes)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.AuthorDate.Equal(at) || !c.CommitDate.Equal(at) {
+			t.Errorf("commit dated %v and %v, want %v", c.AuthorDate, c.CommitDate, at)
+		}
+		return hashes
+	}
+
+	if first, second := generate(), generate(); !slices.Equal(first, second) {
+		t.Errorf("commits differ between runs: %v and %v", first, second)
+	}
+}
+
+func TestGenerateAndPack(t *testing.T) {
+	r := newTestRepo(t)
+	g := New(r, testContent{}, WithFilesPerCommit(2))
+
+	parent := mainRef(t, r)
+	hash, pack, err := g.GenerateAndPack()
+	if err != nil {
+		t.Fatalf("GenerateAndPack: %v", err)
+	}
+	if head := mainRef(t, r); head != hash {
+		t.Errorf("main = %s, want %s", head, hash)
+	}
+
+	// The new objects are everything in the new commit's tree that its
+	// parent's tree lacks, plus the tree and commit themselves.
+	treeEntries := func(commit string) (string, map[string]bool) {
+		t.Helper()
+		data, err := r.ReadObject(commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = r.ReadObject(c.Tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := object.ParseTree(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := make(map[string]bool)
+		for _, e := range tree.Entries {
+			entries[e.Hash] = true
+		}
+		return c.Tree, entries
+	}
+	_, old := treeEntries(parent)
+	tree, cur := treeEntries(hash)
+	want := []string{hash, tree}
+	for h := range cur {
+		if !old[h] {
+			want = append(want, h)
+		}
+	}
+	slices.Sort(want)
+
+	st := memory.NewStorage()
+	if err := packfile.UpdateObjectStorage(st, bytes.NewReader(pack)); err != nil {
+		t.Fatalf("reading pack: %v", err)
+	}
+	var got []string
+	for h, obj := range st.Objects {
+		got = append(got, h.String())
+		data, err := r.ReadObject(h.String())
+		if err != nil {
+			t.Fatalf("packed object %s is not in the repo: %v", h, err)
+		}
+		rd, err := obj.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packed, data) {
+			t.Errorf("packed object %s differs from the repo's", h)
+		}
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("pack holds %v, want %v", got, want)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	var trailers []Trailer
+	for _, s := range []string{"Signed-off-by: Infinite Git <infinite@example.com>", "Co-authored-by:A <a@example.com>"} {
+		tr, err := ParseTrailer(s)
+		if err != nil {
+			t.Fatalf("ParseTrailer(%q): %v", s, err)
+		}
+		trailers = append(trailers, tr)
+	}
+	for _, s := range []string{"no colon", ":empty key", "empty value:", "two words: value"} {
+		if _, err := ParseTrailer(s); err == nil {
+			t.Errorf("ParseTrailer(%q) succeeded", s)
+		}
+	}
+
+	r := newTestRepo(t)
+	hash, err := New(r, testContent{}, WithTrailers(trailers...)).GenerateCommit()
+	if err != nil {
+		t.Fatalf("GenerateCommit: %v", err)
+	}
+	data, err := r.ReadObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := object.ParseCommit(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Pull #1\n\nSigned-off-by: Infinite Git <infinite@example.com>\nCo-authored-by: A <a@example.com>\n"
+	if c.Message != want {
+		t.Errorf("message = %q, want %q", c.Message, want)
+	}
+	if !bytes.Equal(c.Serialize(), data) {
+		t.Error("commit does not round-trip through ParseCommit")
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	authors := []string{"Ada <ada@example.com>", "Brian <bwk@example.com>", "Grace <grace@example.com>"}
+	for _, s := range authors {
+		if _, err := ParseIdentity(s); err != nil {
+			t.Errorf("ParseIdentity(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"no email", "<a@example.com>", "A <a@example.com", "A <a b@example.com>", "A<b> <a@example.com>"} {
+		if _, err := ParseIdentity(s); err == nil {
+			t.Errorf("ParseIdentity(%q) succeeded", s)
+		}
+	}
+
+	r := newTestRepo(t)
+	gen := New(r, testContent{}, WithAuthors(authors...))
+	for range 2 * len(authors) {
+		if _, err := gen.GenerateCommit(); err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+	}
+
+	gitRepo, err := git.PlainOpen(r.Path())
+	if err != nil {
+		t.Fatalf("opening repo with go-git: %v", err)
+	}
+	head, err := gitRepo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := gitRepo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = iter.ForEach(func(c *gitobject.Commit) error {
+		if len(c.ParentHashes) > 0 {
+			got = append(got, fmt.Sprintf("%s <%s>", c.Author.Name, c.Author.Email))
+			if c.Committer.Email != c.Author.Email {
+				t.Errorf("commit %s committed by %s, authored by %s", c.Hash, c.Committer.Email, c.Author.Email)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(got)
+	want := append(slices.Clone(authors), authors...)
+	if !slices.Equal(got, want) {
+		t.Errorf("authors = %q, want %q", got, want)
+	}
+}
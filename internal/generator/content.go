@@ -12,3 +12,12 @@ type ContentProvider interface {
 	// CommitMessage returns the commit message for a pull.
 	CommitMessage(count int64, now time.Time) string
 }
+
+// SymlinkProvider is implemented by ContentProviders that also create
+// symbolic links on each pull.
+type SymlinkProvider interface {
+	// GenerateSymlinks returns links to create/update on each pull, as
+	// a map from path to link target. A path must not also be returned
+	// by GenerateFiles.
+	GenerateSymlinks(count int64, now time.Time) map[string]string
+}
@@ -0,0 +1,28 @@
+package generator
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// entropyPattern fills the low-entropy part of generated data.
+const entropyPattern = "All work and no play makes Jack a dull boy.\n"
+
+// entropyData returns size bytes in which each byte is random with
+// probability entropy and otherwise comes from entropyPattern. The data
+// depends only on the arguments, and differs between pulls.
+func entropyData(count int64, size int, entropy float64) []byte {
+	var seed [32]byte
+	binary.LittleEndian.PutUint64(seed[:], uint64(count))
+	rng := rand.New(rand.NewChaCha8(seed))
+
+	data := make([]byte, size)
+	for i := range data {
+		if entropy > 0 && rng.Float64() < entropy {
+			data[i] = byte(rng.Uint32())
+		} else {
+			data[i] = entropyPattern[i%len(entropyPattern)]
+		}
+	}
+	return data
+}
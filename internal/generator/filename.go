@@ -0,0 +1,84 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultFileNamePattern names the files WithFilesPerCommit adds unless
+// WithFileNamePattern says otherwise.
+const DefaultFileNamePattern = "pull-%d-file-%d.txt"
+
+// WithFileNamePattern names the files WithFilesPerCommit adds with a
+// printf-style pattern such as "data/%06d.log". Its %d verbs take, in
+// order, the pull count and the file's number within the pull, so a
+// pattern with one verb suits one file per commit. Slashes make
+// directories. The pattern must pass ValidateFileNamePattern.
+func WithFileNamePattern(pattern string) Option {
+	return func(g *Generator) {
+		g.pattern = pattern
+	}
+}
+
+// fileName returns the name of the i'th extra file of the count'th pull.
+func (g *Generator) fileName(count int64, i int) string {
+	pattern := g.pattern
+	if pattern == "" {
+		pattern = DefaultFileNamePattern
+	}
+	if strings.Count(pattern, "%")-2*strings.Count(pattern, "%%") == 1 {
+		return fmt.Sprintf(pattern, count)
+	}
+	return fmt.Sprintf(pattern, count, i)
+}
+
+// ValidateFileNamePattern checks that pattern names each of perCommit
+// files of every pull uniquely, with a relative path that stays inside
+// the repository. It allows %% and one or two %d verbs, optionally
+// zero-padded as in %06d; two verbs must be separated by something other
+// than a digit, or pull 1's file 11 would clash with pull 11's file 1.
+func ValidateFileNamePattern(pattern string, perCommit int) error {
+	verbs := 0
+	digitSinceVerb := true // whether a non-digit separates the verbs
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			if pattern[i] < '0' || pattern[i] > '9' {
+				digitSinceVerb = false
+			}
+			continue
+		}
+		i++
+		if i < len(pattern) && pattern[i] == '%' {
+			digitSinceVerb = false
+			continue
+		}
+		for i < len(pattern) && pattern[i] >= '0' && pattern[i] <= '9' {
+			i++
+		}
+		if i == len(pattern) || pattern[i] != 'd' {
+			return fmt.Errorf("file name pattern %q: only %%d verbs are supported", pattern)
+		}
+		if verbs == 1 && digitSinceVerb {
+			return fmt.Errorf("file name pattern %q: verbs must be separated by a non-digit", pattern)
+		}
+		verbs++
+		digitSinceVerb = true
+	}
+	switch {
+	case verbs == 0 || verbs > 2:
+		return fmt.Errorf("file name pattern %q: want one or two %%d verbs, got %d", pattern, verbs)
+	case verbs == 1 && perCommit > 1:
+		return fmt.Errorf("file name pattern %q: one verb cannot name %d files per commit apart; add one for the file number", pattern, perCommit)
+	}
+
+	// Numbers never add slashes or dots, so one name shows the shape of
+	// them all.
+	g := &Generator{pattern: pattern}
+	name := g.fileName(1, 1)
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.EqualFold(part, ".git") || strings.ContainsAny(part, "\x00\\") {
+			return fmt.Errorf("file name pattern %q makes invalid path %q", pattern, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// readPath returns the content of the blob at the slash-separated path in
+// the tree of commit, or false if there is none.
+func readPath(t *testing.T, r *repo.Repository, commit, path string) (string, bool) {
+	t.Helper()
+	data, err := r.ReadObject(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := object.ParseCommit(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := c.Tree
+	for _, part := range strings.Split(path, "/") {
+		data, err := r.ReadObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := object.ParseTree(data)
+		if err != nil {
+			t.Fatalf("%s is not a tree: %v", hash, err)
+		}
+		hash = ""
+		for _, e := range tree.Entries {
+			if e.Name == part {
+				hash = e.Hash
+			}
+		}
+		if hash == "" {
+			return "", false
+		}
+	}
+	data, err = r.ReadObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), true
+}
+
+func TestFileNamePattern(t *testing.T) {
+	const pattern = "data/%04d/%02d.log"
+	if err := ValidateFileNamePattern(pattern, 2); err != nil {
+		t.Fatalf("ValidateFileNamePattern: %v", err)
+	}
+	r := newTestRepo(t)
+	g := New(r, testContent{}, WithFilesPerCommit(2), WithFileNamePattern(pattern))
+
+	var hash string
+	for i := 0; i < 2; i++ {
+		var err error
+		if hash, err = g.GenerateCommit(); err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+	}
+
+	// The second commit keeps the first's files alongside its own.
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"data/0001/01.log", "Pull #1, file 1\n"},
+		{"data/0001/02.log", "Pull #1, file 2\n"},
+		{"data/0002/01.log", "Pull #2, file 1\n"},
+		{"data/0002/02.log", "Pull #2, file 2\n"},
+		{"hello.txt", "Pull #2\n"},
+	} {
+		got, ok := readPath(t, r, hash, tc.path)
+		if !ok {
+			t.Errorf("%s is missing", tc.path)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+	if _, ok := readPath(t, r, hash, fmt.Sprintf(DefaultFileNamePattern, 1, 1)); ok {
+		t.Errorf("%s exists with a custom pattern", fmt.Sprintf(DefaultFileNamePattern, 1, 1))
+	}
+}
+
+func TestValidateFileNamePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern   string
+		perCommit int
+		ok        bool
+	}{
+		{DefaultFileNamePattern, 5, true},
+		{"data/%06d.log", 1, true},
+		{"data/%06d.log", 2, false},
+		{"logs/%d/%03d.txt", 3, true},
+		{"100%% %d.txt", 1, true},
+		{"%d%d.txt", 2, false},
+		{"%d1%d.txt", 2, false},
+		{"%d-%d-%d.txt", 1, false},
+		{"static.txt", 1, false},
+		{"%s.txt", 1, false},
+		{"../%d.txt", 1, false},
+		{"a/./%d.txt", 1, false},
+		{"/%d.txt", 1, false},
+		{"a//%d.txt", 1, false},
+		{"%d/", 1, false},
+		{".git/%d", 1, false},
+		{"a\\%d.txt", 1, false},
+	} {
+		err := ValidateFileNamePattern(tc.pattern, tc.perCommit)
+		if (err == nil) != tc.ok {
+			t.Errorf("ValidateFileNamePattern(%q, %d) = %v, want ok %t", tc.pattern, tc.perCommit, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package generator
+
+import (
+	"fmt"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/packfile"
+)
+
+// objectSet collects the objects a generated commit adds, in the order
+// they are written.
+type objectSet struct {
+	seen    map[string]bool
+	objects []object.Object
+}
+
+// newObjectSet returns a set that ignores the entries of parent, which
+// the parent commit already has.
+func newObjectSet(parent *object.Tree) *objectSet {
+	s := &objectSet{seen: make(map[string]bool)}
+	s.ignore(parent)
+	return s
+}
+
+// ignore leaves the entries of t out of the set.
+func (s *objectSet) ignore(t *object.Tree) {
+	for _, e := range t.Entries {
+		s.seen[e.Hash] = true
+	}
+}
+
+func (s *objectSet) add(hash string, obj object.Object) {
+	if s.seen[hash] {
+		return
+	}
+	s.seen[hash] = true
+	s.objects = append(s.objects, obj)
+}
+
+// pack returns a packfile holding the objects, which are named in format.
+func (s *objectSet) pack(format object.Format) ([]byte, error) {
+	pw := packfile.NewWriter(packfile.WithChecksum(format.New))
+	for _, obj := range s.objects {
+		var typ int
+		switch obj.Type() {
+		case object.TypeCommit:
+			typ = packfile.OBJ_COMMIT
+		case object.TypeTree:
+			typ = packfile.OBJ_TREE
+		case object.TypeBlob:
+			typ = packfile.OBJ_BLOB
+		case object.TypeTag:
+			typ = packfile.OBJ_TAG
+		default:
+			return nil, fmt.Errorf("unexpected object type %s", obj.Type())
+		}
+		if err := pw.AddObject(typ, obj.Serialize()); err != nil {
+			return nil, err
+		}
+	}
+	return pw.Finalize(), nil
+}
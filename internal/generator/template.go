@@ -0,0 +1,73 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// TemplateContent replays the files of a template directory, one per
+// commit in name order, looping back to the first after the last. This
+// makes the history look like a project evolving file by file.
+type TemplateContent struct {
+	names []string
+	files map[string][]byte
+}
+
+// NewTemplateContent loads the regular files at the top level of dir.
+func NewTemplateContent(dir string) (*TemplateContent, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading template dir: %w", err)
+	}
+
+	t := &TemplateContent{files: make(map[string][]byte)}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading template file %s: %w", entry.Name(), err)
+		}
+		t.names = append(t.names, entry.Name())
+		t.files[entry.Name()] = content
+	}
+	if len(t.names) == 0 {
+		return nil, fmt.Errorf("template dir %s has no files", dir)
+	}
+	sort.Strings(t.names)
+
+	return t, nil
+}
+
+// InitialFiles returns a README describing the repository.
+func (t *TemplateContent) InitialFiles() map[string][]byte {
+	return map[string][]byte{
+		"README.md": []byte("# Infinite Git Repository\n\nEvery pull replays the next file from a template.\n"),
+	}
+}
+
+// GenerateFiles returns the template file for this pull.
+func (t *TemplateContent) GenerateFiles(count int64, now time.Time) map[string][]byte {
+	name := t.fileFor(count)
+	return map[string][]byte{name: t.files[name]}
+}
+
+// CommitMessage names the template file committed by this pull.
+func (t *TemplateContent) CommitMessage(count int64, now time.Time) string {
+	return fmt.Sprintf("Update %s\n\nPull #%d at %s", t.fileFor(count), count, now.Format("2006-01-02 15:04:05"))
+}
+
+// fileFor returns the template file applied by the count'th pull.
+func (t *TemplateContent) fileFor(count int64) string {
+	i := (count - 1) % int64(len(t.names))
+	if i < 0 {
+		i += int64(len(t.names))
+	}
+	return t.names[i]
+}
+
+var _ ContentProvider = (*TemplateContent)(nil)
@@ -0,0 +1,92 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// headTree returns the files in the tree of the main branch head.
+func headTree(t *testing.T, r *repo.Repository) map[string]string {
+	t.Helper()
+	data, err := r.ReadObject(mainRef(t, r))
+	if err != nil {
+		t.Fatalf("reading head commit: %v", err)
+	}
+	commit, err := object.ParseCommit(data)
+	if err != nil {
+		t.Fatalf("parsing head commit: %v", err)
+	}
+	data, err = r.ReadObject(commit.Tree)
+	if err != nil {
+		t.Fatalf("reading head tree: %v", err)
+	}
+	tree, err := object.ParseTree(data)
+	if err != nil {
+		t.Fatalf("parsing head tree: %v", err)
+	}
+	files := make(map[string]string)
+	for _, e := range tree.Entries {
+		content, err := r.ReadObject(e.Hash)
+		if err != nil {
+			t.Fatalf("reading %s: %v", e.Name, err)
+		}
+		files[e.Name] = string(content)
+	}
+	return files
+}
+
+func TestTemplateContent(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"1-intro.md": "intro\n",
+		"2-main.go":  "package main\n",
+		"3-notes":    "notes\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ignored"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := NewTemplateContent(dir)
+	if err != nil {
+		t.Fatalf("NewTemplateContent: %v", err)
+	}
+	r, err := repo.New(t.TempDir(), content.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	g := New(r, content)
+
+	want := []string{"1-intro.md", "2-main.go", "3-notes"}
+	for i, name := range want {
+		if _, err := g.GenerateCommit(); err != nil {
+			t.Fatalf("GenerateCommit: %v", err)
+		}
+		files := headTree(t, r)
+		if len(files) != i+2 { // README plus the files so far
+			t.Errorf("commit %d has %d files, want %d", i+1, len(files), i+2)
+		}
+		if _, ok := files[name]; !ok {
+			t.Errorf("commit %d missing %s", i+1, name)
+		}
+	}
+
+	// After the last file the sequence loops.
+	if got := content.GenerateFiles(4, time.Time{}); got["1-intro.md"] == nil {
+		t.Errorf("pull #4 generated %v, want 1-intro.md", got)
+	}
+}
+
+func TestTemplateContentEmptyDir(t *testing.T) {
+	if _, err := NewTemplateContent(t.TempDir()); err == nil {
+		t.Error("NewTemplateContent succeeded on an empty dir")
+	}
+}
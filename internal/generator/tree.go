@@ -0,0 +1,113 @@
+package generator
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// generatedEntry is a file or symlink a commit writes.
+type generatedEntry struct {
+	mode    string
+	content []byte
+}
+
+// generatedTree is a directory of a commit's generated entries, keyed by
+// name, before it is merged into the parent's tree.
+type generatedTree struct {
+	entries map[string]generatedEntry
+	dirs    map[string]*generatedTree
+}
+
+func newGeneratedTree() *generatedTree {
+	return &generatedTree{entries: make(map[string]generatedEntry), dirs: make(map[string]*generatedTree)}
+}
+
+// add places e at the slash-separated path, creating directories along
+// the way.
+func (t *generatedTree) add(path string, e generatedEntry) error {
+	parts := strings.Split(path, "/")
+	dir := t
+	for _, part := range parts[:len(parts)-1] {
+		if _, ok := dir.entries[part]; ok {
+			return fmt.Errorf("%s: %s is generated as a file", path, part)
+		}
+		if dir.dirs[part] == nil {
+			dir.dirs[part] = newGeneratedTree()
+		}
+		dir = dir.dirs[part]
+	}
+	name := parts[len(parts)-1]
+	if _, ok := dir.dirs[name]; ok {
+		return fmt.Errorf("%s is generated as a directory", path)
+	}
+	dir.entries[name] = e
+	return nil
+}
+
+// writeTree writes the tree that is base, the tree at baseHash, with t's
+// entries added or replacing its own, and returns its hash. Directories
+// of t are merged into base's subtrees of the same name; anything else
+// of that name is replaced. New objects go into fresh, and their hashes
+// into written. baseHash is empty for a directory base lacks.
+func (g *Generator) writeTree(t *generatedTree, baseHash string, base *object.Tree, fresh *objectSet, written *[]string) (string, error) {
+	tree := object.NewTree()
+	subtrees := make(map[string]string)
+	for _, entry := range base.Entries {
+		if _, ok := t.dirs[entry.Name]; ok {
+			if entry.Mode == object.ModeDir {
+				subtrees[entry.Name] = entry.Hash
+			}
+			continue
+		}
+		if _, ok := t.entries[entry.Name]; !ok {
+			tree.AddEntry(entry.Mode, entry.Name, entry.Hash)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(t.entries)) {
+		e := t.entries[name]
+		blob := object.NewBlob(e.content)
+		hash, err := g.writeObject(blob)
+		if err != nil {
+			return "", fmt.Errorf("writing blob for %s: %w", name, err)
+		}
+		tree.AddEntry(e.mode, name, hash)
+		*written = append(*written, hash)
+		fresh.add(hash, blob)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(t.dirs)) {
+		subHash := subtrees[name]
+		sub := object.NewTree()
+		if subHash != "" {
+			data, err := g.repo.ReadObject(subHash)
+			if err != nil {
+				return "", fmt.Errorf("reading tree %s: %w", name, err)
+			}
+			if sub, err = g.repo.Format().ParseTree(data); err != nil {
+				return "", fmt.Errorf("parsing tree %s: %w", name, err)
+			}
+			// The parent commit has the subtree's entries already.
+			fresh.ignore(sub)
+		}
+		hash, err := g.writeTree(t.dirs[name], subHash, sub, fresh, written)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		tree.AddEntry(object.ModeDir, name, hash)
+	}
+
+	hash, err := g.writeObject(tree)
+	if err != nil {
+		return "", fmt.Errorf("writing tree: %w", err)
+	}
+	*written = append(*written, hash)
+	if hash != baseHash {
+		fresh.add(hash, tree)
+	}
+	return hash, nil
+}
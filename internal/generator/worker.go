@@ -0,0 +1,98 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrWorkerClosed is returned by Worker.Generate after Close.
+var ErrWorkerClosed = errors.New("generation worker is closed")
+
+// Worker generates commits one at a time on its own goroutine, so that
+// request handlers hand generations off instead of contending for the
+// repo lock themselves. Requests are served in the order they arrive,
+// and each gets a commit of its own.
+type Worker struct {
+	requests chan workRequest
+	done     chan struct{}
+	stopped  chan struct{}
+	close    sync.Once
+}
+
+type workRequest struct {
+	ctx      context.Context
+	generate func() (string, error)
+	result   chan workResult
+}
+
+type workResult struct {
+	hash string
+	err  error
+}
+
+// NewWorker starts a worker that queues up to queue requests before
+// Generate blocks.
+func NewWorker(queue int) *Worker {
+	w := &Worker{
+		requests: make(chan workRequest, max(queue, 0)),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *Worker) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case <-w.done:
+			return
+		case req := <-w.requests:
+			// Nobody is waiting for a request whose context ended while
+			// it was queued, so don't generate a commit for it.
+			if err := req.ctx.Err(); err != nil {
+				req.result <- workResult{err: err}
+				continue
+			}
+			hash, err := req.generate()
+			req.result <- workResult{hash, err}
+		}
+	}
+}
+
+// Generate has the worker call generate, one of the Generator's methods
+// such as GenerateCommit, and waits for the commit it makes. It returns
+// ctx's error if ctx ends first; a generation that has already started
+// still completes, and main advances to it.
+func (w *Worker) Generate(ctx context.Context, generate func() (string, error)) (string, error) {
+	req := workRequest{ctx: ctx, generate: generate, result: make(chan workResult, 1)}
+	select {
+	case w.requests <- req:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-w.done:
+		return "", ErrWorkerClosed
+	}
+	select {
+	case res := <-req.result:
+		return res.hash, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-w.stopped:
+		// The worker sends a result before it stops, if it took req.
+		select {
+		case res := <-req.result:
+			return res.hash, res.err
+		default:
+			return "", ErrWorkerClosed
+		}
+	}
+}
+
+// Close stops the worker once the generation in progress, if any, is
+// done. Requests still queued fail with ErrWorkerClosed.
+func (w *Worker) Close() {
+	w.close.Do(func() { close(w.done) })
+}
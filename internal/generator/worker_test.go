@@ -0,0 +1,78 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorker(t *testing.T) {
+	w := NewWorker(4)
+	defer w.Close()
+
+	// Generations never overlap.
+	var running, calls atomic.Int32
+	generate := func() (string, error) {
+		if running.Add(1) != 1 {
+			t.Error("generations overlap")
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		return string(rune('a' + calls.Add(1) - 1)), nil
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hash, err := w.Generate(context.Background(), generate)
+			if err != nil {
+				t.Errorf("Generate: %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[hash] {
+				t.Errorf("hash %q returned twice", hash)
+			}
+			seen[hash] = true
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 10 {
+		t.Errorf("got %d distinct results, want 10", len(seen))
+	}
+
+	// A caller that gives up gets its context's error, and a request
+	// queued behind a slow generation is dropped once its caller has.
+	started, release := make(chan struct{}), make(chan struct{})
+	go w.Generate(context.Background(), func() (string, error) {
+		close(started)
+		<-release
+		return "slow", nil
+	})
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var generated atomic.Bool
+	if _, err := w.Generate(ctx, func() (string, error) { generated.Store(true); return "", nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Generate past its deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if hash, err := w.Generate(context.Background(), func() (string, error) { return "next", nil }); err != nil || hash != "next" {
+		t.Errorf("Generate = %q, %v; want next", hash, err)
+	}
+	if generated.Load() {
+		t.Error("expired request was generated")
+	}
+
+	w.Close()
+	if _, err := w.Generate(context.Background(), generate); !errors.Is(err, ErrWorkerClosed) {
+		t.Errorf("Generate after Close = %v, want %v", err, ErrWorkerClosed)
+	}
+}
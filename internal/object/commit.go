@@ -3,26 +3,38 @@ package object
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Commit represents a Git commit object.
 type Commit struct {
 	Tree       string    // SHA-1 hash of the tree object
-	Parent     string    // SHA-1 hash of the parent commit (empty for initial commit)
+	Parents    []string  // SHA-1 hashes of the parent commits (empty for initial commit)
 	Author     string    // Author name and email
 	AuthorDate time.Time // Author timestamp
 	Committer  string    // Committer name and email
 	CommitDate time.Time // Commit timestamp
 	Message    string    // Commit message
+	Signature  string    // Armored signature, empty if unsigned
 }
 
-// NewCommit creates a new commit object.
+// NewCommit creates a new commit object dated now.
+// An empty parent creates a root commit.
 func NewCommit(tree, parent, author, committer, message string) *Commit {
-	now := time.Now()
+	return NewCommitAt(tree, parent, author, committer, message, time.Now())
+}
+
+// NewCommitAt creates a new commit object authored and committed at now.
+func NewCommitAt(tree, parent, author, committer, message string, now time.Time) *Commit {
+	var parents []string
+	if parent != "" {
+		parents = []string{parent}
+	}
 	return &Commit{
 		Tree:       tree,
-		Parent:     parent,
+		Parents:    parents,
 		Author:     author,
 		AuthorDate: now,
 		Committer:  committer,
@@ -43,9 +55,9 @@ func (c *Commit) Serialize() []byte {
 	// Tree reference
 	fmt.Fprintf(&buf, "tree %s\n", c.Tree)
 
-	// Parent reference (if exists)
-	if c.Parent != "" {
-		fmt.Fprintf(&buf, "parent %s\n", c.Parent)
+	// Parent references (if any)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&buf, "parent %s\n", parent)
 	}
 
 	// Author
@@ -60,6 +72,11 @@ func (c *Commit) Serialize() []byte {
 		c.CommitDate.Unix(),
 		c.CommitDate.Format("-0700"))
 
+	// Signature, folded onto continuation lines
+	if c.Signature != "" {
+		writeFolded(&buf, "gpgsig", c.Signature)
+	}
+
 	// Empty line before message
 	buf.WriteByte('\n')
 
@@ -73,3 +90,129 @@ func (c *Commit) Serialize() []byte {
 
 	return buf.Bytes()
 }
+
+// SignWith signs the commit with sign, which is given the commit without
+// any signature and returns an armored signature, such as the output of
+// gpg --armor --detach-sign.
+func (c *Commit) SignWith(sign func(payload []byte) ([]byte, error)) error {
+	c.Signature = ""
+	sig, err := sign(c.Serialize())
+	if err != nil {
+		return fmt.Errorf("signing commit: %w", err)
+	}
+	c.Signature = string(sig)
+	return nil
+}
+
+// writeFolded writes a multi-line header the way git does: the first
+// line after the key and each further line after a single space.
+func writeFolded(buf *bytes.Buffer, key, value string) {
+	lines := strings.Split(strings.TrimSuffix(value, "\n"), "\n")
+	fmt.Fprintf(buf, "%s %s\n", key, lines[0])
+	for _, line := range lines[1:] {
+		fmt.Fprintf(buf, " %s\n", line)
+	}
+}
+
+// ParseCommit parses commit object content (without the object header).
+// Unknown headers such as encoding or mergetag are skipped, along with
+// their continuation lines. A missing or malformed tree, parent or
+// identity is an error.
+func ParseCommit(data []byte) (*Commit, error) {
+	c := &Commit{}
+	rest := data
+	var sig []string
+	inSig := false
+	for {
+		nl := bytes.IndexByte(rest, '\n')
+		if nl == -1 {
+			return nil, fmt.Errorf("commit header not terminated")
+		}
+		line := string(rest[:nl])
+		rest = rest[nl+1:]
+
+		if line == "" {
+			// Blank line separates headers from the message
+			break
+		}
+		if line[0] == ' ' {
+			// Continuation of a multi-line header
+			if inSig {
+				sig = append(sig, line[1:])
+			}
+			continue
+		}
+		inSig = false
+
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			if !ValidHash(value) {
+				return nil, fmt.Errorf("invalid tree %q", value)
+			}
+			c.Tree = value
+		case "parent":
+			if !ValidHash(value) {
+				return nil, fmt.Errorf("invalid parent %q", value)
+			}
+			c.Parents = append(c.Parents, value)
+		case "author":
+			ident, when, err := parseIdent(value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing author: %w", err)
+			}
+			c.Author, c.AuthorDate = ident, when
+		case "committer":
+			ident, when, err := parseIdent(value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing committer: %w", err)
+			}
+			c.Committer, c.CommitDate = ident, when
+		case "gpgsig":
+			sig, inSig = []string{value}, true
+		}
+	}
+
+	if c.Tree == "" {
+		return nil, fmt.Errorf("commit has no tree")
+	}
+	if sig != nil {
+		c.Signature = strings.Join(sig, "\n") + "\n"
+	}
+	c.Message = string(rest)
+	return c, nil
+}
+
+// parseIdent parses "Name <email> <unix-seconds> <+hhmm>" into the
+// identity and its timestamp in the recorded timezone.
+func parseIdent(s string) (string, time.Time, error) {
+	end := strings.LastIndexByte(s, '>')
+	if end == -1 {
+		return "", time.Time{}, fmt.Errorf("missing email in %q", s)
+	}
+	ident := s[:end+1]
+
+	fields := strings.Fields(s[end+1:])
+	if len(fields) != 2 {
+		return "", time.Time{}, fmt.Errorf("missing timestamp in %q", s)
+	}
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid timestamp %q", fields[0])
+	}
+	tz := fields[1]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return "", time.Time{}, fmt.Errorf("invalid timezone %q", tz)
+	}
+	hours, err1 := strconv.Atoi(tz[1:3])
+	mins, err2 := strconv.Atoi(tz[3:5])
+	if err1 != nil || err2 != nil {
+		return "", time.Time{}, fmt.Errorf("invalid timezone %q", tz)
+	}
+	offset := hours*3600 + mins*60
+	if tz[0] == '-' {
+		offset = -offset
+	}
+
+	return ident, time.Unix(secs, 0).In(time.FixedZone("", offset)), nil
+}
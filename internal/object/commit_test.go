@@ -0,0 +1,149 @@
+package object
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommitRoundTrip(t *testing.T) {
+	tree := "4b825dc642cb6eb9a060e54bf8d69288fbe4904b"
+	parent := "0123456789abcdef0123456789abcdef01234567"
+	when := time.Unix(1700000000, 0).In(time.FixedZone("", 5*3600+30*60))
+	c := NewCommitAt(tree, parent, "Author <a@example.com>", "Committer <c@example.com>", "Subject\n\nBody\n", when)
+
+	got, err := ParseCommit(c.Serialize())
+	if err != nil {
+		t.Fatalf("ParseCommit: %v", err)
+	}
+	if got.Tree != tree || len(got.Parents) != 1 || got.Parents[0] != parent {
+		t.Errorf("links = %s %v, want %s [%s]", got.Tree, got.Parents, tree, parent)
+	}
+	if got.Author != c.Author || got.Committer != c.Committer || got.Message != c.Message {
+		t.Errorf("parsed %+v, want %+v", got, c)
+	}
+	if !got.AuthorDate.Equal(when) || got.CommitDate.Format("-0700") != "+0530" {
+		t.Errorf("dates = %v, %v, want %v in +0530", got.AuthorDate, got.CommitDate, when)
+	}
+	if Hash(got) != Hash(c) {
+		t.Errorf("reserialized hash = %s, want %s", Hash(got), Hash(c))
+	}
+}
+
+func TestParseCommitSignedAndMerge(t *testing.T) {
+	data := "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b\n" +
+		"parent 0123456789abcdef0123456789abcdef01234567\n" +
+		"parent 89abcdef0123456789abcdef0123456789abcdef\n" +
+		"author A <a@example.com> 1700000000 +0000\n" +
+		"committer C <c@example.com> 1700000001 -0800\n" +
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n" +
+		" \n" +
+		" iQEzBAABCAAdFiEE\n" +
+		" -----END PGP SIGNATURE-----\n" +
+		"\n" +
+		"Merge\n"
+	c, err := ParseCommit([]byte(data))
+	if err != nil {
+		t.Fatalf("ParseCommit: %v", err)
+	}
+	if len(c.Parents) != 2 {
+		t.Errorf("parents = %v, want 2", c.Parents)
+	}
+	if c.CommitDate.Unix() != 1700000001 || c.Message != "Merge\n" {
+		t.Errorf("parsed %+v", c)
+	}
+	if want := "-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----\n"; c.Signature != want {
+		t.Errorf("signature = %q, want %q", c.Signature, want)
+	}
+}
+
+func TestParseCommitErrors(t *testing.T) {
+	const ident = "A <a@example.com> 1700000000 +0000"
+	for _, tt := range []struct {
+		name, data, want string
+	}{
+		{"no tree", "author " + ident + "\n\nmsg\n", "no tree"},
+		{"bad tree", "tree nope\n\nmsg\n", "invalid tree"},
+		{"bad parent", "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b\nparent 123\n\nmsg\n", "invalid parent"},
+		{"bad timestamp", "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b\nauthor A <a@example.com> soon +0000\n\n", "invalid timestamp"},
+		{"bad timezone", "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b\ncommitter A <a@example.com> 1 UTC\n\n", "invalid timezone"},
+		{"no email", "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b\nauthor A 1 +0000\n\n", "missing email"},
+		{"unterminated", "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b", "not terminated"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCommit([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseCommit error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitSignWith(t *testing.T) {
+	when := time.Unix(1700000000, 0).UTC()
+	c := NewCommitAt("4b825dc642cb6eb9a060e54bf8d69288fbe4904b", "", "A <a@example.com>", "A <a@example.com>", "Signed\n", when)
+	unsigned := c.Serialize()
+
+	const sig = "-----BEGIN SSH SIGNATURE-----\nU1NIU0lH\n\nAAAA\n-----END SSH SIGNATURE-----\n"
+	var payload []byte
+	err := c.SignWith(func(p []byte) ([]byte, error) {
+		payload = p
+		return []byte(sig), nil
+	})
+	if err != nil {
+		t.Fatalf("SignWith: %v", err)
+	}
+	if !bytes.Equal(payload, unsigned) {
+		t.Errorf("signed payload = %q, want the unsigned commit %q", payload, unsigned)
+	}
+
+	want := "tree 4b825dc642cb6eb9a060e54bf8d69288fbe4904b\n" +
+		"author A <a@example.com> 1700000000 +0000\n" +
+		"committer A <a@example.com> 1700000000 +0000\n" +
+		"gpgsig -----BEGIN SSH SIGNATURE-----\n" +
+		" U1NIU0lH\n" +
+		" \n" +
+		" AAAA\n" +
+		" -----END SSH SIGNATURE-----\n" +
+		"\n" +
+		"Signed\n"
+	if got := string(c.Serialize()); got != want {
+		t.Errorf("Serialize() = %q, want %q", got, want)
+	}
+
+	parsed, err := ParseCommit(c.Serialize())
+	if err != nil {
+		t.Fatalf("ParseCommit: %v", err)
+	}
+	if parsed.Signature != sig {
+		t.Errorf("parsed signature = %q, want %q", parsed.Signature, sig)
+	}
+	if Hash(parsed) != Hash(c) {
+		t.Errorf("reserialized hash = %s, want %s", Hash(parsed), Hash(c))
+	}
+
+	// Signing again replaces the signature rather than signing it.
+	if err := c.SignWith(func(p []byte) ([]byte, error) {
+		if !bytes.Equal(p, unsigned) {
+			t.Errorf("re-signed payload = %q, want %q", p, unsigned)
+		}
+		return []byte(sig), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	cmd := exec.Command("git", "hash-object", "-t", "commit", "--stdin")
+	cmd.Stdin = strings.NewReader(want)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git hash-object: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != Hash(c) {
+		t.Errorf("git hash-object = %s, want %s", got, Hash(c))
+	}
+}
@@ -0,0 +1,91 @@
+package object
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Format is an object format: the hash function that names objects.
+type Format string
+
+const (
+	SHA1   Format = "sha1"
+	SHA256 Format = "sha256"
+)
+
+// ParseFormat parses an object format name, as in extensions.objectformat.
+// The empty string is SHA1.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case "":
+		return SHA1, nil
+	case SHA1, SHA256:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown object format %q", s)
+}
+
+// FormatOf returns the format of an object name, which its length tells.
+func FormatOf(hash string) (Format, bool) {
+	for _, f := range []Format{SHA1, SHA256} {
+		if f.ValidHash(hash) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// New returns a new hash.Hash computing the format's hash.
+func (f Format) New() hash.Hash {
+	if f == SHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// Size returns the length of a binary object name, as in tree entries.
+func (f Format) Size() int {
+	if f == SHA256 {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+// HexLen returns the length of a hex object name.
+func (f Format) HexLen() int {
+	return 2 * f.Size()
+}
+
+// ZeroID returns the all-zero object name, which git uses for "no object".
+func (f Format) ZeroID() string {
+	return strings.Repeat("0", f.HexLen())
+}
+
+// ValidHash reports whether s is a full lowercase hex object name in
+// this format.
+func (f Format) ValidHash(s string) bool {
+	if len(s) != f.HexLen() {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash computes the name of an object in this format.
+func (f Format) Hash(obj Object) string {
+	data := obj.Serialize()
+	header := fmt.Sprintf("%s %d\x00", obj.Type(), len(data))
+
+	h := f.New()
+	h.Write([]byte(header))
+	h.Write(data)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
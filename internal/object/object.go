@@ -1,13 +1,16 @@
 package object
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
-	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // Type represents a Git object type.
@@ -17,6 +20,7 @@ const (
 	TypeBlob   Type = "blob"
 	TypeTree   Type = "tree"
 	TypeCommit Type = "commit"
+	TypeTag    Type = "tag"
 )
 
 // Object represents a Git object.
@@ -25,22 +29,35 @@ type Object interface {
 	Serialize() []byte
 }
 
+// ValidHash reports whether s is a full lowercase hex object name in
+// any format.
+func ValidHash(s string) bool {
+	_, ok := FormatOf(s)
+	return ok
+}
+
 // Hash computes the SHA-1 hash of an object.
 func Hash(obj Object) string {
-	data := obj.Serialize()
-	header := fmt.Sprintf("%s %d\x00", obj.Type(), len(data))
-
-	h := sha1.New()
-	h.Write([]byte(header))
-	h.Write(data)
-
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return SHA1.Hash(obj)
 }
 
 // Write writes an object to the Git object store.
 func Write(gitDir string, obj Object) (string, error) {
+	hash, _, err := WriteN(gitDir, obj)
+	return hash, err
+}
+
+// WriteN writes an object like Write and also returns the number of bytes
+// it added to the store, which is zero if the object already existed.
+func WriteN(gitDir string, obj Object) (string, int64, error) {
+	return SHA1.WriteN(gitDir, obj)
+}
+
+// WriteN writes an object named in this format to the Git object store
+// like the package's WriteN.
+func (f Format) WriteN(gitDir string, obj Object) (string, int64, error) {
 	// Compute hash
-	hash := Hash(obj)
+	hash := f.Hash(obj)
 
 	// Prepare object data
 	data := obj.Serialize()
@@ -49,33 +66,69 @@ func Write(gitDir string, obj Object) (string, error) {
 	// Create object directory
 	objDir := filepath.Join(gitDir, "objects", hash[:2])
 	if err := os.MkdirAll(objDir, 0755); err != nil {
-		return "", fmt.Errorf("creating object dir: %w", err)
+		return "", 0, fmt.Errorf("creating object dir: %w", err)
 	}
 
-	// Write compressed object
+	// Objects are content-addressed, and only ever renamed into place
+	// whole, so an existing file already holds this content.
 	objPath := filepath.Join(objDir, hash[2:])
-	file, err := os.Create(objPath)
+	if _, err := os.Stat(objPath); err == nil {
+		return hash, 0, nil
+	}
+
+	// Write the object to a temp file and rename it into place, so that
+	// a write that fails partway, or a crash, never leaves a truncated
+	// object under its name, and a concurrent writer of the same object
+	// sees either all of it or none. Like git's, the file is read-only.
+	file, err := os.CreateTemp(objDir, "tmp_obj_*")
 	if err != nil {
-		return "", fmt.Errorf("creating object file: %w", err)
+		return "", 0, fmt.Errorf("creating object file: %w", err)
 	}
-	defer file.Close()
+	tmp := file.Name()
+	n, err := writeLoose(file, header, data)
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("closing object file: %w", cerr)
+	}
+	if err == nil {
+		if err = os.Chmod(tmp, 0444); err != nil {
+			err = fmt.Errorf("making object file read-only: %w", err)
+		}
+	}
+	if err == nil {
+		if err = os.Rename(tmp, objPath); err != nil {
+			err = fmt.Errorf("renaming object file: %w", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	return hash, n, nil
+}
 
-	// Compress with zlib
+// writeLoose compresses an object's header and data into file and
+// returns the number of bytes written.
+func writeLoose(file *os.File, header string, data []byte) (int64, error) {
+	// Compress with zlib. The writer is closed exactly once below: a
+	// second Close would append another checksum.
 	w := zlib.NewWriter(file)
-	defer w.Close()
 
 	if _, err := w.Write([]byte(header)); err != nil {
-		return "", fmt.Errorf("writing header: %w", err)
+		return 0, fmt.Errorf("writing header: %w", err)
 	}
 	if _, err := w.Write(data); err != nil {
-		return "", fmt.Errorf("writing data: %w", err)
+		return 0, fmt.Errorf("writing data: %w", err)
 	}
 
 	if err := w.Close(); err != nil {
-		return "", fmt.Errorf("closing zlib writer: %w", err)
+		return 0, fmt.Errorf("closing zlib writer: %w", err)
 	}
 
-	return hash, nil
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat object file: %w", err)
+	}
+	return fi.Size(), nil
 }
 
 // ReadFull reads an object from the Git object store with its header.
@@ -103,34 +156,180 @@ func ReadFull(gitDir string, hash string) ([]byte, error) {
 	return data, nil
 }
 
-// Read reads an object from the Git object store.
+// Verify reads an object back from the Git object store and checks that
+// its header is well formed and its content hashes to hash.
+func Verify(gitDir string, hash string) error {
+	data, err := ReadFull(gitDir, hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := parseHeader(hash, data); err != nil {
+		return err
+	}
+
+	f, ok := FormatOf(hash)
+	if !ok {
+		return fmt.Errorf("invalid object name %q", hash)
+	}
+	h := f.New()
+	h.Write(data)
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != hash {
+		return fmt.Errorf("object hash mismatch: got %s", got)
+	}
+	return nil
+}
+
+// Read reads an object from the Git object store. It fails with a
+// *HeaderError if the object does not start with a "<type> <size>\0"
+// header matching its content.
 func Read(gitDir string, hash string) ([]byte, error) {
+	data, err := ReadFull(gitDir, hash)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseHeader(hash, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[n:], nil
+}
+
+// ReadLenient reads an object like Read, but returns the whole
+// decompressed file as the content of an object without a valid header,
+// as written by some tools. Use it when serving imported repositories.
+func ReadLenient(gitDir string, hash string) ([]byte, error) {
+	data, err := ReadFull(gitDir, hash)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseHeader(hash, data)
+	if err != nil {
+		return data, nil
+	}
+	return data[n:], nil
+}
+
+// HeaderError reports an object whose header is missing or malformed,
+// with the first bytes of the object to help identify what wrote it.
+type HeaderError struct {
+	Hash   string
+	Reason string
+	Prefix []byte
+}
+
+// headerErrorPrefix is how many leading bytes a HeaderError reports.
+const headerErrorPrefix = 32
+
+// maxHeaderLen is longer than any valid header: "commit", a space, a
+// 64-bit size and the null byte.
+const maxHeaderLen = 64
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("object %s: %s; first bytes: %q", e.Hash, e.Reason, e.Prefix)
+}
+
+func newHeaderError(hash, reason string, data []byte) *HeaderError {
+	return &HeaderError{Hash: hash, Reason: reason, Prefix: data[:min(len(data), headerErrorPrefix)]}
+}
+
+// parseHeader checks that data starts with a well-formed header for its
+// content and returns the header's length.
+func parseHeader(hash string, data []byte) (int, error) {
+	nullIndex := bytes.IndexByte(data, 0)
+	if nullIndex == -1 {
+		return 0, newHeaderError(hash, "no header: missing null byte", data)
+	}
+	typ, sizeStr, ok := strings.Cut(string(data[:nullIndex]), " ")
+	if !ok || typ == "" {
+		return 0, newHeaderError(hash, "malformed header", data)
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		return 0, newHeaderError(hash, "malformed header size", data)
+	}
+	if got := len(data) - nullIndex - 1; got != size {
+		return 0, newHeaderError(hash, fmt.Sprintf("header says %d bytes, got %d", size, got), data)
+	}
+	return nullIndex + 1, nil
+}
+
+// ReadStream opens an object for streaming. It parses the object header and
+// returns the object's type, its content size, and a reader over the
+// decompressed content, so large blobs never have to be held in memory.
+// The caller must close the reader.
+func ReadStream(gitDir string, hash string) (Type, int64, io.ReadCloser, error) {
 	objPath := filepath.Join(gitDir, "objects", hash[:2], hash[2:])
 
 	file, err := os.Open(objPath)
 	if err != nil {
-		return nil, fmt.Errorf("opening object file: %w", err)
+		return "", 0, nil, fmt.Errorf("opening object file: %w", err)
 	}
-	defer file.Close()
 
-	// Decompress
-	r, err := zlib.NewReader(file)
+	zr, err := zlib.NewReader(file)
 	if err != nil {
-		return nil, fmt.Errorf("creating zlib reader: %w", err)
+		file.Close()
+		return "", 0, nil, fmt.Errorf("creating zlib reader: %w", err)
 	}
-	defer r.Close()
+	br := bufio.NewReader(zr)
+	rc := &streamReader{Reader: br, zr: zr, file: file}
 
-	data, err := io.ReadAll(r)
+	// Peek rather than scan for the null byte, so a header-less object
+	// is reported without reading all of it.
+	peek, err := br.Peek(maxHeaderLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		rc.Close()
+		return "", 0, nil, fmt.Errorf("reading object header: %w", err)
+	}
+	nullIndex := bytes.IndexByte(peek, 0)
+	if nullIndex == -1 {
+		rc.Close()
+		return "", 0, nil, newHeaderError(hash, "no header: missing null byte", peek)
+	}
+	typ, sizeStr, ok := strings.Cut(string(peek[:nullIndex]), " ")
+	if !ok || typ == "" {
+		rc.Close()
+		return "", 0, nil, newHeaderError(hash, "malformed header", peek)
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("reading object: %w", err)
+		rc.Close()
+		return "", 0, nil, newHeaderError(hash, "malformed header size", peek)
+	}
+	if _, err := br.Discard(nullIndex + 1); err != nil {
+		rc.Close()
+		return "", 0, nil, fmt.Errorf("reading object header: %w", err)
 	}
 
-	// Parse header
-	nullIndex := bytes.IndexByte(data, 0)
-	if nullIndex == -1 {
-		return nil, fmt.Errorf("invalid object format: no null byte")
+	return Type(typ), size, rc, nil
+}
+
+// ReadStreamLenient opens an object like ReadStream, but streams an object
+// without a valid header as a blob whose content is the whole decompressed
+// file, as ReadLenient reads it. Nothing in such an object says what type
+// it is, and a blob is the one type whose content has no format to check.
+func ReadStreamLenient(gitDir string, hash string) (Type, int64, io.ReadCloser, error) {
+	typ, size, rc, err := ReadStream(gitDir, hash)
+	var herr *HeaderError
+	if !errors.As(err, &herr) {
+		return typ, size, rc, err
 	}
+	data, err := ReadFull(gitDir, hash)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return TypeBlob, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// streamReader reads decompressed object content and closes both the
+// decompressor and the underlying file.
+type streamReader struct {
+	io.Reader
+	zr   io.ReadCloser
+	file *os.File
+}
 
-	// Return content after header
-	return data[nullIndex+1:], nil
+func (s *streamReader) Close() error {
+	s.zr.Close()
+	return s.file.Close()
 }
@@ -0,0 +1,156 @@
+package object
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadStreamLargeBlob(t *testing.T) {
+	gitDir := t.TempDir()
+
+	content := make([]byte, 8<<20)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := Write(gitDir, NewBlob(content))
+	if err != nil {
+		t.Fatalf("writing blob: %v", err)
+	}
+
+	typ, size, rc, err := ReadStream(gitDir, hash)
+	if err != nil {
+		t.Fatalf("ReadStream: %v", err)
+	}
+	defer rc.Close()
+
+	if typ != TypeBlob {
+		t.Errorf("type = %q, want %q", typ, TypeBlob)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("size = %d, want %d", size, len(content))
+	}
+
+	// Hash the stream as it is read rather than materializing it.
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", size)
+	n, err := io.Copy(h, rc)
+	if err != nil {
+		t.Fatalf("streaming blob: %v", err)
+	}
+	if n != size {
+		t.Errorf("streamed %d bytes, want %d", n, size)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != hash {
+		t.Errorf("streamed hash = %s, want %s", got, hash)
+	}
+}
+
+func TestWriteConcurrent(t *testing.T) {
+	gitDir := t.TempDir()
+	blob := NewBlob([]byte("written by many\n"))
+
+	// Writers of the same object never see each other's partial file.
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hash, err := Write(gitDir, blob)
+			if err == nil {
+				err = Verify(gitDir, hash)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// Only the object is left, read-only as git writes it.
+	hash := Hash(blob)
+	entries, err := os.ReadDir(filepath.Join(gitDir, "objects", hash[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != hash[2:] {
+		t.Fatalf("object dir holds %v, want only the object", entries)
+	}
+	fi, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0444 {
+		t.Errorf("object mode = %v, want 0444", mode)
+	}
+}
+
+func TestReadHeaderlessObject(t *testing.T) {
+	gitDir := t.TempDir()
+	hash := "0123456789abcdef0123456789abcdef01234567"
+	content := []byte("just some bytes, no header here at all")
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	dir := filepath.Join(gitDir, "objects", hash[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, hash[2:]), buf.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Read(gitDir, hash)
+	var herr *HeaderError
+	if !errors.As(err, &herr) {
+		t.Fatalf("Read error = %v, want a HeaderError", err)
+	}
+	for _, want := range []string{hash, "missing null byte", `first bytes: "just some bytes, no header here "`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+
+	if _, _, _, err := ReadStream(gitDir, hash); !errors.As(err, &herr) {
+		t.Errorf("ReadStream error = %v, want a HeaderError", err)
+	}
+
+	got, err := ReadLenient(gitDir, hash)
+	if err != nil {
+		t.Fatalf("ReadLenient: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("ReadLenient = %q, want %q", got, content)
+	}
+
+	// The streaming reader is lenient the same way, reading the object
+	// as a blob.
+	typ, size, rc, err := ReadStreamLenient(gitDir, hash)
+	if err != nil {
+		t.Fatalf("ReadStreamLenient: %v", err)
+	}
+	defer rc.Close()
+	got, err = io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != TypeBlob || size != int64(len(content)) || !bytes.Equal(got, content) {
+		t.Errorf("ReadStreamLenient = %s, %d, %q; want blob, %d, %q", typ, size, got, len(content), content)
+	}
+}
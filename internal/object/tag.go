@@ -0,0 +1,122 @@
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tag represents a Git annotated tag object.
+type Tag struct {
+	Object     string    // SHA-1 hash of the tagged object
+	ObjectType Type      // Type of the tagged object
+	Name       string    // Tag name, without refs/tags/
+	Tagger     string    // Tagger name and email
+	TaggerDate time.Time // Tag timestamp
+	Message    string    // Tag message
+	Signature  string    // Armored signature, empty if unsigned
+}
+
+// NewTag creates a new annotated tag of the object target, tagged at now.
+func NewTag(target string, targetType Type, name, tagger, message string, now time.Time) *Tag {
+	return &Tag{
+		Object:     target,
+		ObjectType: targetType,
+		Name:       name,
+		Tagger:     tagger,
+		TaggerDate: now,
+		Message:    message,
+	}
+}
+
+// Type returns the object type.
+func (t *Tag) Type() Type {
+	return TypeTag
+}
+
+// Serialize returns the tag content in Git format.
+func (t *Tag) Serialize() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "object %s\n", t.Object)
+	fmt.Fprintf(&buf, "type %s\n", t.ObjectType)
+	fmt.Fprintf(&buf, "tag %s\n", t.Name)
+	fmt.Fprintf(&buf, "tagger %s %d %s\n",
+		t.Tagger,
+		t.TaggerDate.Unix(),
+		t.TaggerDate.Format("-0700"))
+
+	// Empty line before message
+	buf.WriteByte('\n')
+
+	buf.WriteString(t.Message)
+	if len(t.Message) > 0 && t.Message[len(t.Message)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	// Unlike a commit's, a tag's signature follows its message.
+	buf.WriteString(t.Signature)
+
+	return buf.Bytes()
+}
+
+// SignWith signs the tag with sign, which is given the tag without any
+// signature and returns an armored signature.
+func (t *Tag) SignWith(sign func(payload []byte) ([]byte, error)) error {
+	t.Signature = ""
+	sig, err := sign(t.Serialize())
+	if err != nil {
+		return fmt.Errorf("signing tag: %w", err)
+	}
+	t.Signature = string(sig)
+	return nil
+}
+
+// ParseTag parses tag object content (without the object header). A
+// signature is left at the end of the message. A missing or malformed
+// object, or a malformed tagger, is an error.
+func ParseTag(data []byte) (*Tag, error) {
+	t := &Tag{}
+	rest := data
+	for {
+		nl := bytes.IndexByte(rest, '\n')
+		if nl == -1 {
+			// A tag may have no message, nor the blank line before it.
+			if len(rest) != 0 {
+				return nil, fmt.Errorf("tag header not terminated")
+			}
+			break
+		}
+		line := string(rest[:nl])
+		rest = rest[nl+1:]
+		if line == "" {
+			break
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "object":
+			if !ValidHash(value) {
+				return nil, fmt.Errorf("invalid object %q", value)
+			}
+			t.Object = value
+		case "type":
+			t.ObjectType = Type(value)
+		case "tag":
+			t.Name = value
+		case "tagger":
+			ident, when, err := parseIdent(value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing tagger: %w", err)
+			}
+			t.Tagger, t.TaggerDate = ident, when
+		}
+	}
+
+	if t.Object == "" {
+		return nil, fmt.Errorf("tag has no object")
+	}
+	t.Message = string(rest)
+	return t, nil
+}
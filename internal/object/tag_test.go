@@ -0,0 +1,108 @@
+package object
+
+import (
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTag(t *testing.T) {
+	gitDir := t.TempDir()
+
+	blob := "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	when := time.Unix(1700000000, 0).In(time.FixedZone("", -7*3600))
+	tag := NewTag(blob, TypeBlob, "v1.0.0", "Tagger <tagger@example.com>", "Release v1.0.0", when)
+
+	want := "object " + blob + "\n" +
+		"type blob\n" +
+		"tag v1.0.0\n" +
+		"tagger Tagger <tagger@example.com> 1700000000 -0700\n" +
+		"\n" +
+		"Release v1.0.0\n"
+	if got := string(tag.Serialize()); got != want {
+		t.Errorf("Serialize() = %q, want %q", got, want)
+	}
+
+	hash, err := Write(gitDir, tag)
+	if err != nil {
+		t.Fatalf("writing tag: %v", err)
+	}
+	if hash != Hash(tag) {
+		t.Errorf("Write() = %s, Hash() = %s", hash, Hash(tag))
+	}
+
+	typ, _, rc, err := ReadStream(gitDir, hash)
+	if err != nil {
+		t.Fatalf("ReadStream: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != TypeTag {
+		t.Errorf("type = %q, want %q", typ, TypeTag)
+	}
+	if string(data) != want {
+		t.Errorf("stored content = %q, want %q", data, want)
+	}
+
+	// Git must agree on the object name.
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	cmd := exec.Command("git", "hash-object", "-t", "tag", "--stdin")
+	cmd.Stdin = strings.NewReader(want)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git hash-object: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != hash {
+		t.Errorf("git hash-object = %s, want %s", got, hash)
+	}
+}
+
+func TestTagSignWith(t *testing.T) {
+	tag := NewTag("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", TypeBlob, "v1", "T <t@example.com>", "v1\n", time.Unix(0, 0).UTC())
+	unsigned := string(tag.Serialize())
+
+	const sig = "-----BEGIN PGP SIGNATURE-----\nabc\n-----END PGP SIGNATURE-----\n"
+	if err := tag.SignWith(func(p []byte) ([]byte, error) {
+		if string(p) != unsigned {
+			t.Errorf("signed payload = %q, want %q", p, unsigned)
+		}
+		return []byte(sig), nil
+	}); err != nil {
+		t.Fatalf("SignWith: %v", err)
+	}
+	if got := string(tag.Serialize()); got != unsigned+sig {
+		t.Errorf("Serialize() = %q, want the signature after the message", got)
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	commit := "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	when := time.Unix(1700000000, 0).In(time.FixedZone("", -7*3600))
+	want := NewTag(commit, TypeCommit, "v1.0.0", "Tagger <tagger@example.com>", "Release v1.0.0\n", when)
+
+	got, err := ParseTag(want.Serialize())
+	if err != nil {
+		t.Fatalf("ParseTag: %v", err)
+	}
+	if got.Object != want.Object || got.ObjectType != want.ObjectType || got.Name != want.Name ||
+		got.Tagger != want.Tagger || !got.TaggerDate.Equal(want.TaggerDate) || got.Message != want.Message {
+		t.Errorf("ParseTag = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		"type commit\ntag v1\n\nno object\n",
+		"object nothex\ntype commit\n\n",
+		"object " + commit + "\ntagger broken\n\n",
+	} {
+		if _, err := ParseTag([]byte(bad)); err == nil {
+			t.Errorf("ParseTag(%q) succeeded", bad)
+		}
+	}
+}
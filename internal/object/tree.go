@@ -7,6 +7,13 @@ import (
 	"sort"
 )
 
+// Tree entry modes for the entries the generator writes.
+const (
+	ModeFile    = "100644"
+	ModeSymlink = "120000"
+	ModeDir     = "40000"
+)
+
 // TreeEntry represents an entry in a Git tree object.
 type TreeEntry struct {
 	Mode string // File mode (e.g., "100644" for regular file)
@@ -14,6 +21,14 @@ type TreeEntry struct {
 	Hash string // SHA-1 hash of the object
 }
 
+// sortKey returns the name used to order the entry within a tree.
+func (e TreeEntry) sortKey() string {
+	if e.Mode == ModeDir || e.Mode == "040000" {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
 // Tree represents a Git tree object (directory listing).
 type Tree struct {
 	Entries []TreeEntry
@@ -42,15 +57,16 @@ func (t *Tree) Type() Type {
 
 // Serialize returns the tree content in Git format.
 func (t *Tree) Serialize() []byte {
-	// Sort entries by name for consistency
+	// Sort entries the way git does: subtrees compare as if their
+	// name had a trailing slash.
 	sort.Slice(t.Entries, func(i, j int) bool {
-		return t.Entries[i].Name < t.Entries[j].Name
+		return t.Entries[i].sortKey() < t.Entries[j].sortKey()
 	})
 
 	var buf bytes.Buffer
 
 	for _, entry := range t.Entries {
-		// Format: <mode> <name>\0<20-byte SHA-1>
+		// Format: <mode> <name>\0<binary object name>
 		fmt.Fprintf(&buf, "%s %s\x00", entry.Mode, entry.Name)
 
 		// Convert hex hash to binary
@@ -64,3 +80,83 @@ func (t *Tree) Serialize() []byte {
 
 	return buf.Bytes()
 }
+
+// ParseTree parses SHA-1 tree object content (without the object header).
+func ParseTree(data []byte) (*Tree, error) {
+	return SHA1.ParseTree(data)
+}
+
+// ParseTree parses tree object content (without the object header) whose
+// entries are named in this format.
+func (f Format) ParseTree(data []byte) (*Tree, error) {
+	tree := NewTree()
+	err := f.WalkTree(data, func(e TreeEntry) error {
+		tree.AddEntry(e.Mode, e.Name, e.Hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// WalkTree calls fn for each entry of serialized SHA-1 tree data in
+// order, without holding the entries in memory, and stops at the first
+// error fn returns. Truncated entries, modes that are not octal and empty
+// names are errors.
+func WalkTree(data []byte, fn func(TreeEntry) error) error {
+	return SHA1.WalkTree(data, fn)
+}
+
+// WalkTree is the package's WalkTree for trees whose entries are named in
+// this format.
+func (f Format) WalkTree(data []byte, fn func(TreeEntry) error) error {
+	size := f.Size()
+	for len(data) > 0 {
+		// Format: <mode> <name>\0<binary object name>
+		sp := bytes.IndexByte(data, ' ')
+		if sp == -1 {
+			return fmt.Errorf("truncated tree entry: missing mode")
+		}
+		mode := string(data[:sp])
+		if !validMode(mode) {
+			return fmt.Errorf("invalid tree entry mode %q", mode)
+		}
+		data = data[sp+1:]
+
+		nul := bytes.IndexByte(data, 0)
+		if nul == -1 {
+			return fmt.Errorf("truncated tree entry: missing name")
+		}
+		name := string(data[:nul])
+		if name == "" {
+			return fmt.Errorf("tree entry with mode %s has no name", mode)
+		}
+		data = data[nul+1:]
+
+		if len(data) < size {
+			return fmt.Errorf("truncated tree entry %q: short hash", name)
+		}
+		var hash [64]byte
+		n := hex.Encode(hash[:], data[:size])
+		if err := fn(TreeEntry{Mode: mode, Name: name, Hash: string(hash[:n])}); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// validMode reports whether mode looks like a tree entry mode: five or
+// six octal digits, as git writes directories as "40000".
+func validMode(mode string) bool {
+	if len(mode) != 5 && len(mode) != 6 {
+		return false
+	}
+	for _, c := range mode {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return true
+}
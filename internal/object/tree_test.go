@@ -0,0 +1,138 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEmptyTreeHash(t *testing.T) {
+	// Git's well-known empty tree: `git hash-object -t tree /dev/null`.
+	const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	if got := Hash(NewTree()); got != emptyTree {
+		t.Errorf("Hash(empty tree) = %s, want %s", got, emptyTree)
+	}
+	const emptyTree256 = "6ef19b41225c5369f1c104d45d8d85efa9b057b53b14b4b9b939dd74decc5321"
+	if got := SHA256.Hash(NewTree()); got != emptyTree256 {
+		t.Errorf("SHA256.Hash(empty tree) = %s, want %s", got, emptyTree256)
+	}
+
+	gitDir := t.TempDir()
+	hash, err := Write(gitDir, NewTree())
+	if err != nil {
+		t.Fatalf("writing empty tree: %v", err)
+	}
+	data, err := Read(gitDir, hash)
+	if err != nil {
+		t.Fatalf("reading empty tree: %v", err)
+	}
+	tree, err := ParseTree(data)
+	if err != nil {
+		t.Fatalf("parsing empty tree: %v", err)
+	}
+	if len(tree.Entries) != 0 {
+		t.Errorf("empty tree parsed to %d entries", len(tree.Entries))
+	}
+}
+
+func TestWalkTreeLarge(t *testing.T) {
+	const n = 50000
+	tree := NewTree()
+	for i := range n {
+		tree.AddEntry(ModeFile, fmt.Sprintf("file-%05d", i), fmt.Sprintf("%040x", i))
+	}
+	data := tree.Serialize()
+
+	seen := 0
+	err := WalkTree(data, func(e TreeEntry) error {
+		if want := fmt.Sprintf("file-%05d", seen); e.Name != want || e.Hash != fmt.Sprintf("%040x", seen) {
+			t.Fatalf("entry %d = %+v, want %s", seen, e, want)
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != n {
+		t.Errorf("visited %d entries, want %d", seen, n)
+	}
+
+	// Each entry costs its three strings and nothing else: no slice of
+	// entries is built up.
+	allocs := testing.AllocsPerRun(5, func() {
+		WalkTree(data, func(TreeEntry) error { return nil })
+	})
+	if allocs > 3*n {
+		t.Errorf("WalkTree made %.0f allocations for %d entries, want at most %d", allocs, n, 3*n)
+	}
+}
+
+func TestParseTreeNested(t *testing.T) {
+	gitDir := t.TempDir()
+
+	blob, err := Write(gitDir, NewBlob([]byte("hello\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := NewTree()
+	sub.AddEntry(ModeFile, "inner.txt", blob)
+	subHash, err := Write(gitDir, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := NewTree()
+	root.AddEntry(ModeFile, "dir.txt", blob)
+	root.AddEntry("40000", "dir", subHash)
+	root.AddEntry(ModeSymlink, "link", blob)
+
+	got, err := ParseTree(root.Serialize())
+	if err != nil {
+		t.Fatalf("ParseTree: %v", err)
+	}
+	// "dir" sorts as "dir/", after "dir.txt".
+	want := []TreeEntry{
+		{ModeFile, "dir.txt", blob},
+		{"40000", "dir", subHash},
+		{ModeSymlink, "link", blob},
+	}
+	if fmt.Sprint(got.Entries) != fmt.Sprint(want) {
+		t.Errorf("entries = %v, want %v", got.Entries, want)
+	}
+
+	data, err := Read(gitDir, got.Entries[1].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := ParseTree(data)
+	if err != nil {
+		t.Fatalf("parsing subtree: %v", err)
+	}
+	if len(inner.Entries) != 1 || inner.Entries[0].Name != "inner.txt" || inner.Entries[0].Hash != blob {
+		t.Errorf("subtree entries = %v", inner.Entries)
+	}
+}
+
+func TestParseTreeErrors(t *testing.T) {
+	tree := NewTree()
+	tree.AddEntry(ModeFile, "a.txt", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	valid := string(tree.Serialize())
+
+	for _, tt := range []struct {
+		name, data, want string
+	}{
+		{"missing mode", "100644", "missing mode"},
+		{"missing name", "100644 a.txt", "missing name"},
+		{"short hash", valid[:len(valid)-1], "short hash"},
+		{"second entry truncated", valid + "100644 b", "missing name"},
+		{"bad mode", "10x644 a.txt\x00" + valid[len(valid)-20:], "invalid tree entry mode"},
+		{"empty name", "100644 \x00" + valid[len(valid)-20:], "no name"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTree([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseTree error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
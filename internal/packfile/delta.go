@@ -0,0 +1,180 @@
+package packfile
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// deltaBlock is the length of the base chunks Delta indexes to find
+	// copies. Shorter matches are inserted.
+	deltaBlock = 16
+	// maxCopy is the most one copy instruction can copy.
+	maxCopy = 0x10000
+	// maxInsert is the most one insert instruction can insert.
+	maxInsert = 0x7f
+)
+
+// Delta returns a git delta that rebuilds target from base: the sizes of
+// both, then instructions that either copy a range of base or insert
+// literal bytes.
+func Delta(base, target []byte) []byte {
+	var buf bytes.Buffer
+	writeDeltaSize(&buf, len(base))
+	writeDeltaSize(&buf, len(target))
+
+	// Index each block of base by its content. Later blocks win, which
+	// does not matter for correctness.
+	index := make(map[string]int)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		index[string(base[off:off+deltaBlock])] = off
+	}
+
+	insertFrom := 0
+	for i := 0; i+deltaBlock <= len(target); {
+		off, ok := index[string(target[i:i+deltaBlock])]
+		if !ok {
+			i++
+			continue
+		}
+		// Extend the match backwards into pending literals and forwards
+		// past the block.
+		start, baseStart := i, off
+		for start > insertFrom && baseStart > 0 && target[start-1] == base[baseStart-1] {
+			start--
+			baseStart--
+		}
+		end := i + deltaBlock
+		for end < len(target) && off+end-i < len(base) && target[end] == base[off+end-i] {
+			end++
+		}
+
+		writeInserts(&buf, target[insertFrom:start])
+		for n := end - start; n > 0; {
+			chunk := min(n, maxCopy)
+			writeCopy(&buf, baseStart, chunk)
+			baseStart += chunk
+			n -= chunk
+		}
+		i, insertFrom = end, end
+	}
+	writeInserts(&buf, target[insertFrom:])
+	return buf.Bytes()
+}
+
+// writeDeltaSize writes a delta header size: seven bits at a time, least
+// significant first, with the high bit set on all but the last byte.
+func writeDeltaSize(buf *bytes.Buffer, n int) {
+	for n >= 0x80 {
+		buf.WriteByte(byte(n) | 0x80)
+		n >>= 7
+	}
+	buf.WriteByte(byte(n))
+}
+
+// writeInserts writes instructions inserting data literally.
+func writeInserts(buf *bytes.Buffer, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), maxInsert)
+		buf.WriteByte(byte(n))
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+// writeCopy writes an instruction copying size bytes of the base from
+// offset. Only the non-zero bytes of each are written, flagged in the
+// opcode; a size of 0x10000 is written as no size bytes at all.
+func writeCopy(buf *bytes.Buffer, offset, size int) {
+	op := byte(0x80)
+	var args []byte
+	for i := range 4 {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			op |= 1 << i
+			args = append(args, b)
+		}
+	}
+	if size != maxCopy {
+		for i := range 3 {
+			if b := byte(size >> (8 * i)); b != 0 {
+				op |= 1 << (4 + i)
+				args = append(args, b)
+			}
+		}
+	}
+	buf.WriteByte(op)
+	buf.Write(args)
+}
+
+// ApplyDelta rebuilds the target of delta from base.
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != len(base) {
+		return nil, fmt.Errorf("delta base is %d bytes, want %d", len(base), baseSize)
+	}
+	targetSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	target := make([]byte, 0, targetSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			var offset, size int
+			for i := range 7 {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, fmt.Errorf("truncated copy instruction")
+				}
+				if i < 4 {
+					offset |= int(delta[0]) << (8 * i)
+				} else {
+					size |= int(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = maxCopy
+			}
+			if offset+size > len(base) {
+				return nil, fmt.Errorf("copy of %d bytes at %d is past the %d byte base", size, offset, len(base))
+			}
+			target = append(target, base[offset:offset+size]...)
+		case op != 0:
+			n := int(op)
+			if n > len(delta) {
+				return nil, fmt.Errorf("truncated insert instruction")
+			}
+			target = append(target, delta[:n]...)
+			delta = delta[n:]
+		default:
+			return nil, fmt.Errorf("reserved delta instruction 0")
+		}
+	}
+	if len(target) != targetSize {
+		return nil, fmt.Errorf("delta produced %d bytes, want %d", len(target), targetSize)
+	}
+	return target, nil
+}
+
+// readDeltaSize reads a size written by writeDeltaSize and returns the
+// rest of the delta.
+func readDeltaSize(delta []byte) (int, []byte, error) {
+	n, shift := 0, 0
+	for i, b := range delta {
+		n |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return n, delta[i+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("truncated delta header")
+}
@@ -0,0 +1,227 @@
+package packfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	gitpackfile "github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.UintN(256))
+		}
+		return b
+	}
+	text := []byte(strings.Repeat("All work and no play makes Jack a dull boy.\n", 50))
+	big := random(3 * maxCopy)
+
+	for _, tt := range []struct {
+		name         string
+		base, target []byte
+	}{
+		{"empty", nil, nil},
+		{"from nothing", nil, text},
+		{"to nothing", text, nil},
+		{"identical", text, text},
+		{"append", text, append(bytes.Clone(text), "The end.\n"...)},
+		{"prepend", text, append([]byte("Once upon a time.\n"), text...)},
+		{"edit", text, bytes.Replace(text, []byte("Jack"), []byte("Jill"), 7)},
+		{"unrelated", random(1000), random(1000)},
+		{"long copy", big, append(bytes.Clone(big), 'x')},
+		{"long insert", text, random(1000)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := Delta(tt.base, tt.target)
+
+			got, err := ApplyDelta(tt.base, delta)
+			if err != nil {
+				t.Fatalf("ApplyDelta: %v", err)
+			}
+			if !bytes.Equal(got, tt.target) {
+				t.Errorf("ApplyDelta rebuilt %d bytes that differ from the %d byte target", len(got), len(tt.target))
+			}
+
+			// Check against an independent decoder too, which refuses
+			// empty objects; git never deltas them.
+			if len(tt.base) == 0 || len(tt.target) == 0 {
+				return
+			}
+			got, err = gitpackfile.PatchDelta(tt.base, delta)
+			if err != nil {
+				t.Fatalf("go-git PatchDelta: %v", err)
+			}
+			if !bytes.Equal(got, tt.target) {
+				t.Errorf("go-git rebuilt %d bytes that differ from the %d byte target", len(got), len(tt.target))
+			}
+		})
+	}
+
+	// Similar content compresses to a small delta.
+	if delta := Delta(big, append(bytes.Clone(big), 'x')); len(delta) > 64 {
+		t.Errorf("delta for a one byte append is %d bytes", len(delta))
+	}
+}
+
+func TestApplyDeltaErrors(t *testing.T) {
+	base := []byte(strings.Repeat("base content ", 5))
+	delta := Delta(base, append(bytes.Clone(base), "more"...))
+
+	for _, tt := range []struct {
+		name        string
+		base, delta []byte
+		want        string
+	}{
+		{"wrong base", base[1:], delta, "delta base is"},
+		{"truncated header", base, []byte{0x80}, "truncated delta header"},
+		{"truncated", base, delta[:len(delta)-2], "truncated insert"},
+		{"copy past base", base, []byte{byte(len(base)), 10, 0x91, 0xff, 10}, "past the"},
+		{"reserved", base, []byte{byte(len(base)), 0, 0}, "reserved"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ApplyDelta(tt.base, tt.delta); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ApplyDelta error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddRefDelta(t *testing.T) {
+	base := []byte(strings.Repeat("line of the base blob\n", 100))
+	target := append(bytes.Clone(base), "one more line\n"...)
+	baseHash := object.Hash(object.NewBlob(base))
+
+	w := NewWriter()
+	if err := w.AddObject(OBJ_BLOB, base); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRefDelta(baseHash, base, target); err != nil {
+		t.Fatalf("AddRefDelta: %v", err)
+	}
+	pack := w.Finalize()
+
+	st := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(pack)); err != nil {
+		t.Fatalf("reading pack: %v", err)
+	}
+	obj, err := st.EncodedObject(plumbing.BlobObject, plumbing.NewHash(object.Hash(object.NewBlob(target))))
+	if err != nil {
+		t.Fatalf("delta target not in pack: %v", err)
+	}
+	rc, err := obj.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Errorf("delta target content differs")
+	}
+
+	if err := w.AddRefDelta("not a hash", base, target); err == nil {
+		t.Error("AddRefDelta with an invalid base name succeeded")
+	}
+}
+
+func TestEncodeOfsDistance(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		want []byte
+	}{
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x00}},
+		{129, []byte{0x80, 0x01}},
+		{16511, []byte{0xff, 0x7f}},
+		{16512, []byte{0x80, 0x80, 0x00}},
+	} {
+		if got := encodeOfsDistance(tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeOfsDistance(%d) = %x, want %x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestAddOfsDelta(t *testing.T) {
+	base := []byte(strings.Repeat("line of the base blob\n", 100))
+	middle := append(bytes.Clone(base), "one more line\n"...)
+	target := append([]byte("a new first line\n"), middle...)
+
+	w := NewWriter()
+	if err := w.AddObject(OBJ_BLOB, base); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddOfsDelta(w.Offset(0), base, middle); err != nil {
+		t.Fatalf("AddOfsDelta: %v", err)
+	}
+	// A delta whose base is itself a delta.
+	if err := w.AddOfsDelta(w.Offset(1), middle, target); err != nil {
+		t.Fatalf("AddOfsDelta: %v", err)
+	}
+	if err := w.AddOfsDelta(w.Offset(1)+1, middle, target); err == nil {
+		t.Error("AddOfsDelta against an offset with no object succeeded")
+	}
+	pack := w.Finalize()
+
+	st := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(pack)); err != nil {
+		t.Fatalf("reading pack: %v", err)
+	}
+	for _, want := range [][]byte{base, middle, target} {
+		obj, err := st.EncodedObject(plumbing.BlobObject, plumbing.NewHash(object.Hash(object.NewBlob(want))))
+		if err != nil {
+			t.Fatalf("blob not in pack: %v", err)
+		}
+		rc, err := obj.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("blob content differs")
+		}
+	}
+
+	// Index the pack the way a clone would.
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	cmd := exec.Command("git", "index-pack", "--stdin", "--strict")
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(pack)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git index-pack: %v\n%s", err, out)
+	}
+	packs, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("found packs %v: %v", packs, err)
+	}
+	out, err := exec.Command("git", "verify-pack", "-v", packs[0]).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git verify-pack: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "chain length = 2: 1 object") {
+		t.Errorf("verify-pack did not find the delta chain:\n%s", out)
+	}
+}
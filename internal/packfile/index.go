@@ -0,0 +1,157 @@
+package packfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// indexMagic starts a version 2 pack index.
+var indexMagic = []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}
+
+// IndexEntry describes an object in a pack index.
+type IndexEntry struct {
+	Hash   string // hex object name
+	Offset int64  // where the object's entry starts in the pack
+	CRC32  uint32 // of the entry as stored in the pack
+}
+
+// BuildIndex returns the version 2 .idx file for a pack holding entries,
+// whose trailing checksum is packChecksum. Object names and the index's
+// own checksum use newHash, which must match the repository's object
+// format.
+func BuildIndex(entries []IndexEntry, packChecksum []byte, newHash func() hash.Hash) []byte {
+	sorted := slices.Clone(entries)
+	slices.SortFunc(sorted, func(a, b IndexEntry) int { return strings.Compare(a.Hash, b.Hash) })
+
+	var buf bytes.Buffer
+	buf.Write(indexMagic)
+
+	// Fanout: the number of objects whose name's first byte is at most i.
+	var fanout [256]uint32
+	names := make([][]byte, len(sorted))
+	for i, e := range sorted {
+		names[i], _ = hex.DecodeString(e.Hash)
+		if len(names[i]) > 0 {
+			fanout[names[i][0]]++
+		}
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&buf, binary.BigEndian, fanout)
+
+	for _, name := range names {
+		buf.Write(name)
+	}
+	for _, e := range sorted {
+		binary.Write(&buf, binary.BigEndian, e.CRC32)
+	}
+
+	// Offsets that do not fit in 31 bits go in a table of 64-bit offsets,
+	// pointed to by the small offset with its high bit set.
+	var large []uint64
+	for _, e := range sorted {
+		if e.Offset < 1<<31 {
+			binary.Write(&buf, binary.BigEndian, uint32(e.Offset))
+			continue
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(large))|1<<31)
+		large = append(large, uint64(e.Offset))
+	}
+	binary.Write(&buf, binary.BigEndian, large)
+
+	buf.Write(packChecksum)
+	h := newHash()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes()
+}
+
+// Index is a parsed version 2 pack index.
+type Index struct {
+	names        []byte // sorted object names, back to back
+	offsets      []int64
+	size         int // length of an object name
+	packChecksum []byte
+}
+
+// ReadIndex parses a version 2 .idx file whose names and checksum use
+// newHash, verifying its checksum.
+func ReadIndex(data []byte, newHash func() hash.Hash) (*Index, error) {
+	h := newHash()
+	size := h.Size()
+	header := len(indexMagic) + 256*4
+	if len(data) < header+2*size {
+		return nil, fmt.Errorf("pack index too small")
+	}
+	if !bytes.Equal(data[:len(indexMagic)], indexMagic) {
+		return nil, fmt.Errorf("not a version 2 pack index")
+	}
+	h.Write(data[:len(data)-size])
+	if !bytes.Equal(h.Sum(nil), data[len(data)-size:]) {
+		return nil, fmt.Errorf("pack index checksum mismatch")
+	}
+
+	n := int(binary.BigEndian.Uint32(data[header-4 : header]))
+	tables := data[header : len(data)-2*size]
+	if len(tables) < n*(size+8) {
+		return nil, fmt.Errorf("pack index truncated: %d objects need %d bytes of tables, have %d", n, n*(size+8), len(tables))
+	}
+	x := &Index{
+		names:        tables[:n*size],
+		offsets:      make([]int64, n),
+		size:         size,
+		packChecksum: data[len(data)-2*size : len(data)-size],
+	}
+	small := tables[n*(size+4) : n*(size+8)]
+	large := tables[n*(size+8):]
+	for i := range n {
+		off := binary.BigEndian.Uint32(small[i*4:])
+		if off&(1<<31) == 0 {
+			x.offsets[i] = int64(off)
+			continue
+		}
+		j := int(off &^ (1 << 31))
+		if (j+1)*8 > len(large) {
+			return nil, fmt.Errorf("pack index large offset %d out of range", j)
+		}
+		x.offsets[i] = int64(binary.BigEndian.Uint64(large[j*8:]))
+	}
+	return x, nil
+}
+
+// Len returns the number of objects in the index.
+func (x *Index) Len() int {
+	return len(x.offsets)
+}
+
+// PackChecksum returns the checksum of the pack the index describes.
+func (x *Index) PackChecksum() []byte {
+	return x.packChecksum
+}
+
+// Offset returns the offset in the pack of the object named hash.
+func (x *Index) Offset(hash string) (int64, bool) {
+	name, err := hex.DecodeString(hash)
+	if err != nil || len(name) != x.size {
+		return 0, false
+	}
+	i := sort.Search(x.Len(), func(i int) bool {
+		return bytes.Compare(x.name(i), name) >= 0
+	})
+	if i == x.Len() || !bytes.Equal(x.name(i), name) {
+		return 0, false
+	}
+	return x.offsets[i], true
+}
+
+// name returns the i'th object name in sorted order.
+func (x *Index) name(i int) []byte {
+	return x.names[i*x.size : (i+1)*x.size]
+}
@@ -0,0 +1,138 @@
+package packfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestFinalizeWithIndex(t *testing.T) {
+	w := NewWriter()
+	var names []string
+	for _, o := range testObjects {
+		if err := w.AddObject(o.typ, []byte(o.data)); err != nil {
+			t.Fatal(err)
+		}
+		var obj object.Object = object.NewBlob([]byte(o.data))
+		if o.typ == OBJ_TREE {
+			tree, err := object.ParseTree([]byte(o.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj = tree
+		}
+		names = append(names, object.Hash(obj))
+	}
+	base := []byte(testObjects[1].data)
+	target := append(bytes.Clone(base), "and one more line\n"...)
+	if err := w.AddOfsDelta(w.Offset(1), base, target); err != nil {
+		t.Fatal(err)
+	}
+	names = append(names, object.Hash(object.NewBlob(target)))
+
+	pack, idx := w.FinalizeWithIndex()
+	if idx == nil {
+		t.Fatal("no index for a pack of known objects")
+	}
+	x, err := ReadIndex(idx, sha1.New)
+	if err != nil {
+		t.Fatalf("ReadIndex: %v", err)
+	}
+	if x.Len() != len(names) {
+		t.Errorf("index has %d objects, want %d", x.Len(), len(names))
+	}
+	if !bytes.Equal(x.PackChecksum(), pack[len(pack)-sha1.Size:]) {
+		t.Error("index does not name the pack's checksum")
+	}
+	for i, name := range names {
+		if off, ok := x.Offset(name); !ok || off != w.Offset(i) {
+			t.Errorf("Offset(%s) = %d, %t; want %d", name, off, ok, w.Offset(i))
+		}
+	}
+	if _, ok := x.Offset(strings.Repeat("0", 40)); ok {
+		t.Error("found an object that is not in the pack")
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	prefix := filepath.Join(dir, "objects", "pack", "pack-"+hex.EncodeToString(x.PackChecksum()))
+	if err := os.WriteFile(prefix+".pack", pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(prefix+".idx", idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("git", "verify-pack", prefix+".idx").CombinedOutput(); err != nil {
+		t.Fatalf("git verify-pack: %v\n%s", err, out)
+	}
+	for _, name := range names {
+		cmd := exec.Command("git", "cat-file", "-e", name)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("git cat-file -e %s: %v\n%s", name, err, out)
+		}
+	}
+
+	// git's own index of the pack is byte-identical.
+	cmd := exec.Command("git", "index-pack", "-o", filepath.Join(t.TempDir(), "git.idx"), prefix+".pack")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git index-pack: %v\n%s", err, out)
+	}
+	gitIdx, err := os.ReadFile(cmd.Args[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idx, gitIdx) {
+		t.Error("index differs from the one git index-pack builds")
+	}
+}
+
+func TestFinalizeWithIndexUnknownNames(t *testing.T) {
+	entry, err := EncodeObject(OBJ_BLOB, 5, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter()
+	if err := w.AddEncoded(entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, idx := w.FinalizeWithIndex(); idx != nil {
+		t.Error("indexed a pack holding an object of unknown name")
+	}
+}
+
+func TestIndexLargeOffsets(t *testing.T) {
+	entries := []IndexEntry{
+		{Hash: strings.Repeat("ab", 32), Offset: 12, CRC32: 1},
+		{Hash: strings.Repeat("01", 32), Offset: 1 << 33, CRC32: 2},
+		{Hash: strings.Repeat("ff", 32), Offset: 1<<31 + 5, CRC32: 3},
+	}
+	x, err := ReadIndex(BuildIndex(entries, make([]byte, sha256.Size), sha256.New), sha256.New)
+	if err != nil {
+		t.Fatalf("ReadIndex: %v", err)
+	}
+	for _, e := range entries {
+		if off, ok := x.Offset(e.Hash); !ok || off != e.Offset {
+			t.Errorf("Offset(%s) = %d, %t; want %d", e.Hash, off, ok, e.Offset)
+		}
+	}
+
+	idx := BuildIndex(entries, make([]byte, sha256.Size), sha256.New)
+	idx[len(indexMagic)+256*4] ^= 1
+	if _, err := ReadIndex(idx, sha256.New); err == nil {
+		t.Error("ReadIndex accepted a corrupt index")
+	}
+}
@@ -5,9 +5,14 @@ import (
 	"compress/zlib"
 	"crypto/sha1"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
+	"slices"
+
+	"github.com/imjasonh/infinite-git/internal/object"
 )
 
 const (
@@ -16,22 +21,63 @@ const (
 	OBJ_TREE   = 2
 	OBJ_BLOB   = 3
 	OBJ_TAG    = 4
+	// OBJ_OFS_DELTA is a delta against an earlier entry in the same
+	// pack, located by its offset.
+	OBJ_OFS_DELTA = 6
+	// OBJ_REF_DELTA is a delta against an object named by its hash.
+	OBJ_REF_DELTA = 7
 )
 
 // Writer writes a packfile.
+//
+// A Writer created with NewWriter buffers the pack in memory and patches
+// the object count into the header in Finalize. A Writer created with
+// NewStreamWriter writes each object through as it is added, which needs
+// the object count to be declared up front.
 type Writer struct {
 	buf     bytes.Buffer
+	dst     io.Writer // stream destination, nil when buffering
+	out     io.Writer // dst plus the running checksum
 	objects int
+	count   int // declared object count when streaming
 	hash    hash.Hash
+	newHash func() hash.Hash // names objects, for the index
+	entries []packEntry
+	size    int64 // bytes written so far
+}
+
+// packEntry records what the index needs to know about an added object.
+type packEntry struct {
+	offset int64  // where the entry starts in the pack
+	crc    uint32 // of the entry as stored
+	typ    int    // type of the object, after resolving any delta
+	name   []byte // nil if unknown
+}
+
+// WriterOption configures a Writer.
+type WriterOption func(*Writer)
+
+// WithChecksum computes the pack's trailing checksum with newHash, which
+// must match the repository's object format. The default is SHA-1.
+func WithChecksum(newHash func() hash.Hash) WriterOption {
+	return func(w *Writer) {
+		w.hash = newHash()
+		w.newHash = newHash
+	}
 }
 
 // NewWriter creates a new packfile writer.
-func NewWriter() *Writer {
+func NewWriter(opts ...WriterOption) *Writer {
 	w := &Writer{
-		hash: sha1.New(),
+		hash:    sha1.New(),
+		newHash: sha1.New,
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
 
 	// Write pack header
+	w.size = 12
 	w.buf.WriteString("PACK")
 	binary.Write(&w.buf, binary.BigEndian, uint32(2)) // version
 	binary.Write(&w.buf, binary.BigEndian, uint32(0)) // placeholder for object count
@@ -39,39 +85,231 @@ func NewWriter() *Writer {
 	return w
 }
 
+// NewStreamWriter creates a packfile writer that writes to out as objects
+// are added rather than buffering the pack. Exactly count objects must be
+// added before calling Close.
+func NewStreamWriter(out io.Writer, count int, opts ...WriterOption) (*Writer, error) {
+	w := &Writer{
+		hash:    sha1.New(),
+		newHash: sha1.New,
+		dst:     out,
+		count:   count,
+		size:    12,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.out = io.MultiWriter(out, w.hash)
+
+	var header bytes.Buffer
+	header.WriteString("PACK")
+	binary.Write(&header, binary.BigEndian, uint32(2))     // version
+	binary.Write(&header, binary.BigEndian, uint32(count)) // object count
+	if _, err := w.out.Write(header.Bytes()); err != nil {
+		return nil, fmt.Errorf("writing pack header: %w", err)
+	}
+
+	return w, nil
+}
+
 // AddObject adds an object to the packfile.
 func (w *Writer) AddObject(objType int, data []byte) error {
-	w.objects++
+	return w.AddObjectStream(objType, int64(len(data)), bytes.NewReader(data))
+}
+
+// AddObjectStream adds an object whose content is read from r, which must
+// yield exactly size bytes. The content is compressed as it is read.
+func (w *Writer) AddObjectStream(objType int, size int64, r io.Reader) error {
+	if w.out != nil && w.objects == w.count {
+		return fmt.Errorf("pack already holds the declared %d objects", w.count)
+	}
+	name := w.newHash()
+	fmt.Fprintf(name, "%s %d\x00", typeNames[objType], size)
+	entry, err := EncodeObject(objType, size, io.TeeReader(r, name))
+	if err != nil {
+		return err
+	}
+	return w.add(entry, objType, name.Sum(nil))
+}
 
-	// Encode object header
+// typeNames are the names objects are hashed under.
+var typeNames = map[int]string{
+	OBJ_COMMIT: "commit",
+	OBJ_TREE:   "tree",
+	OBJ_BLOB:   "blob",
+	OBJ_TAG:    "tag",
+}
+
+// objectName returns the name of an object of type typ with content
+// data, or nil if typ is unknown.
+func (w *Writer) objectName(typ int, data []byte) []byte {
+	if _, ok := typeNames[typ]; !ok {
+		return nil
+	}
+	h := w.newHash()
+	fmt.Fprintf(h, "%s %d\x00", typeNames[typ], len(data))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// EncodeObject returns the pack entry for an object: its type and size
+// header followed by the compressed content read from r, which must yield
+// exactly size bytes. Encoding is independent of the pack it ends up in,
+// so callers may encode objects concurrently and add them in order with
+// AddEncoded.
+func EncodeObject(objType int, size int64, r io.Reader) ([]byte, error) {
+	var entry bytes.Buffer
+	writeEntryHeader(&entry, objType, size)
+	if err := compressInto(&entry, size, r); err != nil {
+		return nil, err
+	}
+	return entry.Bytes(), nil
+}
+
+// writeEntryHeader writes a pack entry's type and size.
+func writeEntryHeader(entry *bytes.Buffer, objType int, size int64) {
 	// Format: 1-bit continuation, 3-bit type, 4-bit size (then 7-bit size chunks)
-	size := len(data)
-	header := (objType << 4) | (size & 0xf)
-	size >>= 4
+	header := (int64(objType) << 4) | (size & 0xf)
+	rest := size >> 4
 
-	for size > 0 {
+	for rest > 0 {
 		header |= 0x80 // Set continuation bit
-		w.buf.WriteByte(byte(header))
-		header = size & 0x7f
-		size >>= 7
+		entry.WriteByte(byte(header))
+		header = rest & 0x7f
+		rest >>= 7
 	}
-	w.buf.WriteByte(byte(header))
+	entry.WriteByte(byte(header))
+}
 
-	// Compress and write object data
-	var compressedBuf bytes.Buffer
-	zw := zlib.NewWriter(&compressedBuf)
-	if _, err := zw.Write(data); err != nil {
+// compressInto appends the compressed content read from r, which must
+// yield exactly size bytes, to entry.
+func compressInto(entry *bytes.Buffer, size int64, r io.Reader) error {
+	zw := zlib.NewWriter(entry)
+	n, err := io.Copy(zw, r)
+	if err != nil {
 		return fmt.Errorf("compressing object: %w", err)
 	}
+	if n != size {
+		return fmt.Errorf("object size mismatch: expected %d bytes, got %d", size, n)
+	}
 	if err := zw.Close(); err != nil {
 		return fmt.Errorf("closing compressor: %w", err)
 	}
+	return nil
+}
+
+// Offset returns the offset in the pack of the i'th object added, for use
+// as the base of an AddOfsDelta.
+func (w *Writer) Offset(i int) int64 {
+	return w.entries[i].offset
+}
+
+// AddOfsDelta adds target to the pack as a delta against base, the
+// content of the object at baseOffset in this pack, as Offset returns.
+// Unlike a ref-delta, it needs no base name, so entries are smaller.
+func (w *Writer) AddOfsDelta(baseOffset int64, base, target []byte) error {
+	if w.out != nil && w.objects == w.count {
+		return fmt.Errorf("pack already holds the declared %d objects", w.count)
+	}
+	i := slices.IndexFunc(w.entries, func(e packEntry) bool { return e.offset == baseOffset })
+	if i == -1 {
+		return fmt.Errorf("no object at offset %d to delta against", baseOffset)
+	}
+	typ := w.entries[i].typ
+	delta := Delta(base, target)
+
+	var entry bytes.Buffer
+	writeEntryHeader(&entry, OBJ_OFS_DELTA, int64(len(delta)))
+	entry.Write(encodeOfsDistance(w.size - baseOffset))
+	if err := compressInto(&entry, int64(len(delta)), bytes.NewReader(delta)); err != nil {
+		return err
+	}
+	return w.add(entry.Bytes(), typ, w.objectName(typ, target))
+}
+
+// encodeOfsDistance encodes how far back an ofs-delta's base is: seven
+// bits at a time, most significant first, with the high bit set on all
+// but the last byte. Each continuation adds one to what it encodes, so
+// that no value has two encodings.
+func encodeOfsDistance(n int64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(n & 0x7f)
+	for n >>= 7; n > 0; n >>= 7 {
+		n--
+		i--
+		buf[i] = 0x80 | byte(n&0x7f)
+	}
+	return buf[i:]
+}
+
+// AddRefDelta adds target to the pack as a delta against base, the
+// content of the object baseHash. The base must be in the pack too, or,
+// in a thin pack, be one the client has.
+func (w *Writer) AddRefDelta(baseHash string, base, target []byte) error {
+	if w.out != nil && w.objects == w.count {
+		return fmt.Errorf("pack already holds the declared %d objects", w.count)
+	}
+	entry, err := EncodeRefDelta(baseHash, base, target)
+	if err != nil {
+		return err
+	}
+	// The base's type is only known if it is in this pack.
+	typ := 0
+	if name, err := hex.DecodeString(baseHash); err == nil {
+		if i := slices.IndexFunc(w.entries, func(e packEntry) bool { return bytes.Equal(e.name, name) }); i != -1 {
+			typ = w.entries[i].typ
+		}
+	}
+	return w.add(entry, typ, w.objectName(typ, target))
+}
+
+// EncodeRefDelta returns the pack entry for target as a delta against
+// base, the content of the object baseHash: the entry header with the
+// size of the delta, the binary base name, then the compressed delta.
+func EncodeRefDelta(baseHash string, base, target []byte) ([]byte, error) {
+	name, err := hex.DecodeString(baseHash)
+	if err != nil || (len(name) != 20 && len(name) != 32) {
+		return nil, fmt.Errorf("invalid delta base %q", baseHash)
+	}
+	delta := Delta(base, target)
+
+	var entry bytes.Buffer
+	writeEntryHeader(&entry, OBJ_REF_DELTA, int64(len(delta)))
+	entry.Write(name)
+	if err := compressInto(&entry, int64(len(delta)), bytes.NewReader(delta)); err != nil {
+		return nil, err
+	}
+	return entry.Bytes(), nil
+}
 
-	w.buf.Write(compressedBuf.Bytes())
+// AddEncoded adds an entry produced by EncodeObject to the pack. The
+// writer does not learn the object's name, so FinalizeWithIndex cannot
+// index a pack built this way.
+func (w *Writer) AddEncoded(entry []byte) error {
+	return w.add(entry, 0, nil)
+}
+
+// add adds an encoded entry for an object of type typ named name.
+func (w *Writer) add(entry []byte, typ int, name []byte) error {
+	if w.out != nil && w.objects == w.count {
+		return fmt.Errorf("pack already holds the declared %d objects", w.count)
+	}
+
+	// Count the object only once it is written, so a failed object
+	// leaves the pack as it was.
+	if w.out == nil {
+		w.buf.Write(entry)
+	} else if _, err := w.out.Write(entry); err != nil {
+		return fmt.Errorf("writing object: %w", err)
+	}
+	w.objects++
+	w.entries = append(w.entries, packEntry{offset: w.size, crc: crc32.ChecksumIEEE(entry), typ: typ, name: name})
+	w.size += int64(len(entry))
 	return nil
 }
 
-// Finalize completes the packfile and returns the data.
+// Finalize completes a buffered packfile and returns the data.
 func (w *Writer) Finalize() []byte {
 	data := w.buf.Bytes()
 
@@ -86,14 +324,70 @@ func (w *Writer) Finalize() []byte {
 	return result
 }
 
-// Reader reads objects from a packfile.
+// FinalizeWithIndex completes a buffered packfile like Finalize and also
+// returns its version 2 index. The index is nil if the name of any object
+// is unknown, as for entries added with AddEncoded or deltas against
+// objects outside the pack.
+func (w *Writer) FinalizeWithIndex() (pack []byte, idx []byte) {
+	pack = w.Finalize()
+	entries := make([]IndexEntry, len(w.entries))
+	for i, e := range w.entries {
+		if e.name == nil {
+			return pack, nil
+		}
+		entries[i] = IndexEntry{Hash: hex.EncodeToString(e.name), Offset: e.offset, CRC32: e.crc}
+	}
+	sum := pack[len(pack)-w.hash.Size():]
+	return pack, BuildIndex(entries, sum, w.newHash)
+}
+
+// Close completes a streamed packfile by writing its trailing checksum.
+func (w *Writer) Close() error {
+	if w.out == nil {
+		return fmt.Errorf("Close called on a buffered pack writer")
+	}
+	if w.objects != w.count {
+		return fmt.Errorf("pack declared %d objects but %d were added", w.count, w.objects)
+	}
+	if _, err := w.dst.Write(w.hash.Sum(nil)); err != nil {
+		return fmt.Errorf("writing pack checksum: %w", err)
+	}
+	return nil
+}
+
+// Reader reads objects from a packfile. Deltas are resolved against the
+// objects read before them, so ReadObject only ever returns whole objects.
 type Reader struct {
 	data   []byte
 	offset int
+
+	// objects read so far by offset, the bases ofs-deltas refer to
+	bases map[int]baseObject
+	// offsets by object name, built on the first ref-delta
+	names map[string]int
+	// format names objects, for ref-delta bases
+	format object.Format
+}
+
+// ReaderOption configures a Reader.
+type ReaderOption func(*Reader)
+
+// WithObjectFormat reads ref-delta base names as f's object names, which
+// must match the pack's. The default is SHA-1.
+func WithObjectFormat(f object.Format) ReaderOption {
+	return func(r *Reader) {
+		r.format = f
+	}
+}
+
+// baseObject is an object already read, kept for the deltas after it.
+type baseObject struct {
+	typ  int
+	data []byte
 }
 
 // NewReader creates a new packfile reader.
-func NewReader(data []byte) (*Reader, error) {
+func NewReader(data []byte, opts ...ReaderOption) (*Reader, error) {
 	if len(data) < 12 {
 		return nil, fmt.Errorf("packfile too small")
 	}
@@ -107,10 +401,16 @@ func NewReader(data []byte) (*Reader, error) {
 		return nil, fmt.Errorf("unsupported packfile version: %d", version)
 	}
 
-	return &Reader{
+	r := &Reader{
 		data:   data,
 		offset: 12, // Skip header
-	}, nil
+		bases:  make(map[int]baseObject),
+		format: object.SHA1,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
 }
 
 // readVarint reads a variable-length integer.
@@ -139,15 +439,47 @@ func (r *Reader) readVarint() (int, int, error) {
 	return objType, size, nil
 }
 
-// ReadObject reads the next object from the packfile.
+// ReadObject reads the next object from the packfile. Delta entries are
+// returned resolved, with their base's type; ref-deltas must name an
+// earlier object in the pack.
 func (r *Reader) ReadObject() (objType int, data []byte, err error) {
+	start := r.offset
+
 	// Read object header
 	objType, size, err := r.readVarint()
 	if err != nil {
 		return 0, nil, err
 	}
 
-	// Wrap the remaining data in a counting reader to track compressed bytes consumed.
+	var base baseObject
+	switch objType {
+	case OBJ_OFS_DELTA:
+		distance, err := r.readOfsDistance()
+		if err != nil {
+			return 0, nil, err
+		}
+		b, ok := r.bases[start-distance]
+		if !ok {
+			return 0, nil, fmt.Errorf("delta at offset %d: no object at base offset %d", start, start-distance)
+		}
+		base = b
+	case OBJ_REF_DELTA:
+		size := r.format.Size()
+		if r.offset+size > len(r.data) {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		name := r.data[r.offset : r.offset+size]
+		r.offset += size
+		b, ok := r.bases[r.nameIndex()[string(name)]]
+		if !ok {
+			return 0, nil, fmt.Errorf("delta at offset %d: base %x is not in the pack", start, name)
+		}
+		base = b
+	}
+
+	// Wrap the remaining data in a counting reader to track compressed
+	// bytes consumed. It is a flate.Reader, so the decompressor reads
+	// only what it needs instead of buffering past the end of the entry.
 	cr := &countingReader{reader: bytes.NewReader(r.data[r.offset:])}
 	zr, err := zlib.NewReader(cr)
 	if err != nil {
@@ -160,18 +492,74 @@ func (r *Reader) ReadObject() (objType int, data []byte, err error) {
 		return 0, nil, fmt.Errorf("decompressing object: %w", err)
 	}
 
-	// Drain the zlib reader so cr.n reflects all compressed bytes consumed.
-	io.Copy(io.Discard, zr)
+	// Read to the end of the stream so the checksum is verified and cr.n
+	// covers it.
+	if n, err := io.Copy(io.Discard, zr); err != nil {
+		return 0, nil, fmt.Errorf("decompressing object: %w", err)
+	} else if n != 0 {
+		return 0, nil, fmt.Errorf("object is %d bytes longer than its header says", n)
+	}
 
 	// Advance offset past the compressed data.
 	r.offset += int(cr.n)
 
+	if objType == OBJ_OFS_DELTA || objType == OBJ_REF_DELTA {
+		if data, err = ApplyDelta(base.data, data); err != nil {
+			return 0, nil, fmt.Errorf("delta at offset %d: %w", start, err)
+		}
+		objType = base.typ
+	}
+	r.bases[start] = baseObject{typ: objType, data: data}
+	if r.names != nil {
+		r.names[string(r.nameOf(objType, data))] = start
+	}
+
 	return objType, data, nil
 }
 
-// countingReader wraps an io.Reader and counts bytes read.
+// readOfsDistance reads the distance back to an ofs-delta's base, the
+// inverse of encodeOfsDistance.
+func (r *Reader) readOfsDistance() (int, error) {
+	if r.offset >= len(r.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := r.data[r.offset]
+	r.offset++
+	n := int(c & 0x7f)
+	for c&0x80 != 0 {
+		if r.offset >= len(r.data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		c = r.data[r.offset]
+		r.offset++
+		n = (n+1)<<7 | int(c&0x7f)
+	}
+	return n, nil
+}
+
+// nameIndex returns the offsets of the objects read so far by name. It is
+// built on first use, since only ref-deltas need it.
+func (r *Reader) nameIndex() map[string]int {
+	if r.names == nil {
+		r.names = make(map[string]int, len(r.bases))
+		for offset, b := range r.bases {
+			r.names[string(r.nameOf(b.typ, b.data))] = offset
+		}
+	}
+	return r.names
+}
+
+// nameOf returns the name of an object in the reader's format.
+func (r *Reader) nameOf(typ int, data []byte) []byte {
+	h := r.format.New()
+	fmt.Fprintf(h, "%s %d\x00", typeNames[typ], len(data))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// countingReader wraps a bytes.Reader and counts bytes read.
 type countingReader struct {
-	reader io.Reader
+	reader *bytes.Reader
 	n      int64
 }
 
@@ -180,3 +568,11 @@ func (c *countingReader) Read(p []byte) (int, error) {
 	c.n += int64(n)
 	return n, err
 }
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.reader.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
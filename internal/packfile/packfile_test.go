@@ -0,0 +1,227 @@
+package packfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	gitpackfile "github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+var testObjects = []struct {
+	typ  int
+	data string
+}{
+	{OBJ_BLOB, "hello\n"},
+	{OBJ_BLOB, strings.Repeat("a long blob with a multi-byte size header\n", 100)},
+	{OBJ_TREE, "100644 hello.txt\x00\xce\x01\x36\x25\x03\x0b\xa8\xdb\xa9\x06\xf7\x56\x96\x7f\x9e\x9c\xa3\x94\x46\x4a"},
+}
+
+func TestStreamWriter(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewStreamWriter(&out, len(testObjects))
+	if err != nil {
+		t.Fatalf("NewStreamWriter: %v", err)
+	}
+
+	// The header is final before any object is added.
+	if out.Len() != 12 {
+		t.Fatalf("wrote %d bytes before any object, want the 12 byte header", out.Len())
+	}
+	if got := binary.BigEndian.Uint32(out.Bytes()[8:12]); got != uint32(len(testObjects)) {
+		t.Errorf("header object count = %d, want %d", got, len(testObjects))
+	}
+
+	for _, obj := range testObjects {
+		before := out.Len()
+		if err := w.AddObject(obj.typ, []byte(obj.data)); err != nil {
+			t.Fatalf("AddObject: %v", err)
+		}
+		if out.Len() == before {
+			t.Error("AddObject buffered the object instead of streaming it")
+		}
+	}
+	if err := w.AddObject(OBJ_BLOB, []byte("one too many")); err == nil {
+		t.Error("AddObject past the declared count succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Streaming produces the same bytes as buffering and back-patching.
+	bw := NewWriter()
+	for _, obj := range testObjects {
+		if err := bw.AddObject(obj.typ, []byte(obj.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), bw.Finalize()) {
+		t.Error("streamed pack differs from buffered pack")
+	}
+
+	st := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(out.Bytes())); err != nil {
+		t.Fatalf("reading streamed pack: %v", err)
+	}
+	if len(st.Objects) != len(testObjects) {
+		t.Errorf("pack holds %d objects, want %d", len(st.Objects), len(testObjects))
+	}
+}
+
+func TestStreamWriterShortCount(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewStreamWriter(&out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddObject(OBJ_BLOB, []byte("only one\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "declared 2 objects but 1") {
+		t.Errorf("Close error = %v, want a count mismatch", err)
+	}
+}
+
+// failingReader fails partway through an object's content.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("allocator on fire")
+}
+
+// failOnceWriter rejects its first write without writing anything.
+type failOnceWriter struct {
+	io.Writer
+	failed bool
+}
+
+func (w *failOnceWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		w.failed = true
+		return 0, errors.New("disk full")
+	}
+	return w.Writer.Write(p)
+}
+
+func TestAddObjectFailureLeavesWriterConsistent(t *testing.T) {
+	// A buffered pack skips an object that fails to compress.
+	bw := NewWriter()
+	if err := bw.AddObject(OBJ_BLOB, []byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.AddObjectStream(OBJ_BLOB, 100, failingReader{}); err == nil || !strings.Contains(err.Error(), "allocator on fire") {
+		t.Fatalf("AddObjectStream error = %v, want the compression failure", err)
+	}
+	if err := bw.AddObject(OBJ_BLOB, []byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+	st := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(bw.Finalize())); err != nil {
+		t.Fatalf("reading buffered pack: %v", err)
+	}
+	if len(st.Objects) != 2 {
+		t.Errorf("buffered pack holds %d objects, want 2", len(st.Objects))
+	}
+
+	// A streamed pack does not count an object it failed to write, so
+	// the declared count can still be met.
+	var out bytes.Buffer
+	sw, err := NewStreamWriter(&out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.AddObjectStream(OBJ_BLOB, 100, failingReader{}); err == nil {
+		t.Fatal("AddObjectStream with a failing reader succeeded")
+	}
+	sw.out = io.MultiWriter(&failOnceWriter{Writer: &out}, sw.hash)
+	if err := sw.AddObject(OBJ_BLOB, []byte("lost\n")); err == nil {
+		t.Fatal("AddObject with a failing writer succeeded")
+	}
+	for _, data := range []string{"before\n", "after\n"} {
+		if err := sw.AddObject(OBJ_BLOB, []byte(data)); err != nil {
+			t.Fatalf("AddObject after failures: %v", err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	st = memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(out.Bytes())); err != nil {
+		t.Fatalf("reading streamed pack: %v", err)
+	}
+	if len(st.Objects) != 2 {
+		t.Errorf("streamed pack holds %d objects, want 2", len(st.Objects))
+	}
+}
+
+func TestReader(t *testing.T) {
+	w := NewWriter()
+	for _, o := range testObjects {
+		if err := w.AddObject(o.typ, []byte(o.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pack := w.Finalize()
+
+	r, err := NewReader(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, o := range testObjects {
+		typ, data, err := r.ReadObject()
+		if err != nil {
+			t.Fatalf("reading object %d: %v", i, err)
+		}
+		if typ != o.typ {
+			t.Errorf("object %d has type %d, want %d", i, typ, o.typ)
+		}
+		if string(data) != o.data {
+			t.Errorf("object %d content differs", i)
+		}
+	}
+	if want := len(pack) - 20; r.offset != want {
+		t.Errorf("reader stopped at offset %d, want %d at the trailer", r.offset, want)
+	}
+}
+
+func TestReaderResolvesDeltas(t *testing.T) {
+	base := []byte(strings.Repeat("the quick brown fox\n", 50))
+	v2 := append(bytes.Clone(base), "jumps\n"...)
+	v3 := append(bytes.Clone(v2), "over the lazy dog\n"...)
+
+	for _, format := range []object.Format{object.SHA1, object.SHA256} {
+		t.Run(string(format), func(t *testing.T) {
+			w := NewWriter(WithChecksum(format.New))
+			if err := w.AddObject(OBJ_BLOB, base); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.AddOfsDelta(w.Offset(0), base, v2); err != nil {
+				t.Fatal(err)
+			}
+			// A ref-delta whose base is itself a delta, named in the
+			// pack's format.
+			if err := w.AddRefDelta(format.Hash(object.NewBlob(v2)), v2, v3); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := NewReader(w.Finalize(), WithObjectFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range [][]byte{base, v2, v3} {
+				typ, data, err := r.ReadObject()
+				if err != nil {
+					t.Fatalf("reading object %d: %v", i, err)
+				}
+				if typ != OBJ_BLOB || !bytes.Equal(data, want) {
+					t.Errorf("object %d = type %d, %d bytes; want a %d byte blob", i, typ, len(data), len(want))
+				}
+			}
+		})
+	}
+}
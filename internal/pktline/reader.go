@@ -2,23 +2,65 @@ package pktline
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// ErrLimit is returned, wrapped, once a Reader has read more lines or
+// bytes than its limits allow.
+var ErrLimit = errors.New("pkt-line limit exceeded")
+
+// ErrDelim is returned on a delim-pkt (0001), which separates the
+// sections of a protocol v2 request.
+var ErrDelim = errors.New("unexpected delim-pkt")
+
 // Reader implements the Git packet line protocol for reading.
 type Reader struct {
-	r *bufio.Reader
+	r       *bufio.Reader
+	flushed bool
+
+	// Limits on what the reader consumes in total, or zero for none.
+	maxLines int
+	maxBytes int64
+	lines    int
+	bytes    int64
+}
+
+// ReaderOption configures a Reader.
+type ReaderOption func(*Reader)
+
+// WithMaxLines fails reads once more than n pkt-lines, not counting
+// flushes, have been read. Zero means no limit.
+func WithMaxLines(n int) ReaderOption {
+	return func(r *Reader) {
+		r.maxLines = n
+	}
+}
+
+// WithMaxBytes fails reads that would take the total read, headers
+// included, over n bytes. Zero means no limit.
+func WithMaxBytes(n int64) ReaderOption {
+	return func(r *Reader) {
+		r.maxBytes = n
+	}
 }
 
 // NewReader creates a new packet line reader.
-func NewReader(r io.Reader) *Reader {
-	return &Reader{r: bufio.NewReader(r)}
+func NewReader(r io.Reader, opts ...ReaderOption) *Reader {
+	pr := &Reader{r: bufio.NewReader(r)}
+	for _, opt := range opts {
+		opt(pr)
+	}
+	return pr
 }
 
 // Read reads a single pkt-line.
-// Returns io.EOF on flush packet (0000).
+// Returns io.EOF on flush packet (0000) and at the end of the input;
+// Flushed tells them apart. A delim-pkt returns ErrDelim.
 func (r *Reader) Read() ([]byte, error) {
+	r.flushed = false
+
 	// Read 4-byte length header
 	header := make([]byte, 4)
 	if _, err := io.ReadFull(r.r, header); err != nil {
@@ -31,12 +73,26 @@ func (r *Reader) Read() ([]byte, error) {
 		return nil, fmt.Errorf("invalid pkt-line header: %s", header)
 	}
 
+	// Enforce the limits before allocating for the data.
+	size := int64(max(length, 4))
+	if r.maxBytes > 0 && r.bytes+size > r.maxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrLimit, r.maxBytes)
+	}
+	r.bytes += size
+	if length > 2 {
+		if r.maxLines > 0 && r.lines == r.maxLines {
+			return nil, fmt.Errorf("%w: more than %d lines", ErrLimit, r.maxLines)
+		}
+		r.lines++
+	}
+
 	// Handle special packets
 	switch length {
 	case 0: // flush-pkt
+		r.flushed = true
 		return nil, io.EOF
 	case 1: // delimiter packet (0001)
-		return nil, fmt.Errorf("delimiter packet not supported")
+		return nil, ErrDelim
 	case 2: // response-end packet (0002)
 		return nil, fmt.Errorf("response-end packet not supported")
 	}
@@ -54,6 +110,21 @@ func (r *Reader) Read() ([]byte, error) {
 	return data, nil
 }
 
+// Flushed reports whether the last read ended at a flush-pkt rather
+// than at the end of the input. Requests over stateless HTTP end without
+// a flush, so parsers use it to tell a finished section from a
+// truncated request.
+func (r *Reader) Flushed() bool {
+	return r.flushed
+}
+
+// Rest returns what follows the pkt-lines read so far, such as the
+// packfile after a push's commands. The reader's limits do not apply to
+// it.
+func (r *Reader) Rest() io.Reader {
+	return r.r
+}
+
 // ReadString reads a pkt-line as a string, trimming newline.
 func (r *Reader) ReadString() (string, error) {
 	data, err := r.Read()
@@ -69,7 +140,8 @@ func (r *Reader) ReadString() (string, error) {
 	return string(data), nil
 }
 
-// ReadAll reads all pkt-lines until flush packet.
+// ReadAll reads all pkt-lines until flush packet, within the reader's
+// limits.
 func (r *Reader) ReadAll() ([][]byte, error) {
 	var lines [][]byte
 
@@ -0,0 +1,56 @@
+package pktline
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReaderLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for range 3 {
+		w.WriteString("have x\n") // 11 bytes with the header
+	}
+	w.Flush()
+	data := buf.Bytes()
+
+	for _, tc := range []struct {
+		name string
+		opts []ReaderOption
+		read int  // lines read before the limit
+		over bool // whether the limit stops the read of the flush
+	}{
+		{"no limits", nil, 3, false},
+		{"lines", []ReaderOption{WithMaxLines(2)}, 2, true},
+		{"exact lines", []ReaderOption{WithMaxLines(3)}, 3, false},
+		{"bytes", []ReaderOption{WithMaxBytes(30)}, 2, true},
+		// The flush counts towards the bytes.
+		{"bytes with flush", []ReaderOption{WithMaxBytes(36)}, 3, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(data), tc.opts...)
+			for i := range tc.read {
+				if _, err := r.Read(); err != nil {
+					t.Fatalf("reading line %d: %v", i, err)
+				}
+			}
+			_, err := r.Read()
+			if !tc.over {
+				if err != io.EOF || !r.Flushed() {
+					t.Errorf("read after the lines = %v, want the flush", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrLimit) {
+				t.Errorf("read over the limit = %v, want ErrLimit", err)
+			}
+		})
+	}
+
+	// ReadAll stops at the limit too.
+	if _, err := NewReader(bytes.NewReader(data), WithMaxLines(1)).ReadAll(); !errors.Is(err, ErrLimit) {
+		t.Errorf("ReadAll = %v, want ErrLimit", err)
+	}
+}
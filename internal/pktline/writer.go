@@ -5,6 +5,10 @@ import (
 	"io"
 )
 
+// MaxDataSize is the largest payload a single pkt-line can carry
+// (65520 bytes minus the 4-byte length header).
+const MaxDataSize = 65516
+
 // Writer implements the Git packet line protocol for writing.
 type Writer struct {
 	w io.Writer
@@ -22,7 +26,7 @@ func (w *Writer) Write(data []byte) error {
 	}
 
 	// Maximum pkt-line length is 65520 (65516 bytes of data + 4 bytes length)
-	if len(data) > 65516 {
+	if len(data) > MaxDataSize {
 		return fmt.Errorf("pkt-line too long: %d bytes", len(data))
 	}
 
@@ -38,6 +42,20 @@ func (w *Writer) Write(data []byte) error {
 	return err
 }
 
+// WriteLarge writes data of any size as a sequence of maximum-size
+// pkt-lines. It is meant for raw data only: side-band data needs its band
+// byte at the start of every pkt-line, so it must be split by the caller.
+func (w *Writer) WriteLarge(data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), MaxDataSize)
+		if err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
 // WriteString writes a string as a pkt-line.
 func (w *Writer) WriteString(s string) error {
 	return w.Write([]byte(s))
@@ -48,6 +66,13 @@ func (w *Writer) Writef(format string, args ...interface{}) error {
 	return w.WriteString(fmt.Sprintf(format, args...))
 }
 
+// Delim writes a delim-pkt (0001), which separates the sections of a
+// protocol v2 message.
+func (w *Writer) Delim() error {
+	_, err := w.w.Write([]byte("0001"))
+	return err
+}
+
 // Flush writes a flush packet (0000).
 func (w *Writer) Flush() error {
 	_, err := w.w.Write([]byte("0000"))
@@ -0,0 +1,49 @@
+package pktline
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestWriteLarge(t *testing.T) {
+	data := make([]byte, 200*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteLarge(data); err != nil {
+		t.Fatalf("WriteLarge: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := (len(data) + MaxDataSize - 1) / MaxDataSize; len(lines) != want {
+		t.Errorf("got %d pkt-lines, want %d", len(lines), want)
+	}
+	for i, line := range lines {
+		if len(line) > MaxDataSize {
+			t.Errorf("pkt-line %d has %d bytes, over the maximum", i, len(line))
+		}
+	}
+	if got := bytes.Join(lines, nil); !bytes.Equal(got, data) {
+		t.Error("reassembled data differs from the original")
+	}
+}
+
+func TestWriteLargeEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).WriteLarge(nil); err != nil {
+		t.Fatalf("WriteLarge: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteLarge(nil) wrote %q, want nothing", buf.Bytes())
+	}
+}
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// PackCache is an LRU cache of finalized packfiles keyed by the wanted head.
+// Packs for full clones depend only on the wanted objects, which are
+// immutable, so a cached pack never goes stale; old heads simply age out.
+// The one exception is an operation that deletes objects from the store:
+// it must call Purge, or the cache could keep serving history that no
+// longer exists.
+type PackCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+	hits    int64
+	// building holds a channel for each key whose pack is being built,
+	// closed when the build ends.
+	building map[string]chan struct{}
+}
+
+type packCacheEntry struct {
+	key  string
+	pack []byte
+}
+
+// NewPackCache creates a pack cache holding at most size packs.
+func NewPackCache(size int) *PackCache {
+	return &PackCache{
+		size:     size,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+		building: make(map[string]chan struct{}),
+	}
+}
+
+// Get returns the cached pack for key, if present.
+func (c *PackCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	atomic.AddInt64(&c.hits, 1)
+	return e.Value.(*packCacheEntry).pack, true
+}
+
+// startBuild claims the build of key's pack, so that others wait for it
+// instead of building it too. If the pack is cached it returns false. If
+// another build holds the claim it waits for that to end and tries again,
+// or returns ctx's error if ctx ends first. Otherwise it returns true, and
+// done must be called once the pack is added or the build fails. Calling
+// done again does nothing.
+func (c *PackCache) startBuild(ctx context.Context, key string) (done func(), ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if _, cached := c.entries[key]; cached {
+			return nil, false, nil
+		}
+		ch, busy := c.building[key]
+		if !busy {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			c.mu.Lock()
+			return nil, false, fmt.Errorf("waiting for the pack being built: %w", ctx.Err())
+		}
+		c.mu.Lock()
+	}
+	ch := make(chan struct{})
+	c.building[key] = ch
+	return sync.OnceFunc(func() {
+		c.mu.Lock()
+		delete(c.building, key)
+		c.mu.Unlock()
+		close(ch)
+	}), true, nil
+}
+
+// Add stores a pack for key, evicting the least recently used entry if full.
+func (c *PackCache) Add(key string, pack []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*packCacheEntry).pack = pack
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&packCacheEntry{key: key, pack: pack})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*packCacheEntry).key)
+	}
+}
+
+// Purge drops every cached pack.
+func (c *PackCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Len returns the number of cached packs.
+func (c *PackCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Hits returns the number of cache hits served so far.
+func (c *PackCache) Hits() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import "testing"
+
+func TestPackCacheEviction(t *testing.T) {
+	c := NewPackCache(2)
+	c.Add("a", []byte("a"))
+	c.Add("b", []byte("b"))
+	c.Get("a")
+	c.Add("c", []byte("c"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("entry %q missing", k)
+		}
+	}
+}
+
+func TestPackCachePurge(t *testing.T) {
+	c := NewPackCache(2)
+	c.Add("a", []byte("a"))
+	c.Add("b", []byte("b"))
+	c.Purge()
+
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after Purge, want 0", c.Len())
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("purged entry still served")
+	}
+
+	c.Add("a", []byte("new"))
+	if got, _ := c.Get("a"); string(got) != "new" {
+		t.Errorf("Get(a) = %q after re-adding, want %q", got, "new")
+	}
+}
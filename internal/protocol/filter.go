@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/imjasonh/infinite-git/internal/packfile"
+)
+
+// objectFilter is a parsed filter spec, which leaves objects out of a
+// partial clone's pack for the client to fetch later. Objects the client
+// wants by name are always sent, so that it can do so.
+type objectFilter struct {
+	// blobLimit leaves out blobs of at least this many bytes; zero
+	// leaves out every blob. It is negative if blobs are not filtered.
+	blobLimit int64
+	// objType, if set, leaves out objects of every other type.
+	objType int
+}
+
+// filterTypes are the object types object:type filters may keep.
+var filterTypes = map[string]int{
+	"commit": packfile.OBJ_COMMIT,
+	"tree":   packfile.OBJ_TREE,
+	"blob":   packfile.OBJ_BLOB,
+	"tag":    packfile.OBJ_TAG,
+}
+
+// parseFilter parses a filter spec as git sends it: blob:none, or
+// blob:limit=<n> with an optional k, m or g suffix, or if types is set,
+// object:type=<type>. It returns nil for an empty spec.
+func parseFilter(spec string, types bool) (*objectFilter, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "blob:none":
+		return &objectFilter{blobLimit: 0}, nil
+	case strings.HasPrefix(spec, "blob:limit="):
+		n, err := parseFilterSize(spec[len("blob:limit="):])
+		if err != nil {
+			return nil, newRequestError("invalid filter %q: %v", spec, err)
+		}
+		return &objectFilter{blobLimit: n}, nil
+	case types && strings.HasPrefix(spec, "object:type="):
+		typ, ok := filterTypes[spec[len("object:type="):]]
+		if !ok {
+			return nil, newRequestError("invalid filter %q: unknown object type", spec)
+		}
+		return &objectFilter{blobLimit: -1, objType: typ}, nil
+	default:
+		return nil, newRequestError("unsupported filter %q", spec)
+	}
+}
+
+// parseFilterSize parses a byte count with git's optional unit suffix.
+func parseFilterSize(s string) (int64, error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		shift = 10
+	case strings.HasSuffix(s, "m"):
+		shift = 20
+	case strings.HasSuffix(s, "g"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, strconv.ErrSyntax
+	}
+	return n << shift, nil
+}
+
+// omits reports whether f leaves obj out of the pack, unless the client
+// wants it by name.
+func (f *objectFilter) omits(obj packObject) bool {
+	if f == nil {
+		return false
+	}
+	if f.objType != 0 && obj.objType != f.objType {
+		return true
+	}
+	return obj.objType == packfile.OBJ_BLOB && f.blobLimit >= 0 && obj.size >= f.blobLimit
+}
+
+// omitsTrees reports whether f leaves out every tree and blob, so the
+// trees of commits need not be walked.
+func (f *objectFilter) omitsTrees() bool {
+	return f != nil && (f.objType == packfile.OBJ_COMMIT || f.objType == packfile.OBJ_TAG)
+}
+
+// requestFilter parses the filter req asks for, telling the client if it
+// cannot be applied. Clients may only filter when the server advertised
+// it.
+func (u *UploadPack) requestFilter(req *FetchRequest, resp *FetchResponse) (*objectFilter, error) {
+	if req.Filter == "" {
+		return nil, nil
+	}
+	if !u.filter {
+		return nil, resp.Err(newRequestError("filter requested but not advertised"))
+	}
+	f, err := parseFilter(req.Filter, u.typeFilter)
+	if err != nil {
+		return nil, resp.Err(err)
+	}
+	return f, nil
+}
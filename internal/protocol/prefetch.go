@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// prefetcher reads objects for the walk ahead of it, on up to n
+// goroutines at a time. It is only used by the walking goroutine. With n
+// below 1 it reads each object when it is needed.
+type prefetcher struct {
+	u       *UploadPack
+	n       int
+	slots   chan struct{}
+	pending map[string]*prefetch
+}
+
+// prefetch is an object read that has been started.
+type prefetch struct {
+	done  chan struct{}
+	obj   packObject
+	links []string
+	err   error
+}
+
+// newPrefetcher returns a prefetcher for one walk.
+func (u *UploadPack) newPrefetcher() *prefetcher {
+	return &prefetcher{
+		u:       u,
+		n:       u.readAhead,
+		slots:   make(chan struct{}, max(u.readAhead, 1)),
+		pending: make(map[string]*prefetch),
+	}
+}
+
+// ahead starts reading the objects the walk visits next: those at the
+// top of stack, then the trees queued after it. Objects that are visited
+// or already being read are skipped.
+func (p *prefetcher) ahead(stack, trees []string, visited map[string]bool) {
+	next := make([]string, 0, p.n)
+	for i := len(stack) - 1; i >= 0 && len(next) < p.n; i-- {
+		next = append(next, stack[i])
+	}
+	for i := 0; i < len(trees) && len(next) < p.n; i++ {
+		next = append(next, trees[i])
+	}
+	for _, hash := range next {
+		if visited[hash] || p.pending[hash] != nil {
+			continue
+		}
+		f := &prefetch{done: make(chan struct{})}
+		p.pending[hash] = f
+		go func() {
+			p.slots <- struct{}{}
+			f.obj, f.links, f.err = p.u.readPackObject(hash)
+			<-p.slots
+			close(f.done)
+		}()
+	}
+}
+
+// read returns the object hash, waiting for its read if one was started.
+func (p *prefetcher) read(hash string) (packObject, []string, error) {
+	if f := p.pending[hash]; f != nil {
+		delete(p.pending, hash)
+		<-f.done
+		return f.obj, f.links, f.err
+	}
+	return p.u.readPackObject(hash)
+}
+
+// opener opens the streams of the blobs being packed, which are not held
+// in memory, up to n ahead of the one being written. With n below 1 each
+// stream is opened when it is needed.
+type opener struct {
+	u       *UploadPack
+	objects []packObject
+	results []chan opened
+	slots   chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// opened is the result of opening a blob's stream.
+type opened struct {
+	size int64
+	rc   io.ReadCloser
+	err  error
+}
+
+// openAhead starts opening the streams of the blobs in objects, in order.
+// Call close when done.
+func (u *UploadPack) openAhead(objects []packObject) *opener {
+	o := &opener{u: u, objects: objects, stop: make(chan struct{})}
+	if u.readAhead < 1 {
+		return o
+	}
+	o.results = make([]chan opened, len(objects))
+	o.slots = make(chan struct{}, u.readAhead)
+	for i, obj := range objects {
+		if obj.content == nil {
+			o.results[i] = make(chan opened, 1)
+		}
+	}
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		for i, obj := range objects {
+			if o.results[i] == nil {
+				continue
+			}
+			// A slot is given back when the stream is taken by open.
+			select {
+			case o.slots <- struct{}{}:
+			case <-o.stop:
+				return
+			}
+			o.wg.Add(1)
+			go func() {
+				defer o.wg.Done()
+				_, size, rc, err := u.readStream(obj.hash)
+				o.results[i] <- opened{size, rc, err}
+			}()
+		}
+	}()
+	return o
+}
+
+// open returns the stream of the i-th object, which must be a blob, and
+// its size. The caller must close the stream.
+func (o *opener) open(i int) (int64, io.ReadCloser, error) {
+	if o.results == nil {
+		_, size, rc, err := o.u.readStream(o.objects[i].hash)
+		return size, rc, err
+	}
+	select {
+	case r := <-o.results[i]:
+		<-o.slots
+		return r.size, r.rc, r.err
+	case <-o.stop:
+		// An encoder still running after the pack was abandoned.
+		return 0, nil, errors.New("pack abandoned")
+	}
+}
+
+// close stops opening streams and closes those that were opened but not
+// taken, as when writing the pack fails partway.
+func (o *opener) close() {
+	close(o.stop)
+	o.wg.Wait()
+	for _, ch := range o.results {
+		if ch == nil {
+			continue
+		}
+		select {
+		case r := <-ch:
+			if r.rc != nil {
+				r.rc.Close()
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/packfile"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// ReceivePack handles git-receive-pack, which pushes objects and ref
+// updates to the repository.
+type ReceivePack struct {
+	repo     *repo.Repository
+	checkRef func(cmd RefCommand) error
+	maxBytes int64
+}
+
+// ReceivePackOption configures a ReceivePack.
+type ReceivePackOption func(*ReceivePack)
+
+// WithRefCheck refuses ref updates for which check returns an error, such
+// as ones to refs the server manages itself. The client sees the error
+// as the reason the update was rejected. check runs with the repository
+// lock held, so it must not take it.
+func WithRefCheck(check func(cmd RefCommand) error) ReceivePackOption {
+	return func(rp *ReceivePack) {
+		rp.checkRef = check
+	}
+}
+
+// WithMaxPushBytes rejects pushes whose commands or packfile are larger
+// than n bytes. Zero means no limit.
+func WithMaxPushBytes(n int64) ReceivePackOption {
+	return func(rp *ReceivePack) {
+		rp.maxBytes = n
+	}
+}
+
+// NewReceivePack creates a new receive-pack handler.
+func NewReceivePack(r *repo.Repository, opts ...ReceivePackOption) *ReceivePack {
+	rp := &ReceivePack{repo: r}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp
+}
+
+// RefCommand is one ref update a push asks for. Old or New is the zero ID
+// when the ref is created or deleted.
+type RefCommand struct {
+	Old, New, Ref string
+}
+
+// Capabilities returns the capabilities to advertise for pushes. The
+// packfile is stored object by object, so thin packs, whose deltas refer
+// to objects outside the pack, are refused with no-thin.
+func (rp *ReceivePack) Capabilities() []string {
+	caps := []string{"report-status", "delete-refs", "ofs-delta", "no-thin"}
+	for _, c := range rp.repo.GetCapabilities() {
+		if strings.HasPrefix(c, "agent=") || strings.HasPrefix(c, "object-format=") {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// Advertise writes the receive-pack ref advertisement of refs, which
+// follows the service line, ending with a flush.
+func (rp *ReceivePack) Advertise(w io.Writer, refs map[string]string) error {
+	pw := pktline.NewWriter(w)
+	caps := strings.Join(rp.Capabilities(), " ")
+	names := slices.Sorted(maps.Keys(refs))
+	if len(names) == 0 {
+		// Capabilities need a line to go on.
+		if err := pw.Writef("%s capabilities^{}\x00%s\n", rp.repo.Format().ZeroID(), caps); err != nil {
+			return fmt.Errorf("writing capabilities: %w", err)
+		}
+	}
+	for i, name := range names {
+		line := refs[name] + " " + name
+		if i == 0 {
+			line += "\x00" + caps
+		}
+		if err := pw.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("writing ref %s: %w", name, err)
+		}
+	}
+	return pw.Flush()
+}
+
+// HandleRequest processes a push: the ref commands, then the packfile
+// of the objects they need, which is stored before any ref is updated.
+// Each ref is then updated only if it still points where the client
+// thought, and the outcome of each is reported if the client asked for
+// report-status.
+func (rp *ReceivePack) HandleRequest(r io.Reader, w io.Writer) error {
+	reader := pktline.NewReader(r, pktline.WithMaxBytes(rp.maxBytes))
+	pw := pktline.NewWriter(w)
+
+	cmds, caps, err := rp.parseCommands(reader)
+	if err != nil {
+		var rerr *requestError
+		if errors.As(err, &rerr) {
+			return writeErr(pw, err)
+		}
+		return err
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	// Only deletions come without a pack.
+	zero := rp.repo.Format().ZeroID()
+	var pack []byte
+	var unpackErr error
+	hasPack := slices.ContainsFunc(cmds, func(c RefCommand) bool { return c.New != zero })
+	if hasPack {
+		rest := reader.Rest()
+		if rp.maxBytes > 0 {
+			// Read one byte past the limit to tell if it was exceeded.
+			rest = io.LimitReader(rest, rp.maxBytes+1)
+		}
+		pack, err = io.ReadAll(rest)
+		switch {
+		case err != nil:
+			unpackErr = fmt.Errorf("reading pack: %w", err)
+		case rp.maxBytes > 0 && int64(len(pack)) > rp.maxBytes:
+			unpackErr = fmt.Errorf("push is larger than %d bytes", rp.maxBytes)
+		}
+	}
+
+	// Hold the repository lock from unpacking until the refs point at
+	// the new objects, so a Prune in between cannot delete them as
+	// unreachable.
+	rp.repo.Lock()
+	if hasPack && unpackErr == nil {
+		unpackErr = rp.unpack(pack)
+	}
+	results := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		if unpackErr != nil {
+			results[i] = "ng " + cmd.Ref + " unpacker error"
+			continue
+		}
+		if err := rp.update(cmd); err != nil {
+			results[i] = "ng " + cmd.Ref + " " + strings.ReplaceAll(err.Error(), "\n", " ")
+			continue
+		}
+		results[i] = "ok " + cmd.Ref
+	}
+	rp.repo.Unlock()
+
+	if !slices.Contains(caps, "report-status") {
+		return unpackErr
+	}
+	status := "unpack ok"
+	if unpackErr != nil {
+		status = "unpack " + strings.ReplaceAll(unpackErr.Error(), "\n", " ")
+	}
+	for _, line := range append([]string{status}, results...) {
+		if err := pw.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("writing status: %w", err)
+		}
+	}
+	if err := pw.Flush(); err != nil {
+		return fmt.Errorf("writing status: %w", err)
+	}
+	return unpackErr
+}
+
+// parseCommands reads the command list, "<old> <new> <ref>" lines ended
+// by a flush, with the client's capabilities after a NUL on the first.
+func (rp *ReceivePack) parseCommands(r *pktline.Reader) ([]RefCommand, []string, error) {
+	format := rp.repo.Format()
+	var cmds []RefCommand
+	var caps []string
+	for {
+		line, err := r.ReadString()
+		if err == io.EOF {
+			if len(cmds) > 0 && !r.Flushed() {
+				return nil, nil, newRequestError("push ended before its flush")
+			}
+			return cmds, caps, nil
+		}
+		if err != nil {
+			return nil, nil, readError("push", err)
+		}
+		if len(cmds) == 0 {
+			var rest string
+			line, rest, _ = strings.Cut(line, "\x00")
+			caps = strings.Fields(rest)
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !format.ValidHash(fields[0]) || !format.ValidHash(fields[1]) {
+			return nil, nil, newRequestError("invalid push command %q", line)
+		}
+		if err := repo.ValidateRefName(fields[2]); err != nil || !strings.HasPrefix(fields[2], "refs/") {
+			return nil, nil, newRequestError("invalid ref name %q in push", fields[2])
+		}
+		cmds = append(cmds, RefCommand{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+}
+
+// receiveTypes maps pack object types to object types.
+var receiveTypes = map[int]object.Type{
+	packfile.OBJ_COMMIT: object.TypeCommit,
+	packfile.OBJ_TREE:   object.TypeTree,
+	packfile.OBJ_BLOB:   object.TypeBlob,
+	packfile.OBJ_TAG:    object.TypeTag,
+}
+
+// unpack checks pack's trailing checksum and writes every object in it
+// to the repository.
+func (rp *ReceivePack) unpack(pack []byte) error {
+	format := rp.repo.Format()
+	if len(pack) < 12+format.Size() {
+		return fmt.Errorf("pack is truncated")
+	}
+	body, sum := pack[:len(pack)-format.Size()], pack[len(pack)-format.Size():]
+	h := format.New()
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("pack checksum mismatch")
+	}
+	pr, err := packfile.NewReader(body, packfile.WithObjectFormat(format))
+	if err != nil {
+		return err
+	}
+	count := int(binary.BigEndian.Uint32(pack[8:12]))
+	for i := range count {
+		typ, data, err := pr.ReadObject()
+		if err != nil {
+			return fmt.Errorf("reading pack object %d: %w", i, err)
+		}
+		t, ok := receiveTypes[typ]
+		if !ok {
+			return fmt.Errorf("pack object %d has unknown type %d", i, typ)
+		}
+		if _, err := rp.repo.WriteRawObject(t, data); err != nil {
+			return fmt.Errorf("writing pack object %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// update applies one ref command, which must name an object the
+// repository has and, for branches, a commit. Caller must hold the
+// repository lock.
+func (rp *ReceivePack) update(cmd RefCommand) error {
+	if rp.checkRef != nil {
+		if err := rp.checkRef(cmd); err != nil {
+			return err
+		}
+	}
+	if cmd.New != rp.repo.Format().ZeroID() {
+		typ, _, rc, err := rp.repo.ReadObjectStream(cmd.New)
+		if err != nil {
+			return fmt.Errorf("missing object %s", cmd.New)
+		}
+		rc.Close()
+		if strings.HasPrefix(cmd.Ref, "refs/heads/") && typ != object.TypeCommit {
+			return fmt.Errorf("%s is a %s, not a commit", cmd.New, typ)
+		}
+	}
+	return rp.repo.CompareAndSwapRefLocked(cmd.Ref, cmd.Old, cmd.New)
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/packfile"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+)
+
+// pushRequest builds a push of cmds, each "<old> <new> <ref>", asking
+// for report-status, followed by pack.
+func pushRequest(t *testing.T, pack []byte, cmds ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	for i, cmd := range cmds {
+		if i == 0 {
+			cmd += "\x00report-status"
+		}
+		if err := pw.WriteString(cmd + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(pack)
+	return &buf
+}
+
+// pushStatus runs a push and returns the reported status lines.
+func pushStatus(t *testing.T, rp *ReceivePack, req *bytes.Buffer) []string {
+	t.Helper()
+	var out bytes.Buffer
+	rp.HandleRequest(req, &out)
+	var lines []string
+	reader := pktline.NewReader(&out)
+	for {
+		line, err := reader.ReadString()
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return lines
+}
+
+func TestReceivePackStatus(t *testing.T) {
+	r, head := newTestRepo(t, 2)
+	zero := r.Format().ZeroID()
+	rp := NewReceivePack(r)
+	for _, ref := range []string{"refs/heads/a", "refs/heads/b"} {
+		if err := r.UpdateRef(ref, head); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deletions need no pack, and each ref succeeds or fails alone.
+	got := pushStatus(t, rp, pushRequest(t, nil,
+		head+" "+zero+" refs/heads/a",
+		zero+" "+zero+" refs/heads/b"))
+	if len(got) != 3 || got[0] != "unpack ok" || got[1] != "ok refs/heads/a" || !strings.HasPrefix(got[2], "ng refs/heads/b ") {
+		t.Errorf("status = %q, want unpack ok, ok for a and ng for b", got)
+	}
+	if r.RefExists("refs/heads/a") || !r.RefExists("refs/heads/b") {
+		t.Error("only refs/heads/a should have been deleted")
+	}
+
+	// A corrupt pack updates nothing.
+	pack := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00"), make([]byte, r.Format().Size())...)
+	got = pushStatus(t, rp, pushRequest(t, pack, zero+" "+head+" refs/heads/c"))
+	want := []string{"unpack pack checksum mismatch", "ng refs/heads/c unpacker error"}
+	if !slices.Equal(got, want) {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+	if r.RefExists("refs/heads/c") {
+		t.Error("refs/heads/c was created from a corrupt pack")
+	}
+}
+
+func TestReceivePackDuringPrune(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+	zero := r.Format().ZeroID()
+	rp := NewReceivePack(r)
+
+	// Prune over and over while the pushes run.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := r.Prune(nil); err != nil {
+				t.Errorf("Prune: %v", err)
+				return
+			}
+		}
+	}()
+
+	const pushes = 20
+	for i := range pushes {
+		blob := object.NewBlob([]byte(fmt.Sprintf("pushed %d\n", i)))
+		tree := object.NewTree()
+		tree.AddEntry(object.ModeFile, "pushed.txt", object.Hash(blob))
+		commit := object.NewCommit(object.Hash(tree), head, "P <p@example.com>", "P <p@example.com>", "push\n")
+		pw := packfile.NewWriter()
+		for _, obj := range []object.Object{commit, tree, blob} {
+			typ := map[object.Type]int{object.TypeCommit: packfile.OBJ_COMMIT, object.TypeTree: packfile.OBJ_TREE, object.TypeBlob: packfile.OBJ_BLOB}[obj.Type()]
+			if err := pw.AddObject(typ, obj.Serialize()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ref := fmt.Sprintf("refs/heads/push-%d", i)
+		got := pushStatus(t, rp, pushRequest(t, pw.Finalize(), zero+" "+object.Hash(commit)+" "+ref))
+		if want := []string{"unpack ok", "ok " + ref}; !slices.Equal(got, want) {
+			t.Errorf("status = %q, want %q", got, want)
+		}
+		for _, obj := range []object.Object{commit, tree, blob} {
+			if _, err := r.ReadObject(object.Hash(obj)); err != nil {
+				t.Errorf("push %d: %s was pruned: %v", i, obj.Type(), err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,241 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+)
+
+// FetchRequest is a parsed git-upload-pack request.
+type FetchRequest struct {
+	// Wants are the objects the client asked for, in request order.
+	Wants []string
+	// Capabilities are the capabilities sent on the first want line.
+	Capabilities []string
+	// Shallows are the commits the client's shallow clone ends at.
+	Shallows []string
+	// Deepen is the requested history depth, or zero for full history.
+	Deepen int
+	// DeepenSince, if set, leaves out commits older than it.
+	DeepenSince time.Time
+	// DeepenNot are refs whose history is left out.
+	DeepenNot []string
+	// Filter is the requested object filter spec, if any.
+	Filter string
+	// Haves are the objects the client already has, in request order.
+	Haves []string
+	// Done reports whether the client ended negotiation with "done" and
+	// expects a pack. Without it the request is one stateless
+	// negotiation round.
+	Done bool
+	// Rounds is the number of batches of haves, counting the one that
+	// ends in done.
+	Rounds int
+	// HaveRounds is the number of haves in each batch, in order.
+	HaveRounds []int
+	// WantsOnly reports whether the body ended right after the wants, as
+	// a stateless client's first request does when it deepens a shallow
+	// history: it only asks for the shallow section.
+	WantsOnly bool
+}
+
+// requestError is a malformed or over-limit request, which is reported
+// to the client with an ERR line.
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func newRequestError(format string, args ...any) *requestError {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// readError wraps an error reading part of a request. Going over the
+// reader's limits is the client's fault, so it becomes a requestError.
+func readError(what string, err error) error {
+	if errors.Is(err, pktline.ErrLimit) {
+		return newRequestError("request too large: %v", err)
+	}
+	return fmt.Errorf("reading %s: %w", what, err)
+}
+
+// ParseFetchRequest reads a git-upload-pack request: the want section up
+// to its flush, then batches of haves until "done" or the end of the
+// request. An ERR line from the client is returned as a
+// *ClientAbortError.
+//
+// Over smart HTTP the whole request arrives in one body, so how it ends
+// matters. A body that only ends the want section, with no wants, asks
+// for nothing. Otherwise the body must end with done, or with the flush
+// after a batch of haves for a negotiation round. A body that stops
+// anywhere else was cut short and is an error rather than being served
+// as whatever part of it arrived.
+func ParseFetchRequest(r *pktline.Reader) (*FetchRequest, error) {
+	return parseFetchRequest(r, object.SHA1, 0, 0)
+}
+
+// parseFetchRequest is ParseFetchRequest for a repository whose objects
+// are named in format, failing once the client sends more than maxRounds
+// batches or maxHaves haves. Zero means no limit.
+func parseFetchRequest(r *pktline.Reader, format object.Format, maxRounds, maxHaves int) (*FetchRequest, error) {
+	req := &FetchRequest{}
+
+	for {
+		line, err := r.ReadString()
+		if err == io.EOF {
+			if !r.Flushed() {
+				return nil, newRequestError("request ended before the flush after the wants")
+			}
+			break
+		}
+		if err != nil {
+			return nil, readError("wants", err)
+		}
+
+		if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+			return nil, &ClientAbortError{Message: msg}
+		}
+
+		if _, err := req.parseWantLine(line, format); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(req.Wants) == 0 {
+		// Nothing wanted, so no negotiation follows.
+		if _, err := r.ReadString(); err != io.EOF || r.Flushed() {
+			return nil, newRequestError("request has no wants but continues after them")
+		}
+		return req, nil
+	}
+
+	// The client may send "done" immediately (for clone), or batches of
+	// haves each ended by a flush, then more haves or done. A request
+	// that ends without done is one round of stateless negotiation.
+	for !req.Done {
+		lines, start := 0, len(req.Haves)
+		for {
+			line, err := r.ReadString()
+			if err == io.EOF {
+				if lines > 0 && !r.Flushed() {
+					return nil, newRequestError("request ended in a batch of haves without a flush or done")
+				}
+				req.WantsOnly = req.Rounds == 0 && lines == 0 && !r.Flushed()
+				// Flush packet - end of this batch
+				break
+			}
+			if err != nil {
+				return nil, readError("negotiation", err)
+			}
+			lines++
+
+			if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+				return nil, &ClientAbortError{Message: msg}
+			}
+
+			if line == "done" {
+				req.Done = true
+				break
+			} else if have, ok := strings.CutPrefix(line, "have "); ok {
+				if err := req.addHave(have, format, maxHaves); err != nil {
+					return nil, err
+				}
+			} else if line != "" {
+				return nil, newRequestError("unexpected line in negotiation: %q", line)
+			}
+		}
+		if lines == 0 {
+			break
+		}
+
+		req.Rounds++
+		req.HaveRounds = append(req.HaveRounds, len(req.Haves)-start)
+		if maxRounds > 0 && req.Rounds > maxRounds {
+			return nil, newRequestError("too many negotiation rounds (limit %d)", maxRounds)
+		}
+	}
+
+	if req.Done {
+		// Read the flush after "done". Nothing else may follow it.
+		line, err := r.ReadString()
+		switch {
+		case err == io.EOF:
+		case err != nil:
+			return nil, readError("after done", err)
+		case strings.HasPrefix(line, "want ") || strings.HasPrefix(line, "have "):
+			return nil, newRequestError("%s after done", line[:4])
+		default:
+			return nil, newRequestError("expected flush after done, got %q", line)
+		}
+	}
+	return req, nil
+}
+
+// addHave records a have line's object id, shared by protocol v0 and v2.
+// Haves name files in the object store, so anything but a valid object id
+// is refused.
+func (req *FetchRequest) addHave(oid string, format object.Format, maxHaves int) error {
+	if !format.ValidHash(oid) {
+		return newRequestError("invalid have %q: not a %s object id", oid, format)
+	}
+	req.Haves = append(req.Haves, oid)
+	if maxHaves > 0 && len(req.Haves) > maxHaves {
+		return newRequestError("too many haves (limit %d)", maxHaves)
+	}
+	return nil
+}
+
+// parseWantLine parses a line of the want section, shared by protocol v0
+// and v2: a want, with capabilities after the first in v0, or a shallow,
+// deepen or filter line. It reports whether it knew the line.
+func (req *FetchRequest) parseWantLine(line string, format object.Format) (bool, error) {
+	switch {
+	case strings.HasPrefix(line, "want "):
+		// First want may have capabilities after space
+		oid, caps, ok := strings.Cut(line[5:], " ")
+		if oid == format.ZeroID() {
+			return true, newRequestError("invalid want %s: the zero object id names no object", oid)
+		}
+		if !format.ValidHash(oid) {
+			return true, newRequestError("invalid want %q: not a %s object id", oid, format)
+		}
+		req.Wants = append(req.Wants, oid)
+		if ok && len(req.Capabilities) == 0 {
+			req.Capabilities = strings.Split(caps, " ")
+		}
+	case strings.HasPrefix(line, "shallow "):
+		oid := line[8:]
+		if !format.ValidHash(oid) {
+			return true, newRequestError("invalid shallow %q: not a %s object id", oid, format)
+		}
+		req.Shallows = append(req.Shallows, oid)
+	case strings.HasPrefix(line, "deepen "):
+		n, err := strconv.Atoi(line[7:])
+		if err != nil || n <= 0 {
+			return true, newRequestError("invalid deepen %q", line[7:])
+		}
+		req.Deepen = n
+	case strings.HasPrefix(line, "deepen-since "):
+		secs, err := strconv.ParseInt(line[13:], 10, 64)
+		if err != nil {
+			return true, newRequestError("invalid deepen-since %q", line[13:])
+		}
+		req.DeepenSince = time.Unix(secs, 0)
+	case strings.HasPrefix(line, "deepen-not "):
+		req.DeepenNot = append(req.DeepenNot, line[11:])
+	case strings.HasPrefix(line, "filter "):
+		req.Filter = line[7:]
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+)
+
+// pktRequest encodes lines as pkt-lines, with "" standing for a flush.
+func pktRequest(lines ...string) *pktline.Reader {
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	for _, line := range lines {
+		if line == "" {
+			pw.Flush()
+		} else {
+			pw.WriteString(line + "\n")
+		}
+	}
+	return pktline.NewReader(&buf)
+}
+
+func TestParseFetchRequest(t *testing.T) {
+	a := strings.Repeat("a", 40)
+	b := strings.Repeat("b", 40)
+	c := strings.Repeat("c", 40)
+
+	req, err := ParseFetchRequest(pktRequest(
+		"want "+a+" side-band-64k ofs-delta",
+		"want "+b,
+		"shallow "+c,
+		"deepen 3",
+		"filter blob:none",
+		"",
+		"have "+c,
+		"",
+		"have "+b,
+		"done",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{a, b}; !slices.Equal(req.Wants, want) {
+		t.Errorf("Wants = %v, want %v", req.Wants, want)
+	}
+	if want := []string{"side-band-64k", "ofs-delta"}; !slices.Equal(req.Capabilities, want) {
+		t.Errorf("Capabilities = %v, want %v", req.Capabilities, want)
+	}
+	if want := []string{c}; !slices.Equal(req.Shallows, want) {
+		t.Errorf("Shallows = %v, want %v", req.Shallows, want)
+	}
+	if req.Deepen != 3 {
+		t.Errorf("Deepen = %d, want 3", req.Deepen)
+	}
+	if req.Filter != "blob:none" {
+		t.Errorf("Filter = %q, want blob:none", req.Filter)
+	}
+	if want := []string{c, b}; !slices.Equal(req.Haves, want) {
+		t.Errorf("Haves = %v, want %v", req.Haves, want)
+	}
+	if !req.Done {
+		t.Error("Done = false, want true")
+	}
+	if req.Rounds != 2 {
+		t.Errorf("Rounds = %d, want 2", req.Rounds)
+	}
+}
+
+func TestParseFetchRequestWithoutDone(t *testing.T) {
+	a := strings.Repeat("a", 40)
+
+	req, err := ParseFetchRequest(pktRequest("want "+a, "", "have "+a, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Done {
+		t.Error("Done = true, want false")
+	}
+	if req.Rounds != 1 || len(req.Haves) != 1 {
+		t.Errorf("Rounds = %d, Haves = %v; want one round with one have", req.Rounds, req.Haves)
+	}
+	if req.Capabilities != nil {
+		t.Errorf("Capabilities = %v, want none", req.Capabilities)
+	}
+}
+
+func TestParseStatelessRequestTermination(t *testing.T) {
+	a := strings.Repeat("a", 40)
+
+	// Well-formed stateless bodies.
+	for _, tc := range []struct {
+		name  string
+		r     *pktline.Reader
+		wants int
+		done  bool
+	}{
+		{"clone ending in done", pktRequest("want "+a, "", "done"), 1, true},
+		{"fetch ending in done", pktRequest("want "+a, "", "have "+a, "done"), 1, true},
+		{"done then flush", pktRequest("want "+a, "", "done", ""), 1, true},
+		{"negotiation round", pktRequest("want "+a, "", "have "+a, ""), 1, false},
+		{"no wants", pktRequest(""), 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := ParseFetchRequest(tc.r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(req.Wants) != tc.wants || req.Done != tc.done {
+				t.Errorf("wants = %d, done = %t; want %d, %t", len(req.Wants), req.Done, tc.wants, tc.done)
+			}
+		})
+	}
+
+	// Bodies cut short.
+	for _, tc := range []struct {
+		name string
+		r    *pktline.Reader
+		want string
+	}{
+		{"empty", pktRequest(), "before the flush after the wants"},
+		{"wants without flush", pktRequest("want " + a), "before the flush after the wants"},
+		{"haves without terminator", pktRequest("want "+a, "", "have "+a), "without a flush or done"},
+		{"no wants then more", pktRequest("", "have "+a, "done"), "no wants but continues"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseFetchRequest(tc.r)
+			var rerr *requestError
+			if !errors.As(err, &rerr) || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want request error %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFetchRequestErrors(t *testing.T) {
+	a := strings.Repeat("a", 40)
+
+	for _, tc := range []struct {
+		name      string
+		r         *pktline.Reader
+		maxRounds int
+		maxHaves  int
+		want      string
+	}{
+		{"bad deepen", pktRequest("want "+a, "deepen x", ""), 0, 0, "invalid deepen"},
+		{"unexpected line", pktRequest("want "+a, "", "want "+a, "done"), 0, 0, "unexpected line"},
+		{"too many rounds", pktRequest("want "+a, "", "have "+a, "", "have "+a, "", "done"), 2, 0, "too many negotiation rounds"},
+		{"want after done", pktRequest("want "+a, "", "done", "want "+a, ""), 0, 0, "want after done"},
+		{"have after done", pktRequest("want "+a, "", "have "+a, "done", "have "+a), 0, 0, "have after done"},
+		{"too many haves", pktRequest("want "+a, "", "have "+a, "have "+a, "done"), 0, 1, "too many haves"},
+		{"short have", pktRequest("want "+a, "", "have a", "done"), 0, 0, "invalid have"},
+		{"traversal have", pktRequest("want "+a, "", "have ../../../../../../etc/passwd", "done"), 0, 0, "invalid have"},
+		{"short shallow", pktRequest("want "+a, "shallow a", "", "done"), 0, 0, "invalid shallow"},
+		{"traversal shallow", pktRequest("want "+a, "shallow ../../../../etc/passwd", "", "done"), 0, 0, "invalid shallow"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseFetchRequest(tc.r, object.SHA1, tc.maxRounds, tc.maxHaves)
+			var rerr *requestError
+			if !errors.As(err, &rerr) || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want request error %q", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("client abort", func(t *testing.T) {
+		_, err := ParseFetchRequest(pktRequest("want "+a, "", "ERR bye"))
+		var abort *ClientAbortError
+		if !errors.As(err, &abort) || abort.Message != "bye" {
+			t.Fatalf("error = %v, want client abort", err)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/pktline"
+)
+
+// FetchResponse writes a git-upload-pack response in the shape the
+// client's capabilities call for: the shallow section, ACK or NAK lines,
+// then the packfile, on side-band channels if the client asked for them.
+type FetchResponse struct {
+	w        io.Writer
+	pw       *pktline.Writer
+	sideBand bool
+	progress bool // whether the client accepts the progress channel
+	maxData  int
+	pack     *bufio.Writer
+
+	// mu serializes writes to the pack and progress channels once
+	// keep-alives run alongside the pack; sent counts pack writes.
+	mu   sync.Mutex
+	sent int64
+}
+
+// NewFetchResponse creates a response to a client that sent capabilities.
+func NewFetchResponse(w io.Writer, capabilities []string) *FetchResponse {
+	r := &FetchResponse{w: w, pw: pktline.NewWriter(w)}
+	switch {
+	case slices.Contains(capabilities, "side-band-64k"):
+		r.sideBand, r.maxData = true, maxSidebandData
+	case slices.Contains(capabilities, "side-band"):
+		r.sideBand, r.maxData = true, maxSmallSidebandData
+	}
+	r.progress = r.sideBand && !slices.Contains(capabilities, "no-progress")
+	return r
+}
+
+// SideBand reports whether the packfile is sent on side-band channels.
+func (r *FetchResponse) SideBand() bool {
+	return r.sideBand
+}
+
+// Shallow tells the client that commit oid is now a shallow boundary.
+func (r *FetchResponse) Shallow(oid string) error {
+	return r.pw.WriteString("shallow " + oid + "\n")
+}
+
+// Unshallow tells the client that commit oid is no longer a shallow
+// boundary. End the shallow section with Flush.
+func (r *FetchResponse) Unshallow(oid string) error {
+	return r.pw.WriteString("unshallow " + oid + "\n")
+}
+
+// ACK acknowledges a common object. Status is empty for a final ACK or
+// one of "continue", "common" and "ready" with multi_ack.
+func (r *FetchResponse) ACK(oid, status string) error {
+	if status != "" {
+		return r.pw.WriteString("ACK " + oid + " " + status + "\n")
+	}
+	return r.pw.WriteString("ACK " + oid + "\n")
+}
+
+// NAK tells the client no common objects were found.
+func (r *FetchResponse) NAK() error {
+	return r.pw.WriteString("NAK\n")
+}
+
+// Flush writes a flush-pkt, ending a section or a negotiation round.
+func (r *FetchResponse) Flush() error {
+	return r.pw.Flush()
+}
+
+// Err sends err to the client as an ERR line, which git shows as a
+// remote error, and returns it. It is only understood before the pack.
+func (r *FetchResponse) Err(err error) error {
+	return writeErr(r.pw, err)
+}
+
+// PackWriter returns the writer the packfile goes to. Writes are
+// buffered into large pkt-lines; call ClosePack or AbortPack when done.
+func (r *FetchResponse) PackWriter() io.Writer {
+	return r.packBuffer()
+}
+
+func (r *FetchResponse) packBuffer() *bufio.Writer {
+	if r.pack == nil {
+		if r.sideBand {
+			r.pack = bufio.NewWriterSize(&packChannel{r: r, sw: &sidebandWriter{w: r.pw, band: bandData, max: r.maxData}}, r.maxData)
+		} else {
+			r.pack = bufio.NewWriterSize(r.w, maxSidebandData)
+		}
+	}
+	return r.pack
+}
+
+// packChannel sends pack data on the data channel, taking turns with
+// keep-alives.
+type packChannel struct {
+	r  *FetchResponse
+	sw *sidebandWriter
+}
+
+func (c *packChannel) Write(p []byte) (int, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.r.sent++
+	return c.sw.Write(p)
+}
+
+// writeProgress sends msg on the progress channel, unless the client
+// cannot take it: without side-band there is no such channel, and with
+// no-progress the client asked for none. Every progress write goes
+// through here. The caller holds r.mu.
+func (r *FetchResponse) writeProgress(msg []byte) error {
+	if !r.progress {
+		return nil
+	}
+	if err := r.pw.Write(append([]byte{bandProgress}, msg...)); err != nil {
+		return fmt.Errorf("writing progress: %w", err)
+	}
+	// Keep-alives are useless sitting in a buffer.
+	if f, ok := r.w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// KeepAlive sends an empty progress packet whenever interval passes
+// without pack data being sent, so proxies and clients do not time out
+// while slow objects are read, until the returned stop is called; stop
+// may be called more than once. It sends nothing if interval is not
+// positive or the client negotiated no-progress.
+func (r *FetchResponse) KeepAlive(interval time.Duration) (stop func()) {
+	if interval <= 0 || !r.progress {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		var last int64
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			r.mu.Lock()
+			if r.sent == last {
+				// A failed write will fail the pack too.
+				r.writeProgress(nil)
+			}
+			last = r.sent
+			r.mu.Unlock()
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// ClosePack writes out the rest of the packfile and ends the response.
+func (r *FetchResponse) ClosePack() error {
+	if err := r.packBuffer().Flush(); err != nil {
+		return fmt.Errorf("writing packfile: %w", err)
+	}
+	if r.sideBand {
+		// Send flush packet to indicate end
+		return r.pw.Flush()
+	}
+	return nil
+}
+
+// AbortPack reports err on the error channel after a partial pack. The
+// transfer has begun, so without side-band the client can only notice
+// the truncated pack.
+func (r *FetchResponse) AbortPack(err error) error {
+	if !r.sideBand {
+		return nil
+	}
+	r.packBuffer().Flush()
+	if werr := sendSidebandError(r.pw, err); werr != nil {
+		return fmt.Errorf("writing sideband error: %w", werr)
+	}
+	return nil
+}
+
+// Progress shows msg to the user on the progress channel, which git
+// prints prefixed with "remote: ". A message ending in "\r" is replaced
+// by the next one. Like keep-alives, it is dropped unless the client
+// accepts the progress channel.
+func (r *FetchResponse) Progress(msg string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeProgress([]byte(msg))
+}
+
+// progressMeter shows how far a phase such as writing objects has got,
+// in git's format, updating as the percentage changes.
+type progressMeter struct {
+	r       *FetchResponse
+	title   string
+	total   int
+	percent int
+}
+
+func newProgressMeter(r *FetchResponse, title string, total int) *progressMeter {
+	return &progressMeter{r: r, title: title, total: total, percent: -1}
+}
+
+// update reports that n of the total are done.
+func (m *progressMeter) update(n int) error {
+	percent := 100
+	if m.total > 0 {
+		percent = n * 100 / m.total
+	}
+	if percent == m.percent {
+		return nil
+	}
+	m.percent = percent
+	return m.r.Progress(fmt.Sprintf("%s: %3d%% (%d/%d)\r", m.title, percent, n, m.total))
+}
+
+// done ends the phase's line.
+func (m *progressMeter) done() error {
+	return m.r.Progress(fmt.Sprintf("%s: 100%% (%d/%d), done.\n", m.title, m.total, m.total))
+}
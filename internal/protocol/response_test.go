@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFetchResponse(t *testing.T) {
+	a := strings.Repeat("a", 40)
+	b := strings.Repeat("b", 40)
+
+	for _, tc := range []struct {
+		name  string
+		caps  []string
+		write func(*FetchResponse) error
+		want  string
+	}{{
+		name: "negotiation round",
+		write: func(r *FetchResponse) error {
+			if err := r.NAK(); err != nil {
+				return err
+			}
+			return r.Flush()
+		},
+		want: "0008NAK\n0000",
+	}, {
+		name: "shallow and acks",
+		write: func(r *FetchResponse) error {
+			for _, err := range []error{
+				r.Shallow(a),
+				r.Unshallow(b),
+				r.Flush(),
+				r.ACK(a, "common"),
+				r.ACK(a, ""),
+			} {
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		want: "0035shallow " + a + "\n0037unshallow " + b + "\n0000" +
+			"0038ACK " + a + " common\n0031ACK " + a + "\n",
+	}, {
+		name: "error",
+		write: func(r *FetchResponse) error {
+			if err := r.Err(errors.New("boom")); err.Error() != "boom" {
+				return err
+			}
+			return nil
+		},
+		want: "000dERR boom\n",
+	}, {
+		name: "pack without side-band",
+		write: func(r *FetchResponse) error {
+			r.NAK()
+			io.WriteString(r.PackWriter(), "PACK")
+			return r.ClosePack()
+		},
+		want: "0008NAK\nPACK",
+	}, {
+		name: "pack with side-band-64k",
+		caps: []string{"ofs-delta", "side-band-64k"},
+		write: func(r *FetchResponse) error {
+			r.NAK()
+			io.WriteString(r.PackWriter(), "PACK")
+			return r.ClosePack()
+		},
+		want: "0008NAK\n0009\x01PACK0000",
+	}, {
+		name: "aborted pack",
+		caps: []string{"side-band-64k"},
+		write: func(r *FetchResponse) error {
+			io.WriteString(r.PackWriter(), "PA")
+			return r.AbortPack(errors.New("boom"))
+		},
+		want: "0007\x01PA0011\x03fatal: boom\n0000",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := tc.write(NewFetchResponse(&out, tc.caps)); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tc.want {
+				t.Errorf("response = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFetchResponseSmallSideBand checks that clients without
+// side-band-64k never get a pkt-line over 1000 bytes.
+func TestFetchResponseSmallSideBand(t *testing.T) {
+	var out bytes.Buffer
+	r := NewFetchResponse(&out, []string{"side-band"})
+	if _, err := r.PackWriter().Write(bytes.Repeat([]byte("x"), 2500)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ClosePack(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "03e8\x01" + strings.Repeat("x", 995) +
+		"03e8\x01" + strings.Repeat("x", 995) +
+		"0203\x01" + strings.Repeat("x", 510) + "0000"
+	if got := out.String(); got != want {
+		t.Errorf("got %d bytes starting %q, want %d bytes", len(got), got[:min(len(got), 8)], len(want))
+	}
+}
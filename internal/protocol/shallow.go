@@ -0,0 +1,249 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// shallowInfo is where the history sent to a shallow client ends.
+type shallowInfo struct {
+	// shallow are the commits the client's history now ends at, and
+	// unshallow the client's shallow commits it no longer ends at, for
+	// the shallow section of the response.
+	shallow, unshallow []string
+	// boundary holds the commits whose parents are left out of the pack.
+	boundary map[string]bool
+	// roots are commits the walk must start from besides the wants: the
+	// parents of unshallowed commits, which the client has but whose
+	// history it lacks.
+	roots []string
+	// update is set if the client deepened, so the response starts with
+	// the shallow section.
+	update bool
+}
+
+// shallow works out the shallow boundary of a request, as git does:
+// with deepen, commits more than that many commits from a want are left
+// out; with deepen-since, commits older than the cutoff; and with
+// deepen-not, commits reachable from the named refs. It returns nil if
+// the request is for full history from a complete clone.
+func (u *UploadPack) shallow(req *FetchRequest) (*shallowInfo, error) {
+	since, not := !req.DeepenSince.IsZero(), len(req.DeepenNot) > 0
+	sh := &shallowInfo{boundary: make(map[string]bool)}
+	for _, c := range req.Shallows {
+		sh.boundary[c] = true
+	}
+	if req.Deepen == 0 && !since && !not {
+		if len(req.Shallows) == 0 {
+			return nil, nil
+		}
+		// The client's history keeps ending where it does.
+		return sh, nil
+	}
+	if req.Deepen > 0 && (since || not) {
+		return nil, newRequestError("deepen cannot be combined with deepen-since or deepen-not")
+	}
+	sh.update = true
+
+	var excluded map[string]bool
+	if not {
+		var tips []string
+		for _, name := range req.DeepenNot {
+			hash, err := u.resolveDeepenNot(name)
+			if err != nil {
+				return nil, err
+			}
+			tips = append(tips, hash)
+		}
+		var err error
+		if excluded, err = u.ancestors(tips); err != nil {
+			return nil, err
+		}
+	}
+	// keep reports whether a commit is within the requested history.
+	keep := func(hash string, c *object.Commit) bool {
+		return !excluded[hash] && (!since || !c.CommitDate.Before(req.DeepenSince))
+	}
+
+	// Walk breadth first, so each commit is first reached at its
+	// smallest depth.
+	type queued struct {
+		hash  string
+		depth int
+	}
+	var queue []queued
+	reached := make(map[string]bool)
+	for _, want := range req.Wants {
+		hash, err := u.peelToCommit(want)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" && !reached[hash] {
+			reached[hash] = true
+			queue = append(queue, queued{hash, 1})
+		}
+	}
+	for len(queue) > 0 {
+		q := queue[0]
+		queue = queue[1:]
+		c, err := u.readCommit(q.hash)
+		if err != nil {
+			return nil, err
+		}
+		if q.depth == 1 && !keep(q.hash, c) {
+			return nil, newRequestError("deepen-since or deepen-not leaves out all of %s", q.hash)
+		}
+		if req.Deepen > 0 && q.depth == req.Deepen {
+			if len(c.Parents) > 0 {
+				sh.boundary[q.hash] = true
+			}
+			continue
+		}
+		delete(sh.boundary, q.hash)
+		for _, p := range c.Parents {
+			if req.Deepen == 0 {
+				pc, err := u.readCommit(p)
+				if err != nil {
+					return nil, err
+				}
+				if !keep(p, pc) {
+					sh.boundary[q.hash] = true
+					continue
+				}
+			}
+			if !reached[p] {
+				reached[p] = true
+				queue = append(queue, queued{p, q.depth + 1})
+			}
+		}
+	}
+
+	for hash := range sh.boundary {
+		if reached[hash] && !slices.Contains(req.Shallows, hash) {
+			sh.shallow = append(sh.shallow, hash)
+		}
+	}
+	for _, hash := range req.Shallows {
+		if reached[hash] && !sh.boundary[hash] {
+			sh.unshallow = append(sh.unshallow, hash)
+			c, err := u.readCommit(hash)
+			if err != nil {
+				return nil, err
+			}
+			sh.roots = append(sh.roots, c.Parents...)
+		}
+	}
+	slices.Sort(sh.shallow)
+	return sh, nil
+}
+
+// write sends the lines of the shallow section: the new boundary
+// commits, then the client's boundary commits that no longer are. The
+// caller ends the section.
+func (sh *shallowInfo) write(resp *FetchResponse) error {
+	for _, hash := range sh.shallow {
+		if err := resp.Shallow(hash); err != nil {
+			return fmt.Errorf("writing shallow: %w", err)
+		}
+	}
+	for _, hash := range sh.unshallow {
+		if err := resp.Unshallow(hash); err != nil {
+			return fmt.Errorf("writing unshallow: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveDeepenNot resolves a deepen-not argument, a full or short ref
+// name, to the commit it points at.
+func (u *UploadPack) resolveDeepenNot(name string) (string, error) {
+	refs, err := u.repo.GetRefs()
+	if err != nil {
+		return "", err
+	}
+	for _, full := range []string{name, "refs/tags/" + name, "refs/heads/" + name} {
+		if hash, ok := refs[full]; ok {
+			return u.peelToCommit(hash)
+		}
+	}
+	return "", newRequestError("deepen-not %s is not a ref", name)
+}
+
+// ancestors returns the commits reachable from tips.
+func (u *UploadPack) ancestors(tips []string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	stack := slices.Clone(tips)
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hash == "" || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		c, err := u.readCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, c.Parents...)
+	}
+	return seen, nil
+}
+
+// peelToCommit follows annotated tags from hash to the commit they tag.
+// It returns "" if hash names a tree or blob, which has no history.
+func (u *UploadPack) peelToCommit(hash string) (string, error) {
+	hash, typ, err := u.peel(hash)
+	if err != nil || typ != object.TypeCommit {
+		return "", err
+	}
+	return hash, nil
+}
+
+// peel follows annotated tags from hash to the object they tag, and
+// returns it with its type.
+func (u *UploadPack) peel(hash string) (string, object.Type, error) {
+	for {
+		typ, _, rc, err := u.readStream(hash)
+		if err != nil {
+			return "", "", fmt.Errorf("reading %s: %w", hash, err)
+		}
+		if typ != object.TypeTag {
+			rc.Close()
+			return hash, typ, nil
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", "", fmt.Errorf("reading tag %s: %w", hash, err)
+		}
+		n := u.repo.Format().HexLen()
+		if len(data) < len("object ")+n {
+			return "", "", fmt.Errorf("tag %s has no object", hash)
+		}
+		hash = string(data[len("object ") : len("object ")+n])
+	}
+}
+
+// readCommit reads and parses a commit.
+func (u *UploadPack) readCommit(hash string) (*object.Commit, error) {
+	typ, _, rc, err := u.readStream(hash)
+	if err != nil {
+		return nil, fmt.Errorf("reading commit %s: %w", hash, err)
+	}
+	defer rc.Close()
+	if typ != object.TypeCommit {
+		return nil, fmt.Errorf("%s is a %s, not a commit", hash, typ)
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("reading commit %s: %w", hash, err)
+	}
+	c, err := object.ParseCommit(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing commit %s: %w", hash, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/imjasonh/infinite-git/internal/pktline"
+)
+
+// Side-band channels.
+const (
+	bandData     = 1 // pack data
+	bandProgress = 2 // progress messages for the user
+	bandError    = 3 // fatal error message, aborts the fetch
+)
+
+// maxSidebandData is the largest payload per side-band pkt-line: the max
+// pkt-line data size minus the band byte.
+const maxSidebandData = 65515
+
+// maxSmallSidebandData is the payload limit for clients that only
+// support side-band, whose pkt-lines are at most 1000 bytes.
+const maxSmallSidebandData = 995
+
+// sidebandWriter is an io.Writer that sends everything written to it on
+// one side-band channel, split into pkt-lines of at most max bytes of
+// payload, or maxSidebandData if max is zero.
+type sidebandWriter struct {
+	w    *pktline.Writer
+	band byte
+	max  int
+}
+
+func (s *sidebandWriter) Write(p []byte) (int, error) {
+	limit := s.max
+	if limit == 0 {
+		limit = maxSidebandData
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), limit)
+		chunk := make([]byte, 0, n+1)
+		chunk = append(chunk, s.band)
+		chunk = append(chunk, p[:n]...)
+		if err := s.w.Write(chunk); err != nil {
+			return written, fmt.Errorf("writing sideband chunk: %w", err)
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// sendSidebandError reports a fatal error on the error channel, which git
+// shows to the user as "remote: fatal: ..." before aborting the fetch.
+func sendSidebandError(w *pktline.Writer, err error) error {
+	sb := &sidebandWriter{w: w, band: bandError}
+	if _, werr := fmt.Fprintf(sb, "fatal: %v\n", err); werr != nil {
+		return werr
+	}
+	return w.Flush()
+}
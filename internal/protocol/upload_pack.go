@@ -2,9 +2,16 @@ package protocol
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/imjasonh/infinite-git/internal/object"
 	"github.com/imjasonh/infinite-git/internal/packfile"
@@ -14,302 +21,1099 @@ import (
 
 // UploadPack implements the git-upload-pack protocol.
 type UploadPack struct {
-	repo *repo.Repository
+	repo          *repo.Repository
+	cache         *PackCache
+	maxObjectSize int64
+	zlibWorkers   int
+	readAhead     int
+	packOrder     PackOrder
+	filter        bool
+	typeFilter    bool
+	maxRounds     int
+	maxHaves      int
+	maxLines      int
+	maxBytes      int64
+	keepAlive     time.Duration
+	advertised    func() ([]string, error)
+	onRequest     func(*FetchRequest)
+	ctx           context.Context
+
+	// readStream opens objects for reading; tests replace it to inject
+	// failures.
+	readStream func(hash string) (object.Type, int64, io.ReadCloser, error)
+}
+
+// Option configures an UploadPack.
+type Option func(*UploadPack)
+
+// WithPackCache serves full clones from c, populating it on a miss.
+func WithPackCache(c *PackCache) Option {
+	return func(u *UploadPack) {
+		u.cache = c
+	}
+}
+
+// WithMaxObjectSize refuses to pack any object larger than n bytes,
+// failing the fetch instead. Zero means no limit.
+func WithMaxObjectSize(n int64) Option {
+	return func(u *UploadPack) {
+		u.maxObjectSize = n
+	}
+}
+
+// WithZlibWorkers zlib-compresses pack entries on n goroutines. That is
+// all they do: objects are never deltified, serially or not. Entries are
+// still written in the same order, so packs are byte-identical to those
+// built serially. Values below 2 compress on the writing goroutine.
+func WithZlibWorkers(n int) Option {
+	return func(u *UploadPack) {
+		u.zlibWorkers = n
+	}
+}
+
+// WithReadAhead reads up to n of the objects the walk will visit next
+// concurrently with the current one, and opens up to n blobs ahead of the
+// one being compressed, hiding the latency of slow storage such as a
+// network file system. The walk order, and so the pack, is unchanged.
+// Values below 1 read one object at a time.
+func WithReadAhead(n int) Option {
+	return func(u *UploadPack) {
+		u.readAhead = n
+	}
+}
+
+// PackOrder is the order objects are written to a packfile in.
+type PackOrder string
+
+const (
+	// PackOrderHash sorts objects by hash.
+	PackOrderHash PackOrder = "hash"
+	// PackOrderRecency writes commits, then tags, trees and blobs, each
+	// newest first, as git does. Objects that are delta candidates for
+	// each other end up near each other, which helps clients resolve
+	// and compress them.
+	PackOrderRecency PackOrder = "recency"
+)
+
+// ParsePackOrder parses a pack order name. The empty string is
+// PackOrderHash.
+func ParsePackOrder(s string) (PackOrder, error) {
+	switch o := PackOrder(s); o {
+	case "":
+		return PackOrderHash, nil
+	case PackOrderHash, PackOrderRecency:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown pack order %q (want %q or %q)", s, PackOrderHash, PackOrderRecency)
+}
+
+// WithPackOrder writes pack objects in order o. Either order is
+// deterministic, so the same wants always produce byte-identical packs.
+// The default is PackOrderHash.
+func WithPackOrder(o PackOrder) Option {
+	return func(u *UploadPack) {
+		u.packOrder = o
+	}
+}
+
+// WithFilter advertises the filter capability, so clients can make
+// partial clones with blob:none or blob:limit=<n> and fetch the blobs
+// left out later by wanting them.
+func WithFilter(enabled bool) Option {
+	return func(u *UploadPack) {
+		u.filter = enabled
+	}
+}
+
+// WithObjectTypeFilter also accepts the object:type=<type> filter, which
+// sends only objects of one type, such as commits for clients that
+// analyze history without file contents. It needs WithFilter.
+func WithObjectTypeFilter(enabled bool) Option {
+	return func(u *UploadPack) {
+		u.typeFilter = enabled
+	}
+}
+
+// WithMaxNegotiationRounds aborts a fetch whose client sends more than n
+// batches of haves, bounding the work one request can cause. Zero means
+// no limit.
+func WithMaxNegotiationRounds(n int) Option {
+	return func(u *UploadPack) {
+		u.maxRounds = n
+	}
+}
+
+// WithMaxHaves aborts a fetch whose client sends more than n haves in
+// total. Zero means no limit.
+func WithMaxHaves(n int) Option {
+	return func(u *UploadPack) {
+		u.maxHaves = n
+	}
+}
+
+// WithRequestLimits aborts a fetch whose request holds more than lines
+// pkt-lines, not counting flushes, or more than bytes bytes, however the
+// request reached the server. The lines are read one at a time, so this
+// bounds the memory wants and haves take. Zero means no limit.
+func WithRequestLimits(lines int, bytes int64) Option {
+	return func(u *UploadPack) {
+		u.maxLines = lines
+		u.maxBytes = bytes
+	}
+}
+
+// WithKeepAlive sends an empty progress packet whenever d passes without
+// pack data going out, as git's uploadpack.keepAlive does, so clients
+// and proxies do not give up on a pack held up by slow reads. Clients
+// that negotiated no-progress or lack side-band get none. Zero disables
+// keep-alives.
+func WithKeepAlive(d time.Duration) Option {
+	return func(u *UploadPack) {
+		u.keepAlive = d
+	}
+}
+
+// WithAdvertisedTips only serves wants that are reachable from the
+// commits tips returns, normally the heads of the advertised refs, so
+// clients cannot fetch objects known only to internal refs. Without it,
+// any object in the store can be fetched.
+func WithAdvertisedTips(tips func() ([]string, error)) Option {
+	return func(u *UploadPack) {
+		u.advertised = tips
+	}
+}
+
+// WithOnRequest calls fn with each parsed request, after unadvertised
+// capabilities have been dropped from it, before it is served.
+func WithOnRequest(fn func(*FetchRequest)) Option {
+	return func(u *UploadPack) {
+		u.onRequest = fn
+	}
+}
+
+// WithContext stops a request from waiting for a pack another request
+// is building once ctx ends. It is normally the HTTP request's context.
+func WithContext(ctx context.Context) Option {
+	return func(u *UploadPack) {
+		u.ctx = ctx
+	}
 }
 
 // NewUploadPack creates a new upload-pack handler.
-func NewUploadPack(r *repo.Repository) *UploadPack {
-	return &UploadPack{repo: r}
+func NewUploadPack(r *repo.Repository, opts ...Option) *UploadPack {
+	u := &UploadPack{repo: r, readStream: r.ReadObjectStream, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
+}
+
+// Capabilities returns the capabilities to advertise for this handler.
+func (u *UploadPack) Capabilities() []string {
+	caps := u.repo.GetCapabilities()
+	if u.filter {
+		caps = append(caps, "filter")
+	}
+	return caps
+}
+
+// acceptCapabilities returns the requested capabilities that were
+// advertised, so the response never relies on one the server did not
+// offer. Others are ignored, as git does. Clients may send their own
+// agent.
+func (u *UploadPack) acceptCapabilities(requested []string) []string {
+	advertised := make(map[string]bool)
+	for _, c := range u.Capabilities() {
+		name, _, _ := strings.Cut(c, "=")
+		advertised[name] = true
+	}
+	var accepted []string
+	for _, c := range requested {
+		name, _, _ := strings.Cut(c, "=")
+		if advertised[name] {
+			accepted = append(accepted, c)
+		}
+	}
+	return accepted
+}
+
+// ClientAbortError is returned by HandleRequest when the client aborts
+// the fetch by sending an ERR line.
+type ClientAbortError struct {
+	Message string
 }
 
-// HandleRequest processes a git-upload-pack request.
+func (e *ClientAbortError) Error() string {
+	return "client aborted: " + e.Message
+}
+
+// HandleRequest processes a git-upload-pack request. Objects the client
+// says it has are left out of the pack, so a clone that failed partway can
+// be retried as a fetch with what it received as haves. The pack itself
+// cannot be resumed at a byte offset.
 func (u *UploadPack) HandleRequest(r io.Reader, w io.Writer) error {
-	reader := pktline.NewReader(r)
-	writer := pktline.NewWriter(w)
+	reader := pktline.NewReader(r, pktline.WithMaxLines(u.maxLines), pktline.WithMaxBytes(u.maxBytes))
 
-	// Read want lines first
-	var wants []string
-	var capabilities []string
+	req, err := parseFetchRequest(reader, u.repo.Format(), u.maxRounds, u.maxHaves)
+	if err != nil {
+		var rerr *requestError
+		if errors.As(err, &rerr) {
+			return writeErr(pktline.NewWriter(w), err)
+		}
+		return err
+	}
+	// From here on, only act on capabilities we advertised.
+	req.Capabilities = u.acceptCapabilities(req.Capabilities)
+	if u.onRequest != nil {
+		u.onRequest(req)
+	}
+	resp := NewFetchResponse(w, req.Capabilities)
+	wants := req.Wants
+	if len(wants) == 0 {
+		// A client that wants nothing gets nothing, as from git.
+		return nil
+	}
 
-	for {
-		line, err := reader.ReadString()
-		if err == io.EOF {
-			break // flush-pkt
+	f, err := u.requestFilter(req, resp)
+	if err != nil {
+		return err
+	}
+
+	// The shallow section comes before any ACK or NAK, in every
+	// stateless round.
+	sh, err := u.requestShallow(req, resp)
+	if err != nil {
+		return err
+	}
+	if sh != nil && sh.update {
+		if err := sh.write(resp); err != nil {
+			return err
 		}
-		if err != nil {
-			return fmt.Errorf("reading wants: %w", err)
+		if err := resp.Flush(); err != nil {
+			return fmt.Errorf("flushing shallow section: %w", err)
 		}
+	}
+	if req.WantsOnly {
+		// Negotiation follows in the next request, as from git.
+		return nil
+	}
 
-		if strings.HasPrefix(line, "want ") {
-			wantLine := line[5:]
-			// First want may have capabilities after space
-			parts := strings.SplitN(wantLine, " ", 2)
-			wants = append(wants, parts[0])
+	n, err := u.negotiate(req, resp)
+	if err != nil {
+		return err
+	}
+	if !n.proceed {
+		return nil
+	}
 
-			// Parse capabilities if present
-			if len(parts) > 1 && len(capabilities) == 0 {
-				capabilities = strings.Split(parts[1], " ")
+	return u.sendPack(req, resp, sh, f, func() error {
+		// Answer done with the final ACK, or NAK if nothing was in
+		// common, unless that answer was sent already.
+		switch {
+		case n.answered:
+		case n.final != "":
+			if err := resp.ACK(n.final, ""); err != nil {
+				return fmt.Errorf("writing final ACK: %w", err)
+			}
+		default:
+			if err := resp.NAK(); err != nil {
+				return fmt.Errorf("writing final NAK: %w", err)
 			}
 		}
+		return nil
+	})
+}
+
+// sendPack sends the pack for req once negotiation has finished. The
+// object graph is walked first, so that a failure can still be reported
+// with an ERR line, then announce writes what precedes the pack and the
+// pack follows. sh limits a shallow fetch and f a partial one; either may
+// be nil.
+func (u *UploadPack) sendPack(req *FetchRequest, resp *FetchResponse, sh *shallowInfo, f *objectFilter, announce func() error) error {
+	wants := req.Wants
+	if u.advertised != nil {
+		if err := u.checkWantsAdvertised(wants); err != nil {
+			return resp.Err(err)
+		}
 	}
 
-	// Now handle negotiation phase
-	// The client may send:
-	// 1. "done" immediately (for clone)
-	// 2. "have" lines followed by flush, then we NAK, then more haves or done
+	// Only full clones are cacheable: with haves, a shallow boundary or
+	// a filter the pack would depend on what the client has or asked for.
+	var cacheKey string
+	var cached []byte
+	var release func()
+	if u.cache != nil && len(req.Haves) == 0 && sh == nil && f == nil {
+		cacheKey = packCacheKey(wants)
+		// Wait for a build of the same pack that is under way, such as a
+		// prewarm, instead of building it again.
+		done, ok, err := u.cache.startBuild(u.ctx, cacheKey)
+		if err != nil {
+			return err
+		}
+		if ok {
+			defer done()
+			release = done
+		} else {
+			cached, _ = u.cache.Get(cacheKey)
+		}
+	}
 
-	for {
-		// Read lines until we get a flush or done
-		var haves []string
-		gotDone := false
+	// Walk the object graph before answering so a failure can still be
+	// reported in place of the answer, which git shows as a remote error.
+	var objects []packObject
+	if cached == nil {
+		var err error
+		if objects, err = u.collect(wants, req.Haves, sh, f); err != nil {
+			return fmt.Errorf("collecting objects: %w", resp.Err(err))
+		}
+	}
 
-		for {
-			line, err := reader.ReadString()
-			if err == io.EOF {
-				// Flush packet - end of this batch
-				break
-			}
+	if err := announce(); err != nil {
+		return err
+	}
+
+	stopKeepAlive := resp.KeepAlive(u.keepAlive)
+	defer stopKeepAlive()
+
+	// Progress goes out on its own channel as the pack is written, so
+	// the user sees something while a large pack is built.
+	count := len(objects)
+	if cached != nil {
+		// The object count follows the signature and version.
+		count = int(binary.BigEndian.Uint32(cached[8:12]))
+	}
+	if err := resp.Progress(fmt.Sprintf("Counting objects: %d, done.\n", count)); err != nil {
+		return err
+	}
+	meter := newProgressMeter(resp, "Writing objects", count)
+
+	// abort reports a pack that failed partway on the error channel.
+	abort := func(err error) error {
+		// The transfer has begun, so the only way to tell the client is
+		// the error channel.
+		stopKeepAlive()
+		if werr := resp.AbortPack(err); werr != nil {
+			return werr
+		}
+		return fmt.Errorf("writing packfile: %w", err)
+	}
+
+	if release != nil {
+		// Build the whole pack and cache it before sending any of it, so
+		// that requests waiting for it are not held up by how fast this
+		// client reads. Nothing is sent to the client meanwhile but
+		// keep-alives.
+		var buf bytes.Buffer
+		if err := u.writePack(&buf, objects); err != nil {
+			return abort(err)
+		}
+		cached = buf.Bytes()
+		u.cache.Add(cacheKey, cached)
+		release()
+	}
+
+	out := resp.PackWriter()
+	if cached != nil {
+		if _, err := out.Write(cached); err != nil {
+			return fmt.Errorf("writing cached packfile: %w", err)
+		}
+	} else if err := u.writePackProgress(out, objects, meter.update); err != nil {
+		return abort(err)
+	}
+	if err := meter.done(); err != nil {
+		return err
+	}
+
+	stopKeepAlive()
+	return resp.ClosePack()
+}
+
+// negotiation is what answering the client's haves decided about the
+// rest of the response.
+type negotiation struct {
+	// proceed is set if a pack follows: the client sent done, or
+	// negotiated no-done and the server said it was ready.
+	proceed bool
+	// final is the common object to ACK before the pack, or empty for a
+	// NAK.
+	final string
+	// answered is set if the answer before the pack was already sent.
+	answered bool
+}
+
+// negotiate answers the client's batches of haves the way git does for
+// the multi-ack mode the client chose:
+//
+//   - Without multi_ack, the first have the server also has is
+//     acknowledged as soon as it is seen, and each batch ending before
+//     then gets a NAK.
+//   - With multi_ack, each common have gets "ACK <oid> continue", and
+//     with multi_ack_detailed "ACK <oid> common". Once every want reaches
+//     a common commit the server has enough to build the pack and says
+//     "ready" instead, and every batch ends with a NAK. Done is answered
+//     with an ACK of the last common have.
+//
+// Either way every have is left out of the pack.
+func (u *UploadPack) negotiate(req *FetchRequest, resp *FetchResponse) (negotiation, error) {
+	var multiAck int
+	switch {
+	case slices.Contains(req.Capabilities, "multi_ack_detailed"):
+		multiAck = 2
+	case slices.Contains(req.Capabilities, "multi_ack"):
+		multiAck = 1
+	}
+	noDone := multiAck == 2 && slices.Contains(req.Capabilities, "no-done")
+
+	rounds := req.HaveRounds
+	if !req.Done && len(rounds) == 0 {
+		// A request without done gets a NAK even if it sent no haves,
+		// since the client waits for it.
+		rounds = []int{0}
+	}
+
+	var common []string
+	giveUp := u.newGiveUpWalk(req.Wants)
+	okToGiveUp := giveUp.ok
+
+	var n negotiation
+	sentReady := false
+	haves := req.Haves
+	for i, size := range rounds {
+		batch := haves[:size]
+		haves = haves[size:]
+		gotCommon, gotOther := false, false
+		for _, have := range batch {
+			ok, err := u.hasObject(have)
 			if err != nil {
-				return fmt.Errorf("reading negotiation: %w", err)
+				return n, fmt.Errorf("checking have %s: %w", have, err)
 			}
-
-			if line == "done" {
-				gotDone = true
-				break
-			} else if strings.HasPrefix(line, "have ") {
-				haves = append(haves, line[5:])
-			} else if line != "" {
-				return fmt.Errorf("unexpected line in negotiation: %q", line)
+			var status string
+			if ok {
+				gotCommon = true
+				common = append(common, have)
+				if err := giveUp.addCommon(have); err != nil {
+					return n, err
+				}
+				switch multiAck {
+				case 2:
+					status = "common"
+				case 1:
+					status = "continue"
+				default:
+					if len(common) > 1 {
+						continue
+					}
+					n.answered = true
+				}
+			} else {
+				gotOther = true
+				if multiAck == 0 {
+					continue
+				}
+				ready, err := okToGiveUp()
+				if err != nil {
+					return n, err
+				}
+				if !ready {
+					continue
+				}
+				status = "continue"
+				if multiAck == 2 {
+					status, sentReady = "ready", true
+				}
+			}
+			if err := resp.ACK(have, status); err != nil {
+				return n, fmt.Errorf("writing ACK: %w", err)
 			}
 		}
-
-		// If we got done, we're finished
-		if gotDone {
+		if req.Done && i == len(rounds)-1 {
+			// The batch ending in done is answered before the pack.
+			n.proceed = true
 			break
 		}
 
-		// If we got haves, send NAK and continue
-		if len(haves) > 0 {
-			if err := writer.WriteString("NAK\n"); err != nil {
-				return fmt.Errorf("writing NAK: %w", err)
+		if multiAck == 2 && gotCommon && !gotOther {
+			ready, err := okToGiveUp()
+			if err != nil {
+				return n, err
 			}
-			if err := writer.Flush(); err != nil {
-				return fmt.Errorf("flushing NAK: %w", err)
+			if ready {
+				sentReady = true
+				if err := resp.ACK(common[len(common)-1], "ready"); err != nil {
+					return n, fmt.Errorf("writing ACK: %w", err)
+				}
 			}
-		} else if !gotDone {
-			// Empty flush without haves or done - client expects NAK
-			if err := writer.WriteString("NAK\n"); err != nil {
-				return fmt.Errorf("writing NAK for empty flush: %w", err)
+		}
+		if len(common) == 0 || multiAck > 0 {
+			if err := resp.NAK(); err != nil {
+				return n, fmt.Errorf("writing NAK: %w", err)
 			}
-			if err := writer.Flush(); err != nil {
-				return fmt.Errorf("flushing NAK: %w", err)
+			if err := resp.Flush(); err != nil {
+				return n, fmt.Errorf("flushing NAK: %w", err)
 			}
 		}
+		if noDone && sentReady {
+			// The client will not send done, so the pack follows now.
+			if err := resp.ACK(common[len(common)-1], ""); err != nil {
+				return n, fmt.Errorf("writing final ACK: %w", err)
+			}
+			n.proceed, n.answered = true, true
+			break
+		}
 	}
+	if multiAck > 0 && len(common) > 0 {
+		n.final = common[len(common)-1]
+	}
+	return n, nil
+}
 
-	// Read the flush after "done"
-	if _, err := reader.ReadString(); err != io.EOF {
-		return fmt.Errorf("expected flush after done")
+// giveUpWalk decides, as git's ok_to_give_up does, whether every want
+// reaches a common commit, so the pack can be built without hearing more
+// haves. It lives for one request, caching the commits it reads and the
+// wants known to reach a common commit.
+type giveUpWalk struct {
+	u       *UploadPack
+	wants   []string
+	common  map[string]bool
+	oldest  time.Time
+	commits map[string]*object.Commit
+	covered map[string]bool
+}
+
+func (u *UploadPack) newGiveUpWalk(wants []string) *giveUpWalk {
+	return &giveUpWalk{
+		u:       u,
+		wants:   wants,
+		common:  make(map[string]bool),
+		commits: make(map[string]*object.Commit),
+		covered: make(map[string]bool),
 	}
+}
 
-	// Send final NAK before packfile
-	if err := writer.WriteString("NAK\n"); err != nil {
-		return fmt.Errorf("writing final NAK: %w", err)
+// addCommon records a have the repository holds. Only commits count, and
+// the oldest of them bounds how far back ok walks.
+func (g *giveUpWalk) addCommon(hash string) error {
+	hash, err := g.u.peelToCommit(hash)
+	if err != nil || hash == "" || g.common[hash] {
+		return err
 	}
+	c, err := g.commit(hash)
+	if err != nil {
+		return err
+	}
+	g.common[hash] = true
+	if g.oldest.IsZero() || c.CommitDate.Before(g.oldest) {
+		g.oldest = c.CommitDate
+	}
+	return nil
+}
 
-	// Check if client supports side-band
-	sideBand := false
-	for _, cap := range capabilities {
-		if cap == "side-band" || cap == "side-band-64k" {
-			sideBand = true
-			break
+// commit reads and caches a commit.
+func (g *giveUpWalk) commit(hash string) (*object.Commit, error) {
+	if c, ok := g.commits[hash]; ok {
+		return c, nil
+	}
+	c, err := g.u.readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	g.commits[hash] = c
+	return c, nil
+}
+
+// ok reports whether every want reaches a common commit.
+func (g *giveUpWalk) ok() (bool, error) {
+	if len(g.common) == 0 {
+		return false, nil
+	}
+	for _, want := range g.wants {
+		if g.covered[want] {
+			continue
+		}
+		ok, err := g.reaches(want)
+		if err != nil {
+			return false, fmt.Errorf("checking want %s: %w", want, err)
 		}
+		if !ok {
+			return false, nil
+		}
+		g.covered[want] = true
 	}
+	return true, nil
+}
 
-	// Create and send packfile
-	if sideBand {
-		// With side-band, we need to prefix data with channel number
-		return u.sendPackfileWithSideband(writer, wants)
-	} else {
-		// Without side-band, write packfile directly to underlying writer
-		return u.sendPackfile(w, wants)
+// reaches walks the parents of want for a common commit, not descending
+// past commits older than the oldest common one, which cannot lead to
+// any.
+func (g *giveUpWalk) reaches(want string) (bool, error) {
+	start, err := g.u.peelToCommit(want)
+	if err != nil || start == "" {
+		return false, err
+	}
+	seen := map[string]bool{start: true}
+	stack := []string{start}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if g.common[hash] {
+			return true, nil
+		}
+		c, err := g.commit(hash)
+		if err != nil {
+			return false, err
+		}
+		if c.CommitDate.Before(g.oldest) {
+			continue
+		}
+		for _, p := range c.Parents {
+			if !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
 	}
+	return false, nil
 }
 
-// sendPackfile sends a packfile containing the requested objects.
-func (u *UploadPack) sendPackfile(w io.Writer, wants []string) error {
-	pack, err := u.createPackfile(wants)
+// hasObject reports whether the object store holds hash.
+func (u *UploadPack) hasObject(hash string) (bool, error) {
+	_, _, rc, err := u.readStream(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
 	if err != nil {
-		return fmt.Errorf("creating packfile: %w", err)
+		return false, err
 	}
+	rc.Close()
+	return true, nil
+}
 
-	// Write packfile data directly (not as pkt-line)
-	if _, err := w.Write(pack); err != nil {
-		return fmt.Errorf("writing packfile: %w", err)
+// Prewarm builds the pack for a full clone of wants and adds it to the
+// pack cache, unless it is already there, so the first clone is served
+// from the cache.
+func (u *UploadPack) Prewarm(wants []string) error {
+	if u.cache == nil {
+		return fmt.Errorf("prewarming needs a pack cache")
 	}
-
+	key := packCacheKey(wants)
+	done, ok, err := u.cache.startBuild(u.ctx, key)
+	if !ok {
+		return err
+	}
+	defer done()
+	var buf bytes.Buffer
+	if err := u.WritePack(&buf, wants); err != nil {
+		return err
+	}
+	u.cache.Add(key, buf.Bytes())
 	return nil
 }
 
-// sendPackfileWithSideband sends a packfile with sideband encoding.
-func (u *UploadPack) sendPackfileWithSideband(w *pktline.Writer, wants []string) error {
-	pack, err := u.createPackfile(wants)
+// checkWantsAdvertised fails unless every want is reachable from an
+// advertised tip.
+func (u *UploadPack) checkWantsAdvertised(wants []string) error {
+	tips, err := u.advertised()
 	if err != nil {
-		return fmt.Errorf("creating packfile: %w", err)
+		return fmt.Errorf("listing advertised refs: %w", err)
 	}
-
-	// Send packfile data in chunks with sideband 1 prefix
-	const maxChunkSize = 65515 // Max pkt-line size minus sideband byte
-	for i := 0; i < len(pack); i += maxChunkSize {
-		end := i + maxChunkSize
-		if end > len(pack) {
-			end = len(pack)
+	for _, want := range wants {
+		ok, err := u.repo.IsReachable(want, tips)
+		if err != nil {
+			return fmt.Errorf("checking want %s: %w", want, err)
 		}
-
-		chunk := append([]byte{1}, pack[i:end]...) // 1 = pack data channel
-		if err := w.Write(chunk); err != nil {
-			return fmt.Errorf("writing sideband chunk: %w", err)
+		if !ok {
+			return fmt.Errorf("want %s is not reachable from any advertised ref", want)
 		}
 	}
+	return nil
+}
+
+// writeErr sends err to the client as an ERR line, which git shows as a
+// remote error, and returns it.
+func writeErr(w *pktline.Writer, err error) error {
+	if werr := w.WriteString(fmt.Sprintf("ERR %v\n", err)); werr != nil {
+		return fmt.Errorf("writing ERR: %w", werr)
+	}
+	return err
+}
 
-	// Send flush packet to indicate end
-	return w.Flush()
+// packCacheKey returns the pack cache key for a set of wants.
+func packCacheKey(wants []string) string {
+	sorted := append([]string(nil), wants...)
+	sort.Strings(sorted)
+	// Repeated wants ask for the same objects.
+	return strings.Join(slices.Compact(sorted), ",")
+}
+
+// packObject is an object collected during the reachability walk.
+// Blob content is not held in memory; it is streamed from the object
+// store when the pack is written.
+type packObject struct {
+	hash    string
+	objType int
+	size    int64
+	content []byte
+}
+
+// WritePack writes a packfile of everything reachable from wants to w,
+// without any negotiation.
+func (u *UploadPack) WritePack(w io.Writer, wants []string) error {
+	objects, err := u.collectObjects(wants, nil)
+	if err != nil {
+		return err
+	}
+	return u.writePack(w, objects)
 }
 
 // createPackfile creates a packfile containing the requested objects and their dependencies.
 func (u *UploadPack) createPackfile(wants []string) ([]byte, error) {
-	pw := packfile.NewWriter()
+	objects, err := u.collectObjects(wants, nil)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := u.writePack(&buf, objects); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// collectObjects walks the objects reachable from wants, stopping at
+// haves. The visited set is shared across wants, so history common to
+// several wants, such as the ancestors of two branch tips, is walked and
+// packed once. Objects are returned in the pack order.
+func (u *UploadPack) collectObjects(wants, haves []string) ([]packObject, error) {
+	return u.collect(wants, haves, nil, nil)
+}
+
+// collect is collectObjects for a shallow or partial fetch, leaving out
+// the parents of sh's boundary commits and the objects f filters out,
+// unless they are wanted. A nil sh fetches full history, and a nil f
+// every object.
+func (u *UploadPack) collect(wants, haves []string, sh *shallowInfo, f *objectFilter) ([]packObject, error) {
 	visited := make(map[string]bool)
+	var objects []packObject
+
+	if err := u.excludeHaves(haves, visited); err != nil {
+		return nil, err
+	}
 
 	// Process each wanted object
+	var boundary map[string]bool
+	if sh != nil {
+		boundary = sh.boundary
+		wants = append(slices.Clip(wants), sh.roots...)
+	}
+	p := u.newPrefetcher()
 	for _, want := range wants {
-		if err := u.addObjectToPack(pw, want, visited); err != nil {
+		if err := u.addObjectToPack(&objects, want, visited, boundary, f, wants, p); err != nil {
 			return nil, fmt.Errorf("adding object %s: %w", want, err)
 		}
 	}
 
-	return pw.Finalize(), nil
+	if u.packOrder == PackOrderRecency {
+		// The walk visits each type newest first already.
+		slices.SortStableFunc(objects, func(a, b packObject) int {
+			return packTypeRank(a.objType) - packTypeRank(b.objType)
+		})
+	} else {
+		sort.Slice(objects, func(i, j int) bool {
+			return objects[i].hash < objects[j].hash
+		})
+	}
+	return objects, nil
 }
 
-// addObjectToPack recursively adds an object and its dependencies to the packfile.
-func (u *UploadPack) addObjectToPack(pw *packfile.Writer, hash string, visited map[string]bool) error {
-	if visited[hash] {
-		return nil
-	}
-	visited[hash] = true
+// excludeHaves marks the objects the client has as visited, so the walk
+// leaves them out. A commit the client has implies its ancestors, so the
+// walk stops there, and its tree, which is walked here. Objects of older
+// history that newer commits bring back may still be sent; the client
+// tolerates duplicates. Haves missing from the store are ignored, since
+// the client may have objects the server never saw.
+func (u *UploadPack) excludeHaves(haves []string, visited map[string]bool) error {
+	stack := slices.Clone(haves)
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[hash] {
+			continue
+		}
 
-	// Read object with header
-	data, err := u.repo.ReadObjectFull(hash)
-	if err != nil {
-		return fmt.Errorf("reading object: %w", err)
+		typ, _, rc, err := u.readStream(hash)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading have %s: %w", hash, err)
+		}
+		visited[hash] = true
+		var data []byte
+		if typ == object.TypeCommit || typ == object.TypeTree {
+			data, err = io.ReadAll(rc)
+		}
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("reading have %s: %w", hash, err)
+		}
+
+		switch typ {
+		case object.TypeCommit:
+			c, err := object.ParseCommit(data)
+			if err != nil {
+				return fmt.Errorf("parsing commit %s: %w", hash, err)
+			}
+			stack = append(stack, c.Tree)
+		case object.TypeTree:
+			err := u.repo.Format().WalkTree(data, func(e object.TreeEntry) error {
+				if e.Mode == "40000" {
+					stack = append(stack, e.Hash)
+				} else {
+					// Blobs need not be opened to be excluded.
+					visited[e.Hash] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("parsing tree %s: %w", hash, err)
+			}
+		}
 	}
+	return nil
+}
 
-	// Parse header
-	nullIndex := bytes.IndexByte(data, 0)
-	if nullIndex == -1 {
-		return fmt.Errorf("invalid object format")
+// packTypeRank orders pack object types for PackOrderRecency.
+func packTypeRank(objType int) int {
+	switch objType {
+	case packfile.OBJ_COMMIT:
+		return 0
+	case packfile.OBJ_TAG:
+		return 1
+	case packfile.OBJ_TREE:
+		return 2
 	}
+	return 3
+}
 
-	header := string(data[:nullIndex])
-	content := data[nullIndex+1:]
+// writePack streams a packfile of objects to w.
+func (u *UploadPack) writePack(w io.Writer, objects []packObject) error {
+	return u.writePackProgress(w, objects, nil)
+}
 
-	var objType int
-	switch {
-	case strings.HasPrefix(header, "commit "):
-		objType = packfile.OBJ_COMMIT
-		// Parse commit to find tree and parent
-		if err := u.addCommitDependencies(pw, content, visited); err != nil {
+// writePackProgress is writePack, calling progress, if not nil, with the
+// number of objects written so far after each one.
+func (u *UploadPack) writePackProgress(w io.Writer, objects []packObject, progress func(n int) error) error {
+	pw, err := packfile.NewStreamWriter(w, len(objects), packfile.WithChecksum(u.repo.Format().New))
+	if err != nil {
+		return err
+	}
+	o := u.openAhead(objects)
+	defer o.close()
+	if progress == nil {
+		progress = func(int) error { return nil }
+	}
+	if u.zlibWorkers > 1 {
+		if err := u.writeCompressed(pw, objects, o, progress); err != nil {
 			return err
 		}
-	case strings.HasPrefix(header, "tree "):
-		objType = packfile.OBJ_TREE
-		// Parse tree to find blobs and subtrees
-		if err := u.addTreeDependencies(pw, content, visited); err != nil {
+		return pw.Close()
+	}
+	for i, obj := range objects {
+		if err := u.writePackObject(pw, obj, o, i); err != nil {
+			return fmt.Errorf("packing object %s: %w", obj.hash, err)
+		}
+		if err := progress(i + 1); err != nil {
 			return err
 		}
-	case strings.HasPrefix(header, "blob "):
-		objType = packfile.OBJ_BLOB
-		// Blobs have no dependencies
-	default:
-		return fmt.Errorf("unknown object type: %s", header)
 	}
-
-	// Add object to packfile
-	return pw.AddObject(objType, content)
+	return pw.Close()
 }
 
-// addCommitDependencies adds a commit's tree and parent to the packfile.
-func (u *UploadPack) addCommitDependencies(pw *packfile.Writer, commitData []byte, visited map[string]bool) error {
-	lines := bytes.Split(commitData, []byte("\n"))
-	for _, line := range lines {
-		if bytes.HasPrefix(line, []byte("tree ")) {
-			treeHash := string(line[5:])
-			if err := u.addObjectToPack(pw, treeHash, visited); err != nil {
-				return fmt.Errorf("adding tree: %w", err)
-			}
-		} else if bytes.HasPrefix(line, []byte("parent ")) {
-			parentHash := string(line[7:])
-			if err := u.addObjectToPack(pw, parentHash, visited); err != nil {
-				return fmt.Errorf("adding parent: %w", err)
+// writeCompressed compresses objects on zlibWorkers goroutines and adds
+// them to pw in order. A worker may only run ahead of the writer by
+// zlibWorkers entries, which bounds the compressed data held in memory.
+func (u *UploadPack) writeCompressed(pw *packfile.Writer, objects []packObject, o *opener, progress func(n int) error) error {
+	type result struct {
+		entry []byte
+		err   error
+	}
+	results := make([]chan result, len(objects))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// Each slot is taken before an object is encoded and given back once
+	// the writer has consumed it.
+	slots := make(chan struct{}, u.zlibWorkers)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for i, obj := range objects {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
 			}
+			go func() {
+				entry, err := u.encodePackObject(obj, o, i)
+				results[i] <- result{entry, err}
+			}()
+		}
+	}()
+
+	for i, obj := range objects {
+		res := <-results[i]
+		if res.err != nil {
+			return fmt.Errorf("packing object %s: %w", obj.hash, res.err)
+		}
+		if err := pw.AddEncoded(res.entry); err != nil {
+			return fmt.Errorf("packing object %s: %w", obj.hash, err)
+		}
+		<-slots
+		if err := progress(i + 1); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// addTreeDependencies adds a tree's entries to the packfile.
-func (u *UploadPack) addTreeDependencies(pw *packfile.Writer, treeData []byte, visited map[string]bool) error {
-	entries := parseTreeData(treeData)
-	for _, entry := range entries {
-		if err := u.addObjectToPack(pw, entry.Hash, visited); err != nil {
-			return fmt.Errorf("adding tree entry %s: %w", entry.Name, err)
-		}
+// writePackObject adds the i-th collected object to the pack, streaming
+// blobs from the object store through o.
+func (u *UploadPack) writePackObject(pw *packfile.Writer, obj packObject, o *opener, i int) error {
+	if obj.content != nil {
+		return pw.AddObject(obj.objType, obj.content)
 	}
-	return nil
+
+	size, rc, err := o.open(i)
+	if err != nil {
+		return fmt.Errorf("reading object: %w", err)
+	}
+	defer rc.Close()
+	return pw.AddObjectStream(obj.objType, size, rc)
 }
 
-// parseTreeData parses raw tree data into entries.
-func parseTreeData(data []byte) []object.TreeEntry {
-	var entries []object.TreeEntry
-	i := 0
+// encodePackObject returns the compressed pack entry for the i-th
+// collected object, streaming blobs from the object store through o.
+func (u *UploadPack) encodePackObject(obj packObject, o *opener, i int) ([]byte, error) {
+	if obj.content != nil {
+		return packfile.EncodeObject(obj.objType, int64(len(obj.content)), bytes.NewReader(obj.content))
+	}
 
-	for i < len(data) {
-		// Find space (end of mode)
-		modeEnd := i
-		for modeEnd < len(data) && data[modeEnd] != ' ' {
-			modeEnd++
+	size, rc, err := o.open(i)
+	if err != nil {
+		return nil, fmt.Errorf("reading object: %w", err)
+	}
+	defer rc.Close()
+	return packfile.EncodeObject(obj.objType, size, rc)
+}
+
+// addObjectToPack collects an object and everything it references for
+// the packfile. It walks with an explicit stack rather than recursing, so
+// arbitrarily long histories neither overflow the goroutine stack nor
+// hold a file open per ancestor. History is walked before any trees, and
+// the trees of newer commits before those of older ones, so objects are
+// first reached from the newest commit that uses them. Objects are read
+// through p, which may read ahead of the walk. The parents of boundary
+// commits are not walked, and objects f filters out are left out of the
+// pack unless they are among wants. Commit trees are not walked at all if
+// f leaves out everything they lead to.
+func (u *UploadPack) addObjectToPack(objects *[]packObject, hash string, visited, boundary map[string]bool, f *objectFilter, wants []string, p *prefetcher) error {
+	stack := []string{hash}
+	var trees []string
+	for len(stack) > 0 || len(trees) > 0 {
+		if len(stack) == 0 {
+			stack = append(stack, trees[0])
+			trees = trees[1:]
 		}
-		if modeEnd >= len(data) {
-			break
+		p.ahead(stack, trees, visited)
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[hash] {
+			continue
 		}
-		mode := string(data[i:modeEnd])
+		visited[hash] = true
 
-		// Find null (end of name)
-		nameStart := modeEnd + 1
-		nameEnd := nameStart
-		for nameEnd < len(data) && data[nameEnd] != 0 {
-			nameEnd++
+		obj, links, err := p.read(hash)
+		if err != nil {
+			return err
 		}
-		if nameEnd >= len(data) {
-			break
+		if !f.omits(obj) || slices.Contains(wants, hash) {
+			*objects = append(*objects, obj)
 		}
-		name := string(data[nameStart:nameEnd])
-
-		// Read 20-byte SHA-1
-		hashStart := nameEnd + 1
-		if hashStart+20 > len(data) {
-			break
+		if obj.objType == packfile.OBJ_COMMIT && len(links) > 0 {
+			// The tree header comes first.
+			if !f.omitsTrees() {
+				trees = append(trees, links[0])
+			}
+			links = links[1:]
+			if boundary[hash] {
+				links = nil
+			}
 		}
-		hash := fmt.Sprintf("%x", data[hashStart:hashStart+20])
+		// Push in reverse so links are visited in order: first parents
+		// first, and tree entries by name.
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return nil
+}
 
-		entries = append(entries, object.TreeEntry{
-			Mode: mode,
-			Name: name,
-			Hash: hash,
-		})
+// readPackObject reads an object for the packfile and returns the hashes
+// of the objects it references.
+func (u *UploadPack) readPackObject(hash string) (packObject, []string, error) {
+	typ, size, rc, err := u.readStream(hash)
+	if err != nil {
+		return packObject{}, nil, fmt.Errorf("reading object %s: %w", hash, err)
+	}
+	defer rc.Close()
 
-		i = hashStart + 20
+	if u.maxObjectSize > 0 && size > u.maxObjectSize {
+		return packObject{}, nil, fmt.Errorf("%s %s is %d bytes, over the %d byte object size limit", typ, hash, size, u.maxObjectSize)
 	}
 
-	return entries
+	obj := packObject{hash: hash, size: size}
+	var links []string
+	switch typ {
+	case object.TypeCommit:
+		obj.objType = packfile.OBJ_COMMIT
+		if obj.content, err = io.ReadAll(rc); err != nil {
+			return packObject{}, nil, fmt.Errorf("reading commit %s: %w", hash, err)
+		}
+		// Parse commit to find tree and parents
+		c, err := object.ParseCommit(obj.content)
+		if err != nil {
+			return packObject{}, nil, fmt.Errorf("parsing commit %s: %w", hash, err)
+		}
+		links = append([]string{c.Tree}, c.Parents...)
+	case object.TypeTree:
+		obj.objType = packfile.OBJ_TREE
+		if obj.content, err = io.ReadAll(rc); err != nil {
+			return packObject{}, nil, fmt.Errorf("reading tree %s: %w", hash, err)
+		}
+		// Parse tree to find blobs and subtrees
+		err = u.repo.Format().WalkTree(obj.content, func(entry object.TreeEntry) error {
+			links = append(links, entry.Hash)
+			return nil
+		})
+		if err != nil {
+			return packObject{}, nil, fmt.Errorf("parsing tree %s: %w", hash, err)
+		}
+	case object.TypeBlob:
+		obj.objType = packfile.OBJ_BLOB
+		// Blobs have no dependencies; content is streamed when packing
+	case object.TypeTag:
+		obj.objType = packfile.OBJ_TAG
+		if obj.content, err = io.ReadAll(rc); err != nil {
+			return packObject{}, nil, fmt.Errorf("reading tag %s: %w", hash, err)
+		}
+		// A tag depends on the object it tags
+		n := u.repo.Format().HexLen()
+		if target, ok := bytes.CutPrefix(obj.content, []byte("object ")); ok && len(target) >= n {
+			links = []string{string(target[:n])}
+		}
+	default:
+		return packObject{}, nil, fmt.Errorf("unknown object type: %s", typ)
+	}
+	return obj, links, nil
 }
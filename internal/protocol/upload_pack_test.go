@@ -0,0 +1,1678 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	gitpackfile "github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/imjasonh/infinite-git/internal/clock"
+	"github.com/imjasonh/infinite-git/internal/generator"
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/packfile"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// testContent is a minimal ContentProvider for protocol tests.
+type testContent struct{}
+
+func (testContent) InitialFiles() map[string][]byte {
+	return map[string][]byte{
+		"README.md": []byte("# Test\n"),
+		"hello.txt": []byte("Pull #0\n"),
+	}
+}
+
+func (testContent) GenerateFiles(count int64, now time.Time) map[string][]byte {
+	return map[string][]byte{
+		"hello.txt": []byte(fmt.Sprintf("Pull #%d\n", count)),
+	}
+}
+
+func (testContent) CommitMessage(count int64, now time.Time) string {
+	return fmt.Sprintf("Pull #%d", count)
+}
+
+// newTestRepo creates a repository with n generated commits on top of the
+// initial commit and returns it along with the head commit hash.
+func newTestRepo(t testing.TB, n int) (*repo.Repository, string) {
+	t.Helper()
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	gen := generator.New(r, testContent{})
+	for i := 0; i < n; i++ {
+		if _, err := gen.GenerateCommit(); err != nil {
+			t.Fatalf("generating commit: %v", err)
+		}
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	return r, refs["refs/heads/main"]
+}
+
+func TestCreatePackfileDeterministic(t *testing.T) {
+	// Build the same history twice, each in its own repository, so that
+	// nothing carries over between runs but the fixed seed and clock.
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	build := func() (string, []byte) {
+		t.Helper()
+		r, err := repo.New(t.TempDir(), testContent{}.InitialFiles(), repo.WithClock(clock.Fixed(at)))
+		if err != nil {
+			t.Fatalf("creating repo: %v", err)
+		}
+		gen := generator.New(r, testContent{}, generator.WithClock(clock.Fixed(at)))
+		var head string
+		for i := 0; i < 3; i++ {
+			if head, err = gen.GenerateSeededCommit(42); err != nil {
+				t.Fatalf("generating commit: %v", err)
+			}
+		}
+		pack, err := NewUploadPack(r).createPackfile([]string{head})
+		if err != nil {
+			t.Fatalf("creating pack: %v", err)
+		}
+		return head, pack
+	}
+
+	head, first := build()
+	_, second := build()
+	if !bytes.Equal(first, second) {
+		t.Errorf("packs differ: %d bytes vs %d bytes", len(first), len(second))
+	}
+
+	// The hashes are pinned, so a change that makes output depend on
+	// anything but the inputs, such as map order, fails here.
+	if want := "01cee1058ae93631c17e57db667ba3ac5cb5e479"; head != want {
+		t.Errorf("head = %s, want %s", head, want)
+	}
+	if got, want := fmt.Sprintf("%x", first[len(first)-20:]), "ef4b08da0ba1544e04af7b81d1baf9d500676722"; got != want {
+		t.Errorf("pack checksum = %s, want %s", got, want)
+	}
+}
+
+func TestZlibWorkersMatchSerial(t *testing.T) {
+	r, head := newTestRepo(t, 20)
+
+	serial, err := NewUploadPack(r).createPackfile([]string{head})
+	if err != nil {
+		t.Fatalf("creating serial pack: %v", err)
+	}
+	for _, n := range []int{2, 8} {
+		parallel, err := NewUploadPack(r, WithZlibWorkers(n)).createPackfile([]string{head})
+		if err != nil {
+			t.Fatalf("creating pack with %d workers: %v", n, err)
+		}
+		if !bytes.Equal(serial, parallel) {
+			t.Errorf("pack with %d workers differs from serial pack", n)
+		}
+	}
+}
+
+func TestPackOrder(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+
+	// History from the head back to the initial commit.
+	var history []string
+	for hash := head; hash != ""; {
+		history = append(history, hash)
+		_, _, rc, err := r.ReadObjectStream(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash = ""
+		if len(c.Parents) > 0 {
+			hash = c.Parents[0]
+		}
+	}
+
+	for _, order := range []PackOrder{PackOrderHash, PackOrderRecency} {
+		t.Run(string(order), func(t *testing.T) {
+			up := NewUploadPack(r, WithPackOrder(order))
+			objects, err := up.collectObjects([]string{head}, nil)
+			if err != nil {
+				t.Fatalf("collecting objects: %v", err)
+			}
+
+			switch order {
+			case PackOrderHash:
+				if !slices.IsSortedFunc(objects, func(a, b packObject) int { return strings.Compare(a.hash, b.hash) }) {
+					t.Error("objects are not sorted by hash")
+				}
+			case PackOrderRecency:
+				ranks := make([]int, len(objects))
+				for i, obj := range objects {
+					ranks[i] = packTypeRank(obj.objType)
+				}
+				if !slices.IsSorted(ranks) {
+					t.Errorf("objects are not grouped by type: %v", ranks)
+				}
+				var commits []string
+				for _, obj := range objects[:len(history)] {
+					commits = append(commits, obj.hash)
+				}
+				if !slices.Equal(commits, history) {
+					t.Errorf("commits = %v, want newest first %v", commits, history)
+				}
+			}
+
+			pack, err := up.createPackfile([]string{head})
+			if err != nil {
+				t.Fatalf("creating pack: %v", err)
+			}
+			st := memory.NewStorage()
+			if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(pack)); err != nil {
+				t.Fatalf("reading pack: %v", err)
+			}
+			if got := len(st.Objects); got != len(objects) {
+				t.Errorf("pack holds %d objects, want %d", got, len(objects))
+			}
+		})
+	}
+}
+
+// latentStorage delays every object read, like a network file system.
+func latentStorage(r *repo.Repository, latency time.Duration) func(string) (object.Type, int64, io.ReadCloser, error) {
+	return func(hash string) (object.Type, int64, io.ReadCloser, error) {
+		time.Sleep(latency)
+		return r.ReadObjectStream(hash)
+	}
+}
+
+func TestReadAheadMatchesSerial(t *testing.T) {
+	r, head := newTestRepo(t, 20)
+
+	serial, err := NewUploadPack(r).createPackfile([]string{head})
+	if err != nil {
+		t.Fatalf("creating serial pack: %v", err)
+	}
+	for _, n := range []int{1, 4, 64} {
+		up := NewUploadPack(r, WithReadAhead(n))
+		up.readStream = latentStorage(r, 100*time.Microsecond)
+		pack, err := up.createPackfile([]string{head})
+		if err != nil {
+			t.Fatalf("creating pack reading %d ahead: %v", n, err)
+		}
+		if !bytes.Equal(serial, pack) {
+			t.Errorf("pack reading %d ahead differs from serial pack", n)
+		}
+	}
+
+	// A failed read ahead is reported when the walk reaches it.
+	up := NewUploadPack(r, WithReadAhead(8))
+	up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+		if hash != head {
+			return "", 0, nil, fmt.Errorf("disk on fire")
+		}
+		return r.ReadObjectStream(hash)
+	}
+	if _, err := up.collectObjects([]string{head}, nil); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("collectObjects error = %v, want the read failure", err)
+	}
+
+	// So is a failure to open a blob ahead of writing it, with or
+	// without pack workers.
+	objects, err := NewUploadPack(r).collectObjects([]string{head}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 4} {
+		up := NewUploadPack(r, WithReadAhead(8), WithZlibWorkers(workers))
+		up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+			return "", 0, nil, fmt.Errorf("disk on fire")
+		}
+		if err := up.writePack(io.Discard, objects); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+			t.Errorf("writePack with %d workers error = %v, want the read failure", workers, err)
+		}
+	}
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	r, head := newTestRepo(b, 50)
+	for _, n := range []int{0, 8, 32} {
+		b.Run(fmt.Sprintf("readahead=%d", n), func(b *testing.B) {
+			up := NewUploadPack(r, WithReadAhead(n))
+			up.readStream = latentStorage(r, time.Millisecond)
+			for b.Loop() {
+				if err := up.WritePack(io.Discard, []string{head}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestZlibWorkersError(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+	up := NewUploadPack(r, WithZlibWorkers(4))
+	objects, err := up.collectObjects([]string{head}, nil)
+	if err != nil {
+		t.Fatalf("collecting objects: %v", err)
+	}
+
+	up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+		return "", 0, nil, fmt.Errorf("disk on fire")
+	}
+	if err := up.writePack(io.Discard, objects); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("writePack error = %v, want the read failure", err)
+	}
+}
+
+func BenchmarkZlibWorkers(b *testing.B) {
+	r, head := newTestRepo(b, 200)
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			up := NewUploadPack(r, WithZlibWorkers(n))
+			objects, err := up.collectObjects([]string{head}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for b.Loop() {
+				if err := up.writePack(io.Discard, objects); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// cloneRequest builds a stateless upload-pack request body wanting head
+// with the given capabilities and no haves.
+func cloneRequest(t *testing.T, head string, caps ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	want := "want " + head
+	if len(caps) > 0 {
+		want += " " + strings.Join(caps, " ")
+	}
+	if err := pw.WriteString(want + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.WriteString("done\n"); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestPackCacheHit(t *testing.T) {
+	r, head := newTestRepo(t, 2)
+	cache := NewPackCache(4)
+
+	var responses [][]byte
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		up := NewUploadPack(r, WithPackCache(cache))
+		// Progress is reported as an uncached pack is built.
+		if err := up.HandleRequest(cloneRequest(t, head, "side-band-64k", "no-progress"), &out); err != nil {
+			t.Fatalf("clone %d: %v", i+1, err)
+		}
+		responses = append(responses, out.Bytes())
+	}
+
+	if got := cache.Hits(); got != 1 {
+		t.Errorf("cache hits = %d, want 1", got)
+	}
+	if !bytes.Equal(responses[0], responses[1]) {
+		t.Error("cached response differs from original")
+	}
+}
+
+func TestPackCacheSkipsHaves(t *testing.T) {
+	r, head := newTestRepo(t, 2)
+	cache := NewPackCache(4)
+
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	pw.WriteString("want " + head + "\n")
+	pw.Flush()
+	pw.WriteString("have " + head + "\n")
+	pw.WriteString("done\n")
+
+	up := NewUploadPack(r, WithPackCache(cache))
+	if err := up.HandleRequest(&buf, io.Discard); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("cache has %d entries after negotiated fetch, want 0", cache.Len())
+	}
+}
+
+func TestPackCacheSharesBuild(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+
+	// countingReads returns an UploadPack sharing cache that counts its
+	// reads of head, slowed so that concurrent requests overlap.
+	var reads atomic.Int64
+	countingReads := func(cache *PackCache) *UploadPack {
+		up := NewUploadPack(r, WithPackCache(cache))
+		slow := latentStorage(r, time.Millisecond)
+		up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+			if hash == head {
+				reads.Add(1)
+			}
+			return slow(hash)
+		}
+		return up
+	}
+
+	// One build reads head this many times.
+	if err := countingReads(NewPackCache(1)).HandleRequest(cloneRequest(t, head), io.Discard); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	perBuild := reads.Swap(0)
+
+	// A prewarm and concurrent clones of the same head build it once.
+	const clones = 8
+	cache := NewPackCache(4)
+	var wg sync.WaitGroup
+	errs := make(chan error, clones+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- countingReads(cache).Prewarm([]string{head})
+	}()
+	for range clones {
+		req := cloneRequest(t, head)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- countingReads(cache).HandleRequest(req, io.Discard)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("clone: %v", err)
+		}
+	}
+	if got := reads.Load(); got != perBuild {
+		t.Errorf("head read %d times, want %d for a single build", got, perBuild)
+	}
+	if got := cache.Hits(); got < clones-1 {
+		t.Errorf("cache hits = %d, want at least %d", got, clones-1)
+	}
+}
+
+// stalledWriter takes writes until the pack starts, then blocks them
+// until unblock is closed, like a client that stopped reading.
+type stalledWriter struct {
+	stalled, unblock chan struct{}
+	once             sync.Once
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("PACK")) {
+		w.once.Do(func() { close(w.stalled) })
+		<-w.unblock
+	}
+	return len(p), nil
+}
+
+func TestPackCacheStalledClient(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+	cache := NewPackCache(4)
+
+	// The first clone builds the pack, then stops reading it.
+	w := &stalledWriter{stalled: make(chan struct{}), unblock: make(chan struct{})}
+	defer close(w.unblock)
+	go NewUploadPack(r, WithPackCache(cache)).HandleRequest(cloneRequest(t, head), w)
+	<-w.stalled
+
+	// A second clone of the same head is not held up by it.
+	done := make(chan error, 1)
+	req := cloneRequest(t, head)
+	go func() {
+		done <- NewUploadPack(r, WithPackCache(cache)).HandleRequest(req, io.Discard)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("second clone: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second clone waited for the stalled one")
+	}
+	if got := cache.Hits(); got != 1 {
+		t.Errorf("cache hits = %d, want 1", got)
+	}
+}
+
+func TestPackCacheWaitCanceled(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+	cache := NewPackCache(4)
+
+	// Another request is building the pack and never finishes.
+	done, ok, err := cache.startBuild(context.Background(), packCacheKey([]string{head}))
+	if !ok || err != nil {
+		t.Fatalf("startBuild = %v, %v", ok, err)
+	}
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = NewUploadPack(r, WithPackCache(cache), WithContext(ctx)).HandleRequest(cloneRequest(t, head), io.Discard)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HandleRequest error = %v, want the context's", err)
+	}
+}
+
+func TestResumeWithHaves(t *testing.T) {
+	r, partial := newTestRepo(t, 3)
+	up := NewUploadPack(r)
+
+	// fetchPack runs a request without side-band and returns the pack
+	// after the NAK, or the ACK of partial.
+	fetchPack := func(req io.Reader) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		if err := up.HandleRequest(req, &out); err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		pack, ok := bytes.CutPrefix(out.Bytes(), []byte("0008NAK\n"))
+		if !ok {
+			pack, ok = bytes.CutPrefix(out.Bytes(), []byte("0031ACK "+partial+"\n"))
+		}
+		if !ok {
+			t.Fatalf("response does not start with a NAK or ACK: %q", out.Bytes()[:min(out.Len(), 16)])
+		}
+		return pack
+	}
+
+	// A first clone gets the history up to partial before failing. The
+	// generator below starts its count over, so some of the content it
+	// writes matches older history than partial's tree, and is sent again.
+	st := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(fetchPack(cloneRequest(t, partial)))); err != nil {
+		t.Fatalf("reading first pack: %v", err)
+	}
+
+	gen := generator.New(r, testContent{})
+	var head string
+	for range 3 {
+		var err error
+		if head, err = gen.GenerateCommit(); err != nil {
+			t.Fatalf("generating commit: %v", err)
+		}
+	}
+	full, err := up.collectObjects([]string{head}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry says what it already has and gets only the rest.
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	pw.WriteString("want " + head + "\n")
+	pw.Flush()
+	pw.WriteString("have " + partial + "\n")
+	pw.WriteString("have " + strings.Repeat("ab", 20) + "\n") // unknown to the server
+	pw.WriteString("done\n")
+	pack := fetchPack(&buf)
+
+	if sent := int(binary.BigEndian.Uint32(pack[8:12])); sent >= len(full) {
+		t.Errorf("resumed fetch sent %d objects, want fewer than the %d of a full clone", sent, len(full))
+	}
+	resumed := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(resumed, bytes.NewReader(pack)); err != nil {
+		t.Fatalf("reading resumed pack: %v", err)
+	}
+	for hash, obj := range resumed.Objects {
+		if _, ok := st.Objects[hash]; ok && obj.Type() == plumbing.CommitObject {
+			t.Errorf("resumed fetch resent commit %s", hash)
+		}
+	}
+	if err := gitpackfile.UpdateObjectStorage(st, bytes.NewReader(pack)); err != nil {
+		t.Fatalf("reading resumed pack: %v", err)
+	}
+	for _, obj := range full {
+		if _, ok := st.Objects[plumbing.NewHash(obj.hash)]; !ok {
+			t.Errorf("object %s missing after resuming", obj.hash)
+		}
+	}
+}
+
+// negotiationRepo returns a repository and an upload-pack for it, with
+// the head after two generated commits and the head after three more.
+func negotiationRepo(t *testing.T) (up *UploadPack, old, head string) {
+	t.Helper()
+	r, _ := newTestRepo(t, 0)
+	gen := generator.New(r, testContent{})
+	generate := func(n int) string {
+		t.Helper()
+		var head string
+		for range n {
+			var err error
+			if head, err = gen.GenerateCommit(); err != nil {
+				t.Fatalf("generating commit: %v", err)
+			}
+		}
+		return head
+	}
+	old = generate(2)
+	head = generate(3)
+	return NewUploadPack(r), old, head
+}
+
+// fetchLines runs a request without side-band and returns the lines
+// before the pack, without flushes, and the objects in the pack, which
+// are nil if there is none.
+func fetchLines(t *testing.T, up *UploadPack, body io.Reader) ([]string, *memory.Storage) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := up.HandleRequest(body, &out); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	var lines []string
+	for out.Len() > 0 && !bytes.HasPrefix(out.Bytes(), []byte("PACK")) {
+		// Read one pkt-line at a time, so the pack is left in out.
+		n, err := strconv.ParseUint(string(out.Next(4)), 16, 16)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		if n == 0 {
+			continue // flush after a NAK
+		}
+		lines = append(lines, strings.TrimSuffix(string(out.Next(int(n)-4)), "\n"))
+	}
+	if out.Len() == 0 {
+		return lines, nil
+	}
+	st := memory.NewStorage()
+	if err := gitpackfile.UpdateObjectStorage(st, &out); err != nil {
+		t.Fatalf("reading pack: %v", err)
+	}
+	return lines, st
+}
+
+// negotiationRequest encodes a request wanting want with caps, then
+// the batches of haves, each ended by a flush, or by done for the last
+// if done is set.
+func negotiationRequest(want string, caps []string, done bool, batches ...[]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	pw.WriteString(strings.Join(append([]string{"want " + want}, caps...), " ") + "\n")
+	pw.Flush()
+	for i, batch := range batches {
+		for _, have := range batch {
+			pw.WriteString("have " + have + "\n")
+		}
+		if done && i == len(batches)-1 {
+			pw.WriteString("done\n")
+		} else {
+			pw.Flush()
+		}
+	}
+	return &buf
+}
+
+func TestIncrementalFetch(t *testing.T) {
+	up, old, head := negotiationRepo(t)
+	fetch := func(body io.Reader) ([]string, *memory.Storage) {
+		t.Helper()
+		return fetchLines(t, up, body)
+	}
+
+	_, cloned := fetch(cloneRequest(t, old))
+	_, full := fetch(cloneRequest(t, head))
+
+	// The pull sends an unknown have, then the old head, as git sends
+	// newest first.
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	pw.WriteString("want " + head + "\n")
+	pw.Flush()
+	pw.WriteString("have " + strings.Repeat("ab", 20) + "\n")
+	pw.WriteString("have " + old + "\n")
+	pw.WriteString("done\n")
+	lines, pulled := fetch(&buf)
+
+	if want := []string{"ACK " + old}; !slices.Equal(lines, want) {
+		t.Errorf("negotiation = %q, want %q", lines, want)
+	}
+	// Each new commit changes hello.txt, so brings a commit, a tree and
+	// a blob.
+	if len(pulled.Objects) != 9 {
+		t.Errorf("pull sent %d objects, want 9 for 3 commits", len(pulled.Objects))
+	}
+	for hash := range pulled.Objects {
+		if _, ok := cloned.Objects[hash]; ok {
+			t.Errorf("pull resent %s, which the clone has", hash)
+		}
+	}
+	for hash := range full.Objects {
+		_, inClone := cloned.Objects[hash]
+		_, inPull := pulled.Objects[hash]
+		if !inClone && !inPull {
+			t.Errorf("object %s missing after the pull", hash)
+		}
+	}
+
+	// Batches before a common object is found each get a NAK.
+	buf.Reset()
+	pw.WriteString("want " + head + "\n")
+	pw.Flush()
+	pw.WriteString("have " + strings.Repeat("ab", 20) + "\n")
+	pw.Flush()
+	pw.WriteString("have " + old + "\n")
+	pw.Flush()
+	pw.WriteString("done\n")
+	if lines, _ := fetch(&buf); !slices.Equal(lines, []string{"NAK", "ACK " + old}) {
+		t.Errorf("negotiation = %q, want a NAK then the ACK", lines)
+	}
+}
+
+func TestMultiAckNegotiation(t *testing.T) {
+	up, old, head := negotiationRepo(t)
+	unknown1, unknown2 := strings.Repeat("ab", 20), strings.Repeat("cd", 20)
+
+	for _, tc := range []struct {
+		name string
+		caps []string
+		done bool
+		// batches of haves; the last ends in done if done is set
+		batches [][]string
+		want    []string
+		pack    bool
+	}{{
+		name:    "multi_ack_detailed",
+		caps:    []string{"multi_ack_detailed"},
+		done:    true,
+		batches: [][]string{{unknown1}, {old, unknown2}, {}},
+		want:    []string{"NAK", "ACK " + old + " common", "ACK " + unknown2 + " ready", "NAK", "ACK " + old},
+		pack:    true,
+	}, {
+		name:    "multi_ack",
+		caps:    []string{"multi_ack"},
+		done:    true,
+		batches: [][]string{{unknown1}, {old, unknown2}, {}},
+		want:    []string{"NAK", "ACK " + old + " continue", "ACK " + unknown2 + " continue", "NAK", "ACK " + old},
+		pack:    true,
+	}, {
+		name:    "ready after a batch of only common haves",
+		caps:    []string{"multi_ack_detailed"},
+		batches: [][]string{{old}},
+		want:    []string{"ACK " + old + " common", "ACK " + old + " ready", "NAK"},
+	}, {
+		name:    "no-done sends the pack once ready",
+		caps:    []string{"multi_ack_detailed", "no-done"},
+		batches: [][]string{{old}},
+		want:    []string{"ACK " + old + " common", "ACK " + old + " ready", "NAK", "ACK " + old},
+		pack:    true,
+	}, {
+		name:    "nothing in common",
+		caps:    []string{"multi_ack_detailed"},
+		done:    true,
+		batches: [][]string{{unknown1}, {unknown2}},
+		want:    []string{"NAK", "NAK"},
+		pack:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines, st := fetchLines(t, up, negotiationRequest(head, tc.caps, tc.done, tc.batches...))
+			if !slices.Equal(lines, tc.want) {
+				t.Errorf("negotiation = %q, want %q", lines, tc.want)
+			}
+			if got := st != nil; got != tc.pack {
+				t.Errorf("sent a pack: %t, want %t", got, tc.pack)
+			}
+		})
+	}
+}
+
+func TestGiveUpWalksCommitsOnly(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+	log, err := r.FirstParentLog(head, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := NewUploadPack(r)
+	read := make(map[object.Type]int)
+	up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+		typ, size, rc, err := r.ReadObjectStream(hash)
+		read[typ]++
+		return typ, size, rc, err
+	}
+
+	g := up.newGiveUpWalk([]string{head})
+	if ok, err := g.ok(); err != nil || ok {
+		t.Fatalf("ok with no common commits = %t, %v, want false", ok, err)
+	}
+	// The parent of main is common, so main reaches it.
+	if err := g.addCommon(log[0].Parents[0]); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := g.ok(); err != nil || !ok {
+		t.Fatalf("ok = %t, %v, want true", ok, err)
+	}
+	if read[object.TypeTree] != 0 || read[object.TypeBlob] != 0 {
+		t.Errorf("read %d trees and %d blobs, want only commits", read[object.TypeTree], read[object.TypeBlob])
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	var out bytes.Buffer
+	up := NewUploadPack(r, WithMaxObjectSize(4))
+	err := up.HandleRequest(cloneRequest(t, head, "side-band-64k"), &out)
+	if err == nil {
+		t.Fatal("HandleRequest succeeded with objects over the size limit")
+	}
+
+	line, rerr := pktline.NewReader(&out).ReadString()
+	if rerr != nil {
+		t.Fatalf("reading response: %v", rerr)
+	}
+	if !strings.HasPrefix(line, "ERR ") || !strings.Contains(line, "object size limit") {
+		t.Errorf("response = %q, want ERR describing the size limit", line)
+	}
+}
+
+func TestSidebandErrorMidTransfer(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+	up := NewUploadPack(r)
+
+	// Let the walk succeed, then fail blob reads once the pack is being sent.
+	reads := make(map[string]int)
+	up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+		typ, size, rc, err := r.ReadObjectStream(hash)
+		reads[hash]++
+		if err == nil && typ == object.TypeBlob && reads[hash] > 1 {
+			rc.Close()
+			return "", 0, nil, fmt.Errorf("object %s vanished", hash)
+		}
+		return typ, size, rc, err
+	}
+
+	var out bytes.Buffer
+	if err := up.HandleRequest(cloneRequest(t, head, "side-band-64k"), &out); err == nil {
+		t.Fatal("HandleRequest succeeded despite a failed read")
+	}
+
+	pr := pktline.NewReader(&out)
+	if line, err := pr.ReadString(); err != nil || line != "NAK" {
+		t.Fatalf("first line = %q, %v; want NAK", line, err)
+	}
+	var errMsg string
+	for {
+		pkt, err := pr.Read()
+		if err != nil {
+			break
+		}
+		if len(pkt) > 0 && pkt[0] == bandError {
+			errMsg = string(pkt[1:])
+			break
+		}
+	}
+	if !strings.Contains(errMsg, "vanished") {
+		t.Errorf("channel 3 message = %q, want the read failure", errMsg)
+	}
+}
+
+func TestHandleRequestStatelessTermination(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	// Wanting nothing gets an empty response, as from git.
+	var out bytes.Buffer
+	if err := NewUploadPack(r).HandleRequest(strings.NewReader("0000"), &out); err != nil {
+		t.Fatalf("HandleRequest: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("response to a request without wants = %q, want none", out.String())
+	}
+
+	// A body cut off after the wants is refused rather than answered.
+	body := cloneRequest(t, head, "side-band-64k")
+	body.Truncate(body.Len() - len("0009done\n"))
+	body.WriteString("0032have " + head + "\n")
+	out.Reset()
+	if err := NewUploadPack(r).HandleRequest(body, &out); err == nil {
+		t.Fatal("HandleRequest served a truncated request")
+	}
+	if !strings.HasPrefix(out.String()[4:], "ERR ") {
+		t.Errorf("response = %q, want an ERR line", out.String())
+	}
+}
+
+// demux splits a side-band clone response, which must start with a NAK,
+// into the pack, the number of keep-alives, and the progress messages.
+func demux(t *testing.T, out io.Reader) (pack []byte, keepAlives int, progress string) {
+	t.Helper()
+	pr := pktline.NewReader(out)
+	if line, err := pr.ReadString(); err != nil || line != "NAK" {
+		t.Fatalf("first line = %q, %v; want NAK", line, err)
+	}
+	for {
+		pkt, err := pr.Read()
+		if err == io.EOF {
+			return pack, keepAlives, progress
+		} else if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		switch {
+		case pkt[0] == bandData:
+			pack = append(pack, pkt[1:]...)
+		case pkt[0] == bandProgress && len(pkt) == 1:
+			keepAlives++
+		case pkt[0] == bandProgress:
+			progress += string(pkt[1:])
+		default:
+			t.Fatalf("unexpected packet on channel %d: %q", pkt[0], pkt[1:])
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+
+	// fetch clones with slow reads and frequent keep-alives.
+	fetch := func(caps ...string) (pack []byte, keepAlives int, progress string) {
+		t.Helper()
+		up := NewUploadPack(r, WithKeepAlive(time.Millisecond))
+		up.readStream = latentStorage(r, 5*time.Millisecond)
+		var out bytes.Buffer
+		if err := up.HandleRequest(cloneRequest(t, head, caps...), &out); err != nil {
+			t.Fatalf("HandleRequest: %v", err)
+		}
+		return demux(t, &out)
+	}
+
+	pack, n, _ := fetch("side-band-64k")
+	if n == 0 {
+		t.Error("no keep-alives sent during a slow pack")
+	}
+	if !bytes.HasPrefix(pack, []byte("PACK")) {
+		t.Errorf("pack with keep-alives is corrupt: %q", pack[:min(len(pack), 16)])
+	}
+
+	pack, n, progress := fetch("side-band-64k", "no-progress")
+	if n != 0 || progress != "" {
+		t.Errorf("sent %d keep-alives and progress %q despite no-progress", n, progress)
+	}
+	if !bytes.HasPrefix(pack, []byte("PACK")) {
+		t.Errorf("pack is corrupt: %q", pack[:min(len(pack), 16)])
+	}
+}
+
+func TestProgress(t *testing.T) {
+	r, head := newTestRepo(t, 5)
+	want, err := NewUploadPack(r).createPackfile([]string{head})
+	if err != nil {
+		t.Fatalf("creating pack: %v", err)
+	}
+	count := binary.BigEndian.Uint32(want[8:12])
+
+	// Streamed, freshly cached and cached packs report the same totals.
+	// Only a streamed pack counts objects as they are written: one being
+	// cached is built before any of it is sent.
+	up := NewUploadPack(r, WithPackCache(NewPackCache(1)))
+	for _, name := range []string{"streamed", "uncached", "cached"} {
+		var out bytes.Buffer
+		u := up
+		if name == "streamed" {
+			u = NewUploadPack(r)
+		}
+		if err := u.HandleRequest(cloneRequest(t, head, "side-band-64k"), &out); err != nil {
+			t.Fatalf("%s: HandleRequest: %v", name, err)
+		}
+		pack, _, progress := demux(t, &out)
+		if !bytes.Equal(pack, want) {
+			t.Errorf("%s: pack on the data channel differs from the pack", name)
+		}
+		for _, line := range []string{
+			fmt.Sprintf("Counting objects: %d, done.\n", count),
+			fmt.Sprintf("Writing objects: 100%% (%d/%d), done.\n", count, count),
+		} {
+			if !strings.Contains(progress, line) {
+				t.Errorf("%s: progress %q has no %q", name, progress, line)
+			}
+		}
+		if name == "streamed" && !strings.Contains(progress, fmt.Sprintf("Writing objects: %3d%% (%d/%d)\r", count/2*100/count, count/2, count)) {
+			t.Errorf("%s: progress %q does not count objects as they are written", name, progress)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := up.HandleRequest(cloneRequest(t, head, "side-band-64k", "no-progress"), &out); err != nil {
+		t.Fatalf("HandleRequest: %v", err)
+	}
+	if _, _, progress := demux(t, &out); progress != "" {
+		t.Errorf("progress %q sent despite no-progress", progress)
+	}
+}
+
+// filterRequest builds a clone request like cloneRequest, optionally
+// sending a filter line after the wants.
+func filterRequest(t *testing.T, head, filter string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	if err := pw.WriteString("want " + head + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if filter != "" {
+		if err := pw.WriteString("filter " + filter + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.WriteString("done\n"); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestFilterCapability(t *testing.T) {
+	r, head := newTestRepo(t, 2)
+	want, err := NewUploadPack(r).createPackfile([]string{head})
+	if err != nil {
+		t.Fatalf("creating pack: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		advertised bool
+		filter     string
+		wantErr    bool
+	}{
+		{name: "advertised and not requested", advertised: true},
+		{name: "not advertised and not requested"},
+		{name: "not advertised but requested", filter: "blob:none", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up := NewUploadPack(r, WithFilter(tc.advertised))
+			if got := slices.Contains(up.Capabilities(), "filter"); got != tc.advertised {
+				t.Errorf("filter advertised = %t, want %t", got, tc.advertised)
+			}
+
+			var out bytes.Buffer
+			err := up.HandleRequest(filterRequest(t, head, tc.filter), &out)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("HandleRequest succeeded with an unadvertised filter")
+				}
+				line, rerr := pktline.NewReader(&out).ReadString()
+				if rerr != nil || !strings.HasPrefix(line, "ERR ") {
+					t.Errorf("response = %q, %v; want an ERR line", line, rerr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleRequest: %v", err)
+			}
+
+			// Without side-band the pack follows the NAK directly, and
+			// must hold every object.
+			got, ok := bytes.CutPrefix(out.Bytes(), []byte("0008NAK\n"))
+			if !ok {
+				t.Fatalf("response does not start with NAK: %q", out.Bytes()[:min(out.Len(), 16)])
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got a %d byte pack, want the complete %d byte pack", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestFilterBlobs(t *testing.T) {
+	r, head := newTestRepo(t, 2)
+	up := NewUploadPack(r, WithFilter(true))
+	all, err := up.collectObjects([]string{head}, nil)
+	if err != nil {
+		t.Fatalf("collecting objects: %v", err)
+	}
+	var blobs []string
+	var largest int64
+	for _, obj := range all {
+		if obj.objType == packfile.OBJ_BLOB {
+			blobs = append(blobs, obj.hash)
+			largest = max(largest, obj.size)
+		}
+	}
+	smaller := 0
+	for _, obj := range all {
+		if obj.objType == packfile.OBJ_BLOB && obj.size < largest {
+			smaller++
+		}
+	}
+
+	// count returns how many of the objects collected for wants with
+	// filter spec are blobs, and how many are not.
+	count := func(spec string, wants ...string) (nblobs, others int) {
+		t.Helper()
+		f, err := parseFilter(spec, false)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", spec, err)
+		}
+		objects, err := up.collect(wants, nil, nil, f)
+		if err != nil {
+			t.Fatalf("collecting with %q: %v", spec, err)
+		}
+		for _, obj := range objects {
+			if obj.objType == packfile.OBJ_BLOB {
+				nblobs++
+			} else {
+				others++
+			}
+		}
+		return nblobs, others
+	}
+	_, want := count("", head)
+	for _, tc := range []struct {
+		spec  string
+		wants []string
+		blobs int
+	}{
+		{spec: "blob:none", wants: []string{head}, blobs: 0},
+		{spec: "blob:limit=0", wants: []string{head}, blobs: 0},
+		{spec: fmt.Sprintf("blob:limit=%d", largest), wants: []string{head}, blobs: smaller},
+		{spec: fmt.Sprintf("blob:limit=%d", largest+1), wants: []string{head}, blobs: len(blobs)},
+		{spec: "blob:limit=1k", wants: []string{head}, blobs: len(blobs)},
+		// A partial clone fetches the blobs it lacks by wanting them.
+		{spec: "blob:none", wants: []string{head, blobs[0]}, blobs: 1},
+	} {
+		nblobs, others := count(tc.spec, tc.wants...)
+		if nblobs != tc.blobs || others != want {
+			t.Errorf("with %s got %d blobs and %d other objects, want %d and %d", tc.spec, nblobs, others, tc.blobs, want)
+		}
+	}
+
+	// Each blob once wanted on its own is sent whatever the filter.
+	if nblobs, others := count("blob:none", blobs...); nblobs != len(blobs) || others != 0 {
+		t.Errorf("wanting blobs got %d blobs and %d other objects, want %d and 0", nblobs, others, len(blobs))
+	}
+
+	for _, spec := range []string{"blob:limit=", "blob:limit=-1", "blob:limit=1x", "tree:0", "sparse:oid=abc"} {
+		var out bytes.Buffer
+		if err := up.HandleRequest(filterRequest(t, head, spec), &out); err == nil {
+			t.Errorf("HandleRequest with filter %q succeeded", spec)
+		}
+		if line, err := pktline.NewReader(&out).ReadString(); err != nil || !strings.HasPrefix(line, "ERR ") {
+			t.Errorf("response to filter %q = %q, %v; want an ERR line", spec, line, err)
+		}
+	}
+}
+
+func TestFilterObjectType(t *testing.T) {
+	r, head := newTestRepo(t, 3)
+	up := NewUploadPack(r, WithFilter(true), WithObjectTypeFilter(true))
+	all, err := up.collectObjects([]string{head}, nil)
+	if err != nil {
+		t.Fatalf("collecting objects: %v", err)
+	}
+	var commits []string
+	for _, obj := range all {
+		if obj.objType == packfile.OBJ_COMMIT {
+			commits = append(commits, obj.hash)
+		}
+	}
+
+	_, st := fetchLines(t, up, filterRequest(t, head, "object:type=commit"))
+	if st == nil {
+		t.Fatal("no pack sent")
+	}
+	var got []string
+	for hash, obj := range st.Objects {
+		if obj.Type() != plumbing.CommitObject {
+			t.Errorf("pack has %s %s", obj.Type(), hash)
+		}
+		got = append(got, hash.String())
+	}
+	slices.Sort(got)
+	slices.Sort(commits)
+	if !slices.Equal(got, commits) {
+		t.Errorf("pack has %v, want the commits %v", got, commits)
+	}
+
+	// The filter is opt-in, and the type must be one git knows.
+	for _, tc := range []struct {
+		up   *UploadPack
+		spec string
+	}{
+		{NewUploadPack(r, WithFilter(true)), "object:type=commit"},
+		{up, "object:type=note"},
+	} {
+		var out bytes.Buffer
+		if err := tc.up.HandleRequest(filterRequest(t, head, tc.spec), &out); err == nil {
+			t.Errorf("HandleRequest with filter %q succeeded", tc.spec)
+		}
+		if line, err := pktline.NewReader(&out).ReadString(); err != nil || !strings.HasPrefix(line, "ERR ") {
+			t.Errorf("response to filter %q = %q, %v; want an ERR line", tc.spec, line, err)
+		}
+	}
+}
+
+// endlessHaves is a request body that sends a want and then batches of
+// haves forever, never sending done.
+type endlessHaves struct {
+	buf  bytes.Buffer
+	head string
+	n    int
+}
+
+func (e *endlessHaves) Read(p []byte) (int, error) {
+	if e.buf.Len() == 0 {
+		pw := pktline.NewWriter(&e.buf)
+		if e.n == 0 {
+			pw.WriteString("want " + e.head + "\n")
+		} else {
+			pw.WriteString(fmt.Sprintf("have %040x\n", e.n))
+		}
+		pw.Flush()
+		e.n++
+	}
+	return e.buf.Read(p)
+}
+
+// tinyHaves is a request with an endless batch of have lines, each
+// naming head, which only pkt-line limits stop.
+type tinyHaves struct {
+	buf  bytes.Buffer
+	head string
+	sent bool
+}
+
+func (h *tinyHaves) Read(p []byte) (int, error) {
+	if h.buf.Len() == 0 {
+		pw := pktline.NewWriter(&h.buf)
+		if !h.sent {
+			pw.WriteString("want " + h.head + "\n")
+			pw.Flush()
+			h.sent = true
+		}
+		for range 1000 {
+			pw.WriteString("have " + h.head)
+		}
+	}
+	return h.buf.Read(p)
+}
+
+func TestV2FetchRejectsBadIDs(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	for _, line := range []string{
+		"have a",
+		"have ../../../../../../etc/passwd",
+		"shallow a",
+		"shallow ../../../../../../etc/passwd",
+	} {
+		t.Run(line, func(t *testing.T) {
+			var req bytes.Buffer
+			pw := pktline.NewWriter(&req)
+			pw.WriteString("command=fetch\n")
+			pw.Delim()
+			pw.WriteString("want " + head + "\n")
+			pw.WriteString(line + "\n")
+			pw.WriteString("done\n")
+			pw.Flush()
+
+			var out bytes.Buffer
+			err := NewUploadPack(r).HandleV2Request(&req, &out, nil)
+			var rerr *requestError
+			if !errors.As(err, &rerr) || !strings.Contains(err.Error(), "not a sha1 object id") {
+				t.Fatalf("HandleV2Request error = %v, want an invalid object id", err)
+			}
+			if !strings.Contains(out.String(), "ERR invalid ") {
+				t.Errorf("response has no ERR line: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	for _, tc := range []struct {
+		name  string
+		lines int
+		bytes int64
+		want  string
+	}{
+		{"lines", 100000, 0, "more than 100000 lines"},
+		{"bytes", 0, 1 << 20, "more than 1048576 bytes"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := NewUploadPack(r, WithRequestLimits(tc.lines, tc.bytes)).HandleRequest(&tinyHaves{head: head}, &out)
+			var rerr *requestError
+			if !errors.As(err, &rerr) || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("HandleRequest error = %v, want request error %q", err, tc.want)
+			}
+			if !strings.Contains(out.String(), "ERR request too large") {
+				t.Errorf("response has no ERR line: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestNegotiationLimits(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	for _, tc := range []struct {
+		name string
+		opt  Option
+		want string
+	}{
+		{"rounds", WithMaxNegotiationRounds(5), "too many negotiation rounds"},
+		{"haves", WithMaxHaves(3), "too many haves"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			errc := make(chan error, 1)
+			go func() {
+				errc <- NewUploadPack(r, tc.opt).HandleRequest(&endlessHaves{head: head}, &out)
+			}()
+
+			select {
+			case err := <-errc:
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("HandleRequest error = %v, want %q", err, tc.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("HandleRequest did not abort endless negotiation")
+			}
+
+			// The client is told why it was cut off.
+			if !strings.Contains(out.String(), "ERR "+tc.want) {
+				t.Errorf("response has no ERR line: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestMultipleWantsSharedHistory(t *testing.T) {
+	r, main := newTestRepo(t, 3)
+
+	// Branch off main's root commit with a file of its own.
+	var root string
+	for hash := main; hash != ""; {
+		data, err := r.ReadObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Parents) == 0 {
+			root = hash
+			break
+		}
+		hash = c.Parents[0]
+	}
+	blob, err := r.WriteBlob([]byte("side branch\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := object.NewTree()
+	tree.AddEntry(object.ModeFile, "side.txt", blob)
+	treeHash, err := r.WriteTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := "Side <side@example.com>"
+	side, err := r.WriteCommit(object.NewCommit(treeHash, root, ident, ident, "side"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := NewUploadPack(r)
+	union := make(map[string]bool)
+	for _, want := range []string{main, side} {
+		objects, err := up.collectObjects([]string{want}, nil)
+		if err != nil {
+			t.Fatalf("collecting %s: %v", want, err)
+		}
+		for _, obj := range objects {
+			union[obj.hash] = true
+		}
+	}
+
+	objects, err := up.collectObjects([]string{main, side, main}, nil)
+	if err != nil {
+		t.Fatalf("collecting both tips: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, obj := range objects {
+		if seen[obj.hash] {
+			t.Errorf("object %s collected twice", obj.hash)
+		}
+		seen[obj.hash] = true
+	}
+	if !maps.Equal(seen, union) {
+		t.Errorf("collected %d objects, want the %d in the union of both histories", len(seen), len(union))
+	}
+
+	pack, err := up.createPackfile([]string{main, side})
+	if err != nil {
+		t.Fatalf("creating pack: %v", err)
+	}
+	if got := binary.BigEndian.Uint32(pack[8:12]); int(got) != len(union) {
+		t.Errorf("pack holds %d objects, want %d", got, len(union))
+	}
+
+	if packCacheKey([]string{side, main, side}) != packCacheKey([]string{main, side}) {
+		t.Error("repeated wants change the pack cache key")
+	}
+}
+
+func TestClientErrAborts(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	var req bytes.Buffer
+	pw := pktline.NewWriter(&req)
+	pw.WriteString("want " + head + " side-band-64k\n")
+	pw.Flush()
+	pw.WriteString(fmt.Sprintf("have %040x\n", 1))
+	pw.WriteString("ERR out of disk space\n")
+	// Anything after the ERR must not be acted on.
+	pw.WriteString("done\n")
+
+	var out bytes.Buffer
+	err := NewUploadPack(r).HandleRequest(&req, &out)
+	var abort *ClientAbortError
+	if !errors.As(err, &abort) {
+		t.Fatalf("HandleRequest error = %v, want a ClientAbortError", err)
+	}
+	if abort.Message != "out of disk space" {
+		t.Errorf("abort message = %q, want %q", abort.Message, "out of disk space")
+	}
+	if bytes.Contains(out.Bytes(), []byte("PACK")) {
+		t.Error("a pack was sent after the client aborted")
+	}
+}
+
+func TestWantAfterDone(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	var req bytes.Buffer
+	pw := pktline.NewWriter(&req)
+	pw.WriteString("want " + head + "\n")
+	pw.Flush()
+	pw.WriteString("done\n")
+	pw.WriteString("want " + head + "\n")
+
+	var out bytes.Buffer
+	if err := NewUploadPack(r).HandleRequest(&req, &out); err == nil || !strings.Contains(err.Error(), "want after done") {
+		t.Fatalf("HandleRequest error = %v, want a protocol error", err)
+	}
+	if got, want := out.String(), "0018ERR want after done\n"; got != want {
+		t.Errorf("response = %q, want %q", got, want)
+	}
+}
+
+func TestUnadvertisedCapabilitiesIgnored(t *testing.T) {
+	r, head := newTestRepo(t, 1)
+
+	requested := []string{"side-band-64k", "filter", "frobnicate", "agent=git/2.39.5"}
+	if got, want := NewUploadPack(r).acceptCapabilities(requested), []string{"side-band-64k", "agent=git/2.39.5"}; !slices.Equal(got, want) {
+		t.Errorf("accepted %v, want %v", got, want)
+	}
+	if got, want := NewUploadPack(r, WithFilter(true)).acceptCapabilities(requested), []string{"side-band-64k", "filter", "agent=git/2.39.5"}; !slices.Equal(got, want) {
+		t.Errorf("with filter accepted %v, want %v", got, want)
+	}
+
+	// A fetch asking for an unknown capability still gets its pack.
+	var out bytes.Buffer
+	if err := NewUploadPack(r).HandleRequest(cloneRequest(t, head, "frobnicate", "side-band-64k"), &out); err != nil {
+		t.Fatalf("HandleRequest: %v", err)
+	}
+	if !bytes.HasPrefix(out.Bytes(), []byte("0008NAK\n")) || !bytes.Contains(out.Bytes(), []byte("\x01PACK")) {
+		t.Errorf("response is not a side-band pack: %q", out.Bytes()[:min(out.Len(), 32)])
+	}
+}
+
+func TestDeepHistory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes thousands of commits")
+	}
+	const depth = 10000
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := refs["refs/heads/main"]
+	data, err := r.ReadObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := object.ParseCommit(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Commits sharing the root tree keep the store small.
+	ident := "A <a@example.com>"
+	for i := range depth {
+		if head, err = r.WriteCommit(object.NewCommit(root.Tree, head, ident, ident, fmt.Sprintf("commit %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A walk that recursed per commit would need several megabytes of
+	// stack for this history; exceeding the limit crashes the test.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	var out bytes.Buffer
+	if err := NewUploadPack(r).HandleRequest(cloneRequest(t, head), &out); err != nil {
+		t.Fatalf("HandleRequest: %v", err)
+	}
+	pack, ok := bytes.CutPrefix(out.Bytes(), []byte("0008NAK\n"))
+	if !ok || len(pack) < 12 {
+		t.Fatalf("response is not a pack: %q", out.Bytes()[:min(out.Len(), 16)])
+	}
+	// The initial commit, its tree and blobs, and the chain on top.
+	want := depth + 1 + 1 + len(testContent{}.InitialFiles())
+	if got := int(binary.BigEndian.Uint32(pack[8:12])); got != want {
+		t.Errorf("pack holds %d objects, want %d", got, want)
+	}
+}
+
+func TestZeroOIDWant(t *testing.T) {
+	r, _ := newTestRepo(t, 1)
+
+	var out bytes.Buffer
+	zeroOID := object.SHA1.ZeroID()
+	err := NewUploadPack(r).HandleRequest(cloneRequest(t, zeroOID), &out)
+	if err == nil || !strings.Contains(err.Error(), "zero object id") {
+		t.Fatalf("HandleRequest error = %v, want a zero object id error", err)
+	}
+	if got := out.String(); !strings.HasPrefix(got, fmt.Sprintf("%04xERR invalid want %s", len(got), zeroOID)) {
+		t.Errorf("response = %q, want a single ERR line about the zero object id", got)
+	}
+	if strings.Contains(out.String(), "opening object file") {
+		t.Errorf("response leaks a file error: %q", out.String())
+	}
+}
+
+func TestShallowFetch(t *testing.T) {
+	up, old, head := negotiationRepo(t)
+	// history is the first-parent chain from head, newest first.
+	var history []string
+	for hash := head; ; {
+		history = append(history, hash)
+		c, err := up.readCommit(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Parents) == 0 {
+			break
+		}
+		hash = c.Parents[0]
+	}
+	request := func(lines ...string) io.Reader {
+		var buf bytes.Buffer
+		pw := pktline.NewWriter(&buf)
+		pw.WriteString("want " + head + "\n")
+		for _, line := range lines {
+			if line == "" {
+				pw.Flush()
+			} else {
+				pw.WriteString(line + "\n")
+			}
+		}
+		return &buf
+	}
+	commits := func(st *memory.Storage) int {
+		n := 0
+		for _, obj := range st.Objects {
+			if obj.Type() == plumbing.CommitObject {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name    string
+		req     io.Reader
+		lines   []string
+		commits int
+	}{{
+		name:    "depth",
+		req:     request("deepen 2", "", "done"),
+		lines:   []string{"shallow " + history[1], "NAK"},
+		commits: 2,
+	}, {
+		name:    "deepen a shallow clone",
+		req:     request("shallow "+history[1], "deepen 4", "", "have "+head, "done"),
+		lines:   []string{"shallow " + history[3], "unshallow " + history[1], "ACK " + head},
+		commits: 2,
+	}, {
+		name:    "deepen-not",
+		req:     request("deepen-not refs/tags/old", "", "done"),
+		lines:   []string{"shallow " + history[2], "NAK"},
+		commits: 3,
+	}, {
+		name:    "fetch into a shallow clone",
+		req:     request("shallow "+history[1], "", "have "+head, "done"),
+		lines:   []string{"ACK " + head},
+		commits: 0,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.name == "deepen-not" {
+				if err := up.repo.UpdateRef("refs/tags/old", old); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lines, st := fetchLines(t, up, tc.req)
+			if !slices.Equal(lines, tc.lines) {
+				t.Errorf("lines = %q, want %q", lines, tc.lines)
+			}
+			if st == nil {
+				t.Fatal("no pack")
+			}
+			if got := commits(st); got != tc.commits {
+				t.Errorf("pack holds %d commits, want %d", got, tc.commits)
+			}
+		})
+	}
+
+	t.Run("wants only", func(t *testing.T) {
+		// A stateless client first asks for the shallow section alone.
+		lines, st := fetchLines(t, up, request("deepen 2", ""))
+		if want := []string{"shallow " + history[1]}; !slices.Equal(lines, want) || st != nil {
+			t.Errorf("lines = %q, pack = %t; want %q and no pack", lines, st != nil, want)
+		}
+	})
+
+	t.Run("deepen with deepen-since", func(t *testing.T) {
+		var out bytes.Buffer
+		err := up.HandleRequest(request("deepen 1", "deepen-since 1", "", "done"), &out)
+		if err == nil || !strings.Contains(out.String(), "ERR deepen cannot be combined") {
+			t.Errorf("HandleRequest = %v, %q; want an ERR line", err, out.String())
+		}
+	})
+}
+
+func TestSidebandErrorReachesGit(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	r, head := newTestRepo(t, 1)
+
+	// Serve a v0 ref advertisement, and packs whose blobs vanish once
+	// the walk has found them.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info/refs", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		pw := pktline.NewWriter(w)
+		pw.WriteString("# service=git-upload-pack\n")
+		pw.Flush()
+		caps := NewUploadPack(r).Capabilities()
+		pw.WriteString(head + " HEAD\x00" + strings.Join(caps, " ") + "\n")
+		pw.WriteString(head + " refs/heads/main\n")
+		pw.Flush()
+	})
+	mux.HandleFunc("/git-upload-pack", func(w http.ResponseWriter, req *http.Request) {
+		up := NewUploadPack(r)
+		var mu sync.Mutex
+		reads := make(map[string]int)
+		up.readStream = func(hash string) (object.Type, int64, io.ReadCloser, error) {
+			typ, size, rc, err := r.ReadObjectStream(hash)
+			mu.Lock()
+			reads[hash]++
+			n := reads[hash]
+			mu.Unlock()
+			if err == nil && typ == object.TypeBlob && n > 1 {
+				rc.Close()
+				return "", 0, nil, fmt.Errorf("object %s vanished", hash)
+			}
+			return typ, size, rc, err
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		up.HandleRequest(req.Body, w)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	out, err := exec.Command(gitBin, "-c", "protocol.version=0", "clone", ts.URL, t.TempDir()).CombinedOutput()
+	if err == nil {
+		t.Fatalf("clone succeeded despite a failed read:\n%s", out)
+	}
+	if !regexp.MustCompile(`remote: fatal: .* vanished`).Match(out) {
+		t.Errorf("git output does not show the remote error:\n%s", out)
+	}
+}
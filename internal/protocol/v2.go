@@ -0,0 +1,306 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/imjasonh/infinite-git/internal/pktline"
+)
+
+// V2Request is a protocol v2 request: a command, its capabilities, and
+// after a delim-pkt, its arguments.
+type V2Request struct {
+	Command      string
+	Capabilities []string
+	Args         []string
+}
+
+// Ref is a ref listed by ls-refs.
+type Ref struct {
+	Name string
+	Hash string
+	// Target is the ref a symbolic ref such as HEAD points at, if any.
+	Target string
+}
+
+// V2Capabilities returns the protocol v2 capability advertisement, the
+// lines that follow "version 2".
+func (u *UploadPack) V2Capabilities() []string {
+	var caps []string
+	for _, c := range u.repo.GetCapabilities() {
+		if strings.HasPrefix(c, "agent=") {
+			caps = append(caps, c)
+		}
+	}
+	fetch := "fetch=shallow"
+	if u.filter {
+		fetch += " filter"
+	}
+	return append(caps, "ls-refs", fetch, "object-format="+string(u.repo.Format()))
+}
+
+// ParseV2Request reads a protocol v2 request. Like a v0 request over
+// smart HTTP, it must end in a flush.
+func ParseV2Request(r *pktline.Reader) (*V2Request, error) {
+	req := &V2Request{}
+	args := false
+	for {
+		line, err := r.ReadString()
+		switch {
+		case errors.Is(err, pktline.ErrDelim) && !args:
+			args = true
+			continue
+		case err == io.EOF:
+			if !r.Flushed() {
+				return nil, newRequestError("request ended before its flush")
+			}
+			if req.Command == "" {
+				return nil, newRequestError("request has no command")
+			}
+			return req, nil
+		case err != nil:
+			return nil, readError("request", err)
+		}
+
+		if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+			return nil, &ClientAbortError{Message: msg}
+		}
+		switch {
+		case args:
+			req.Args = append(req.Args, line)
+		case strings.HasPrefix(line, "command="):
+			req.Command = line[len("command="):]
+		default:
+			req.Capabilities = append(req.Capabilities, line)
+		}
+	}
+}
+
+// HandleV2Request processes a protocol v2 request to upload-pack: ls-refs,
+// which lists the refs that refs returns, or fetch.
+func (u *UploadPack) HandleV2Request(r io.Reader, w io.Writer, refs func() ([]Ref, error)) error {
+	reader := pktline.NewReader(r, pktline.WithMaxLines(u.maxLines), pktline.WithMaxBytes(u.maxBytes))
+	pw := pktline.NewWriter(w)
+
+	req, err := ParseV2Request(reader)
+	if err == nil {
+		for _, c := range req.Capabilities {
+			if format, ok := strings.CutPrefix(c, "object-format="); ok && format != string(u.repo.Format()) {
+				err = newRequestError("object-format %s requested, but the repository uses %s", format, u.repo.Format())
+			}
+		}
+	}
+	if err != nil {
+		var rerr *requestError
+		if errors.As(err, &rerr) {
+			return writeErr(pw, err)
+		}
+		return err
+	}
+
+	switch req.Command {
+	case "ls-refs":
+		return u.lsRefs(pw, req.Args, refs)
+	case "fetch":
+		return u.fetchV2(w, req.Args)
+	default:
+		return writeErr(pw, newRequestError("unknown command %q", req.Command))
+	}
+}
+
+// lsRefs answers ls-refs with the refs that match the ref-prefix
+// arguments, with their symref targets and peeled tags if asked for.
+func (u *UploadPack) lsRefs(pw *pktline.Writer, args []string, refs func() ([]Ref, error)) error {
+	var symrefs, peel bool
+	var prefixes []string
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			// Not advertised; the head is never unborn anyway.
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, arg[len("ref-prefix "):])
+		default:
+			return writeErr(pw, newRequestError("unexpected ls-refs argument %q", arg))
+		}
+	}
+
+	list, err := refs()
+	if err != nil {
+		return fmt.Errorf("listing refs: %w", writeErr(pw, err))
+	}
+	for _, ref := range list {
+		if len(prefixes) > 0 && !hasAnyPrefix(ref.Name, prefixes) {
+			continue
+		}
+		line := ref.Hash + " " + ref.Name
+		if symrefs && ref.Target != "" {
+			line += " symref-target:" + ref.Target
+		}
+		if peel {
+			peeled, _, err := u.peel(ref.Hash)
+			if err != nil {
+				return fmt.Errorf("peeling %s: %w", ref.Name, writeErr(pw, err))
+			}
+			if peeled != ref.Hash {
+				line += " peeled:" + peeled
+			}
+		}
+		if err := pw.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("writing ref: %w", err)
+		}
+	}
+	return pw.Flush()
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchV2 answers a v2 fetch. Without done, the haves are acknowledged
+// and, unless every want reaches a common commit, the response ends
+// there for the client's next round. Otherwise the shallow section, if
+// any, and the packfile follow, built as for v0. The packfile is always
+// multiplexed.
+func (u *UploadPack) fetchV2(w io.Writer, args []string) error {
+	format := u.repo.Format()
+	req := &FetchRequest{Capabilities: []string{"side-band-64k"}}
+	pw := pktline.NewWriter(w)
+	for _, arg := range args {
+		known, err := req.parseWantLine(arg, format)
+		if err != nil {
+			return writeErr(pw, err)
+		}
+		if known {
+			continue
+		}
+		switch {
+		case arg == "thin-pack", arg == "no-progress", arg == "include-tag", arg == "ofs-delta":
+			req.Capabilities = append(req.Capabilities, arg)
+		case arg == "done":
+			req.Done = true
+		case strings.HasPrefix(arg, "have "):
+			if err := req.addHave(arg[len("have "):], format, u.maxHaves); err != nil {
+				return writeErr(pw, err)
+			}
+		default:
+			return writeErr(pw, newRequestError("unexpected fetch argument %q", arg))
+		}
+	}
+	if len(req.Haves) > 0 {
+		req.Rounds, req.HaveRounds = 1, []int{len(req.Haves)}
+	}
+	req.Capabilities = u.acceptCapabilities(req.Capabilities)
+	if u.onRequest != nil {
+		u.onRequest(req)
+	}
+	resp := NewFetchResponse(w, req.Capabilities)
+	if len(req.Wants) == 0 {
+		return resp.Err(newRequestError("fetch has no wants"))
+	}
+	f, err := u.requestFilter(req, resp)
+	if err != nil {
+		return err
+	}
+	sh, err := u.requestShallow(req, resp)
+	if err != nil {
+		return err
+	}
+
+	if !req.Done {
+		ready, err := u.acknowledge(req, pw)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			return pw.Flush()
+		}
+		if err := pw.Delim(); err != nil {
+			return fmt.Errorf("ending acknowledgments: %w", err)
+		}
+	}
+
+	return u.sendPack(req, resp, sh, f, func() error {
+		if sh != nil && sh.update {
+			if err := pw.WriteString("shallow-info\n"); err != nil {
+				return fmt.Errorf("writing shallow-info: %w", err)
+			}
+			if err := sh.write(resp); err != nil {
+				return err
+			}
+			if err := pw.Delim(); err != nil {
+				return fmt.Errorf("ending shallow-info: %w", err)
+			}
+		}
+		if err := pw.WriteString("packfile\n"); err != nil {
+			return fmt.Errorf("writing packfile header: %w", err)
+		}
+		return nil
+	})
+}
+
+// acknowledge writes the acknowledgments section: an ACK for each have
+// the server has too, or NAK if none, then ready if the pack can be built
+// now. It reports whether it said ready.
+func (u *UploadPack) acknowledge(req *FetchRequest, pw *pktline.Writer) (bool, error) {
+	if err := pw.WriteString("acknowledgments\n"); err != nil {
+		return false, fmt.Errorf("writing acknowledgments: %w", err)
+	}
+	var common []string
+	giveUp := u.newGiveUpWalk(req.Wants)
+	for _, have := range req.Haves {
+		ok, err := u.hasObject(have)
+		if err != nil {
+			return false, fmt.Errorf("checking have %s: %w", have, err)
+		}
+		if !ok {
+			continue
+		}
+		common = append(common, have)
+		if err := giveUp.addCommon(have); err != nil {
+			return false, err
+		}
+		if err := pw.WriteString("ACK " + have + "\n"); err != nil {
+			return false, fmt.Errorf("writing ACK: %w", err)
+		}
+	}
+	if len(common) == 0 {
+		if err := pw.WriteString("NAK\n"); err != nil {
+			return false, fmt.Errorf("writing NAK: %w", err)
+		}
+	}
+	ready, err := giveUp.ok()
+	if err != nil {
+		return false, err
+	}
+	if ready {
+		if err := pw.WriteString("ready\n"); err != nil {
+			return false, fmt.Errorf("writing ready: %w", err)
+		}
+	}
+	return ready, nil
+}
+
+// requestShallow works out the shallow boundary of req, telling the
+// client if it cannot.
+func (u *UploadPack) requestShallow(req *FetchRequest, resp *FetchResponse) (*shallowInfo, error) {
+	sh, err := u.shallow(req)
+	if err != nil {
+		var rerr *requestError
+		if errors.As(err, &rerr) {
+			return nil, resp.Err(err)
+		}
+		return nil, fmt.Errorf("computing shallow boundary: %w", resp.Err(err))
+	}
+	return sh, nil
+}
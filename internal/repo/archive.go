@@ -0,0 +1,149 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/imjasonh/infinite-git/internal/clock"
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/packfile"
+)
+
+// OpenArchive loads the git bundle at path, as written by git bundle
+// create and optionally gzipped, into a read-only repository held in
+// memory. The bundle must be complete, with no prerequisite commits, and
+// include refs/heads/main, which HEAD points at. Only SHA-1 bundles are
+// supported.
+func OpenArchive(path string) (*Repository, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening archive: %w", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var in io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening archive: %w", err)
+		}
+		defer zr.Close()
+		in = zr
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive: %w", err)
+	}
+
+	refs, pack, err := parseBundle(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %w", path, err)
+	}
+	main, ok := refs["refs/heads/main"]
+	if !ok {
+		return nil, fmt.Errorf("archive %s has no refs/heads/main", path)
+	}
+	refs["HEAD"] = main
+
+	store, err := loadPack(pack)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %w", path, err)
+	}
+	for name, hash := range refs {
+		if _, ok := store[hash]; !ok {
+			return nil, fmt.Errorf("archive %s: %s points at %s, which is not in the pack", path, name, hash)
+		}
+	}
+
+	return &Repository{
+		clock:  clock.Real{},
+		format: object.SHA1,
+		store:  store,
+		refs:   refs,
+	}, nil
+}
+
+// parseBundle splits a v2 or v3 bundle into its refs and its pack.
+func parseBundle(data []byte) (map[string]string, []byte, error) {
+	refs := make(map[string]string)
+	for i := 0; ; i++ {
+		n := bytes.IndexByte(data, '\n')
+		if n == -1 {
+			return nil, nil, fmt.Errorf("bundle header is not terminated")
+		}
+		line := string(data[:n])
+		data = data[n+1:]
+
+		switch {
+		case i == 0:
+			if line != "# v2 git bundle" && line != "# v3 git bundle" {
+				return nil, nil, fmt.Errorf("not a git bundle")
+			}
+		case line == "":
+			return refs, data, nil
+		case strings.HasPrefix(line, "@"):
+			// v3 capabilities; only the default object format is known.
+			if strings.HasPrefix(line, "@object-format=") && line != "@object-format=sha1" {
+				return nil, nil, fmt.Errorf("unsupported bundle %s", line[1:])
+			}
+		case strings.HasPrefix(line, "-"):
+			return nil, nil, fmt.Errorf("bundle needs prerequisite %s", strings.Fields(line[1:])[0])
+		default:
+			hash, name, ok := strings.Cut(line, " ")
+			if !ok || !object.SHA1.ValidHash(hash) {
+				return nil, nil, fmt.Errorf("invalid bundle ref line %q", line)
+			}
+			if name != "HEAD" {
+				if err := ValidateRefName(name); err != nil {
+					return nil, nil, err
+				}
+				refs[name] = hash
+			}
+		}
+	}
+}
+
+// packTypes maps pack object types to object types.
+var packTypes = map[int]object.Type{
+	packfile.OBJ_COMMIT: object.TypeCommit,
+	packfile.OBJ_TREE:   object.TypeTree,
+	packfile.OBJ_BLOB:   object.TypeBlob,
+	packfile.OBJ_TAG:    object.TypeTag,
+}
+
+// loadPack reads every object in pack into memory.
+func loadPack(pack []byte) (memoryStorage, error) {
+	pr, err := packfile.NewReader(pack)
+	if err != nil {
+		return nil, err
+	}
+	if len(pack) < 12+sha1.Size {
+		return nil, fmt.Errorf("pack is truncated")
+	}
+	if sum := sha1.Sum(pack[:len(pack)-sha1.Size]); !bytes.Equal(sum[:], pack[len(pack)-sha1.Size:]) {
+		return nil, fmt.Errorf("pack checksum mismatch")
+	}
+	count := int(binary.BigEndian.Uint32(pack[8:12]))
+	store := make(memoryStorage, count)
+	for i := range count {
+		typ, data, err := pr.ReadObject()
+		if err != nil {
+			return nil, fmt.Errorf("reading pack object %d: %w", i, err)
+		}
+		t, ok := packTypes[typ]
+		if !ok {
+			return nil, fmt.Errorf("pack object %d has unknown type %d", i, typ)
+		}
+		o := rawObject{t, data}
+		store[object.SHA1.Hash(o)] = o
+	}
+	return store, nil
+}
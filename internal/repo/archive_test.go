@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// writeBundle builds a repository with the git binary and bundles its
+// main branch, returning the bundle's path and main's hash.
+func writeBundle(t *testing.T, gitBin string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command(gitBin, append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main")
+	// Grow a file a little each commit, so the bundle's pack holds deltas.
+	content := strings.Repeat("a line that stays the same\n", 200)
+	for i := range 3 {
+		content += strings.Repeat("x", i+1) + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", ".")
+		git("commit", "-q", "-m", "commit")
+	}
+	git("tag", "v1")
+	bundle := filepath.Join(t.TempDir(), "repo.bundle")
+	git("bundle", "create", bundle, "main", "v1")
+	return bundle, git("rev-parse", "main")
+}
+
+func TestOpenArchive(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	bundle, head := writeBundle(t, gitBin)
+
+	// The same bundle gzipped loads the same way.
+	data, err := os.ReadFile(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	gzipped := filepath.Join(t.TempDir(), "repo.bundle.gz")
+	if err := os.WriteFile(gzipped, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{bundle, gzipped} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			r, err := OpenArchive(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs, err := r.GetRefs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refs["HEAD"] != head || refs["refs/heads/main"] != head || refs["refs/tags/v1"] != head {
+				t.Errorf("refs = %v, want HEAD, main and v1 at %s", refs, head)
+			}
+
+			// Every reachable object reads back and hashes to its name.
+			log, err := r.FirstParentLog(head, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(log) != 3 {
+				t.Errorf("history has %d commits, want 3", len(log))
+			}
+			err = r.walkReachable([]string{head}, r.VerifyObject)
+			if err != nil {
+				t.Errorf("verifying objects: %v", err)
+			}
+
+			if _, err := r.ReadObject(object.SHA1.ZeroID()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("reading a missing object: %v, want fs.ErrNotExist", err)
+			}
+			if _, err := r.WriteBlob([]byte("new")); err == nil {
+				t.Error("WriteBlob succeeded on an archive")
+			}
+			if err := r.UpdateRef("refs/heads/main", head); err == nil {
+				t.Error("UpdateRef succeeded on an archive")
+			}
+		})
+	}
+}
+
+func TestOpenArchiveErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"not a bundle", "hello\n", "not a git bundle"},
+		{"prerequisite", "# v2 git bundle\n-" + strings.Repeat("a", 40) + " base\n\nPACK", "prerequisite"},
+		{"sha256", "# v3 git bundle\n@object-format=sha256\n\nPACK", "unsupported bundle"},
+		{"no main", "# v2 git bundle\n" + strings.Repeat("a", 40) + " refs/heads/other\n\n", "no refs/heads/main"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenArchive(path); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("OpenArchive error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
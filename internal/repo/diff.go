@@ -0,0 +1,147 @@
+package repo
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// ChangeKind says how a path differs between two commits.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"
+	Modified ChangeKind = "modified"
+	Deleted  ChangeKind = "deleted"
+)
+
+// Change is a file, symlink or submodule that differs between two
+// commits. OldHash is empty for an added path and NewHash for a deleted
+// one.
+type Change struct {
+	Kind    ChangeKind
+	Path    string
+	OldHash string
+	NewHash string
+}
+
+// Diff returns the paths that differ between the trees of oldCommit and
+// newCommit, in tree order. Directories are compared recursively, so
+// only the entries within them are reported. An empty oldCommit compares
+// against an empty tree, listing everything in newCommit as added.
+func (r *Repository) Diff(oldCommit, newCommit string) ([]Change, error) {
+	oldTree, err := r.commitTree(oldCommit)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := r.commitTree(newCommit)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	if err := r.diffTrees("", oldTree, newTree, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// commitTree returns the tree hash of a commit, or "" for no commit.
+func (r *Repository) commitTree(hash string) (string, error) {
+	if hash == "" {
+		return "", nil
+	}
+	data, err := r.ReadObject(hash)
+	if err != nil {
+		return "", fmt.Errorf("reading commit %s: %w", hash, err)
+	}
+	c, err := object.ParseCommit(data)
+	if err != nil {
+		return "", fmt.Errorf("parsing commit %s: %w", hash, err)
+	}
+	return c.Tree, nil
+}
+
+// treeEntries returns the entries of a tree by name, or none for "".
+func (r *Repository) treeEntries(hash string) (map[string]object.TreeEntry, error) {
+	entries := make(map[string]object.TreeEntry)
+	if hash == "" {
+		return entries, nil
+	}
+	data, err := r.ReadObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("reading tree %s: %w", hash, err)
+	}
+	tree, err := r.format.ParseTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing tree %s: %w", hash, err)
+	}
+	for _, e := range tree.Entries {
+		entries[e.Name] = e
+	}
+	return entries, nil
+}
+
+// isDir reports whether a tree entry is a subtree.
+func isDir(e object.TreeEntry) bool {
+	return e.Mode == object.ModeDir || e.Mode == "040000"
+}
+
+// diffTrees appends the changes between the trees at oldHash and
+// newHash, either of which may be "", to changes, naming them under
+// prefix.
+func (r *Repository) diffTrees(prefix, oldHash, newHash string, changes *[]Change) error {
+	if oldHash == newHash {
+		return nil
+	}
+	oldEntries, err := r.treeEntries(oldHash)
+	if err != nil {
+		return err
+	}
+	newEntries, err := r.treeEntries(newHash)
+	if err != nil {
+		return err
+	}
+
+	names := slices.Sorted(maps.Keys(oldEntries))
+	for name := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		path := prefix + name
+		o, inOld := oldEntries[name]
+		n, inNew := newEntries[name]
+
+		// A directory on either side is walked for the files within it;
+		// one replaced by a file is those files deleted and it added.
+		var oldDir, newDir string
+		if inOld && isDir(o) {
+			oldDir, inOld = o.Hash, false
+		}
+		if inNew && isDir(n) {
+			newDir, inNew = n.Hash, false
+		}
+		if oldDir != "" || newDir != "" {
+			if err := r.diffTrees(path+"/", oldDir, newDir, changes); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case inOld && inNew:
+			if o.Hash != n.Hash || o.Mode != n.Mode {
+				*changes = append(*changes, Change{Kind: Modified, Path: path, OldHash: o.Hash, NewHash: n.Hash})
+			}
+		case inOld:
+			*changes = append(*changes, Change{Kind: Deleted, Path: path, OldHash: o.Hash})
+		case inNew:
+			*changes = append(*changes, Change{Kind: Added, Path: path, NewHash: n.Hash})
+		}
+	}
+	return nil
+}
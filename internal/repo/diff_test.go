@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestDiff(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"hello.txt": []byte("Pull #0\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := refs["refs/heads/main"]
+
+	blob := func(content string) string {
+		t.Helper()
+		hash, err := r.WriteBlob([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	tree := func(entries ...object.TreeEntry) string {
+		t.Helper()
+		tree := object.NewTree()
+		for _, e := range entries {
+			tree.AddEntry(e.Mode, e.Name, e.Hash)
+		}
+		hash, err := r.WriteTree(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	file := func(name, hash string) object.TreeEntry {
+		return object.TreeEntry{Mode: object.ModeFile, Name: name, Hash: hash}
+	}
+	dir := func(name, hash string) object.TreeEntry {
+		return object.TreeEntry{Mode: object.ModeDir, Name: name, Hash: hash}
+	}
+	commit := func(tree, parent string) string {
+		t.Helper()
+		hash, err := r.WriteCommit(object.NewCommit(tree, parent, "A <a@example.com>", "A <a@example.com>", "commit\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	// A child that adds one file beside the parent's, as the generator's
+	// extra files do.
+	hello := blob("Pull #0\n")
+	added := blob("Pull #1, file 1\n")
+	child := commit(tree(file("hello.txt", hello), file("pull-1-file-1.txt", added)), parent)
+	changes, err := r.Diff(parent, child)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if want := []Change{{Kind: Added, Path: "pull-1-file-1.txt", NewHash: added}}; !slices.Equal(changes, want) {
+		t.Errorf("Diff = %+v, want %+v", changes, want)
+	}
+
+	if changes, err := r.Diff(child, child); err != nil || len(changes) != 0 {
+		t.Errorf("Diff of a commit with itself = %+v, %v, want none", changes, err)
+	}
+
+	// Changes within directories are reported by their full paths.
+	a1, a2, b, d := blob("a1\n"), blob("a2\n"), blob("b\n"), blob("d\n")
+	before := commit(tree(dir("dir", tree(file("a", a1), file("b", b))), file("hello.txt", hello)), "")
+	after := commit(tree(dir("dir", tree(file("a", a2))), dir("new", tree(file("d", d)))), before)
+	changes, err = r.Diff(before, after)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	want := []Change{
+		{Kind: Modified, Path: "dir/a", OldHash: a1, NewHash: a2},
+		{Kind: Deleted, Path: "dir/b", OldHash: b},
+		{Kind: Deleted, Path: "hello.txt", OldHash: hello},
+		{Kind: Added, Path: "new/d", NewHash: d},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("Diff = %+v, want %+v", changes, want)
+	}
+
+	// With no old commit, everything is added.
+	changes, err = r.Diff("", child)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Kind != Added || changes[1].Kind != Added {
+		t.Errorf("Diff from nothing = %+v, want two additions", changes)
+	}
+}
@@ -0,0 +1,32 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// FirstParentLog returns the commits from start back to the root,
+// following only first parents, so the history merged in by a merge
+// commit is skipped. It returns at most limit commits, or all of them if
+// limit is zero or less.
+func (r *Repository) FirstParentLog(start string, limit int) ([]*object.Commit, error) {
+	var log []*object.Commit
+	for hash := start; hash != "" && (limit <= 0 || len(log) < limit); {
+		data, err := r.ReadObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("reading commit %s: %w", hash, err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing commit %s: %w", hash, err)
+		}
+		log = append(log, c)
+
+		hash = ""
+		if len(c.Parents) > 0 {
+			hash = c.Parents[0]
+		}
+	}
+	return log, nil
+}
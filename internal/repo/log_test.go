@@ -0,0 +1,67 @@
+package repo
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestFirstParentLog(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"a.txt": []byte("a\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	tree, err := r.WriteTree(object.NewTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(msg string, parents ...string) string {
+		t.Helper()
+		c := object.NewCommit(tree, "", "A <a@example.com>", "A <a@example.com>", msg)
+		c.Parents = parents
+		hash, err := r.WriteCommit(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	// root - main1 ----- m - main2
+	//      \            /
+	//       side1 - side2
+	root := commit("root\n")
+	main1 := commit("main1\n", root)
+	side1 := commit("side1\n", root)
+	side2 := commit("side2\n", side1)
+	m := commit("merge\n", main1, side2)
+	main2 := commit("main2\n", m)
+
+	messages := func(log []*object.Commit) []string {
+		var msgs []string
+		for _, c := range log {
+			msgs = append(msgs, c.Message)
+		}
+		return msgs
+	}
+
+	log, err := r.FirstParentLog(main2, 0)
+	if err != nil {
+		t.Fatalf("FirstParentLog: %v", err)
+	}
+	if got, want := messages(log), []string{"main2\n", "merge\n", "main1\n", "root\n"}; !slices.Equal(got, want) {
+		t.Errorf("FirstParentLog = %q, want %q", got, want)
+	}
+
+	log, err = r.FirstParentLog(main2, 2)
+	if err != nil {
+		t.Fatalf("FirstParentLog with limit: %v", err)
+	}
+	if got, want := messages(log), []string{"main2\n", "merge\n"}; !slices.Equal(got, want) {
+		t.Errorf("FirstParentLog limit 2 = %q, want %q", got, want)
+	}
+
+	if _, err := r.FirstParentLog(tree, 0); err == nil {
+		t.Error("FirstParentLog of a tree succeeded, want an error")
+	}
+}
@@ -0,0 +1,199 @@
+package repo
+
+import (
+	"container/heap"
+	"fmt"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// Flags painted onto commits while searching for a merge base.
+const (
+	fromA = 1 << iota
+	fromB
+	stale
+	isResult
+)
+
+// MergeBase returns the best common ancestor of commits a and b: a common
+// ancestor that is not an ancestor of any other common ancestor. When
+// there are several (a criss-cross merge), the most recently committed is
+// returned. It returns "" if the commits share no history.
+func (r *Repository) MergeBase(a, b string) (string, error) {
+	w := &mergeBaseWalk{r: r, flags: make(map[string]int), commits: make(map[string]*object.Commit)}
+	bases, err := w.mergeBases(a, b)
+	if err != nil {
+		return "", err
+	}
+	var best string
+	for _, hash := range bases {
+		if best == "" || w.commits[hash].CommitDate.After(w.commits[best].CommitDate) {
+			best = hash
+		}
+	}
+	return best, nil
+}
+
+// mergeBases returns every best common ancestor of a and b, as git
+// merge-base --all does.
+func (w *mergeBaseWalk) mergeBases(a, b string) ([]string, error) {
+	if a == b {
+		if _, err := w.commit(a); err != nil {
+			return nil, err
+		}
+		return []string{a}, nil
+	}
+	if err := w.push(a, fromA); err != nil {
+		return nil, err
+	}
+	if err := w.push(b, fromB); err != nil {
+		return nil, err
+	}
+
+	// Walk newest first, painting each commit with the sides it is
+	// reachable from. A commit reachable from both is a candidate, and
+	// everything below it is stale: it can only be a worse candidate.
+	var results []string
+	for w.hasFresh() {
+		hash := heap.Pop(&w.queue).(queued).hash
+		flags := w.flags[hash] & (fromA | fromB | stale)
+		if flags == fromA|fromB {
+			if w.flags[hash]&isResult == 0 {
+				w.flags[hash] |= isResult
+				results = append(results, hash)
+			}
+			flags |= stale
+		}
+		for _, parent := range w.commits[hash].Parents {
+			if w.flags[parent]&flags == flags {
+				continue
+			}
+			if err := w.push(parent, flags); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The walk stops once nothing fresh is queued, so the stale paint
+	// need not have reached every candidate below another. Drop those
+	// reachable from the rest, as git's remove_redundant does.
+	if len(results) < 2 {
+		return results, nil
+	}
+	var bases []string
+	for _, hash := range results {
+		redundant, err := w.reachableFromOthers(hash, results)
+		if err != nil {
+			return nil, err
+		}
+		if !redundant {
+			bases = append(bases, hash)
+		}
+	}
+	return bases, nil
+}
+
+// mergeBaseWalk holds the state of one MergeBase search.
+type mergeBaseWalk struct {
+	r       *Repository
+	flags   map[string]int
+	commits map[string]*object.Commit
+	queue   commitQueue
+}
+
+// push paints hash with flags and queues it, reading it if needed.
+func (w *mergeBaseWalk) push(hash string, flags int) error {
+	if _, err := w.commit(hash); err != nil {
+		return err
+	}
+	w.flags[hash] |= flags
+	heap.Push(&w.queue, queued{hash: hash, date: w.commits[hash].CommitDate.Unix()})
+	return nil
+}
+
+// commit reads and caches a commit.
+func (w *mergeBaseWalk) commit(hash string) (*object.Commit, error) {
+	if c, ok := w.commits[hash]; ok {
+		return c, nil
+	}
+	data, err := w.r.ReadObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("reading commit %s: %w", hash, err)
+	}
+	c, err := object.ParseCommit(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing commit %s: %w", hash, err)
+	}
+	w.commits[hash] = c
+	return c, nil
+}
+
+// hasFresh reports whether any queued commit is not yet stale.
+func (w *mergeBaseWalk) hasFresh() bool {
+	for _, q := range w.queue.items {
+		if w.flags[q.hash]&stale == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reachableFromOthers reports whether hash is an ancestor of any other
+// commit in candidates.
+func (w *mergeBaseWalk) reachableFromOthers(hash string, candidates []string) (bool, error) {
+	for _, other := range candidates {
+		if other == hash {
+			continue
+		}
+		seen := map[string]bool{}
+		stack := []string{other}
+		for len(stack) > 0 {
+			cur := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if seen[cur] {
+				continue
+			}
+			seen[cur] = true
+			c, err := w.commit(cur)
+			if err != nil {
+				return false, err
+			}
+			for _, p := range c.Parents {
+				if p == hash {
+					return true, nil
+				}
+				stack = append(stack, p)
+			}
+		}
+	}
+	return false, nil
+}
+
+type queued struct {
+	hash string
+	date int64
+}
+
+// commitQueue is a max-heap of commits by commit date, ties broken by
+// hash so walks are deterministic.
+type commitQueue struct{ items []queued }
+
+func (q commitQueue) Len() int { return len(q.items) }
+
+func (q commitQueue) Less(i, j int) bool {
+	if q.items[i].date != q.items[j].date {
+		return q.items[i].date > q.items[j].date
+	}
+	return q.items[i].hash < q.items[j].hash
+}
+
+func (q commitQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+
+func (q *commitQueue) Push(x any) { q.items = append(q.items, x.(queued)) }
+
+func (q *commitQueue) Pop() any {
+	old := q.items
+	item := old[len(old)-1]
+	q.items = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,195 @@
+package repo
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestMergeBase(t *testing.T) {
+	t.Run("ordered dates", func(t *testing.T) { testMergeBase(t, time.Minute) })
+	// Commits made in the same second are walked in hash order, which
+	// can visit a parent before its child.
+	t.Run("equal dates", func(t *testing.T) { testMergeBase(t, 0) })
+}
+
+func testMergeBase(t *testing.T, step time.Duration) {
+	r, err := New(t.TempDir(), map[string][]byte{"a.txt": []byte("a\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	tree, err := r.WriteTree(object.NewTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Unix(1700000000, 0)
+	commit := func(msg string, parents ...string) string {
+		t.Helper()
+		when = when.Add(step)
+		c := object.NewCommit(tree, "", "A <a@example.com>", "A <a@example.com>", msg)
+		c.Parents = parents
+		c.AuthorDate, c.CommitDate = when, when
+		hash, err := r.WriteCommit(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	//        a1 - a2 ---- m
+	//       /            /
+	// root - c1 - base - b1 - b2
+	//
+	// (a1 branches from base.)
+	root := commit("root")
+	c1 := commit("c1", root)
+	base := commit("base", c1)
+	a1 := commit("a1", base)
+	b1 := commit("b1", base)
+	a2 := commit("a2", a1)
+	b2 := commit("b2", b1)
+	m := commit("merge", a2, b1)
+	other := commit("unrelated root")
+
+	for _, tc := range []struct {
+		name, a, b, want string
+	}{
+		{"divergent tips", a2, b2, base},
+		{"symmetric", b2, a2, base},
+		{"ancestor", a2, c1, c1},
+		{"same commit", b2, b2, b2},
+		{"merge and merged branch", m, b2, b1},
+		{"unrelated histories", a2, other, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := r.MergeBase(tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("MergeBase: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("MergeBase = %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := r.MergeBase(a2, "0000000000000000000000000000000000000001"); err == nil {
+		t.Error("MergeBase succeeded with a missing commit")
+	}
+}
+
+// TestMergeBasesMatchGit compares the merge bases of criss-cross
+// histories whose commits all share one timestamp with git merge-base
+// --all, which the walk order alone cannot get right.
+func TestMergeBasesMatchGit(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+
+	// Each history lists commits by name with their parents; the merge
+	// bases of the last two are checked.
+	for _, tc := range []struct {
+		name    string
+		history [][]string
+	}{
+		{"criss-cross", [][]string{
+			{"root"}, {"x1", "root"}, {"y1", "root"},
+			{"x2", "x1", "y1"}, {"y2", "y1", "x1"},
+		}},
+		{"criss-cross below tips", [][]string{
+			{"root"}, {"x1", "root"}, {"y1", "root"},
+			{"x2", "x1", "y1"}, {"y2", "y1", "x1"},
+			{"x3", "x2"}, {"y3", "y2"},
+		}},
+		{"base below another base", [][]string{
+			{"root"}, {"p", "root"}, {"q", "p"}, {"s", "p"},
+			{"x", "q", "s"}, {"y", "s", "root"},
+		}},
+		{"triple criss-cross", [][]string{
+			{"root"}, {"x1", "root"}, {"y1", "root"}, {"z1", "root"},
+			{"x2", "x1", "y1", "z1"}, {"y2", "y1", "z1", "x1"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			compareMergeBases(t, gitBin, tc.history)
+		})
+	}
+
+	// Random histories find the cases the table misses.
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 50 {
+		var history [][]string
+		for j := range 12 {
+			c := []string{fmt.Sprintf("c%d", j)}
+			if j > 0 {
+				for range 1 + rng.IntN(2) {
+					c = append(c, fmt.Sprintf("c%d", rng.IntN(j)))
+				}
+				c = append(c[:1], slices.Compact(slices.Sorted(slices.Values(c[1:])))...)
+			}
+			history = append(history, c)
+		}
+		t.Run(fmt.Sprintf("random %d", i), func(t *testing.T) {
+			compareMergeBases(t, gitBin, history)
+		})
+	}
+}
+
+// compareMergeBases writes history with every commit at the same time and
+// checks the merge bases of its last two commits against git's.
+func compareMergeBases(t *testing.T, gitBin string, history [][]string) {
+	t.Helper()
+	r, err := New(t.TempDir(), map[string][]byte{"a.txt": []byte("a\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	tree, err := r.WriteTree(object.NewTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1700000000, 0)
+	hashes := make(map[string]string)
+	for _, c := range history {
+		commit := object.NewCommit(tree, "", "A <a@example.com>", "A <a@example.com>", c[0])
+		for _, p := range c[1:] {
+			commit.Parents = append(commit.Parents, hashes[p])
+		}
+		commit.AuthorDate, commit.CommitDate = when, when
+		if hashes[c[0]], err = r.WriteCommit(commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := hashes[history[len(history)-2][0]], hashes[history[len(history)-1][0]]
+
+	out, err := exec.Command(gitBin, "--git-dir", r.GitDir(), "merge-base", "--all", a, b).Output()
+	if err != nil && len(out) != 0 {
+		t.Fatalf("git merge-base failed: %v", err)
+	}
+	want := strings.Fields(string(out))
+	slices.Sort(want)
+
+	w := &mergeBaseWalk{r: r, flags: make(map[string]int), commits: make(map[string]*object.Commit)}
+	got, err := w.mergeBases(a, b)
+	if err != nil {
+		t.Fatalf("mergeBases: %v", err)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("mergeBases = %v, want %v", got, want)
+	}
+
+	best, err := r.MergeBase(a, b)
+	if err != nil {
+		t.Fatalf("MergeBase: %v", err)
+	}
+	if (best == "") != (len(want) == 0) || (best != "" && !slices.Contains(want, best)) {
+		t.Errorf("MergeBase = %s, want one of %v", best, want)
+	}
+}
@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MirrorTo copies every ref and every object reachable from them into a
+// new bare repository at destPath, which must not exist or be empty.
+// Objects are copied as their compressed loose files. The repository
+// is locked while they are, so commits are not generated meanwhile.
+func (r *Repository) MirrorTo(destPath string) error {
+	if entries, err := os.ReadDir(destPath); err == nil && len(entries) > 0 {
+		return fmt.Errorf("mirror destination %s is not empty", destPath)
+	}
+
+	// Prune deletes objects that are no longer referenced, so hold the
+	// lock until everything reachable from the refs has been copied.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	refs, err := r.getRefs()
+	if err != nil {
+		return err
+	}
+	// Archive-backed repositories always point HEAD at main.
+	head := []byte("ref: refs/heads/main\n")
+	if r.store == nil {
+		if head, err = os.ReadFile(filepath.Join(r.gitDir, "HEAD")); err != nil {
+			return fmt.Errorf("reading HEAD: %w", err)
+		}
+	}
+
+	dest := &Repository{gitDir: destPath, format: r.format}
+	if err := dest.init(); err != nil {
+		return fmt.Errorf("initializing mirror: %w", err)
+	}
+
+	var tips []string
+	for _, hash := range refs {
+		tips = append(tips, hash)
+	}
+	err = r.walkReachable(tips, func(hash string) error {
+		return r.copyObject(dest, hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, hash := range refs {
+		if name == "HEAD" {
+			continue
+		}
+		if err := dest.updateRef(name, hash); err != nil {
+			return fmt.Errorf("mirroring %s: %w", name, err)
+		}
+	}
+	// HEAD is copied verbatim, whether it is symbolic or detached.
+	if err := os.WriteFile(filepath.Join(destPath, "HEAD"), head, 0644); err != nil {
+		return fmt.Errorf("writing HEAD: %w", err)
+	}
+	return nil
+}
+
+// copyObject copies a loose object file into dest unchanged, or writes
+// an object from r's Storage as a new loose object.
+func (r *Repository) copyObject(dest *Repository, hash string) error {
+	if r.store != nil {
+		typ, data, err := r.readStored(hash)
+		if err != nil {
+			return err
+		}
+		_, err = dest.WriteObject(rawObject{typ, data})
+		return err
+	}
+	data, err := os.ReadFile(r.objectPath(hash))
+	if err != nil {
+		return fmt.Errorf("reading object %s: %w", hash, err)
+	}
+	dir := filepath.Join(dest.gitDir, "objects", hash[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating object dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, hash[2:]), data, 0444); err != nil {
+		return fmt.Errorf("writing object %s: %w", hash, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// commitOnMain adds a commit to main holding name=content in a subdirectory.
+func commitOnMain(t *testing.T, r *Repository, name, content string) string {
+	t.Helper()
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := r.WriteBlob([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := object.NewTree()
+	sub.AddEntry(object.ModeFile, name, blob)
+	subHash, err := r.WriteTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := object.NewTree()
+	root.AddEntry("40000", "dir", subHash)
+	rootHash, err := r.WriteTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := "A <a@example.com>"
+	hash, err := r.WriteCommit(object.NewCommit(rootHash, refs["refs/heads/main"], ident, ident, "add "+name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateRef("refs/heads/main", hash); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestMirrorTo(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"README.md": []byte("hi\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		commitOnMain(t, r, fmt.Sprintf("f%d.txt", i), fmt.Sprintf("content %d\n", i))
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateRef("refs/tags/v1", refs["refs/heads/main"]); err != nil {
+		t.Fatal(err)
+	}
+	// An unreachable object is not mirrored.
+	stray, err := r.WriteBlob([]byte("stray\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "mirror.git")
+	if err := r.MirrorTo(dest); err != nil {
+		t.Fatalf("MirrorTo: %v", err)
+	}
+
+	mirror, err := New("", nil, WithGitDir(dest))
+	if err != nil {
+		t.Fatalf("opening mirror: %v", err)
+	}
+	want, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := mirror.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("mirror refs = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "objects", stray[:2], stray[2:])); err == nil {
+		t.Error("unreachable object was mirrored")
+	}
+
+	if err := r.MirrorTo(dest); err == nil {
+		t.Error("MirrorTo succeeded into a non-empty directory")
+	}
+
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	cloneDir := t.TempDir()
+	for _, args := range [][]string{
+		{"clone", dest, cloneDir},
+		{"-C", cloneDir, "fsck", "--strict"},
+	} {
+		if out, err := exec.Command(gitBin, args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	out, err := exec.Command(gitBin, "-C", cloneDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	if head := strings.TrimSpace(string(out)); head != want["HEAD"] {
+		t.Errorf("clone of mirror HEAD = %s, want %s", head, want["HEAD"])
+	}
+}
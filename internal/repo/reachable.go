@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// walkReachable calls fn once for every object reachable from tips.
+func (r *Repository) walkReachable(tips []string, fn func(hash string) error) error {
+	visited := make(map[string]bool)
+	stack := append([]string(nil), tips...)
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[hash] {
+			continue
+		}
+		visited[hash] = true
+
+		typ, _, rc, err := r.ReadObjectStream(hash)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", hash, err)
+		}
+		// Blobs have no links, so only commits, trees and tags are read.
+		if typ == object.TypeCommit || typ == object.TypeTree || typ == object.TypeTag {
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("reading %s %s: %w", typ, hash, err)
+			}
+			links, err := objectLinks(r.format, typ, data)
+			if err != nil {
+				return fmt.Errorf("parsing %s %s: %w", typ, hash, err)
+			}
+			stack = append(stack, links...)
+		} else {
+			rc.Close()
+		}
+
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectLinks returns the objects a commit, tree or tag named in format
+// refers to. A tag links to the object it tags, which may be another tag.
+func objectLinks(format object.Format, typ object.Type, data []byte) ([]string, error) {
+	switch typ {
+	case object.TypeCommit:
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{c.Tree}, c.Parents...), nil
+	case object.TypeTag:
+		t, err := object.ParseTag(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{t.Object}, nil
+	}
+
+	t, err := format.ParseTree(data)
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	for _, e := range t.Entries {
+		// Submodule commits live in another repository.
+		if e.Mode != "160000" {
+			links = append(links, e.Hash)
+		}
+	}
+	return links, nil
+}
+
+// errFound stops a walk once the object being looked for is reached.
+var errFound = errors.New("found")
+
+// IsReachable reports whether hash is one of tips or reachable from them.
+func (r *Repository) IsReachable(hash string, tips []string) (bool, error) {
+	if slices.Contains(tips, hash) {
+		return true, nil
+	}
+	err := r.walkReachable(tips, func(h string) error {
+		if h == hash {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// Prune deletes loose objects that are not reachable from any ref or from
+// extraRoots, such as objects left behind by a failed generation. Callers
+// pass heads they have advertised but that may no longer be referenced, so
+// a client can still fetch them. Roots that do not exist are ignored. It
+// returns the number of objects removed.
+func (r *Repository) Prune(extraRoots []string) (int, error) {
+	if r.store != nil {
+		return 0, errReadOnly
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	refs, err := r.getRefs()
+	if err != nil {
+		return 0, err
+	}
+	var roots []string
+	for _, hash := range refs {
+		roots = append(roots, hash)
+	}
+	for _, hash := range extraRoots {
+		if !object.ValidHash(hash) {
+			continue
+		}
+		if _, err := os.Stat(r.objectPath(hash)); err == nil {
+			roots = append(roots, hash)
+		}
+	}
+
+	// Any failure to walk leaves the store untouched: an object that
+	// could not be read might hide reachable objects.
+	reachable := make(map[string]bool)
+	err = r.walkReachable(roots, func(hash string) error {
+		reachable[hash] = true
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walking reachable objects: %w", err)
+	}
+
+	removed := 0
+	var freed int64
+	err = filepath.WalkDir(filepath.Join(r.gitDir, "objects"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		hash := filepath.Base(filepath.Dir(path)) + d.Name()
+		if !object.ValidHash(hash) || reachable[hash] {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+
+	r.addStats(-int64(removed), -freed)
+
+	if err != nil {
+		return removed, fmt.Errorf("pruning objects: %w", err)
+	}
+	return removed, nil
+}
+
+// objectPath returns the path of a loose object.
+func (r *Repository) objectPath(hash string) string {
+	return filepath.Join(r.gitDir, "objects", hash[:2], hash[2:])
+}
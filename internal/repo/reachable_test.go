@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestPruneKeepsAnnotatedTagTargets(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"a.txt": []byte("a\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+
+	// A commit no branch reaches, tagged by a tag that is itself tagged.
+	blob, err := r.WriteBlob([]byte("tagged only\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := object.NewTree()
+	tree.AddEntry(object.ModeFile, "tagged.txt", blob)
+	treeHash, err := r.WriteTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := r.WriteCommit(object.NewCommit(treeHash, "", "A <a@example.com>", "A <a@example.com>", "tagged\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1700000000, 0)
+	inner, err := r.WriteObject(object.NewTag(commit, object.TypeCommit, "inner", "T <t@example.com>", "inner\n", when))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := r.WriteObject(object.NewTag(inner, object.TypeTag, "v1", "T <t@example.com>", "outer\n", when))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateRef("refs/tags/v1", outer); err != nil {
+		t.Fatal(err)
+	}
+	garbage, err := r.WriteBlob([]byte("unreachable\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := r.Prune(nil)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Prune removed %d objects, want 1", removed)
+	}
+	for name, hash := range map[string]string{"outer tag": outer, "inner tag": inner, "commit": commit, "tree": treeHash, "blob": blob} {
+		if _, err := os.Stat(r.objectPath(hash)); err != nil {
+			t.Errorf("%s %s was pruned: %v", name, hash, err)
+		}
+	}
+	if _, err := os.Stat(r.objectPath(garbage)); !os.IsNotExist(err) {
+		t.Errorf("unreachable blob survived Prune: %v", err)
+	}
+
+	if ok, err := r.IsReachable(blob, []string{outer}); err != nil || !ok {
+		t.Errorf("IsReachable(blob, tag) = %t, %v, want true", ok, err)
+	}
+}
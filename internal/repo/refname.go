@@ -0,0 +1,35 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateRefName checks a ref name against git's rules (see
+// git-check-ref-format), which also keeps it from escaping the refs
+// directory when used as a path.
+func ValidateRefName(name string) error {
+	if !strings.HasPrefix(name, "refs/") {
+		return fmt.Errorf("invalid ref name %q: must start with refs/", name)
+	}
+	if strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("invalid ref name %q: must not end with / or .", name)
+	}
+	if strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") {
+		return fmt.Errorf("invalid ref name %q: contains .., @{ or //", name)
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return fmt.Errorf("invalid ref name %q: contains %q", name, c)
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return fmt.Errorf("invalid ref name %q: component starts with .", name)
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return fmt.Errorf("invalid ref name %q: component ends with .lock", name)
+		}
+	}
+	return nil
+}
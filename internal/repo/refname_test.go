@@ -0,0 +1,58 @@
+package repo
+
+import "testing"
+
+func TestValidateRefName(t *testing.T) {
+	for _, name := range []string{
+		"refs/heads/main",
+		"refs/heads/feature/x-1",
+		"refs/tags/v1.0.0",
+		"refs/infinite/counter",
+	} {
+		if err := ValidateRefName(name); err != nil {
+			t.Errorf("ValidateRefName(%q) = %v, want nil", name, err)
+		}
+	}
+
+	for _, name := range []string{
+		"HEAD",
+		"main",
+		"refs/heads/../../config",
+		"refs/heads/a..b",
+		"refs/heads/",
+		"/refs/heads/main",
+		"refs//heads/main",
+		"refs/heads/main.",
+		"refs/heads/main.lock",
+		"refs/heads/.hidden",
+		"refs/heads/a\x00b",
+		"refs/heads/a\nb",
+		"refs/heads/a b",
+		"refs/heads/a~1",
+		"refs/heads/a^",
+		"refs/heads/a:b",
+		"refs/heads/a?",
+		"refs/heads/a*",
+		"refs/heads/a[b",
+		"refs/heads/a\\b",
+		"refs/heads/a@{1}",
+	} {
+		if err := ValidateRefName(name); err == nil {
+			t.Errorf("ValidateRefName(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestUpdateRefRejectsInvalidName(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"README.md": []byte("hi\n")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const hash = "1111111111111111111111111111111111111111"
+	if err := r.UpdateRef("refs/../../escape", hash); err == nil {
+		t.Error("UpdateRef accepted a ref escaping the refs directory")
+	}
+	if err := r.UpdateRef("refs/heads/ok", hash); err != nil {
+		t.Errorf("UpdateRef(refs/heads/ok) = %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package repo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// readPackedRefs adds the refs in packed-refs to refs, unless refs
+// already has a loose ref of the same name.
+func (r *Repository) readPackedRefs(refs map[string]string) error {
+	f, err := os.Open(filepath.Join(r.gitDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading packed refs: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		// Skip the header and the peeled values of annotated tags.
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("malformed packed ref %q", line)
+		}
+		if _, ok := refs[name]; !ok {
+			refs[name] = hash
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading packed refs: %w", err)
+	}
+	return nil
+}
+
+// Branches returns the full names of all branches, sorted.
+func (r *Repository) Branches() ([]string, error) {
+	return r.refsWithPrefix("refs/heads/")
+}
+
+// Tags returns the full names of all tags, sorted.
+func (r *Repository) Tags() ([]string, error) {
+	return r.refsWithPrefix("refs/tags/")
+}
+
+// RefExists reports whether the full ref name, or HEAD, resolves to an
+// object.
+func (r *Repository) RefExists(name string) bool {
+	refs, err := r.GetRefs()
+	return err == nil && refs[name] != ""
+}
+
+func (r *Repository) refsWithPrefix(prefix string) ([]string, error) {
+	refs, err := r.GetRefs()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range refs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// ErrStaleRef is returned by CompareAndSwapRef when a ref no longer
+// points where the caller expected.
+var ErrStaleRef = errors.New("ref changed since it was read")
+
+// CompareAndSwapRef points ref at newHash if it points at oldHash, as a
+// push does, and fails with ErrStaleRef otherwise. An oldHash of the
+// format's zero ID means ref must not exist, and a newHash of it deletes
+// ref.
+func (r *Repository) CompareAndSwapRef(ref, oldHash, newHash string) error {
+	if err := ValidateRefName(ref); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.compareAndSwapRef(ref, oldHash, newHash)
+}
+
+// CompareAndSwapRefLocked is the unlocked implementation of
+// CompareAndSwapRef. Caller must already hold r.mu via Lock().
+func (r *Repository) CompareAndSwapRefLocked(ref, oldHash, newHash string) error {
+	return r.compareAndSwapRef(ref, oldHash, newHash)
+}
+
+// compareAndSwapRef is the internal unlocked implementation of
+// CompareAndSwapRef. Caller must hold r.mu.
+func (r *Repository) compareAndSwapRef(ref, oldHash, newHash string) error {
+	if err := ValidateRefName(ref); err != nil {
+		return err
+	}
+	if r.store != nil {
+		return errReadOnly
+	}
+
+	refs, err := r.getRefs()
+	if err != nil {
+		return err
+	}
+	zero := r.format.ZeroID()
+	current, ok := refs[ref]
+	if !ok {
+		current = zero
+	}
+	if current != oldHash {
+		return fmt.Errorf("%w: %s is at %s", ErrStaleRef, ref, current)
+	}
+	if newHash == zero {
+		return r.deleteRef(ref)
+	}
+	return r.updateRef(ref, newHash)
+}
+
+// deleteRef removes ref, whether it is loose, packed or both. Caller must
+// hold r.mu.
+func (r *Repository) deleteRef(ref string) error {
+	if err := os.Remove(filepath.Join(r.gitDir, ref)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("deleting ref: %w", err)
+	}
+
+	path := filepath.Join(r.gitDir, "packed-refs")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading packed refs: %w", err)
+	}
+	// Drop the ref's line and the peeled line that may follow it.
+	var kept []string
+	found, dropping := false, false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if dropping && strings.HasPrefix(line, "^") {
+			continue
+		}
+		_, name, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		dropping = line != "" && line[0] != '#' && line[0] != '^' && name == ref
+		if dropping {
+			found = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !found {
+		return nil
+	}
+	lockPath := path + ".lock"
+	if err := os.WriteFile(lockPath, []byte(strings.Join(kept, "")), 0644); err != nil {
+		return fmt.Errorf("writing packed refs lock file: %w", err)
+	}
+	if err := os.Rename(lockPath, path); err != nil {
+		os.Remove(lockPath)
+		return fmt.Errorf("updating packed refs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package repo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestTypedRefs(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"README": []byte("hi\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := commitOnMain(t, r, "a", "a\n")
+	for _, ref := range []string{"refs/heads/feature", "refs/tags/v1.0", "refs/infinite/counter"} {
+		if err := r.UpdateRef(ref, head); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Packed refs count too, but a loose ref of the same name wins.
+	packed := "# pack-refs with: peeled fully-peeled sorted\n" +
+		head + " refs/heads/old\n" +
+		head + " refs/tags/v0.9\n" +
+		"^" + head + "\n" +
+		"0000000000000000000000000000000000000000 refs/tags/v1.0\n"
+	if err := os.WriteFile(filepath.Join(r.GitDir(), "packed-refs"), []byte(packed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	branches, err := r.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"refs/heads/feature", "refs/heads/main", "refs/heads/old"}; !slices.Equal(branches, want) {
+		t.Errorf("Branches() = %v, want %v", branches, want)
+	}
+
+	tags, err := r.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"refs/tags/v0.9", "refs/tags/v1.0"}; !slices.Equal(tags, want) {
+		t.Errorf("Tags() = %v, want %v", tags, want)
+	}
+	if refs, err := r.GetRefs(); err != nil || refs["refs/tags/v1.0"] != head {
+		t.Errorf("refs/tags/v1.0 = %q, %v; want loose value %s", refs["refs/tags/v1.0"], err, head)
+	}
+
+	for name, want := range map[string]bool{
+		"HEAD":               true,
+		"refs/heads/main":    true,
+		"refs/heads/old":     true,
+		"refs/tags/v1.0":     true,
+		"refs/heads/missing": false,
+		"main":               false,
+	} {
+		if got := r.RefExists(name); got != want {
+			t.Errorf("RefExists(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestCompareAndSwapRef(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"README": []byte("hi\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commitOnMain(t, r, "a", "a\n")
+	second := commitOnMain(t, r, "b", "b\n")
+	zero := r.Format().ZeroID()
+
+	// Creating needs the ref to be missing, and updating needs its value.
+	if err := r.CompareAndSwapRef("refs/heads/feature", zero, first); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := r.CompareAndSwapRef("refs/heads/feature", zero, second); !errors.Is(err, ErrStaleRef) {
+		t.Errorf("create over an existing ref = %v, want ErrStaleRef", err)
+	}
+	if err := r.CompareAndSwapRef("refs/heads/feature", second, first); !errors.Is(err, ErrStaleRef) {
+		t.Errorf("update from the wrong value = %v, want ErrStaleRef", err)
+	}
+	if err := r.CompareAndSwapRef("refs/heads/feature", first, second); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if refs, _ := r.GetRefs(); refs["refs/heads/feature"] != second {
+		t.Errorf("feature = %s, want %s", refs["refs/heads/feature"], second)
+	}
+
+	// Deleting removes both loose and packed copies, and keeps the rest
+	// of packed-refs.
+	packed := "# pack-refs with: peeled fully-peeled sorted\n" +
+		first + " refs/heads/feature\n" +
+		first + " refs/tags/v1\n" +
+		"^" + first + "\n"
+	if err := os.WriteFile(filepath.Join(r.GitDir(), "packed-refs"), []byte(packed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CompareAndSwapRef("refs/heads/feature", second, zero); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if r.RefExists("refs/heads/feature") {
+		t.Error("feature exists after deleting it")
+	}
+	if refs, _ := r.GetRefs(); refs["refs/tags/v1"] != first {
+		t.Errorf("refs/tags/v1 = %q after deleting feature, want %s", refs["refs/tags/v1"], first)
+	}
+	if err := r.CompareAndSwapRef("refs/tags/v1", first, zero); err != nil {
+		t.Fatalf("delete packed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.GitDir(), "packed-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# pack-refs with: peeled fully-peeled sorted\n"; string(data) != want {
+		t.Errorf("packed-refs = %q, want %q", data, want)
+	}
+}
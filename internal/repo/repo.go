@@ -3,11 +3,14 @@ package repo
 import (
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/imjasonh/infinite-git/internal/clock"
 	"github.com/imjasonh/infinite-git/internal/object"
 )
 
@@ -17,23 +20,95 @@ type Repository struct {
 	gitDir string
 	mu     sync.Mutex
 	count  int64
+	clock  clock.Clock
+	format object.Format
+
+	// lenient accepts objects without a valid header.
+	lenient bool
+
+	// The object store stats are computed on first use, or loaded from
+	// the stats index, and then kept up to date as objects are written.
+	statsIndex bool
+	statsMu    sync.Mutex
+	stats      Stats
+	statsKnown bool
+
+	// store, if set, holds the objects instead of gitDir, and refs the
+	// refs, including HEAD. Such a repository cannot be written.
+	store Storage
+	refs  map[string]string
+}
+
+// Option configures a Repository.
+type Option func(*Repository)
+
+// WithGitDir stores the repository's objects and refs in dir instead of
+// <path>/.git. Combined with an empty path, this creates a bare
+// repository with no working tree.
+func WithGitDir(dir string) Option {
+	return func(r *Repository) {
+		r.gitDir = dir
+	}
+}
+
+// WithLenientObjects reads objects that lack a valid "<type> <size>"
+// header, as written by some tools, as their raw content instead of
+// failing. ReadObjectStream reads them as blobs. Useful when serving
+// imported repositories.
+func WithLenientObjects(lenient bool) Option {
+	return func(r *Repository) {
+		r.lenient = lenient
+	}
+}
+
+// InitialCommitTime dates the initial commit of a new repository unless
+// WithClock is used, so that repositories created with the same files
+// start from the same commit.
+var InitialCommitTime = time.Unix(0, 0).UTC()
+
+// WithClock dates the initial commit with c instead of InitialCommitTime.
+func WithClock(c clock.Clock) Option {
+	return func(r *Repository) {
+		r.clock = c
+	}
+}
+
+// WithObjectFormat creates the repository with objects named by format.
+// The format is recorded in the repository's config, which decides it
+// when an existing repository is opened. The default is SHA-1.
+func WithObjectFormat(format object.Format) Option {
+	return func(r *Repository) {
+		r.format = format
+	}
 }
 
 // New creates or opens a Git repository at the given path.
 // initialFiles specifies the files to include in the initial commit.
-func New(path string, initialFiles map[string][]byte) (*Repository, error) {
+func New(path string, initialFiles map[string][]byte, opts ...Option) (*Repository, error) {
 	repo := &Repository{
 		path:   path,
-		gitDir: filepath.Join(path, ".git"),
+		clock:  clock.Fixed(InitialCommitTime),
+		format: object.SHA1,
+	}
+	if path != "" {
+		repo.gitDir = filepath.Join(path, ".git")
+	}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	if repo.gitDir == "" {
+		return nil, fmt.Errorf("repository needs a path or a git dir")
 	}
 
 	// Create directory if it doesn't exist
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return nil, fmt.Errorf("creating repo directory: %w", err)
+	if path != "" {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, fmt.Errorf("creating repo directory: %w", err)
+		}
 	}
 
 	// Check if it's already a git repo
-	if _, err := os.Stat(repo.gitDir); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(repo.gitDir, "HEAD")); os.IsNotExist(err) {
 		// Initialize new repository
 		if err := repo.init(); err != nil {
 			return nil, fmt.Errorf("initializing repository: %w", err)
@@ -43,7 +118,14 @@ func New(path string, initialFiles map[string][]byte) (*Repository, error) {
 		if err := repo.createInitialCommit(initialFiles); err != nil {
 			return nil, fmt.Errorf("creating initial commit: %w", err)
 		}
+	} else {
+		format, err := readObjectFormat(repo.gitDir)
+		if err != nil {
+			return nil, err
+		}
+		repo.format = format
 	}
+	repo.loadStatsIndex()
 
 	return repo, nil
 }
@@ -73,12 +155,16 @@ func (r *Repository) init() error {
 
 	// Create config file
 	configPath := filepath.Join(r.gitDir, "config")
-	config := `[core]
-	repositoryformatversion = 0
+	config := fmt.Sprintf(`[core]
+	repositoryformatversion = %d
 	filemode = true
-	bare = false
+	bare = %t
 	logallrefupdates = true
-`
+`, r.formatVersion(), r.path == "")
+	if r.formatVersion() > 0 {
+		// Extensions need repository format version 1.
+		config += fmt.Sprintf("[extensions]\n\tobjectformat = %s\n", r.format)
+	}
 	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
 		return fmt.Errorf("creating config: %w", err)
 	}
@@ -86,51 +172,89 @@ func (r *Repository) init() error {
 	return nil
 }
 
+// formatVersion returns the repository format version the config
+// declares: 1 when it uses any extension, such as a non-default object
+// format, and 0 otherwise.
+func (r *Repository) formatVersion() int {
+	if r.format != object.SHA1 {
+		return 1
+	}
+	return 0
+}
+
+// readObjectFormat reads extensions.objectformat from the config in
+// gitDir. A repository without a config or the setting uses SHA-1.
+func readObjectFormat(gitDir string) (object.Format, error) {
+	data, err := os.ReadFile(filepath.Join(gitDir, "config"))
+	if os.IsNotExist(err) {
+		return object.SHA1, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading config: %w", err)
+	}
+	section := ""
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "extensions" && strings.EqualFold(strings.TrimSpace(key), "objectformat") {
+			return object.ParseFormat(strings.TrimSpace(value))
+		}
+	}
+	return object.SHA1, nil
+}
+
 // createInitialCommit creates the first commit in the repository.
 func (r *Repository) createInitialCommit(files map[string][]byte) error {
 	tree := object.NewTree()
 
 	for name, content := range files {
-		blob := object.NewBlob(content)
-		blobHash, err := object.Write(r.gitDir, blob)
+		blobHash, err := r.WriteBlob(content)
 		if err != nil {
 			return fmt.Errorf("writing blob for %s: %w", name, err)
 		}
 		tree.AddEntry("100644", name, blobHash)
 
-		// Also write to working directory
+		// Also write to working directory, if there is one
+		if r.path == "" {
+			continue
+		}
 		filePath := filepath.Join(r.path, name)
 		if err := os.WriteFile(filePath, content, 0644); err != nil {
 			return fmt.Errorf("writing %s to working directory: %w", name, err)
 		}
 	}
 
-	treeHash, err := object.Write(r.gitDir, tree)
+	treeHash, err := r.WriteTree(tree)
 	if err != nil {
 		return fmt.Errorf("writing tree: %w", err)
 	}
 
-	commit := object.NewCommit(
+	commit := object.NewCommitAt(
 		treeHash,
 		"", // No parent for initial commit
 		"Infinite Git <infinite@example.com>",
 		"Infinite Git <infinite@example.com>",
 		"Initial commit",
+		r.clock.Now(),
 	)
-	commitHash, err := object.Write(r.gitDir, commit)
+	commitHash, err := r.WriteCommit(commit)
 	if err != nil {
 		return fmt.Errorf("writing commit: %w", err)
 	}
 
-	refPath := filepath.Join(r.gitDir, "refs", "heads", "main")
-	if err := os.WriteFile(refPath, []byte(commitHash+"\n"), 0644); err != nil {
-		return fmt.Errorf("updating ref: %w", err)
-	}
+	return r.updateRef("refs/heads/main", commitHash)
+}
 
-	return nil
+// Format returns the format the repository's objects are named in.
+func (r *Repository) Format() object.Format {
+	return r.format
 }
 
-// Path returns the repository path.
+// Path returns the repository path, or "" for a bare repository.
 func (r *Repository) Path() string {
 	return r.path
 }
@@ -164,6 +288,10 @@ func (r *Repository) GetRefsLocked() (map[string]string, error) {
 // getRefs is the internal unlocked implementation of GetRefs.
 // Caller must hold r.mu.
 func (r *Repository) getRefs() (map[string]string, error) {
+	if r.store != nil {
+		return maps.Clone(r.refs), nil
+	}
+
 	refs := make(map[string]string)
 
 	// Read refs from refs directory
@@ -172,7 +300,7 @@ func (r *Repository) getRefs() (map[string]string, error) {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
 			return nil
 		}
 
@@ -195,6 +323,11 @@ func (r *Repository) getRefs() (map[string]string, error) {
 		return nil, fmt.Errorf("reading refs: %w", err)
 	}
 
+	// Refs packed by git pack-refs, which loose refs override
+	if err := r.readPackedRefs(refs); err != nil {
+		return nil, err
+	}
+
 	// Read HEAD
 	headPath := filepath.Join(r.gitDir, "HEAD")
 	headContent, err := os.ReadFile(headPath)
@@ -219,13 +352,15 @@ func (r *Repository) getRefs() (map[string]string, error) {
 
 // GetCapabilities returns the Git capabilities this server supports.
 func (r *Repository) GetCapabilities() []string {
-	return []string{
+	caps := []string{
 		"multi_ack",
 		"thin-pack",
 		"side-band",
 		"side-band-64k",
 		"ofs-delta",
 		"shallow",
+		"deepen-since",
+		"deepen-not",
 		"no-progress",
 		"include-tag",
 		"multi_ack_detailed",
@@ -233,25 +368,124 @@ func (r *Repository) GetCapabilities() []string {
 		"symref=HEAD:refs/heads/main",
 		"agent=infinite-git/1.0",
 	}
+	if r.format != object.SHA1 {
+		caps = append(caps, "object-format="+string(r.format))
+	}
+	return caps
 }
 
 // ReadObject reads an object from the repository.
 func (r *Repository) ReadObject(hash string) ([]byte, error) {
+	if r.store != nil {
+		_, data, err := r.readStored(hash)
+		return data, err
+	}
+	if r.lenient {
+		return object.ReadLenient(r.gitDir, hash)
+	}
 	return object.Read(r.gitDir, hash)
 }
 
 // ReadObjectFull reads an object from the repository with its header.
 func (r *Repository) ReadObjectFull(hash string) ([]byte, error) {
+	if r.store != nil {
+		typ, data, err := r.readStored(hash)
+		if err != nil {
+			return nil, err
+		}
+		return append(fmt.Appendf(nil, "%s %d\x00", typ, len(data)), data...), nil
+	}
 	return object.ReadFull(r.gitDir, hash)
 }
 
-// WriteObject writes an object to the repository.
+// ReadObjectStream opens an object for streaming, returning its type, size
+// and a reader over its content. The caller must close the reader.
+func (r *Repository) ReadObjectStream(hash string) (object.Type, int64, io.ReadCloser, error) {
+	if r.store != nil {
+		return r.store.ReadStream(hash)
+	}
+	if r.lenient {
+		return object.ReadStreamLenient(r.gitDir, hash)
+	}
+	return object.ReadStream(r.gitDir, hash)
+}
+
+// WriteObject writes an object to the repository. Repositories backed by
+// a Storage, such as archives, are read-only and refuse it.
 func (r *Repository) WriteObject(obj object.Object) (string, error) {
-	return object.Write(r.gitDir, obj)
+	if r.store != nil {
+		return "", errReadOnly
+	}
+	hash, n, err := r.format.WriteN(r.gitDir, obj)
+	if err != nil {
+		return "", err
+	}
+	if n > 0 {
+		r.addStats(1, n)
+	}
+	return hash, nil
+}
+
+// WriteRawObject writes an object of type typ whose content is data, as
+// read from a pack, and returns its hash.
+func (r *Repository) WriteRawObject(typ object.Type, data []byte) (string, error) {
+	return r.WriteObject(rawObject{typ, data})
+}
+
+// WriteBlob writes a blob holding content and returns its hash.
+func (r *Repository) WriteBlob(content []byte) (string, error) {
+	return r.WriteObject(object.NewBlob(content))
+}
+
+// WriteTree writes a tree and returns its hash.
+func (r *Repository) WriteTree(tree *object.Tree) (string, error) {
+	return r.WriteObject(tree)
+}
+
+// WriteCommit writes a commit and returns its hash.
+func (r *Repository) WriteCommit(commit *object.Commit) (string, error) {
+	return r.WriteObject(commit)
+}
+
+// VerifyObject checks that an object reads back intact and hashes correctly.
+func (r *Repository) VerifyObject(hash string) error {
+	if r.store != nil {
+		typ, data, err := r.readStored(hash)
+		if err != nil {
+			return err
+		}
+		if got := r.format.Hash(rawObject{typ, data}); got != hash {
+			return fmt.Errorf("object hash mismatch: got %s", got)
+		}
+		return nil
+	}
+	return object.Verify(r.gitDir, hash)
 }
 
 // UpdateRef updates a reference to point to a new object.
 func (r *Repository) UpdateRef(ref, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.updateRef(ref, hash)
+}
+
+// UpdateRefLocked is the unlocked implementation of UpdateRef.
+// Caller must already hold r.mu via Lock().
+func (r *Repository) UpdateRefLocked(ref, hash string) error {
+	return r.updateRef(ref, hash)
+}
+
+// updateRef is the internal unlocked implementation of UpdateRef.
+// Caller must hold r.mu.
+func (r *Repository) updateRef(ref, hash string) error {
+	if err := ValidateRefName(ref); err != nil {
+		return err
+	}
+	if r.store != nil {
+		return errReadOnly
+	}
+
 	refPath := filepath.Join(r.gitDir, ref)
 	refDir := filepath.Dir(refPath)
 
@@ -260,8 +494,14 @@ func (r *Repository) UpdateRef(ref, hash string) error {
 		return fmt.Errorf("creating ref directory: %w", err)
 	}
 
-	// Write new hash
-	if err := os.WriteFile(refPath, []byte(hash+"\n"), 0644); err != nil {
+	// Write the new hash to a lock file and rename it into place, as git
+	// does, so readers never see a truncated or partially written ref.
+	lockPath := refPath + ".lock"
+	if err := os.WriteFile(lockPath, []byte(hash+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing ref lock file: %w", err)
+	}
+	if err := os.Rename(lockPath, refPath); err != nil {
+		os.Remove(lockPath)
 		return fmt.Errorf("updating ref: %w", err)
 	}
 
@@ -270,6 +510,9 @@ func (r *Repository) UpdateRef(ref, hash string) error {
 
 // GetObject reads and returns an object by hash.
 func (r *Repository) GetObject(hash string) (io.ReadCloser, error) {
+	if r.store != nil {
+		return nil, fmt.Errorf("opening object %s: archive-backed repositories have no loose objects", hash)
+	}
 	objPath := filepath.Join(r.gitDir, "objects", hash[:2], hash[2:])
 
 	file, err := os.Open(objPath)
@@ -0,0 +1,257 @@
+package repo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/clock"
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+func TestNewWithGitDir(t *testing.T) {
+	root := t.TempDir()
+	gitDir := filepath.Join(root, "store")
+
+	r, err := New("", map[string][]byte{"README.md": []byte("hi\n")}, WithGitDir(gitDir))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if r.GitDir() != gitDir {
+		t.Errorf("GitDir() = %s, want %s", r.GitDir(), gitDir)
+	}
+	if r.Path() != "" {
+		t.Errorf("Path() = %q, want empty for a bare repo", r.Path())
+	}
+
+	// Nothing but the git dir is created.
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "store" {
+		t.Errorf("unexpected files next to the git dir: %v", entries)
+	}
+	for _, name := range []string{"HEAD", "config", "refs/heads/main"} {
+		if _, err := os.Stat(filepath.Join(gitDir, name)); err != nil {
+			t.Errorf("missing %s: %v", name, err)
+		}
+	}
+
+	// Reopening finds the existing repository.
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("GetRefs: %v", err)
+	}
+	r2, err := New("", nil, WithGitDir(gitDir))
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	refs2, err := r2.GetRefs()
+	if err != nil {
+		t.Fatalf("GetRefs after reopen: %v", err)
+	}
+	if refs["refs/heads/main"] != refs2["refs/heads/main"] {
+		t.Errorf("reopened main = %s, want %s", refs2["refs/heads/main"], refs["refs/heads/main"])
+	}
+}
+
+func TestNewRequiresLocation(t *testing.T) {
+	if _, err := New("", nil); err == nil {
+		t.Error("New succeeded with neither a path nor a git dir")
+	}
+}
+
+func TestLenientObjects(t *testing.T) {
+	gitDir := t.TempDir()
+	r, err := New("", map[string][]byte{"README.md": []byte("hi\n")}, WithGitDir(gitDir), WithLenientObjects(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// An object written by a tool that left out the header.
+	hash := strings.Repeat("ab", 20)
+	content := []byte("no header here")
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	if err := os.MkdirAll(filepath.Join(gitDir, "objects", hash[:2]), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "objects", hash[:2], hash[2:]), buf.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := r.ReadObject(hash); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadObject = %q, %v; want %q", got, err, content)
+	}
+	typ, _, rc, err := r.ReadObjectStream(hash)
+	if err != nil {
+		t.Fatalf("ReadObjectStream: %v", err)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || typ != object.TypeBlob || !bytes.Equal(got, content) {
+		t.Errorf("ReadObjectStream = %s %q, %v; want blob %q", typ, got, err, content)
+	}
+}
+
+func TestUpdateRefAtomic(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"README.md": []byte("hi\n")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	refPath := filepath.Join(r.GitDir(), "refs", "heads", "main")
+	hashes := []string{
+		"1111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222",
+	}
+	if err := r.UpdateRef("refs/heads/main", hashes[1]); err != nil {
+		t.Fatalf("UpdateRef: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			if err := r.UpdateRef("refs/heads/main", hashes[i%2]); err != nil {
+				t.Errorf("UpdateRef: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Read the file directly, bypassing the repo lock.
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		data, err := os.ReadFile(refPath)
+		if err != nil {
+			t.Fatalf("reading ref: %v", err)
+		}
+		if got := string(data); got != hashes[0]+"\n" && got != hashes[1]+"\n" {
+			t.Fatalf("read partial ref %q", got)
+		}
+	}
+}
+
+func TestTypedWriteHelpers(t *testing.T) {
+	r, err := New(t.TempDir(), map[string][]byte{"a.txt": []byte("a\n")})
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+
+	content := []byte("hello\n")
+	blobHash, err := r.WriteBlob(content)
+	if err != nil {
+		t.Fatalf("WriteBlob: %v", err)
+	}
+	if want := object.Hash(object.NewBlob(content)); blobHash != want {
+		t.Errorf("WriteBlob = %s, want %s", blobHash, want)
+	}
+
+	tree := object.NewTree()
+	tree.AddEntry("100644", "hello.txt", blobHash)
+	treeHash, err := r.WriteTree(tree)
+	if err != nil {
+		t.Fatalf("WriteTree: %v", err)
+	}
+	if want := object.Hash(tree); treeHash != want {
+		t.Errorf("WriteTree = %s, want %s", treeHash, want)
+	}
+
+	commit := object.NewCommit(treeHash, "", "A <a@example.com>", "A <a@example.com>", "msg")
+	commitHash, err := r.WriteCommit(commit)
+	if err != nil {
+		t.Fatalf("WriteCommit: %v", err)
+	}
+	if want := object.Hash(commit); commitHash != want {
+		t.Errorf("WriteCommit = %s, want %s", commitHash, want)
+	}
+}
+
+func TestObjectFormatPersisted(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir, map[string][]byte{"README.md": []byte("hi\n")}, WithObjectFormat(object.SHA256))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := refs["refs/heads/main"]
+	if !object.SHA256.ValidHash(head) {
+		t.Errorf("head = %q, want a sha256 object name", head)
+	}
+	if err := r.VerifyObject(head); err != nil {
+		t.Errorf("VerifyObject: %v", err)
+	}
+	if !slices.Contains(r.GetCapabilities(), "object-format=sha256") {
+		t.Errorf("capabilities %v do not advertise the object format", r.GetCapabilities())
+	}
+
+	// Reopening reads the format from the config, whatever the options say.
+	reopened, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	if reopened.Format() != object.SHA256 {
+		t.Errorf("reopened format = %s, want sha256", reopened.Format())
+	}
+
+	// Git agrees the repository is well formed.
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	if out, err := exec.Command(gitBin, "-C", dir, "fsck", "--strict").CombinedOutput(); err != nil {
+		t.Fatalf("git fsck: %v\noutput: %s", err, out)
+	}
+	out, err := exec.Command(gitBin, "-C", dir, "rev-parse", "--show-object-format").Output()
+	if err != nil {
+		t.Fatalf("git rev-parse: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "sha256" {
+		t.Errorf("git sees object format %q, want sha256", got)
+	}
+}
+
+func TestInitialCommitDeterministic(t *testing.T) {
+	files := map[string][]byte{"README.md": []byte("hi\n"), "a.txt": []byte("a\n"), "b.txt": []byte("b\n")}
+	head := func(opts ...Option) string {
+		t.Helper()
+		r, err := New(t.TempDir(), files, opts...)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		refs, err := r.GetRefs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refs["refs/heads/main"]
+	}
+
+	first, second := head(), head()
+	if first != second {
+		t.Errorf("fresh repositories start at %s and %s", first, second)
+	}
+
+	// An injected clock dates the commit instead.
+	later := clock.Fixed(InitialCommitTime.Add(time.Hour))
+	if got := head(WithClock(later)); got == first {
+		t.Errorf("initial commit dated by a clock is still %s", got)
+	} else if again := head(WithClock(later)); again != got {
+		t.Errorf("repositories with the same clock start at %s and %s", got, again)
+	}
+}
@@ -0,0 +1,131 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// Stats describes the object store.
+type Stats struct {
+	// Objects is the number of loose objects.
+	Objects int64
+	// Size is the bytes used by the object store.
+	Size int64
+}
+
+// statsIndexFile holds the persisted Stats, relative to the git dir.
+const statsIndexFile = "infinite-stats"
+
+// WithStatsIndex keeps the object store's Stats in an index file in the
+// git dir, updated on every write, so a restarted server does not have to
+// walk the store. A missing or unreadable index is rebuilt on first use.
+func WithStatsIndex(enabled bool) Option {
+	return func(r *Repository) {
+		r.statsIndex = enabled
+	}
+}
+
+// Stat returns the object count and size of the object store. The store
+// is walked once, unless the stats index has them; after that they are
+// tracked as objects are written and pruned, so objects added behind the
+// repository's back are not counted. For a repository backed by a
+// Storage they are the objects in memory and the size of their content.
+func (r *Repository) Stat() (Stats, error) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	if r.statsKnown {
+		return r.stats, nil
+	}
+	if m, ok := r.store.(memoryStorage); ok {
+		var st Stats
+		for _, o := range m {
+			st.Objects++
+			st.Size += int64(len(o.data))
+		}
+		r.stats, r.statsKnown = st, true
+		return st, nil
+	}
+
+	var st Stats
+	err := filepath.WalkDir(filepath.Join(r.gitDir, "objects"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st.Size += fi.Size()
+		if object.ValidHash(filepath.Base(filepath.Dir(path)) + d.Name()) {
+			st.Objects++
+		}
+		return nil
+	})
+	if err != nil {
+		return Stats{}, fmt.Errorf("measuring object store: %w", err)
+	}
+	r.stats, r.statsKnown = st, true
+	r.saveStatsLocked()
+	return st, nil
+}
+
+// ObjectStoreSize returns the bytes used by the object store, as tracked
+// by Stat.
+func (r *Repository) ObjectStoreSize() (int64, error) {
+	st, err := r.Stat()
+	return st.Size, err
+}
+
+// addStats records objects and bytes added to the store, which may be
+// negative. Until the store has been measured there is nothing to
+// update: the first Stat counts them.
+func (r *Repository) addStats(objects, bytes int64) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	if !r.statsKnown {
+		return
+	}
+	r.stats.Objects += objects
+	r.stats.Size += bytes
+	r.saveStatsLocked()
+}
+
+// loadStatsIndex reads the stats index, if enabled and present.
+func (r *Repository) loadStatsIndex() {
+	if !r.statsIndex {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(r.gitDir, statsIndexFile))
+	if err != nil {
+		return
+	}
+	var st Stats
+	if _, err := fmt.Sscanf(string(data), "%d %d\n", &st.Objects, &st.Size); err != nil {
+		return
+	}
+	r.statsMu.Lock()
+	r.stats, r.statsKnown = st, true
+	r.statsMu.Unlock()
+}
+
+// saveStatsLocked writes the stats index, if enabled. An index that
+// cannot be updated is removed so that it is rebuilt rather than trusted.
+func (r *Repository) saveStatsLocked() {
+	if !r.statsIndex {
+		return
+	}
+	path := filepath.Join(r.gitDir, statsIndexFile)
+	tmp := path + ".lock"
+	data := fmt.Sprintf("%d %d\n", r.stats.Objects, r.stats.Size)
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		os.Remove(path)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		os.Remove(path)
+	}
+}
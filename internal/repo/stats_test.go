@@ -0,0 +1,65 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatsIndex(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir, map[string][]byte{"README": []byte("hi\n")}, WithStatsIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Stat(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 50 {
+		commitOnMain(t, r, fmt.Sprintf("file-%d", i), fmt.Sprintf("content %d\n", i))
+	}
+	// Rewriting an existing object must not count it twice.
+	commitOnMain(t, r, "file-0", "content 0\n")
+
+	// A repository without the index walks the store.
+	walked, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := walked.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Objects != 3+50*4+1 {
+		t.Errorf("walk found %d objects", want.Objects)
+	}
+
+	if got, err := r.Stat(); err != nil || got != want {
+		t.Errorf("tracked stats = %+v, %v; want %+v", got, err, want)
+	}
+
+	// A reopened repository reads the index instead of walking.
+	reopened, err := New(dir, nil, WithStatsIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.statsKnown || reopened.stats != want {
+		t.Errorf("reopened stats = %+v (known %t), want %+v from the index", reopened.stats, reopened.statsKnown, want)
+	}
+
+	// A missing index is rebuilt.
+	if err := os.Remove(filepath.Join(r.GitDir(), statsIndexFile)); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := New(dir, nil, WithStatsIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rebuilt.Stat(); err != nil || got != want {
+		t.Errorf("rebuilt stats = %+v, %v; want %+v", got, err, want)
+	}
+	if _, err := os.Stat(filepath.Join(r.GitDir(), statsIndexFile)); err != nil {
+		t.Errorf("index was not rewritten: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+)
+
+// Storage holds the objects of a repository that does not keep them as
+// loose files in a git dir, such as one opened with OpenArchive.
+type Storage interface {
+	// ReadStream opens an object like Repository.ReadObjectStream. An
+	// object that is not stored yields an error matching fs.ErrNotExist.
+	ReadStream(hash string) (object.Type, int64, io.ReadCloser, error)
+}
+
+// rawObject is an object of any type held as its serialized content.
+type rawObject struct {
+	typ  object.Type
+	data []byte
+}
+
+func (o rawObject) Type() object.Type { return o.typ }
+
+func (o rawObject) Serialize() []byte { return o.data }
+
+// memoryStorage is a Storage holding every object in memory.
+type memoryStorage map[string]rawObject
+
+func (m memoryStorage) ReadStream(hash string) (object.Type, int64, io.ReadCloser, error) {
+	o, ok := m[hash]
+	if !ok {
+		return "", 0, nil, fmt.Errorf("object %s: %w", hash, fs.ErrNotExist)
+	}
+	return o.typ, int64(len(o.data)), io.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+// errReadOnly is returned by operations that would change a repository
+// backed by a Storage.
+var errReadOnly = errors.New("repository is read-only")
+
+// readStored reads an object and its type from r's Storage.
+func (r *Repository) readStored(hash string) (object.Type, []byte, error) {
+	typ, _, rc, err := r.store.ReadStream(hash)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading object %s: %w", hash, err)
+	}
+	return typ, data, nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/protocol"
+)
+
+// requireAdmin only lets requests carrying the admin bearer token through.
+// Admin endpoints don't exist at all unless a token is configured.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		want := "Bearer " + s.adminToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminPack returns the packfile of everything reachable from an
+// object, bypassing negotiation, for debugging pack generation.
+func (s *Server) handleAdminPack(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	oid := r.URL.Query().Get("oid")
+	if !s.repo.Format().ValidHash(oid) {
+		http.Error(w, "oid must be a full hex object name", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.repo.ReadObject(oid); err != nil {
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-packfile")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	up := protocol.NewUploadPack(s.repo, s.upOpts...)
+	if err := up.WritePack(w, []string{oid}); err != nil {
+		log.Error("admin pack failed", "oid", oid, "error", err)
+		return
+	}
+	log.Info("served admin pack", "oid", oid)
+}
+
+// maxAdminCommitBytes bounds the JSON body of an admin commit.
+const maxAdminCommitBytes = 10 << 20
+
+// adminCommitRequest describes a commit to write verbatim. Files maps
+// slash-separated paths to their content; the commit's tree holds exactly
+// these files.
+type adminCommitRequest struct {
+	Message string               `json:"message"`
+	Files   map[string]adminFile `json:"files"`
+}
+
+type adminFile struct {
+	Content string `json:"content"`
+	Mode    string `json:"mode"` // 100644 if empty
+}
+
+// handleAdminCommit writes a commit with the requested tree and message on
+// top of main and advances main to it, bypassing the generator.
+func (s *Server) handleAdminCommit(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req adminCommitRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminCommitBytes)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	root, err := buildFileTree(req.Files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.repo.Lock()
+	defer s.repo.Unlock()
+
+	refs, err := s.repo.GetRefsLocked()
+	if err != nil {
+		log.Error("admin commit failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	treeHash, err := s.writeFileTree(root)
+	if err != nil {
+		log.Error("admin commit failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	ident := "Infinite Git <infinite@example.com>"
+	commitHash, err := s.repo.WriteCommit(object.NewCommitAt(treeHash, refs["refs/heads/main"], ident, ident, req.Message, s.clock.Now()))
+	if err != nil {
+		log.Error("admin commit failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.repo.UpdateRefLocked("refs/heads/main", commitHash); err != nil {
+		log.Error("admin commit failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("wrote admin commit", "sha", commitHash, "files", len(req.Files))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"commit": commitHash})
+}
+
+// fileTree is a directory of an admin commit before it is written.
+type fileTree struct {
+	files map[string]adminFile
+	dirs  map[string]*fileTree
+}
+
+func newFileTree() *fileTree {
+	return &fileTree{files: make(map[string]adminFile), dirs: make(map[string]*fileTree)}
+}
+
+// buildFileTree validates paths and modes and arranges the files into
+// directories.
+func buildFileTree(files map[string]adminFile) (*fileTree, error) {
+	root := newFileTree()
+	for path, f := range files {
+		switch f.Mode {
+		case "":
+			f.Mode = object.ModeFile
+		case object.ModeFile, "100755", object.ModeSymlink:
+		default:
+			return nil, fmt.Errorf("%s: unsupported mode %q", path, f.Mode)
+		}
+
+		parts := strings.Split(path, "/")
+		for _, part := range parts {
+			if part == "" || part == "." || part == ".." || strings.EqualFold(part, ".git") || strings.ContainsRune(part, 0) {
+				return nil, fmt.Errorf("invalid path %q", path)
+			}
+		}
+
+		dir := root
+		for _, part := range parts[:len(parts)-1] {
+			if _, ok := dir.files[part]; ok {
+				return nil, fmt.Errorf("%s: %s is a file", path, part)
+			}
+			if dir.dirs[part] == nil {
+				dir.dirs[part] = newFileTree()
+			}
+			dir = dir.dirs[part]
+		}
+		name := parts[len(parts)-1]
+		if _, ok := dir.dirs[name]; ok {
+			return nil, fmt.Errorf("%s is a directory", path)
+		}
+		dir.files[name] = f
+	}
+	return root, nil
+}
+
+// writeFileTree writes t's blobs and trees and returns its tree hash.
+func (s *Server) writeFileTree(t *fileTree) (string, error) {
+	tree := object.NewTree()
+	for name, f := range t.files {
+		hash, err := s.repo.WriteBlob([]byte(f.Content))
+		if err != nil {
+			return "", fmt.Errorf("writing blob for %s: %w", name, err)
+		}
+		tree.AddEntry(f.Mode, name, hash)
+	}
+	for name, sub := range t.dirs {
+		hash, err := s.writeFileTree(sub)
+		if err != nil {
+			return "", err
+		}
+		tree.AddEntry(object.ModeDir, name, hash)
+	}
+	return s.repo.WriteTree(tree)
+}
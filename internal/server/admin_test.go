@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	gitobject "github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/imjasonh/infinite-git/internal/packfile"
+)
+
+func adminGet(t *testing.T, url, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminPack(t *testing.T) {
+	ts, r := newTestServer(t, WithAdminToken("secret"))
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	head := refs["HEAD"]
+
+	resp := adminGet(t, ts.URL+"/admin/pack?oid="+head, "secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/x-git-packfile"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := packfile.NewReader(data)
+	if err != nil {
+		t.Fatalf("invalid pack: %v", err)
+	}
+	if count := binary.BigEndian.Uint32(data[8:12]); count != 3 { // commit, tree, hello.txt
+		t.Errorf("pack has %d objects, want 3", count)
+	}
+	sum := sha1.Sum(data[:len(data)-sha1.Size])
+	if !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		t.Error("pack checksum mismatch")
+	}
+
+	// Every object must match the one stored under the name its type
+	// and content hash to, and the commit must be the one asked for.
+	typeNames := map[int]string{
+		packfile.OBJ_COMMIT: "commit",
+		packfile.OBJ_TREE:   "tree",
+		packfile.OBJ_BLOB:   "blob",
+		packfile.OBJ_TAG:    "tag",
+	}
+	seen := make(map[string]bool)
+	for i := range binary.BigEndian.Uint32(data[8:12]) {
+		typ, content, err := pr.ReadObject()
+		if err != nil {
+			t.Fatalf("reading object %d: %v", i, err)
+		}
+		name := sha1.Sum(append(fmt.Appendf(nil, "%s %d\x00", typeNames[typ], len(content)), content...))
+		hash := hex.EncodeToString(name[:])
+		stored, err := r.ReadObject(hash)
+		if err != nil {
+			t.Errorf("object %d, %s %s, is not in the repository: %v", i, typeNames[typ], hash, err)
+		} else if !bytes.Equal(stored, content) {
+			t.Errorf("object %d, %s, differs from the stored object", i, hash)
+		}
+		seen[hash] = true
+	}
+	if !seen[head] {
+		t.Errorf("pack does not hold the commit %s", head)
+	}
+}
+
+func TestAdminPackRejects(t *testing.T) {
+	ts, _ := newTestServer(t, WithAdminToken("secret"))
+	const missing = "1111111111111111111111111111111111111111"
+
+	for _, tc := range []struct {
+		name, query, token string
+		want               int
+	}{
+		{"no token", "?oid=" + missing, "", http.StatusUnauthorized},
+		{"wrong token", "?oid=" + missing, "nope", http.StatusUnauthorized},
+		{"bad oid", "?oid=../../config", "secret", http.StatusBadRequest},
+		{"missing object", "?oid=" + missing, "secret", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := adminGet(t, ts.URL+"/admin/pack"+tc.query, tc.token).StatusCode; got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	ts, _ := newTestServer(t)
+	if got := adminGet(t, ts.URL+"/admin/pack?oid=x", "").StatusCode; got != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", got)
+	}
+}
+
+func adminPost(t *testing.T, url, token, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminCommit(t *testing.T) {
+	ts, _ := newTestServer(t, WithAdminToken("secret"))
+
+	resp := adminPost(t, ts.URL+"/admin/commit", "secret", `{
+		"message": "Injected commit\n\nWith a body.\n",
+		"files": {
+			"README.md": {"content": "exact\n"},
+			"bin/run.sh": {"content": "#!/bin/sh\n", "mode": "100755"}
+		}
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	var out struct{ Commit string }
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	// Cloning generates a commit on top of the injected one.
+	gitRepo, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	commit, err := gitRepo.CommitObject(plumbing.NewHash(out.Commit))
+	if err != nil {
+		t.Fatalf("injected commit missing from clone: %v", err)
+	}
+	if want := "Injected commit\n\nWith a body.\n"; commit.Message != want {
+		t.Errorf("message = %q, want %q", commit.Message, want)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	tree.Files().ForEach(func(f *gitobject.File) error {
+		content, err := f.Contents()
+		got[f.Name] = f.Mode.String() + " " + content
+		return err
+	})
+	want := map[string]string{
+		"README.md":  "0100644 exact\n",
+		"bin/run.sh": "0100755 #!/bin/sh\n",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("tree = %q, want %q", got, want)
+	}
+}
+
+func TestAdminCommitValidation(t *testing.T) {
+	ts, r := newTestServer(t, WithAdminToken("secret"))
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`not json`,
+		`{"files": {"a": {"content": "x"}}}`,
+		`{"message": "m", "files": {"../a": {"content": "x"}}}`,
+		`{"message": "m", "files": {"/a": {"content": "x"}}}`,
+		`{"message": "m", "files": {"a//b": {"content": "x"}}}`,
+		`{"message": "m", "files": {".git/config": {"content": "x"}}}`,
+		`{"message": "m", "files": {"a": {"content": "x", "mode": "040000"}}}`,
+		`{"message": "m", "files": {"a": {"content": "x"}, "a/b": {"content": "y"}}}`,
+	} {
+		if got := adminPost(t, ts.URL+"/admin/commit", "secret", body).StatusCode; got != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, got)
+		}
+	}
+
+	after, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["refs/heads/main"] != refs["refs/heads/main"] {
+		t.Error("rejected admin commit advanced main")
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// AuthFunc reports whether the HTTP Basic credentials of r may use the
+// repository.
+type AuthFunc func(user, pass string, r *http.Request) bool
+
+// WithAuth requires git clients to present HTTP Basic credentials that
+// auth accepts. Without it, the repository is open to everyone.
+func WithAuth(auth AuthFunc) Option {
+	return func(s *Server) {
+		s.auth = auth
+	}
+}
+
+// requireAuth only lets requests whose Basic credentials pass the auth
+// hook through, asking git for credentials otherwise.
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	if s.auth == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !s.auth(user, pass, r) {
+			clog.FromContext(r.Context()).Info("rejecting unauthenticated request", "path", r.URL.Path, "user", user)
+			w.Header().Set("WWW-Authenticate", `Basic realm="infinite-git"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// StaticCredentials returns an AuthFunc accepting the passwords of
+// creds, keyed by user name.
+func StaticCredentials(creds map[string]string) AuthFunc {
+	return func(user, pass string, _ *http.Request) bool {
+		want, ok := creds[user]
+		return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+	}
+}
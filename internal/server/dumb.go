@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// handleStatic serves the files of the dumb HTTP protocol: HEAD, loose
+// objects and packs. info/refs is served by handleInfoRefs.
+func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch path := r.URL.Path; {
+	case path == "/HEAD":
+		noCache(w)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "ref: refs/heads/main\n")
+	case path == "/objects/info/packs":
+		s.serveInfoPacks(w, r)
+	case strings.HasPrefix(path, "/objects/pack/"):
+		s.servePackFile(w, r, strings.TrimPrefix(path, "/objects/pack/"))
+	case strings.HasPrefix(path, "/objects/"):
+		s.serveLooseObject(w, r, strings.TrimPrefix(path, "/objects/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// noCache marks a response that changes as the repository does, as git
+// http-backend does.
+func noCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+// cacheForever marks a response named by its content, which never
+// changes.
+func cacheForever(w http.ResponseWriter) {
+	w.Header().Set("Expires", time.Now().Add(365*24*time.Hour).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+}
+
+// serveDumbInfoRefs lists the refs clients may see, one "<hash>\t<name>"
+// line each, for clients without a service. No commit is generated.
+func (s *Server) serveDumbInfoRefs(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		log.Error("failed to read refs", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	names := append(s.advertisedRefs(refs), "refs/heads/main")
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		if hash := refs[name]; hash != "" {
+			fmt.Fprintf(&buf, "%s\t%s\n", hash, name)
+		}
+	}
+	noCache(w)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// serveInfoPacks lists the packs in the object store.
+func (s *Server) serveInfoPacks(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if s.repo.GitDir() != "" {
+		packs, _ := filepath.Glob(filepath.Join(s.repo.GitDir(), "objects", "pack", "pack-*.pack"))
+		for _, p := range packs {
+			fmt.Fprintf(&buf, "P %s\n", filepath.Base(p))
+		}
+	}
+	buf.WriteString("\n")
+	noCache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// servePackFile serves a pack or its index by name.
+func (s *Server) servePackFile(w http.ResponseWriter, r *http.Request, name string) {
+	var contentType string
+	base, ok := strings.CutSuffix(name, ".pack")
+	if ok {
+		contentType = "application/x-git-packed-objects"
+	} else if base, ok = strings.CutSuffix(name, ".idx"); ok {
+		contentType = "application/x-git-packed-objects-toc"
+	}
+	hash, hasPrefix := strings.CutPrefix(base, "pack-")
+	if !ok || !hasPrefix || !s.repo.Format().ValidHash(hash) || s.repo.GitDir() == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.repo.GitDir(), "objects", "pack", name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	cacheForever(w)
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// serveLooseObject serves the object at "<xx>/<rest>" as a zlib-compressed
+// loose object. Archive-backed repositories have no loose files, so their
+// objects are compressed as they are served.
+func (s *Server) serveLooseObject(w http.ResponseWriter, r *http.Request, path string) {
+	dir, rest, ok := strings.Cut(path, "/")
+	hash := dir + rest
+	if !ok || len(dir) != 2 || !s.repo.Format().ValidHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data []byte
+	if rc, err := s.repo.GetObject(hash); err == nil {
+		defer rc.Close()
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(rc); err != nil {
+			clog.FromContext(r.Context()).Error("failed to read object", "hash", hash, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		data = buf.Bytes()
+	} else {
+		full, err := s.repo.ReadObjectFull(hash)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(full)
+		zw.Close()
+		data = buf.Bytes()
+	}
+	cacheForever(w)
+	w.Header().Set("Content-Type", "application/x-git-loose-object")
+	w.Write(data)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// DefaultGCGrace is how long an advertised head is protected from GC after
+// it was last advertised, which covers the gap between a client's ref
+// discovery and its upload-pack request.
+const DefaultGCGrace = time.Hour
+
+// recentHeads remembers when each head was last advertised.
+type recentHeads struct {
+	mu    sync.Mutex
+	grace time.Duration
+	now   func() time.Time
+	heads map[string]time.Time
+}
+
+func newRecentHeads(grace time.Duration) *recentHeads {
+	return &recentHeads{grace: grace, now: time.Now, heads: make(map[string]time.Time)}
+}
+
+// add records that sha was just advertised.
+func (h *recentHeads) add(sha string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.heads[sha] = h.now()
+}
+
+// list returns the heads advertised within the grace period, forgetting
+// older ones.
+func (h *recentHeads) list() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var heads []string
+	for sha, at := range h.heads {
+		if h.now().Sub(at) < h.grace {
+			heads = append(heads, sha)
+		} else {
+			delete(h.heads, sha)
+		}
+	}
+	return heads
+}
+
+// GC deletes unreachable objects, keeping everything reachable from heads
+// advertised within the GC grace period so in-flight fetches still
+// succeed. It returns the number of objects removed.
+func (s *Server) GC() (int, error) {
+	removed, err := s.repo.Prune(s.advertised.list())
+	if removed > 0 && s.packCache != nil {
+		// Cached packs may hold objects that are gone.
+		s.packCache.Purge()
+	}
+	return removed, err
+}
+
+// handleAdminGC runs GC on demand.
+func (s *Server) handleAdminGC(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	removed, err := s.GC()
+	if err != nil {
+		log.Error("gc failed", "removed", removed, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("gc complete", "removed", removed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
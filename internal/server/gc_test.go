@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// resetMain points main at a new root commit, leaving the old history
+// unreferenced, and adds a stray blob.
+func resetMain(t *testing.T, r *repo.Repository) {
+	t.Helper()
+	tree, err := r.WriteTree(object.NewTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := "Reset <reset@example.com>"
+	root, err := r.WriteCommit(object.NewCommit(tree, "", ident, ident, "reset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateRef("refs/heads/main", root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.WriteBlob([]byte("stray\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fetchHead runs upload-pack for head and returns the response body.
+func fetchHead(t *testing.T, url, head string) []byte {
+	t.Helper()
+	var req bytes.Buffer
+	pw := pktline.NewWriter(&req)
+	pw.WriteString("want " + head + "\n")
+	pw.Flush()
+	pw.WriteString("done\n")
+
+	resp, err := http.Post(url+"/git-upload-pack", "application/x-git-upload-pack-request", &req)
+	if err != nil {
+		t.Fatalf("upload-pack: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func runGC(t *testing.T, url string) int {
+	t.Helper()
+	resp := adminPost(t, url+"/admin/gc", "secret", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("gc status = %d", resp.StatusCode)
+	}
+	var out struct{ Removed int }
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Removed
+}
+
+func TestGCKeepsAdvertisedHeads(t *testing.T) {
+	ts, r := newTestServer(t, WithAdminToken("secret"))
+
+	head := advertisement(t, ts.URL)["HEAD"]
+	resetMain(t, r)
+
+	if removed := runGC(t, ts.URL); removed != 1 {
+		t.Errorf("gc removed %d objects, want only the stray blob", removed)
+	}
+	if body := fetchHead(t, ts.URL, head); !bytes.Contains(body, []byte("PACK")) {
+		t.Errorf("fetch of advertised head failed after gc: %q", body)
+	}
+}
+
+func TestGCAfterGrace(t *testing.T) {
+	ts, r := newTestServer(t, WithAdminToken("secret"), WithGCGrace(0))
+
+	head := advertisement(t, ts.URL)["HEAD"]
+	resetMain(t, r)
+
+	// The stray blob plus the old history: two commits, two trees and
+	// two blobs.
+	if removed := runGC(t, ts.URL); removed != 7 {
+		t.Errorf("gc removed %d objects, want 7", removed)
+	}
+	if body := fetchHead(t, ts.URL, head); !strings.Contains(string(body), "ERR ") {
+		t.Errorf("fetch of collected head did not fail: %q", body)
+	}
+}
+
+func TestGCPurgesPackCache(t *testing.T) {
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	s := New(r, testContent{}, WithAdminToken("secret"), WithGCGrace(0), WithPackCache(4))
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	head := advertisement(t, ts.URL)["HEAD"]
+	if body := fetchHead(t, ts.URL, head); !bytes.Contains(body, []byte("PACK")) {
+		t.Fatalf("clone response has no pack: %q", body)
+	}
+	if n := s.packCache.Len(); n != 1 {
+		t.Fatalf("cache has %d packs after a clone, want 1", n)
+	}
+	resetMain(t, r)
+
+	if removed := runGC(t, ts.URL); removed == 0 {
+		t.Fatal("gc removed nothing")
+	}
+	if n := s.packCache.Len(); n != 0 {
+		t.Errorf("cache has %d packs after gc removed their tip, want 0", n)
+	}
+	// The removed head is not served from a stale pack.
+	if body := fetchHead(t, ts.URL, head); bytes.Contains(body, []byte("PACK")) {
+		t.Error("fetch of collected head was served a pack")
+	}
+}
@@ -1,45 +1,135 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/chainguard-dev/clog"
+	"github.com/imjasonh/infinite-git/internal/generator"
 	"github.com/imjasonh/infinite-git/internal/pktline"
 	"github.com/imjasonh/infinite-git/internal/protocol"
 )
 
+// PeekHeader is a request header that, set to a true value such as "1",
+// makes the ref advertisement show the current head instead of generating
+// a new commit. Git sends it with -c http.extraHeader="X-Infinite-Git-Peek: 1".
+const PeekHeader = "X-Infinite-Git-Peek"
+
+// SeedHeader is a request header holding an integer that makes the
+// generated commit depend only on its parent and the seed, for
+// reproducible tests. See generator.GenerateSeededCommit.
+const SeedHeader = "X-Seed"
+
+// BranchHeader is a request header naming the branch, one of those
+// allowed by WithClientBranches, that HEAD should point at for this
+// client, so its clone checks that branch out.
+const BranchHeader = "X-Infinite-Git-Branch"
+
 // handleInfoRefs handles the reference discovery phase.
 func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request) {
 	log := clog.FromContext(r.Context())
 	service := r.URL.Query().Get("service")
 
+	// Pushes are rejected with a message git shows to the user, unless
+	// they are enabled
+	if service == "git-receive-pack" {
+		if s.push {
+			s.advertiseReceivePack(w, r)
+			return
+		}
+		s.rejectReceivePackDiscovery(w, r)
+		return
+	}
+
+	// Clients without a service speak the dumb protocol.
+	if service == "" {
+		s.serveDumbInfoRefs(w, r)
+		return
+	}
+
 	// Only support git-upload-pack (fetch/clone)
 	if service != "git-upload-pack" {
 		http.Error(w, "Service not supported", http.StatusForbidden)
 		return
 	}
 
-	// Generate a new commit before advertising refs
-	commitSHA, err := s.generator.GenerateCommit()
-
-	if err != nil {
-		log.Error("failed to generate commit", "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLen && s.idempotency != nil {
+		http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
 		return
 	}
-
-	log.Info("generated new commit", "sha", commitSHA, "counter", s.generator.GetCounter())
+	branch := r.Header.Get(BranchHeader)
+	if branch != "" && !slices.Contains(s.clientBranches, branch) {
+		http.Error(w, fmt.Sprintf("branch %q is not available", branch), http.StatusBadRequest)
+		return
+	}
+	generate := s.generator.GenerateCommit
+	if v := r.Header.Get(SeedHeader); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, SeedHeader+" must be an integer", http.StatusBadRequest)
+			return
+		}
+		generate = func() (string, error) { return s.generator.GenerateSeededCommit(seed) }
+	}
+	if s.worker != nil {
+		direct := generate
+		generate = func() (string, error) {
+			ctx, cancel := context.WithTimeout(r.Context(), s.genTimeout)
+			defer cancel()
+			return s.worker.Generate(ctx, direct)
+		}
+	}
 
 	// Set headers
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
 	w.Header().Set("Cache-Control", "no-cache")
 
+	// A HEAD request gets the headers alone: generating a commit for an
+	// advertisement nobody reads would only waste it.
+	if r.Method == http.MethodHead {
+		log.Info("answering HEAD without generating")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Compress a large advertisement for clients that accept it. Its size
+	// is known before the commit is generated, since generating moves
+	// main but adds no refs.
+	var out io.Writer = w
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if !protocolV2(r) && acceptsGzip(r) && s.advertisementSize() >= gzipMinBytes {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Vary", "Accept-Encoding")
+		out = gz
+		plain := flush
+		flush = func() {
+			gz.Flush()
+			plain()
+		}
+	}
+
 	// Write response
-	pw := pktline.NewWriter(w)
+	pw := pktline.NewWriter(out)
 
-	// Service declaration
+	// Send the service declaration right away, so the client hears from
+	// us even if generating the commit takes a while. From here on,
+	// failures can only be reported as ERR lines.
 	if err := pw.Writef("# service=%s\n", service); err != nil {
 		log.Error("failed to write service line", "error", err)
 		return
@@ -48,14 +138,107 @@ func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request) {
 		log.Error("failed to write flush", "error", err)
 		return
 	}
+	flush()
+
+	// Generate a new commit before advertising refs, unless this is a
+	// retry of a request that already generated one or the client only
+	// wants to look.
+	var commitSHA string
+	var err error
+	reused := false
+	peek, _ := strconv.ParseBool(r.Header.Get(PeekHeader))
+	peek = peek || s.static
+	if peek {
+		commitSHA, err = s.currentHead()
+	} else if key != "" && s.idempotency != nil {
+		commitSHA, reused, err = s.idempotency.do(key, generate)
+	} else {
+		commitSHA, err = generate()
+	}
+
+	switch {
+	case peek && err != nil:
+		log.Error("failed to read main", "error", err)
+		pw.WriteString("ERR internal server error\n")
+		return
+	case peek:
+		log.Info("advertising existing head without generating", "sha", commitSHA)
+	case reused:
+		log.Info("reusing commit for idempotent retry", "sha", commitSHA)
+	case errors.Is(err, generator.ErrDiskCap):
+		// The store is full: keep serving the history that exists.
+		if commitSHA, err = s.currentHead(); err != nil {
+			log.Error("failed to read main at disk cap", "error", err)
+			pw.WriteString("ERR internal server error\n")
+			return
+		}
+		log.Warn("object store at size cap, advertising existing head", "sha", commitSHA)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Error("timed out waiting for the generation worker", "timeout", s.genTimeout)
+		pw.WriteString("ERR timed out generating commit\n")
+		return
+	case err != nil:
+		log.Error("failed to generate commit", "error", err)
+		pw.WriteString("ERR failed to generate commit\n")
+		return
+	default:
+		log.Info("generated new commit", "sha", commitSHA, "counter", s.generator.GetCounter())
+	}
+
+	// The client will want this head in its upload-pack request, so keep
+	// it from GC for a while even if main moves on.
+	s.advertised.add(commitSHA)
+	if s.prewarmer != nil {
+		s.prewarmer.add(commitSHA)
+	}
+
+	if protocolV2(r) {
+		// The refs are listed by the ls-refs command that follows.
+		if err := pw.WriteString("version 2\n"); err != nil {
+			log.Error("failed to write version line", "error", err)
+			return
+		}
+		for _, c := range protocol.NewUploadPack(s.repo, s.upOpts...).V2Capabilities() {
+			if err := pw.WriteString(c + "\n"); err != nil {
+				log.Error("failed to write capability", "error", err)
+				return
+			}
+		}
+		if err := pw.Flush(); err != nil {
+			log.Error("failed to write final flush", "error", err)
+		}
+		return
+	}
+
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		log.Error("failed to read refs", "error", err)
+		return
+	}
 
 	// Use the commitSHA directly from GenerateCommit rather than re-reading
 	// refs. This avoids a race where concurrent requests could all see the
 	// same latest ref, and ensures HEAD is always advertised first.
-	capabilities := strings.Join(s.repo.GetCapabilities(), " ")
+	caps := protocol.NewUploadPack(s.repo, s.upOpts...).Capabilities()
+	headSHA := commitSHA
+	if branch != "" {
+		// HEAD points at the requested branch for this client.
+		ref := "refs/heads/" + branch
+		if headSHA = refs[ref]; headSHA == "" {
+			log.Warn("requested branch not found", "branch", branch)
+			pw.Writef("ERR branch %s not found\n", branch)
+			return
+		}
+		for i, c := range caps {
+			if strings.HasPrefix(c, "symref=HEAD:") {
+				caps[i] = "symref=HEAD:" + ref
+			}
+		}
+	}
+	capabilities := strings.Join(caps, " ")
 
 	// Advertise HEAD first (Git protocol requirement), then refs/heads/main.
-	if err := pw.Writef("%s HEAD\x00%s\n", commitSHA, capabilities); err != nil {
+	if err := pw.Writef("%s HEAD\x00%s\n", headSHA, capabilities); err != nil {
 		log.Error("failed to write HEAD ref", "error", err)
 		return
 	}
@@ -64,6 +247,14 @@ func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Advertise any other refs, such as tags, except internal ones.
+	for _, name := range s.advertisedRefs(refs) {
+		if err := pw.Writef("%s %s\n", refs[name], name); err != nil {
+			log.Error("failed to write ref", "ref", name, "error", err)
+			return
+		}
+	}
+
 	// Final flush
 	if err := pw.Flush(); err != nil {
 		log.Error("failed to write final flush", "error", err)
@@ -71,6 +262,30 @@ func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// rejectReceivePackDiscovery answers push discovery with an ERR line in
+// place of the ref advertisement, which git prints as a remote error
+// instead of a bare HTTP failure.
+func (s *Server) rejectReceivePackDiscovery(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+	log.Info("rejecting push discovery", "path", r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	pw := pktline.NewWriter(w)
+	if err := pw.WriteString("# service=git-receive-pack\n"); err != nil {
+		log.Error("failed to write service line", "error", err)
+		return
+	}
+	if err := pw.Flush(); err != nil {
+		log.Error("failed to write flush", "error", err)
+		return
+	}
+	if err := pw.Writef("ERR %s\n", s.pushMessage); err != nil {
+		log.Error("failed to write ERR line", "error", err)
+	}
+}
+
 // handleUploadPack handles the pack upload phase.
 func (s *Server) handleUploadPack(w http.ResponseWriter, r *http.Request) {
 	log := clog.FromContext(r.Context())
@@ -79,15 +294,98 @@ func (s *Server) handleUploadPack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Read the whole request up front, so an oversized one can still be
+	// refused before any response is written.
+	reqBody := r.Body
+	if s.maxRequest > 0 {
+		reqBody = http.MaxBytesReader(w, r.Body, s.maxRequest)
+	}
+	// Git compresses large requests, such as one wanting many refs. The
+	// limit holds for the decompressed request too.
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(reqBody)
+		if err != nil {
+			log.Warn("invalid gzip upload-pack request", "error", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		reqBody = zr
+		if s.maxRequest > 0 {
+			reqBody = http.MaxBytesReader(w, zr, s.maxRequest)
+		}
+	}
+	body, err := io.ReadAll(reqBody)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			log.Warn("upload-pack request too large", "limit", tooBig.Limit)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Error("failed to read upload-pack request", "error", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
 	// Set headers
 	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
 	w.Header().Set("Cache-Control", "no-cache")
 
 	// Create upload-pack handler
-	up := protocol.NewUploadPack(s.repo)
+	opts := append(slices.Clip(s.upOpts), protocol.WithContext(r.Context()))
+	if s.packCache != nil {
+		opts = append(opts, protocol.WithPackCache(s.packCache))
+	}
+	if !s.anyWant {
+		opts = append(opts, protocol.WithAdvertisedTips(s.advertisedTips))
+	}
+	if s.logCaps {
+		opts = append(opts, protocol.WithOnRequest(func(req *protocol.FetchRequest) {
+			log.Info("negotiated capabilities",
+				"capabilities", req.Capabilities,
+				"filter", req.Filter,
+				"wants", len(req.Wants),
+				"haves", len(req.Haves),
+			)
+		}))
+	}
+	up := protocol.NewUploadPack(s.repo, opts...)
+
+	// With Content-Length, the whole response is built before any of it
+	// is sent, spilling to a temp file once it gets large.
+	out := io.Writer(w)
+	var buf *spillBuffer
+	if s.contentLength {
+		buf = &spillBuffer{limit: s.spillAt, dir: s.spillDir, onSpill: s.onSpill}
+		defer buf.Close()
+		out = buf
+	}
 
 	// Process the request
-	if err := up.HandleRequest(r.Body, w); err != nil {
+	if protocolV2(r) {
+		branch := r.Header.Get(BranchHeader)
+		err = up.HandleV2Request(bytes.NewReader(body), out, func() ([]protocol.Ref, error) {
+			return s.lsRefs(branch)
+		})
+	} else {
+		err = up.HandleRequest(bytes.NewReader(body), out)
+	}
+	s.metrics.countUploadPack(uploadPackOutcome(r.Context(), err))
+	if buf != nil {
+		// Send the response even on failure: it ends with the error
+		// for the client.
+		w.Header().Set("Content-Length", strconv.FormatInt(buf.Len(), 10))
+		if _, werr := buf.WriteTo(w); werr != nil {
+			log.Error("failed to send buffered response", "error", werr)
+		}
+	}
+	if err != nil {
+		var abort *protocol.ClientAbortError
+		if errors.As(err, &abort) {
+			log.Warn("client aborted upload-pack", "message", abort.Message)
+			return
+		}
 		log.Error("upload-pack failed", "error", err)
 		// Don't send HTTP error here as we may have already started writing response
 		return
@@ -95,3 +393,128 @@ func (s *Server) handleUploadPack(w http.ResponseWriter, r *http.Request) {
 
 	log.Info("completed upload-pack")
 }
+
+// gzipMinBytes is the smallest ref advertisement worth compressing.
+// Below it, gzip's header and trailer eat most of the savings.
+const gzipMinBytes = 4096
+
+// acceptsGzip reports whether the client accepts a gzip-encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
+
+// advertisementSize estimates the bytes of the v0 ref advertisement from
+// the refs it will list, leaving out the capabilities.
+func (s *Server) advertisementSize() int {
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		return 0
+	}
+	// HEAD and main, then the rest, each "<len><hash> <name>\n".
+	hexLen := s.repo.Format().HexLen()
+	n := 2 * (4 + hexLen + 2)
+	n += len("HEAD") + len("refs/heads/main")
+	for _, name := range s.advertisedRefs(refs) {
+		n += 4 + hexLen + 1 + len(name) + 1
+	}
+	return n
+}
+
+// protocolV2 reports whether the client asked for protocol v2 in the
+// Git-Protocol header, a colon-separated list of key=value parameters.
+func protocolV2(r *http.Request) bool {
+	return slices.Contains(strings.Split(r.Header.Get("Git-Protocol"), ":"), "version=2")
+}
+
+// lsRefs lists the refs for protocol v2's ls-refs: those the v0
+// advertisement shows, with HEAD pointing at main or the client's branch.
+func (s *Server) lsRefs(branch string) ([]protocol.Ref, error) {
+	head := "refs/heads/main"
+	if branch != "" {
+		if !slices.Contains(s.clientBranches, branch) {
+			return nil, fmt.Errorf("branch %q is not available", branch)
+		}
+		head = "refs/heads/" + branch
+	}
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		return nil, err
+	}
+	if refs[head] == "" {
+		return nil, fmt.Errorf("branch %s not found", strings.TrimPrefix(head, "refs/heads/"))
+	}
+	list := []protocol.Ref{
+		{Name: "HEAD", Hash: refs[head], Target: head},
+		{Name: "refs/heads/main", Hash: refs["refs/heads/main"]},
+	}
+	for _, name := range s.advertisedRefs(refs) {
+		list = append(list, protocol.Ref{Name: name, Hash: refs[name]})
+	}
+	return list, nil
+}
+
+// advertisedRefs returns the sorted names of refs to advertise besides HEAD
+// and refs/heads/main, leaving out refs under hidden prefixes.
+func (s *Server) advertisedRefs(refs map[string]string) []string {
+	var names []string
+	for name := range refs {
+		if name == "HEAD" || name == "refs/heads/main" || s.isHiddenRef(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// currentHead returns the commit main points at.
+func (s *Server) currentHead() (string, error) {
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		return "", err
+	}
+	if refs["refs/heads/main"] == "" {
+		return "", fmt.Errorf("main branch not found")
+	}
+	return refs["refs/heads/main"], nil
+}
+
+// advertisedTips returns the heads clients may fetch from: every
+// advertised ref, plus heads advertised recently that main may have moved
+// away from.
+func (s *Server) advertisedTips() ([]string, error) {
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		return nil, err
+	}
+	tips := s.advertised.list()
+	for _, name := range append(s.advertisedRefs(refs), "refs/heads/main") {
+		if hash := refs[name]; hash != "" {
+			tips = append(tips, hash)
+		}
+	}
+	return tips, nil
+}
+
+// isHiddenRef reports whether a ref is internal bookkeeping that must not
+// be shown to clients.
+func (s *Server) isHiddenRef(name string) bool {
+	for _, prefix := range s.hiddenRefs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyTTL is how long an Idempotency-Key keeps returning the
+// head it first generated.
+const DefaultIdempotencyTTL = 10 * time.Minute
+
+// maxIdempotencyKeyLen bounds the keys the server will remember.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyCache remembers the head generated for each Idempotency-Key,
+// so a client retrying a ref advertisement does not generate another
+// commit.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	sha     string
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]idempotencyEntry),
+	}
+}
+
+// do returns the head remembered for key, or calls generate and remembers
+// its result. Failures are not remembered, so a retry generates again.
+// The lock is held while generating so concurrent requests with the same
+// key cannot both generate.
+func (c *idempotencyCache) do(key string, generate func() (string, error)) (sha string, reused bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		return e.sha, true, nil
+	}
+
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	sha, err = generate()
+	if err != nil {
+		return "", false, err
+	}
+	c.entries[key] = idempotencyEntry{sha: sha, expires: now.Add(c.ttl)}
+	return sha, false, nil
+}
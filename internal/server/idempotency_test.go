@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// advertisedHead fetches the ref advertisement with the given
+// Idempotency-Key and returns the advertised HEAD.
+func advertisedHead(t *testing.T, url, key string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("fetching info/refs: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The HEAD line follows the service line and its flush.
+	_, rest, ok := strings.Cut(string(body), "0000")
+	if !ok || len(rest) < 44 {
+		t.Fatalf("malformed advertisement: %q", body)
+	}
+	return rest[4:44]
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ts, r := newTestServer(t)
+
+	first := advertisedHead(t, ts.URL, "retry-1")
+	if again := advertisedHead(t, ts.URL, "retry-1"); again != first {
+		t.Errorf("retry advertised %s, want %s", again, first)
+	}
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	if refs["refs/heads/main"] != first {
+		t.Errorf("main = %s, want %s; retry generated a commit", refs["refs/heads/main"], first)
+	}
+
+	if other := advertisedHead(t, ts.URL, "retry-2"); other == first {
+		t.Error("a new key reused the previous head")
+	}
+	if unkeyed := advertisedHead(t, ts.URL, ""); unkeyed == first {
+		t.Error("a request without a key reused the previous head")
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	n := 0
+	generate := func() (string, error) {
+		n++
+		return strings.Repeat(string(rune('0'+n)), 40), nil
+	}
+
+	first, _, _ := c.do("k", generate)
+	if sha, reused, _ := c.do("k", generate); !reused || sha != first {
+		t.Errorf("within TTL: got %s reused=%t, want %s reused", sha, reused, first)
+	}
+
+	now = now.Add(time.Minute)
+	if sha, reused, _ := c.do("k", generate); reused || sha == first {
+		t.Errorf("after TTL: got %s reused=%t, want a new head", sha, reused)
+	}
+	if len(c.entries) != 1 {
+		t.Errorf("cache holds %d entries, want expired ones pruned", len(c.entries))
+	}
+}
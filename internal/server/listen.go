@@ -0,0 +1,16 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Listen opens a TCP listener on addr whose accepted connections use TCP
+// keep-alive probes every keepAlive, so clones to peers that vanish
+// without closing the connection are eventually torn down. A negative
+// keepAlive disables keep-alive; zero uses the Go default.
+func Listen(ctx context.Context, addr string, keepAlive time.Duration) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	return lc.Listen(ctx, "tcp", addr)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenKeepAlive(t *testing.T) {
+	ln, err := Listen(context.Background(), "127.0.0.1:0", 42*time.Second)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var enabled, idle int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		if enabled, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); serr != nil {
+			return
+		}
+		idle, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if serr != nil {
+		t.Skipf("cannot read socket options: %v", serr)
+	}
+
+	if enabled == 0 {
+		t.Error("SO_KEEPALIVE not set on accepted connection")
+	}
+	if idle != 42 {
+		t.Errorf("TCP_KEEPIDLE = %d, want 42", idle)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/imjasonh/infinite-git/internal/protocol"
+)
+
+// Outcomes of an upload-pack request, the values of the outcome label of
+// the upload_pack_requests_total metric.
+const (
+	OutcomeSuccess   = "success"
+	OutcomeError     = "error"
+	OutcomeCancelled = "cancelled"
+)
+
+// outcomes lists the outcomes in the order they are exported.
+var outcomes = []string{OutcomeSuccess, OutcomeError, OutcomeCancelled}
+
+// metrics counts served requests for /admin/metrics.
+type metrics struct {
+	mu          sync.Mutex
+	uploadPacks map[string]int64 // by outcome
+}
+
+// uploadPackOutcome classifies an upload-pack request that ended with err.
+// A client that went away or aborted the fetch cancelled it, whatever
+// error that caused on our side.
+func uploadPackOutcome(ctx context.Context, err error) string {
+	var abort *protocol.ClientAbortError
+	switch {
+	case ctx.Err() != nil, errors.As(err, &abort):
+		return OutcomeCancelled
+	case err != nil:
+		return OutcomeError
+	default:
+		return OutcomeSuccess
+	}
+}
+
+func (m *metrics) countUploadPack(outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.uploadPacks == nil {
+		m.uploadPacks = make(map[string]int64)
+	}
+	m.uploadPacks[outcome]++
+}
+
+// UploadPackCount returns how many upload-pack requests ended with
+// outcome.
+func (s *Server) UploadPackCount(outcome string) int64 {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	return s.metrics.uploadPacks[outcome]
+}
+
+// handleAdminMetrics exports the counters in the Prometheus text format.
+func (s *Server) handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP upload_pack_requests_total Upload-pack requests served, by outcome.")
+	fmt.Fprintln(w, "# TYPE upload_pack_requests_total counter")
+	for _, outcome := range outcomes {
+		fmt.Fprintf(w, "upload_pack_requests_total{outcome=%q} %d\n", outcome, s.UploadPackCount(outcome))
+	}
+}
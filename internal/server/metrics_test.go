@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imjasonh/infinite-git/internal/generator"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+func TestUploadPackOutcomeMetric(t *testing.T) {
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An incompressible blob makes the pack larger than the connection
+	// buffers, so the server is still writing when the client goes away.
+	srv := New(r, testContent{},
+		WithAdminToken("secret"),
+		WithGeneratorOptions(generator.WithEntropyData(16<<20, 1)),
+	)
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	head := advertisement(t, ts.URL)["HEAD"]
+
+	var body bytes.Buffer
+	pw := pktline.NewWriter(&body)
+	pw.WriteString("want " + head + " side-band-64k\n")
+	pw.Flush()
+	pw.WriteString("done\n")
+
+	clone := func(ctx context.Context) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.URL+"/git-upload-pack", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("upload-pack: %v", err)
+		}
+		return resp
+	}
+
+	// waitFor waits for the handler, which finishes after the client
+	// stops reading, to count outcome.
+	waitFor := func(outcome string, want int64) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if srv.UploadPackCount(outcome) == want {
+				return
+			}
+		}
+		t.Fatalf("%s count = %d, want %d", outcome, srv.UploadPackCount(outcome), want)
+	}
+
+	resp := clone(context.Background())
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	waitFor(OutcomeSuccess, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp = clone(ctx)
+	if _, err := io.ReadFull(resp.Body, make([]byte, 64)); err != nil {
+		t.Fatalf("reading the start of the pack: %v", err)
+	}
+	cancel()
+	resp.Body.Close()
+	waitFor(OutcomeCancelled, 1)
+
+	if n := srv.UploadPackCount(OutcomeError); n != 0 {
+		t.Errorf("error count = %d, want 0", n)
+	}
+	metrics, err := io.ReadAll(adminGet(t, ts.URL+"/admin/metrics", "secret").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`upload_pack_requests_total{outcome="success"} 1`,
+		`upload_pack_requests_total{outcome="error"} 0`,
+		`upload_pack_requests_total{outcome="cancelled"} 1`,
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics missing %q:\n%s", want, metrics)
+		}
+	}
+	if resp := adminGet(t, ts.URL+"/admin/metrics", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("metrics without the token: status %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"sync"
+)
+
+// prewarmQueue is how many heads may wait to be prewarmed. Heads queued
+// while it is full are skipped; their first clone builds the pack.
+const prewarmQueue = 16
+
+// prewarmer builds clone packs one at a time on its own goroutine. Each
+// head is queued at most once, however often it is advertised.
+type prewarmer struct {
+	mu     sync.Mutex
+	queued map[string]bool
+	heads  chan string
+	build  func(head string)
+
+	done    chan struct{}
+	stopped chan struct{}
+	close   sync.Once
+}
+
+// newPrewarmer starts a prewarmer that calls build for each queued head.
+func newPrewarmer(build func(head string)) *prewarmer {
+	p := &prewarmer{
+		queued:  make(map[string]bool),
+		heads:   make(chan string, prewarmQueue),
+		build:   build,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *prewarmer) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.done:
+			return
+		case head := <-p.heads:
+			p.build(head)
+			p.mu.Lock()
+			delete(p.queued, head)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// add queues head unless it is already queued or being built, or the
+// queue is full. It never blocks.
+func (p *prewarmer) add(head string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued[head] {
+		return
+	}
+	select {
+	case p.heads <- head:
+		p.queued[head] = true
+	default:
+	}
+}
+
+// Close stops the prewarmer once the build in progress, if any, ends.
+// Queued heads are dropped.
+func (p *prewarmer) Close() {
+	p.close.Do(func() { close(p.done) })
+	<-p.stopped
+}
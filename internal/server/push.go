@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+	"github.com/imjasonh/infinite-git/internal/protocol"
+)
+
+// receivePack returns the receive-pack handler for pushes, which may not
+// touch hidden refs or delete main, where commits are generated.
+func (s *Server) receivePack() *protocol.ReceivePack {
+	return protocol.NewReceivePack(s.repo,
+		protocol.WithMaxPushBytes(s.maxPush),
+		protocol.WithRefCheck(func(cmd protocol.RefCommand) error {
+			switch {
+			case s.isHiddenRef(cmd.Ref):
+				return errors.New("ref is managed by the server")
+			case cmd.Ref == "refs/heads/main" && cmd.New == s.repo.Format().ZeroID():
+				return errors.New("main cannot be deleted")
+			}
+			return nil
+		}),
+	)
+}
+
+// advertiseReceivePack answers push discovery with the refs clients may
+// see and the receive-pack capabilities. No commit is generated.
+func (s *Server) advertiseReceivePack(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+
+	refs, err := s.repo.GetRefs()
+	if err != nil {
+		log.Error("failed to read refs", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	visible := map[string]string{"refs/heads/main": refs["refs/heads/main"]}
+	for _, name := range s.advertisedRefs(refs) {
+		visible[name] = refs[name]
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	pw := pktline.NewWriter(w)
+	if err := pw.WriteString("# service=git-receive-pack\n"); err != nil {
+		log.Error("failed to write service line", "error", err)
+		return
+	}
+	if err := pw.Flush(); err != nil {
+		log.Error("failed to write flush", "error", err)
+		return
+	}
+	if err := s.receivePack().Advertise(w, visible); err != nil {
+		log.Error("failed to advertise refs for push", "error", err)
+	}
+}
+
+// handlePush applies a push, reporting the outcome of each ref update.
+func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
+	log := clog.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := s.receivePack().HandleRequest(r.Body, w); err != nil {
+		log.Error("receive-pack failed", "error", err)
+		return
+	}
+	log.Info("completed receive-pack")
+}
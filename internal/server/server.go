@@ -1,42 +1,406 @@
 package server
 
 import (
+	"context"
 	"net/http"
-	"sync"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/chainguard-dev/clog"
+	"github.com/imjasonh/infinite-git/internal/clock"
 	"github.com/imjasonh/infinite-git/internal/generator"
+	"github.com/imjasonh/infinite-git/internal/protocol"
 	"github.com/imjasonh/infinite-git/internal/repo"
 )
 
+// DefaultHiddenRefPrefixes are ref namespaces used for server bookkeeping,
+// which are never advertised to clients.
+var DefaultHiddenRefPrefixes = []string{"refs/infinite/", "refs/scratch/"}
+
+// DefaultPushMessage is shown to users who try to push.
+const DefaultPushMessage = "pushes are disabled: this repository is read-only and generates a new commit on every fetch"
+
+// DefaultMaxRequestBytes bounds upload-pack request bodies. It leaves room
+// for tens of thousands of haves.
+const DefaultMaxRequestBytes = 10 << 20
+
 // Server handles Git HTTP protocol requests.
 type Server struct {
-	repo      *repo.Repository
-	generator *generator.Generator
-	mu        sync.Mutex
+	repo        *repo.Repository
+	generator   *generator.Generator
+	packCache   *protocol.PackCache
+	genOpts     []generator.Option
+	upOpts      []protocol.Option
+	hiddenRefs  []string
+	pushMessage string
+	push        bool
+	maxPush     int64
+	adminToken  string
+	auth        AuthFunc
+	idempotency *idempotencyCache
+	advertised  *recentHeads
+	maxRequest  int64
+	anyWant     bool
+	clock       clock.Clock
+	logCaps     bool
+	prewarm     bool
+	static      bool
+	metrics     metrics
+	// worker generates commits for info/refs requests, which wait up to
+	// genTimeout for them, if WithGenerationWorker is used.
+	worker     *generator.Worker
+	genTimeout time.Duration
+	// prewarmer builds the clone packs of advertised heads if
+	// WithPackPrewarm is used.
+	prewarmer *prewarmer
+	// clientBranches may be requested with BranchHeader.
+	clientBranches []string
+
+	contentLength bool
+	spillAt       int64
+	spillDir      string
+	// onSpill is called with the temp file a response spills to; tests
+	// set it to observe spilling.
+	onSpill func(path string)
+
+	// named are the repositories WithRepository adds, served by children
+	// under their names.
+	named    []namedRepo
+	children map[string]*Server
+}
+
+// namedRepo is a repository served under /<name>/.
+type namedRepo struct {
+	name     string
+	repo     *repo.Repository
+	provider generator.ContentProvider
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPackCache caches up to size finalized packs for full clones,
+// keyed by the wanted head. A size of zero disables caching.
+func WithPackCache(size int) Option {
+	return func(s *Server) {
+		if size > 0 {
+			s.packCache = protocol.NewPackCache(size)
+		}
+	}
+}
+
+// WithGeneratorOptions configures the server's commit generator.
+func WithGeneratorOptions(opts ...generator.Option) Option {
+	return func(s *Server) {
+		s.genOpts = append(s.genOpts, opts...)
+	}
+}
+
+// WithUploadPackOptions configures upload-pack for every fetch.
+func WithUploadPackOptions(opts ...protocol.Option) Option {
+	return func(s *Server) {
+		s.upOpts = append(s.upOpts, opts...)
+	}
+}
+
+// WithHiddenRefPrefixes hides refs under the given prefixes from clients,
+// in addition to DefaultHiddenRefPrefixes.
+func WithHiddenRefPrefixes(prefixes ...string) Option {
+	return func(s *Server) {
+		s.hiddenRefs = append(s.hiddenRefs, prefixes...)
+	}
+}
+
+// WithPushMessage sets the message shown to users who try to push.
+func WithPushMessage(msg string) Option {
+	return func(s *Server) {
+		s.pushMessage = msg
+	}
+}
+
+// WithPush accepts pushes through git-receive-pack, so the server can
+// double as a writable test server, instead of refusing them with the
+// push message. Pushes may update any ref clients can see except by
+// deleting main, and may not be larger than maxBytes, or any size if it
+// is zero.
+func WithPush(enabled bool, maxBytes int64) Option {
+	return func(s *Server) {
+		s.push = enabled
+		s.maxPush = maxBytes
+	}
+}
+
+// WithAdminToken enables the /admin/ endpoints for requests that carry
+// "Authorization: Bearer <token>". Without a token they are not served.
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithIdempotencyTTL sets how long a ref advertisement requested with an
+// Idempotency-Key header keeps returning the same head, so clients can
+// retry without generating another commit. Zero ignores the header.
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.idempotency = nil
+		if ttl > 0 {
+			s.idempotency = newIdempotencyCache(ttl)
+		}
+	}
+}
+
+// WithGCGrace sets how long GC keeps objects reachable from a head after
+// it was last advertised.
+func WithGCGrace(grace time.Duration) Option {
+	return func(s *Server) {
+		s.advertised = newRecentHeads(grace)
+	}
+}
+
+// WithMaxRequestBytes rejects upload-pack requests whose body is larger
+// than n bytes with 413 Request Entity Too Large. Zero means no limit.
+func WithMaxRequestBytes(n int64) Option {
+	return func(s *Server) {
+		s.maxRequest = n
+	}
+}
+
+// WithAllowUnadvertisedWants lets clients fetch any object in the store,
+// including ones only reachable from hidden refs. By default a want must
+// be reachable from an advertised ref.
+func WithAllowUnadvertisedWants(allow bool) Option {
+	return func(s *Server) {
+		s.anyWant = allow
+	}
+}
+
+// WithClock takes the time from c instead of the system clock, for
+// generated and admin commits, idempotency keys and GC.
+func WithClock(c clock.Clock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// WithLogCapabilities logs the capabilities each fetch negotiated, such
+// as its side-band variant and whether it filters, for debugging clients.
+func WithLogCapabilities(enabled bool) Option {
+	return func(s *Server) {
+		s.logCaps = enabled
+	}
+}
+
+// WithContentLength builds each upload-pack response completely before
+// sending it, so it can carry a Content-Length header, for proxies and
+// clients that need one. Responses larger than spillAt bytes are spilled
+// to a temp file in dir, or the default temp dir if dir is empty, to bound
+// memory use; zero keeps every response in memory.
+func WithContentLength(enabled bool, spillAt int64, dir string) Option {
+	return func(s *Server) {
+		s.contentLength = enabled
+		s.spillAt = spillAt
+		s.spillDir = dir
+	}
 }
 
-// New creates a new Git HTTP server.
-func New(r *repo.Repository, provider generator.ContentProvider) *Server {
-	return &Server{
-		repo:      r,
-		generator: generator.New(r, provider),
+// WithClientBranches lets clients pick which of the named branches HEAD
+// points at by sending BranchHeader. The branches must exist when
+// requested; main keeps receiving the generated commits.
+func WithClientBranches(branches ...string) Option {
+	return func(s *Server) {
+		s.clientBranches = append(s.clientBranches, branches...)
+	}
+}
+
+// WithPackPrewarm builds and caches the clone pack of every advertised
+// head in the background, one at a time, so the first clone of it is
+// served from the cache. Clones that arrive while their pack is being
+// built wait for it rather than building it again. It needs
+// WithPackCache.
+func WithPackPrewarm(enabled bool) Option {
+	return func(s *Server) {
+		s.prewarm = enabled
+	}
+}
+
+// WithStaticHistory serves the repository's existing history: every
+// fetch is answered as if it sent PeekHeader, and no commits are
+// generated. Repositories opened with repo.OpenArchive need it, since
+// they cannot be written.
+func WithStaticHistory(enabled bool) Option {
+	return func(s *Server) {
+		s.static = enabled
+	}
+}
+
+// generationQueue is how many info/refs requests may wait for the
+// generation worker before more block handing their request over.
+const generationQueue = 64
+
+// WithGenerationWorker generates commits on a background worker, one at
+// a time, instead of on each info/refs request's goroutine. Requests wait
+// up to timeout for their commit and fail if it takes longer. Zero
+// generates on the request's goroutine.
+func WithGenerationWorker(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.genTimeout = timeout
+	}
+}
+
+// WithRepository also serves r, with content from provider, under
+// /<name>/, generating its own commits with its own counter. It gets the
+// server's other options. The name is a single path segment, and must not
+// be one the server itself uses, such as "info" or "objects".
+func WithRepository(name string, r *repo.Repository, provider generator.ContentProvider) Option {
+	return func(s *Server) {
+		s.named = append(s.named, namedRepo{name, r, provider})
+	}
+}
+
+// New creates a new Git HTTP server for r, served at the root. r may be
+// nil to serve only the repositories of WithRepository, which 404s any
+// path outside them.
+func New(r *repo.Repository, provider generator.ContentProvider, opts ...Option) *Server {
+	s := newServer(r, provider, opts)
+	s.children = make(map[string]*Server, len(s.named))
+	for _, nr := range s.named {
+		child := newServer(nr.repo, nr.provider, opts)
+		child.named = nil
+		s.children[nr.name] = child
+	}
+	return s
+}
+
+// newServer creates the server for one repository.
+func newServer(r *repo.Repository, provider generator.ContentProvider, opts []Option) *Server {
+	s := &Server{
+		repo:        r,
+		hiddenRefs:  append([]string(nil), DefaultHiddenRefPrefixes...),
+		pushMessage: DefaultPushMessage,
+		idempotency: newIdempotencyCache(DefaultIdempotencyTTL),
+		advertised:  newRecentHeads(DefaultGCGrace),
+		maxRequest:  DefaultMaxRequestBytes,
+		clock:       clock.Real{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.idempotency != nil {
+		s.idempotency.now = s.clock.Now
+	}
+	s.advertised.now = s.clock.Now
+	genOpts := append([]generator.Option{generator.WithClock(s.clock)}, s.genOpts...)
+	if r != nil {
+		s.generator = generator.New(r, provider, genOpts...)
+	}
+	if s.genTimeout > 0 {
+		s.worker = generator.NewWorker(generationQueue)
+	}
+	if s.prewarm && s.packCache != nil {
+		s.prewarmer = newPrewarmer(s.prewarmPack)
+	}
+	return s
+}
+
+// Close stops the server's generation and prewarm workers, if it has
+// any. Requests still waiting for them fail.
+func (s *Server) Close() {
+	if s.worker != nil {
+		s.worker.Close()
+	}
+	if s.prewarmer != nil {
+		s.prewarmer.Close()
+	}
+	for _, child := range s.children {
+		child.Close()
+	}
+}
+
+// prewarmPack caches the clone pack for head.
+func (s *Server) prewarmPack(head string) {
+	opts := append(slices.Clip(s.upOpts), protocol.WithPackCache(s.packCache))
+	if err := protocol.NewUploadPack(s.repo, opts...).Prewarm([]string{head}); err != nil {
+		clog.FromContext(context.Background()).Warn("failed to prewarm pack", "head", head, "error", err)
 	}
 }
 
 // Handler returns the HTTP handler for the server.
 func (s *Server) Handler() http.Handler {
+	return s.logMiddleware(s.routes())
+}
+
+// routes returns the handler for the server's repository and, under their
+// names, those WithRepository adds.
+func (s *Server) routes() http.Handler {
 	mux := http.NewServeMux()
+	for name, child := range s.children {
+		mux.Handle("/"+name+"/", http.StripPrefix("/"+name, child.routes()))
+	}
+	if s.repo == nil {
+		mux.HandleFunc("/", http.NotFound)
+		return mux
+	}
 
 	// Git smart HTTP endpoints
-	mux.HandleFunc("/info/refs", s.handleInfoRefs)
-	mux.HandleFunc("/git-upload-pack", s.handleUploadPack)
-	mux.HandleFunc("/git-receive-pack", s.handleReceivePack)
+	mux.HandleFunc("/info/refs", s.requireAuth(s.handleInfoRefs))
+	mux.HandleFunc("/git-upload-pack", s.requireAuth(s.handleUploadPack))
+	mux.HandleFunc("/git-receive-pack", s.requireAuth(s.handleReceivePack))
+
+	// Admin endpoints, gated by the admin token
+	mux.HandleFunc("/admin/pack", s.requireAdmin(s.handleAdminPack))
+	mux.HandleFunc("/admin/commit", s.requireAdmin(s.handleAdminCommit))
+	mux.HandleFunc("/admin/gc", s.requireAdmin(s.handleAdminGC))
+	mux.HandleFunc("/admin/metrics", s.requireAdmin(s.handleAdminMetrics))
 
 	// Static file serving for dumb protocol (objects, refs)
-	mux.HandleFunc("/", s.handleStatic)
+	mux.HandleFunc("/", s.requireAuth(s.handleStatic))
 
-	return s.logMiddleware(mux)
+	return optionsMiddleware(mux)
+}
+
+// endpointMethods lists the methods each endpoint accepts, besides
+// OPTIONS.
+var endpointMethods = map[string][]string{
+	"/info/refs":        {http.MethodGet, http.MethodHead},
+	"/git-upload-pack":  {http.MethodPost},
+	"/git-receive-pack": {http.MethodPost},
+	"/admin/pack":       {http.MethodGet},
+	"/admin/commit":     {http.MethodPost},
+	"/admin/gc":         {http.MethodPost},
+	"/admin/metrics":    {http.MethodGet},
+	"/HEAD":             {http.MethodGet, http.MethodHead},
+}
+
+// allowedMethods returns the methods path accepts, or nil if nothing is
+// served there.
+func allowedMethods(path string) []string {
+	if methods, ok := endpointMethods[path]; ok {
+		return methods
+	}
+	if strings.HasPrefix(path, "/objects/") {
+		return []string{http.MethodGet, http.MethodHead}
+	}
+	return nil
+}
+
+// optionsMiddleware answers OPTIONS requests with the methods the path
+// accepts in an Allow header, without reaching the handler.
+func optionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		methods := allowedMethods(r.URL.Path)
+		if methods == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(append(slices.Clip(methods), http.MethodOptions), ", "))
+		w.WriteHeader(http.StatusOK)
+	})
 }
 
 // logMiddleware logs HTTP requests.
@@ -53,15 +417,13 @@ func (s *Server) logMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// handleReceivePack rejects push operations.
+// handleReceivePack rejects push operations, unless WithPush allows them.
 func (s *Server) handleReceivePack(w http.ResponseWriter, r *http.Request) {
+	if s.push {
+		s.handlePush(w, r)
+		return
+	}
 	log := clog.FromContext(r.Context())
 	log.Info("rejecting push attempt", "path", r.URL.Path)
 	http.Error(w, "Push access denied", http.StatusForbidden)
 }
-
-// handleStatic serves static Git files (for dumb protocol).
-func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request) {
-	// For now, we'll focus on smart protocol only
-	http.NotFound(w, r)
-}
@@ -0,0 +1,1313 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/go-git/go-git/v5"
+	"github.com/imjasonh/infinite-git/internal/clock"
+	"github.com/imjasonh/infinite-git/internal/generator"
+	"github.com/imjasonh/infinite-git/internal/object"
+	"github.com/imjasonh/infinite-git/internal/pktline"
+	"github.com/imjasonh/infinite-git/internal/protocol"
+	"github.com/imjasonh/infinite-git/internal/repo"
+)
+
+// testContent is a minimal ContentProvider for server tests.
+type testContent struct{}
+
+func (testContent) InitialFiles() map[string][]byte {
+	return map[string][]byte{"hello.txt": []byte("Pull #0\n")}
+}
+
+func (testContent) GenerateFiles(count int64, now time.Time) map[string][]byte {
+	return map[string][]byte{"hello.txt": []byte(fmt.Sprintf("Pull #%d\n", count))}
+}
+
+func (testContent) CommitMessage(count int64, now time.Time) string {
+	return fmt.Sprintf("Pull #%d", count)
+}
+
+func newTestServer(t *testing.T, opts ...Option) (*httptest.Server, *repo.Repository) {
+	t.Helper()
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	ts := httptest.NewServer(New(r, testContent{}, opts...).Handler())
+	t.Cleanup(ts.Close)
+	return ts, r
+}
+
+// advertisement fetches the upload-pack ref advertisement and returns the
+// advertised refs by name.
+func advertisement(t *testing.T, url string) map[string]string {
+	t.Helper()
+	refs, err := fetchAdvertisement(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+// fetchAdvertisement is advertisement for use off the test goroutine.
+func fetchAdvertisement(url string) (map[string]string, error) {
+	resp, err := http.Get(url + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		return nil, fmt.Errorf("fetching info/refs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("info/refs status = %d", resp.StatusCode)
+	}
+
+	pr := pktline.NewReader(resp.Body)
+	// Service line and its flush.
+	if _, err := pr.ReadString(); err != nil {
+		return nil, fmt.Errorf("reading service line: %w", err)
+	}
+	if _, err := pr.ReadString(); err != io.EOF {
+		return nil, fmt.Errorf("expected flush after service line, got %v", err)
+	}
+
+	refs := make(map[string]string)
+	for {
+		line, err := pr.ReadString()
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading ref line: %w", err)
+		}
+		line, _, _ = strings.Cut(line, "\x00")
+		hash, name, _ := strings.Cut(line, " ")
+		refs[name] = hash
+	}
+}
+
+func TestHiddenRefsNotAdvertised(t *testing.T) {
+	ts, r := newTestServer(t, WithHiddenRefPrefixes("refs/private/"))
+
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	head := refs["refs/heads/main"]
+	for _, name := range []string{"refs/infinite/counter", "refs/scratch/x", "refs/private/y", "refs/tags/v1"} {
+		if err := r.UpdateRef(name, head); err != nil {
+			t.Fatalf("creating %s: %v", name, err)
+		}
+	}
+
+	advertised := advertisement(t, ts.URL)
+	for _, name := range []string{"refs/infinite/counter", "refs/scratch/x", "refs/private/y"} {
+		if _, ok := advertised[name]; ok {
+			t.Errorf("internal ref %s was advertised", name)
+		}
+	}
+	for _, name := range []string{"HEAD", "refs/heads/main", "refs/tags/v1"} {
+		if _, ok := advertised[name]; !ok {
+			t.Errorf("ref %s was not advertised", name)
+		}
+	}
+
+	// Internal refs remain visible server-side.
+	refs, err = r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	if refs["refs/infinite/counter"] == "" {
+		t.Error("internal ref missing from GetRefs")
+	}
+}
+
+func TestReceivePackDiscoveryMessage(t *testing.T) {
+	ts, _ := newTestServer(t, WithPushMessage("no pushing here"))
+
+	resp, err := http.Get(ts.URL + "/info/refs?service=git-receive-pack")
+	if err != nil {
+		t.Fatalf("fetching info/refs: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.Header.Get("Content-Type"), "application/x-git-receive-pack-advertisement"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	pr := pktline.NewReader(resp.Body)
+	if line, err := pr.ReadString(); err != nil || line != "# service=git-receive-pack" {
+		t.Fatalf("service line = %q, %v", line, err)
+	}
+	if _, err := pr.ReadString(); err != io.EOF {
+		t.Fatalf("expected flush after service line, got %v", err)
+	}
+	line, err := pr.ReadString()
+	if err != nil {
+		t.Fatalf("reading ERR line: %v", err)
+	}
+	if want := "ERR no pushing here"; line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+}
+
+func TestUploadPackRequestTooLarge(t *testing.T) {
+	ts, r := newTestServer(t, WithMaxRequestBytes(1024))
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+
+	var body strings.Builder
+	pw := pktline.NewWriter(&body)
+	pw.WriteString("want " + refs["HEAD"] + "\n")
+	pw.Flush()
+	for i := 0; i < 100; i++ {
+		pw.WriteString(fmt.Sprintf("have %040x\n", i))
+	}
+	pw.WriteString("done\n")
+
+	resp, err := http.Post(ts.URL+"/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatalf("upload-pack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", resp.StatusCode)
+	}
+}
+
+func TestOnCommitPerPull(t *testing.T) {
+	var hashes []string
+	var counts []int64
+	ts, _ := newTestServer(t, WithGeneratorOptions(generator.WithOnCommit(func(hash string, count int64) {
+		hashes = append(hashes, hash)
+		counts = append(counts, count)
+	})))
+
+	for i := 0; i < 2; i++ {
+		head := advertisement(t, ts.URL)["HEAD"]
+		if len(hashes) != i+1 || hashes[i] != head {
+			t.Fatalf("after pull %d callbacks = %v, want last %s", i+1, hashes, head)
+		}
+		if counts[i] != int64(i+1) {
+			t.Errorf("pull %d count = %d", i+1, counts[i])
+		}
+	}
+}
+
+func TestWantMustBeAdvertised(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allow=%t", allow), func(t *testing.T) {
+			ts, r := newTestServer(t, WithAllowUnadvertisedWants(allow))
+
+			// A commit known only to an internal ref.
+			blob, err := r.WriteBlob([]byte("secret\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree := object.NewTree()
+			tree.AddEntry(object.ModeFile, "secret.txt", blob)
+			treeHash, err := r.WriteTree(tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ident := "Internal <internal@example.com>"
+			internal, err := r.WriteCommit(object.NewCommit(treeHash, "", ident, ident, "internal"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.UpdateRef("refs/scratch/internal", internal); err != nil {
+				t.Fatal(err)
+			}
+
+			head := advertisement(t, ts.URL)["HEAD"]
+			if body := fetchHead(t, ts.URL, head); !bytes.Contains(body, []byte("PACK")) {
+				t.Errorf("fetch of advertised head failed: %q", body)
+			}
+
+			body := fetchHead(t, ts.URL, internal)
+			if allow {
+				if !bytes.Contains(body, []byte("PACK")) {
+					t.Errorf("fetch of internal commit failed with the toggle on: %q", body)
+				}
+				return
+			}
+			if bytes.Contains(body, []byte("PACK")) || !bytes.Contains(body, []byte("not reachable from any advertised ref")) {
+				t.Errorf("fetch of internal commit was not rejected: %q", body)
+			}
+		})
+	}
+}
+
+func TestServiceLineBeforeGeneration(t *testing.T) {
+	release := make(chan struct{})
+	ts, _ := newTestServer(t, WithGeneratorOptions(generator.WithOnCommit(func(string, int64) {
+		<-release
+	})))
+
+	resp, err := http.Get(ts.URL + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		close(release)
+		t.Fatalf("fetching info/refs: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Generation is still blocked, yet the service line has arrived.
+	want := "001e# service=git-upload-pack\n0000"
+	got := make([]byte, len(want))
+	_, err = io.ReadFull(resp.Body, got)
+	close(release)
+	if err != nil {
+		t.Fatalf("reading service line: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("response starts with %q, want %q", got, want)
+	}
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading advertisement: %v", err)
+	}
+	if !bytes.Contains(rest, []byte(" HEAD\x00")) {
+		t.Errorf("advertisement has no HEAD: %q", rest)
+	}
+}
+
+func TestLogCapabilities(t *testing.T) {
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	var logs bytes.Buffer
+	logger := clog.New(slog.NewTextHandler(&logs, nil))
+	h := New(r, testContent{}, WithLogCapabilities(true)).Handler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(clog.WithLogger(req.Context(), logger)))
+	}))
+
+	if _, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL}); err != nil {
+		ts.Close()
+		t.Fatalf("clone: %v", err)
+	}
+	// Close waits for the handlers, so the log is complete.
+	ts.Close()
+
+	var line string
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, `msg="negotiated capabilities"`) {
+			line = l
+		}
+	}
+	if line == "" {
+		t.Fatalf("no capabilities logged:\n%s", logs.String())
+	}
+	for _, want := range []string{"side-band-64k", "ofs-delta", "agent=go-git/", "wants=1", "haves=0"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %q lacks %q", line, want)
+		}
+	}
+}
+
+// TestPeekHeader clones with the canonical git client, which sends the
+// header on every request. Skipped when git is not in PATH.
+func TestPeekHeader(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, r := newTestServer(t)
+	before := advertisement(t, ts.URL)["HEAD"]
+
+	dir := t.TempDir()
+	out, err := exec.Command(gitBin, "-c", "http.extraHeader="+PeekHeader+": 1", "clone", ts.URL, dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git clone failed: %v\noutput: %s", err, out)
+	}
+
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["refs/heads/main"] != before {
+		t.Errorf("main moved from %s to %s during a peek", before, refs["refs/heads/main"])
+	}
+	out, err = exec.Command(gitBin, "-C", dir, "rev-parse", "HEAD").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git rev-parse failed: %v\noutput: %s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != before {
+		t.Errorf("cloned HEAD = %s, want %s", got, before)
+	}
+}
+
+func TestHeadInfoRefs(t *testing.T) {
+	ts, r := newTestServer(t)
+	before, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Head(ts.URL + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/x-git-upload-pack-advertisement"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+
+	after, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["refs/heads/main"] != before["refs/heads/main"] {
+		t.Errorf("main moved from %s to %s on HEAD", before["refs/heads/main"], after["refs/heads/main"])
+	}
+}
+
+func TestCommitTrailers(t *testing.T) {
+	ts, _ := newTestServer(t, WithGeneratorOptions(generator.WithTrailers(
+		generator.Trailer{Key: "Co-authored-by", Value: "A <a@example.com>"},
+		generator.Trailer{Key: "Signed-off-by", Value: "B <b@example.com>"},
+	)))
+
+	gitRepo, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	head, err := gitRepo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := gitRepo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\n\nCo-authored-by: A <a@example.com>\nSigned-off-by: B <b@example.com>\n"
+	if !strings.HasSuffix(commit.Message, want) {
+		t.Errorf("message = %q, want it to end with %q", commit.Message, want)
+	}
+}
+
+func TestContentLengthSpill(t *testing.T) {
+	dir := t.TempDir()
+	var spilled []string
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	s := New(r, testContent{}, WithContentLength(true, 64, dir))
+	s.onSpill = func(path string) { spilled = append(spilled, path) }
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	if _, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: ts.URL}); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if len(spilled) == 0 {
+		t.Fatal("response was not spilled to a temp file")
+	}
+	for _, path := range spilled {
+		if filepath.Dir(path) != dir {
+			t.Errorf("spilled to %s, want a file in %s", path, dir)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("spill file %s was not removed: %v", path, err)
+		}
+	}
+}
+
+func TestSeedHeader(t *testing.T) {
+	seeded := func(url, seed string) string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url+"/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(SeedHeader, seed)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("fetching info/refs: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode, body)
+		}
+		_, rest, _ := strings.Cut(string(body), "0000")
+		return rest[4:44]
+	}
+
+	// The initial commit is dated by the repository's clock; seeded
+	// commits are dated by their seed.
+	var want []string
+	for range 2 {
+		r, err := repo.New(t.TempDir(), testContent{}.InitialFiles(), repo.WithClock(clock.Fixed(time.Unix(0, 0).UTC())))
+		if err != nil {
+			t.Fatalf("creating repo: %v", err)
+		}
+		ts := httptest.NewServer(New(r, testContent{}).Handler())
+		got := []string{seeded(ts.URL, "7"), seeded(ts.URL, "42")}
+		ts.Close()
+		if want == nil {
+			want = got
+		} else if !slices.Equal(got, want) {
+			t.Errorf("seeded commits = %v, want %v", got, want)
+		}
+	}
+	if want[0] != "9db85bb66c7de7ccd05482fa31af1d88af8a2429" {
+		t.Errorf("commit for seed 7 = %s", want[0])
+	}
+
+	ts, _ := newTestServer(t)
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(SeedHeader, "x")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status for a bad seed = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// TestClientBranch clones with the canonical git client, which checks out
+// the branch HEAD's symref names. Skipped when git is not in PATH.
+func TestClientBranch(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, r := newTestServer(t, WithClientBranches("demo"))
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	demo := refs["refs/heads/main"]
+	if err := r.UpdateRef("refs/heads/demo", demo); err != nil {
+		t.Fatal(err)
+	}
+
+	runGit := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(gitBin, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\noutput: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	dir := t.TempDir()
+	runGit("-c", "http.extraHeader="+BranchHeader+": demo", "clone", ts.URL, dir)
+	if got := runGit("-C", dir, "rev-parse", "--abbrev-ref", "HEAD"); got != "demo" {
+		t.Errorf("checked out %q, want demo", got)
+	}
+	if got := runGit("-C", dir, "rev-parse", "HEAD"); got != demo {
+		t.Errorf("HEAD = %s, want %s", got, demo)
+	}
+
+	// Without the header, clones still land on main.
+	dir = t.TempDir()
+	runGit("clone", ts.URL, dir)
+	if got := runGit("-C", dir, "rev-parse", "--abbrev-ref", "HEAD"); got != "main" {
+		t.Errorf("checked out %q, want main", got)
+	}
+
+	// Branches outside the allowlist are refused.
+	if out, err := exec.Command(gitBin, "-c", "http.extraHeader="+BranchHeader+": other", "clone", ts.URL, t.TempDir()).CombinedOutput(); err == nil {
+		t.Errorf("clone of an unlisted branch succeeded: %s", out)
+	}
+}
+
+func TestPackPrewarm(t *testing.T) {
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	s := New(r, testContent{}, WithPackCache(4), WithPackPrewarm(true))
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	head := advertisement(t, ts.URL)["HEAD"]
+	deadline := time.Now().Add(5 * time.Second)
+	for s.packCache.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pack cache was not prewarmed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if body := fetchHead(t, ts.URL, head); !bytes.Contains(body, []byte("PACK")) {
+		t.Fatalf("clone response has no pack: %q", body[:min(len(body), 32)])
+	}
+	if hits := s.packCache.Hits(); hits != 1 {
+		t.Errorf("cache hits = %d, want the first clone served from the cache", hits)
+	}
+}
+
+func TestPackPrewarmStaticHistory(t *testing.T) {
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	s := New(r, testContent{}, WithPackCache(4), WithPackPrewarm(true), WithStaticHistory(true))
+	defer s.Close()
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// No commit is generated, but the advertised head is still prewarmed,
+	// and only once however often it is advertised.
+	for range 3 {
+		advertisement(t, ts.URL)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.packCache.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pack cache was not prewarmed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.packCache.Len(); n != 1 {
+		t.Errorf("cache has %d packs, want 1", n)
+	}
+}
+
+func TestSHA256Clone(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles(), repo.WithObjectFormat(object.SHA256))
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	ts := httptest.NewServer(New(r, testContent{}).Handler())
+	t.Cleanup(ts.Close)
+
+	// Pull after cloning, so the second fetch negotiates against
+	// history the client already has.
+	dir := t.TempDir()
+	for _, args := range [][]string{{"clone", ts.URL, dir}, {"-C", dir, "pull"}} {
+		if out, err := exec.Command(gitBin, args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v\noutput: %s", args[0], err, out)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"rev-parse", "--show-object-format"},
+		{"fsck", "--strict"},
+		{"rev-parse", "HEAD"},
+	} {
+		out, err := exec.Command(gitBin, append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s failed: %v\noutput: %s", args[0], err, out)
+		}
+		got := strings.TrimSpace(string(out))
+		switch args[len(args)-1] {
+		case "--show-object-format":
+			if got != "sha256" {
+				t.Errorf("clone object format = %q, want sha256", got)
+			}
+		case "HEAD":
+			refs, err := r.GetRefs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := refs["refs/heads/main"]; got != want || len(got) != 64 {
+				t.Errorf("cloned HEAD = %s, want %s", got, want)
+			}
+		}
+	}
+}
+
+func TestServeArchive(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	runGit := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command(gitBin, args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	src := t.TempDir()
+	runGit("-C", src, "init", "-q", "-b", "main")
+	for i := range 3 {
+		if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte(strings.Repeat("line\n", 100*(i+1))), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit("-C", src, "add", ".")
+		runGit("-C", src, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	head := runGit("-C", src, "rev-parse", "main")
+	bundle := filepath.Join(t.TempDir(), "repo.bundle")
+	runGit("-C", src, "bundle", "create", bundle, "main")
+
+	r, err := repo.OpenArchive(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(New(r, testContent{}, WithStaticHistory(true)).Handler())
+	t.Cleanup(ts.Close)
+
+	// Fetching twice serves the same history: nothing is generated.
+	dir := t.TempDir()
+	runGit("clone", ts.URL, dir)
+	runGit("-C", dir, "pull")
+	runGit("-C", dir, "fsck", "--strict")
+	if got := runGit("-C", dir, "rev-parse", "HEAD"); got != head {
+		t.Errorf("cloned HEAD = %s, want %s", got, head)
+	}
+	if got := runGit("-C", dir, "rev-list", "--count", "HEAD"); got != "3" {
+		t.Errorf("clone has %s commits, want 3", got)
+	}
+}
+
+func TestShallowClone(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	for _, version := range []string{"0", "2"} {
+		t.Run("protocol v"+version, func(t *testing.T) {
+			testShallowClone(t, gitBin, version)
+		})
+	}
+}
+
+func testShallowClone(t *testing.T, gitBin, version string) {
+	ts, r := newTestServer(t)
+	for range 5 {
+		advertisement(t, ts.URL)
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(gitBin, append([]string{"-c", "protocol.version=" + version}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		args  []string
+		depth int // zero for full history
+	}{
+		{[]string{"clone", "--depth", "2", ts.URL, dir}, 2},
+		{[]string{"-C", dir, "fetch", "--depth", "4"}, 4},
+		{[]string{"-C", dir, "fetch", "--unshallow"}, 0},
+	} {
+		git(tc.args...)
+		git("-C", dir, "fsck", "--strict")
+		want := tc.depth
+		if want == 0 {
+			refs, err := r.GetRefs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			log, err := r.FirstParentLog(refs["refs/heads/main"], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = len(log)
+		}
+		if got := git("-C", dir, "rev-list", "--count", "origin/main"); got != fmt.Sprint(want) {
+			t.Errorf("after git %s, client sees %s commits, want %d", tc.args[len(tc.args)-2], got, want)
+		}
+		shallow := git("-C", dir, "rev-parse", "--is-shallow-repository")
+		if wantShallow := fmt.Sprint(tc.depth > 0); shallow != wantShallow {
+			t.Errorf("after git %s, shallow = %s, want %s", tc.args[len(tc.args)-2], shallow, wantShallow)
+		}
+	}
+}
+
+func TestProtocolV2(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, r := newTestServer(t)
+	if err := r.UpdateRef("refs/tags/v1", advertisement(t, ts.URL)["HEAD"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// git traces the packets it exchanges, which shows the protocol.
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command(gitBin, append([]string{"-c", "protocol.version=2"}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_TRACE_PACKET=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return string(out)
+	}
+	dir := t.TempDir()
+	trace := git("clone", ts.URL, dir)
+	for _, want := range []string{"< version 2", "> command=ls-refs", "> command=fetch", "< packfile"} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("clone trace has no %q", want)
+		}
+	}
+
+	// The pull negotiates with haves.
+	trace = git("-C", dir, "pull")
+	for _, want := range []string{"< acknowledgments", "< ready", "< packfile"} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("pull trace has no %q", want)
+		}
+	}
+	git("-C", dir, "fsck", "--strict")
+
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(gitBin, "-C", dir, "rev-parse", "HEAD", "v1").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git rev-parse: %v\n%s", err, out)
+	}
+	if got, want := strings.Fields(string(out)), []string{refs["refs/heads/main"], refs["refs/tags/v1"]}; !slices.Equal(got, want) {
+		t.Errorf("cloned HEAD and v1 = %v, want %v", got, want)
+	}
+}
+
+func TestGenerationWorker(t *testing.T) {
+	r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+	if err != nil {
+		t.Fatalf("creating repo: %v", err)
+	}
+	initial := mainHead(t, r)
+	srv := New(r, testContent{}, WithGenerationWorker(10*time.Second))
+	t.Cleanup(srv.Close)
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	const n = 20
+	heads := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refs, err := fetchAdvertisement(ts.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if refs["HEAD"] != refs["refs/heads/main"] {
+				t.Errorf("advertised HEAD %s but main %s", refs["HEAD"], refs["refs/heads/main"])
+			}
+			heads[i] = refs["HEAD"]
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// Each request got a commit of its own, and together they form one
+	// line of history on top of the initial commit.
+	parents := make(map[string]bool)
+	for _, head := range heads {
+		data, err := r.ReadObject(head)
+		if err != nil {
+			t.Fatalf("reading %s: %v", head, err)
+		}
+		c, err := object.ParseCommit(data)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", head, err)
+		}
+		if len(c.Parents) != 1 {
+			t.Fatalf("%s has parents %v", head, c.Parents)
+		}
+		if parents[c.Parents[0]] {
+			t.Errorf("two advertised heads share parent %s", c.Parents[0])
+		}
+		parents[c.Parents[0]] = true
+	}
+	for _, head := range heads {
+		delete(parents, head)
+	}
+	if want := map[string]bool{initial: true}; !maps.Equal(parents, want) {
+		t.Errorf("parents outside the advertised heads = %v, want %v", parents, want)
+	}
+	if got := mainHead(t, r); !slices.Contains(heads, got) {
+		t.Errorf("main is %s, not one of the advertised heads", got)
+	}
+}
+
+// mainHead returns what main points at.
+func mainHead(t *testing.T, r *repo.Repository) string {
+	t.Helper()
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatalf("getting refs: %v", err)
+	}
+	return refs["refs/heads/main"]
+}
+
+func TestPartialClone(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, _ := newTestServer(t, WithUploadPackOptions(protocol.WithFilter(true)))
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(gitBin, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return string(out)
+	}
+	// missing lists the blobs in HEAD's history the clone lacks.
+	missing := func(dir string) []string {
+		t.Helper()
+		var hashes []string
+		for _, line := range strings.Fields(git("-C", dir, "rev-list", "--objects", "--missing=print", "HEAD")) {
+			if hash, ok := strings.CutPrefix(line, "?"); ok {
+				hashes = append(hashes, hash)
+			}
+		}
+		return hashes
+	}
+
+	dir := t.TempDir()
+	git("clone", "--no-checkout", "--filter=blob:none", ts.URL, dir)
+	absent := missing(dir)
+	if len(absent) == 0 {
+		t.Fatal("partial clone has every blob")
+	}
+
+	// Reading a blob fetches it from the server.
+	want := git("-C", dir, "rev-parse", "HEAD:hello.txt")
+	if !slices.Contains(absent, strings.TrimSpace(want)) {
+		t.Fatalf("hello.txt %s is not among the missing blobs %v", want, absent)
+	}
+	if got := git("-C", dir, "cat-file", "-p", "HEAD:hello.txt"); !strings.HasPrefix(got, "Pull #") {
+		t.Errorf("hello.txt = %q", got)
+	}
+	if got := missing(dir); len(got) != len(absent)-1 || slices.Contains(got, strings.TrimSpace(want)) {
+		t.Errorf("missing after fetching hello.txt = %v, want %v without %s", got, absent, want)
+	}
+	git("-C", dir, "fsck")
+}
+
+func TestPush(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, r := newTestServer(t, WithPush(true, 0))
+	dir := t.TempDir()
+	// git runs git in the clone, returning its output and whether it
+	// succeeded.
+	git := func(args ...string) (string, bool) {
+		t.Helper()
+		cmd := exec.Command(gitBin, append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=Pusher", "GIT_AUTHOR_EMAIL=pusher@example.com",
+			"GIT_COMMITTER_NAME=Pusher", "GIT_COMMITTER_EMAIL=pusher@example.com")
+		out, err := cmd.CombinedOutput()
+		return string(out), err == nil
+	}
+	mustGit := func(args ...string) string {
+		t.Helper()
+		out, ok := git(args...)
+		if !ok {
+			t.Fatalf("git %v failed:\n%s", args, out)
+		}
+		return strings.TrimSpace(out)
+	}
+	if out, err := exec.Command(gitBin, "clone", ts.URL, dir).CombinedOutput(); err != nil {
+		t.Fatalf("git clone: %v\n%s", err, out)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pushed.txt"), []byte("pushed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustGit("add", "pushed.txt")
+	mustGit("commit", "-m", "Pushed")
+	pushed := mustGit("rev-parse", "HEAD")
+
+	// New and existing refs can be updated.
+	mustGit("push", "origin", "HEAD:refs/heads/feature", "HEAD:refs/tags/v1", "HEAD:refs/heads/main")
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"refs/heads/feature", "refs/tags/v1", "refs/heads/main"} {
+		if refs[name] != pushed {
+			t.Errorf("%s = %s after push, want %s", name, refs[name], pushed)
+		}
+	}
+	if err := r.VerifyObject(pushed); err != nil {
+		t.Errorf("pushed commit: %v", err)
+	}
+
+	// Generation carries on from the pushed commit.
+	head := advertisement(t, ts.URL)["refs/heads/main"]
+	data, err := r.ReadObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := object.ParseCommit(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.Parents, []string{pushed}) {
+		t.Errorf("generated commit has parents %v, want the pushed %s", c.Parents, pushed)
+	}
+
+	// Refs can be deleted, but not main, and hidden refs are off limits.
+	mustGit("push", "origin", ":refs/heads/feature")
+	if r.RefExists("refs/heads/feature") {
+		t.Error("feature still exists after deleting it")
+	}
+	for _, tc := range []struct{ refspec, reason string }{
+		{":refs/heads/main", "main cannot be deleted"},
+		{"HEAD:refs/infinite/mine", "ref is managed by the server"},
+	} {
+		out, ok := git("push", "origin", tc.refspec)
+		if ok {
+			t.Errorf("push %s succeeded", tc.refspec)
+		}
+		if !strings.Contains(out, tc.reason) {
+			t.Errorf("push %s output does not say %q:\n%s", tc.refspec, tc.reason, out)
+		}
+	}
+
+	// A push based on a stale view of main is refused by the client or
+	// the server, never applied.
+	mustGit("commit", "--allow-empty", "-m", "Stale")
+	if out, ok := git("push", "origin", "HEAD:refs/heads/main"); ok {
+		t.Errorf("push over a newer main succeeded:\n%s", out)
+	}
+	if got := mainHead(t, r); got != head {
+		t.Errorf("main = %s after a rejected push, want %s", got, head)
+	}
+
+	if out, err := exec.Command(gitBin, "-C", r.Path(), "fsck", "--strict").CombinedOutput(); err != nil {
+		t.Errorf("git fsck of the server repo: %v\n%s", err, out)
+	}
+}
+
+func TestDumbLooseObject(t *testing.T) {
+	ts, r := newTestServer(t)
+	head := advertisement(t, ts.URL)["HEAD"]
+
+	resp, err := http.Get(ts.URL + "/objects/" + head[:2] + "/" + head[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/x-git-loose-object"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	zr, err := zlib.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("opening zlib stream: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompressing object: %v", err)
+	}
+	want, err := r.ReadObjectFull(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("object = %q, want %q", got, want)
+	}
+
+	resp, err = http.Get(ts.URL + "/objects/" + head[:2] + "/" + strings.Repeat("0", len(head)-2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing object status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestDumbClone(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, r := newTestServer(t)
+	head := advertisement(t, ts.URL)["HEAD"]
+
+	dir := t.TempDir()
+	cmd := exec.Command(gitBin, "clone", ts.URL, dir)
+	cmd.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git clone failed: %v\noutput: %s", err, out)
+	}
+	out, err := exec.Command(gitBin, "-C", dir, "rev-parse", "HEAD").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git rev-parse failed: %v\noutput: %s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != head {
+		t.Errorf("cloned HEAD = %s, want %s", got, head)
+	}
+
+	// The dumb protocol only reads; it generates nothing.
+	refs, err := r.GetRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["refs/heads/main"] != head {
+		t.Errorf("main moved from %s to %s during a dumb clone", head, refs["refs/heads/main"])
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ts, _ := newTestServer(t)
+	for _, tc := range []struct {
+		path   string
+		status int
+		allow  string
+	}{
+		{"/info/refs", http.StatusOK, "GET, HEAD, OPTIONS"},
+		{"/git-upload-pack", http.StatusOK, "POST, OPTIONS"},
+		{"/git-receive-pack", http.StatusOK, "POST, OPTIONS"},
+		{"/HEAD", http.StatusOK, "GET, HEAD, OPTIONS"},
+		{"/objects/info/packs", http.StatusOK, "GET, HEAD, OPTIONS"},
+		{"/admin/commit", http.StatusOK, "POST, OPTIONS"},
+		{"/nope", http.StatusNotFound, ""},
+	} {
+		req, err := http.NewRequest(http.MethodOptions, ts.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("OPTIONS %s status = %d, want %d", tc.path, resp.StatusCode, tc.status)
+		}
+		if got := resp.Header.Get("Allow"); got != tc.allow {
+			t.Errorf("OPTIONS %s Allow = %q, want %q", tc.path, got, tc.allow)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	ts, _ := newTestServer(t, WithAuth(StaticCredentials(map[string]string{"alice": "s3cret"})))
+
+	clone := func(url string) ([]byte, error) {
+		cmd := exec.Command(gitBin, "clone", url, t.TempDir())
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+		return cmd.CombinedOutput()
+	}
+	if out, err := clone(ts.URL); err == nil {
+		t.Errorf("clone without credentials succeeded\noutput: %s", out)
+	}
+	if out, err := clone(strings.Replace(ts.URL, "http://", "http://alice:wrong@", 1)); err == nil {
+		t.Errorf("clone with a wrong password succeeded\noutput: %s", out)
+	}
+	if out, err := clone(strings.Replace(ts.URL, "http://", "http://alice:s3cret@", 1)); err != nil {
+		t.Fatalf("clone with credentials failed: %v\noutput: %s", err, out)
+	}
+
+	resp, err := http.Get(ts.URL + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.HasPrefix(got, "Basic") {
+		t.Errorf("WWW-Authenticate = %q, want Basic", got)
+	}
+}
+
+func TestGzipAdvertisement(t *testing.T) {
+	ts, r := newTestServer(t)
+
+	// fetch asks for the advertisement with gzip accepted, returning its
+	// Content-Encoding and decoded ref count.
+	fetch := func() (string, int) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Setting the header ourselves keeps the transport from
+		// decompressing the body.
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := io.Reader(resp.Body)
+		enc := resp.Header.Get("Content-Encoding")
+		if enc == "gzip" {
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("opening gzip stream: %v", err)
+			}
+			body = zr
+		}
+		pr := pktline.NewReader(body)
+		if line, err := pr.ReadString(); err != nil || line != "# service=git-upload-pack" {
+			t.Fatalf("service line = %q, %v", line, err)
+		}
+		if _, err := pr.ReadString(); err != io.EOF {
+			t.Fatalf("expected flush after service line, got %v", err)
+		}
+		lines, err := pr.ReadAll()
+		if err != nil {
+			t.Fatalf("reading refs: %v", err)
+		}
+		return enc, len(lines)
+	}
+
+	if enc, _ := fetch(); enc != "" {
+		t.Errorf("small advertisement Content-Encoding = %q, want none", enc)
+	}
+
+	head := advertisement(t, ts.URL)["HEAD"]
+	for i := range 200 {
+		if err := r.UpdateRef(fmt.Sprintf("refs/tags/v%03d", i), head); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enc, n := fetch()
+	if enc != "gzip" {
+		t.Errorf("large advertisement Content-Encoding = %q, want gzip", enc)
+	}
+	if want := 202; n != want { // HEAD, main and the tags
+		t.Errorf("decoded %d refs, want %d", n, want)
+	}
+
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	// Protocol v2 lists refs with ls-refs instead, so ask for v0 to have
+	// git read the compressed advertisement.
+	dir := t.TempDir()
+	if out, err := exec.Command(gitBin, "-c", "protocol.version=0", "clone", ts.URL, dir).CombinedOutput(); err != nil {
+		t.Fatalf("git clone failed: %v\noutput: %s", err, out)
+	}
+	out, err := exec.Command(gitBin, "-C", dir, "tag").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git tag failed: %v\noutput: %s", err, out)
+	}
+	if got := len(strings.Fields(string(out))); got != 200 {
+		t.Errorf("cloned %d tags, want 200", got)
+	}
+}
+
+func TestNamedRepositories(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary not found in PATH")
+	}
+	repos := make(map[string]*repo.Repository)
+	var opts []Option
+	for _, name := range []string{"alpha", "beta"} {
+		r, err := repo.New(t.TempDir(), testContent{}.InitialFiles())
+		if err != nil {
+			t.Fatalf("creating repo: %v", err)
+		}
+		repos[name] = r
+		opts = append(opts, WithRepository(name, r, testContent{}))
+	}
+	ts := httptest.NewServer(New(nil, nil, opts...).Handler())
+	t.Cleanup(ts.Close)
+
+	// Each clone generates one commit in the repository it names.
+	clone := func(name string) string {
+		t.Helper()
+		dir := t.TempDir()
+		if out, err := exec.Command(gitBin, "clone", ts.URL+"/"+name, dir).CombinedOutput(); err != nil {
+			t.Fatalf("git clone %s failed: %v\noutput: %s", name, err, out)
+		}
+		out, err := exec.Command(gitBin, "-C", dir, "log", "-1", "--format=%s").CombinedOutput()
+		if err != nil {
+			t.Fatalf("git log failed: %v\noutput: %s", err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	for _, tc := range []struct{ name, want string }{
+		{"alpha", "Pull #1"},
+		{"alpha", "Pull #2"},
+		{"beta", "Pull #1"},
+		{"alpha", "Pull #3"},
+	} {
+		if got := clone(tc.name); got != tc.want {
+			t.Errorf("%s head = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	heads := make(map[string]string)
+	for name, r := range repos {
+		refs, err := r.GetRefs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		heads[name] = refs["refs/heads/main"]
+	}
+	if heads["alpha"] == heads["beta"] {
+		t.Errorf("alpha and beta share head %s", heads["alpha"])
+	}
+
+	for _, path := range []string{"/gamma/info/refs", "/info/refs"} {
+		resp, err := http.Get(ts.URL + path + "?service=git-upload-pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s status = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// spillBuffer holds a response in memory until it grows past limit bytes,
+// then moves it to a temp file. Close removes the file.
+type spillBuffer struct {
+	limit   int64 // zero never spills
+	dir     string
+	onSpill func(path string)
+
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.limit > 0 && b.size+int64(len(p)) > b.limit {
+		f, err := os.CreateTemp(b.dir, "infinite-git-response-*")
+		if err != nil {
+			return 0, fmt.Errorf("creating spill file: %w", err)
+		}
+		b.file = f
+		if b.onSpill != nil {
+			b.onSpill(f.Name())
+		}
+		if _, err := b.mem.WriteTo(f); err != nil {
+			return 0, fmt.Errorf("spilling response: %w", err)
+		}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes written.
+func (b *spillBuffer) Len() int64 {
+	return b.size
+}
+
+// WriteTo sends everything written to w.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.file == nil {
+		return b.mem.WriteTo(w)
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("rewinding spill file: %w", err)
+	}
+	return io.Copy(w, b.file)
+}
+
+// Close removes the spill file, if any.
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}